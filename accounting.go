@@ -0,0 +1,169 @@
+package diameter
+
+import "fmt"
+
+// Diameter Base Accounting (RFC 6733 section 9) identifiers.
+const (
+	BaseAccountingApplicationId = 3
+	AccountingCode              = Uint24(271)
+)
+
+// Values for the Accounting-Record-Type AVP (code 480).
+const (
+	AccountingEventRecord   int32 = 1
+	AccountingStartRecord   int32 = 2
+	AccountingInterimRecord int32 = 3
+	AccountingStopRecord    int32 = 4
+)
+
+// Values for the Accounting-Realtime-Required AVP (code 483) (RFC 6733 section 9.8.7), which tells the
+// client what to do with accounting records when it cannot deliver them to the server.
+const (
+	// AccountingRealtimeDeliverAndGrant: the service may be granted only while accounting records can
+	// be delivered
+	AccountingRealtimeDeliverAndGrant int32 = 1
+	// AccountingRealtimeGrantAndStore: records should be delivered, and are stored if they cannot be
+	// delivered; the service is granted regardless
+	AccountingRealtimeGrantAndStore int32 = 2
+	// AccountingRealtimeGrantAndLose: records should be delivered, and are discarded if they cannot be
+	// delivered; the service is granted regardless
+	AccountingRealtimeGrantAndLose int32 = 3
+)
+
+// NewAccountingRealtimeRequired creates an Accounting-Realtime-Required AVP (code 483) with the M-bit
+// set.  value should be one of the AccountingRealtime* values.
+func NewAccountingRealtimeRequired(value int32) *AVP {
+	return NewTypedAVP(483, 0, true, Enumerated, value)
+}
+
+// AccountingRealtimeRequired extracts the value of the first top-level Accounting-Realtime-Required AVP
+// in the message.  If the message has no Accounting-Realtime-Required AVP, or the AVP is malformed, ok is
+// false.
+func (m *Message) AccountingRealtimeRequired() (value int32, ok bool) {
+	accountingRealtimeRequiredAvp := m.FirstAvpMatching(0, 483)
+	if accountingRealtimeRequiredAvp == nil || len(accountingRealtimeRequiredAvp.Data) != 4 {
+		return 0, false
+	}
+
+	return MustConvertAVPDataToTypedData(accountingRealtimeRequiredAvp.Data, Enumerated).(int32), true
+}
+
+// NewAccountingRequest creates an Accounting-Request, with the Application-Id set to 3, the code set
+// to 271 and the request and proxiable flags set.  The message contains, in order, the Session-Id,
+// Origin-Host, Origin-Realm, Destination-Realm, Accounting-Record-Type, Accounting-Record-Number and
+// Acct-Application-Id (3) AVPs.  recordType should be one of the Accounting*Record values.  The
+// hop-by-hop-id and end-to-end-id are zero.  The caller may add any application-specific AVPs.
+func NewAccountingRequest(sessionId string, originHost string, originRealm string, destinationRealm string, recordType int32, recordNumber uint32) *Message {
+	return NewMessage(MsgFlagRequest|MsgFlagProxiable, AccountingCode, BaseAccountingApplicationId, 0, 0, []*AVP{
+		NewTypedAVP(263, 0, true, UTF8String, sessionId),
+		NewTypedAVP(264, 0, true, DiamIdent, originHost),
+		NewTypedAVP(296, 0, true, DiamIdent, originRealm),
+		NewTypedAVP(283, 0, true, DiamIdent, destinationRealm),
+		NewTypedAVP(480, 0, true, Enumerated, recordType),
+		NewTypedAVP(485, 0, true, Unsigned32, recordNumber),
+		NewTypedAVP(259, 0, true, Unsigned32, uint32(BaseAccountingApplicationId)),
+	}, nil)
+}
+
+// IsAccountingRequest returns true if the message is an Accounting-Request (that is, the code is 271
+// and the request flag is set).
+func (m *Message) IsAccountingRequest() bool {
+	return m.Code == AccountingCode && m.IsRequest()
+}
+
+// NewAccountingAnswer creates an Accounting-Answer for the Accounting-Request acr.  The answer contains,
+// in order, the Session-Id from acr, a Result-Code with the value resultCode, Origin-Host, Origin-Realm,
+// and the Accounting-Record-Type and Accounting-Record-Number from acr.  Returns an error if acr is not
+// an Accounting-Request, or if it lacks any of the AVPs copied to the answer.
+func NewAccountingAnswer(acr *Message, resultCode uint32, originHost string, originRealm string) (*Message, error) {
+	if !acr.IsAccountingRequest() {
+		return nil, fmt.Errorf("message is not an Accounting-Request")
+	}
+
+	sessionId := acr.FirstAvpMatching(0, 263)
+	recordType := acr.FirstAvpMatching(0, 480)
+	recordNumber := acr.FirstAvpMatching(0, 485)
+
+	if sessionId == nil || recordType == nil || recordNumber == nil {
+		return nil, fmt.Errorf("Accounting-Request must contain Session-Id, Accounting-Record-Type and Accounting-Record-Number")
+	}
+
+	return acr.GenerateMatchingResponseWithAvps([]*AVP{
+		sessionId.Clone(),
+		NewTypedAVP(268, 0, true, Unsigned32, resultCode),
+		NewTypedAVP(264, 0, true, DiamIdent, originHost),
+		NewTypedAVP(296, 0, true, DiamIdent, originRealm),
+		recordType.Clone(),
+		recordNumber.Clone(),
+	}, nil), nil
+}
+
+type accountingSessionState int
+
+const (
+	accountingSessionIdle accountingSessionState = iota
+	accountingSessionStarted
+	accountingSessionStopped
+)
+
+// AccountingSession generates the Accounting-Requests for a single accounting session, following the
+// client accounting state machine (RFC 6733 section 8.2): a START_RECORD, followed by any number of
+// INTERIM_RECORDs, followed by a STOP_RECORD.  Each request has the next Accounting-Record-Number in the
+// session, starting with 0.  An AccountingSession is not safe for concurrent use.
+type AccountingSession struct {
+	SessionId        string
+	OriginHost       string
+	OriginRealm      string
+	DestinationRealm string
+
+	state            accountingSessionState
+	nextRecordNumber uint32
+}
+
+// NewAccountingSession creates an AccountingSession for which no records have been generated.
+func NewAccountingSession(sessionId string, originHost string, originRealm string, destinationRealm string) *AccountingSession {
+	return &AccountingSession{
+		SessionId:        sessionId,
+		OriginHost:       originHost,
+		OriginRealm:      originRealm,
+		DestinationRealm: destinationRealm,
+	}
+}
+
+// Start returns the START_RECORD Accounting-Request for the session.  Returns an error if the session
+// has already started.
+func (session *AccountingSession) Start() (*Message, error) {
+	if session.state != accountingSessionIdle {
+		return nil, fmt.Errorf("accounting session has already started")
+	}
+
+	session.state = accountingSessionStarted
+	return session.nextRequest(AccountingStartRecord), nil
+}
+
+// Interim returns an INTERIM_RECORD Accounting-Request for the session.  Returns an error if the session
+// has not started or has already stopped.
+func (session *AccountingSession) Interim() (*Message, error) {
+	if session.state != accountingSessionStarted {
+		return nil, fmt.Errorf("interim record requires a started accounting session")
+	}
+
+	return session.nextRequest(AccountingInterimRecord), nil
+}
+
+// Stop returns the STOP_RECORD Accounting-Request for the session.  Returns an error if the session
+// has not started or has already stopped.
+func (session *AccountingSession) Stop() (*Message, error) {
+	if session.state != accountingSessionStarted {
+		return nil, fmt.Errorf("stop record requires a started accounting session")
+	}
+
+	session.state = accountingSessionStopped
+	return session.nextRequest(AccountingStopRecord), nil
+}
+
+func (session *AccountingSession) nextRequest(recordType int32) *Message {
+	acr := NewAccountingRequest(session.SessionId, session.OriginHost, session.OriginRealm, session.DestinationRealm, recordType, session.nextRecordNumber)
+	session.nextRecordNumber++
+	return acr
+}
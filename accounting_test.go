@@ -0,0 +1,200 @@
+package diameter_test
+
+import (
+	"testing"
+
+	diameter "github.com/blorticus-go/diameter"
+)
+
+func accountingRecordTypeAndNumber(t *testing.T, m *diameter.Message) (int32, uint32) {
+	t.Helper()
+
+	recordTypeAvp := m.FirstAvpMatching(0, 480)
+	recordNumberAvp := m.FirstAvpMatching(0, 485)
+	if recordTypeAvp == nil || recordNumberAvp == nil {
+		t.Fatalf("expected message to contain Accounting-Record-Type and Accounting-Record-Number")
+	}
+
+	recordType, err := diameter.ConvertAVPDataToTypedData(recordTypeAvp.Data, diameter.Enumerated)
+	if err != nil {
+		t.Fatalf("failed to convert Accounting-Record-Type: %s", err)
+	}
+	recordNumber, err := diameter.ConvertAVPDataToTypedData(recordNumberAvp.Data, diameter.Unsigned32)
+	if err != nil {
+		t.Fatalf("failed to convert Accounting-Record-Number: %s", err)
+	}
+
+	return recordType.(int32), recordNumber.(uint32)
+}
+
+func TestNewAccountingRequest(t *testing.T) {
+	acr := diameter.NewAccountingRequest("client.example.com;1;1", "client.example.com", "example.com", "server.example.com", diameter.AccountingEventRecord, 0)
+
+	if acr.Code != 271 || acr.AppID != 3 {
+		t.Errorf("expected code (271) and appId (3), got code (%d) and appId (%d)", acr.Code, acr.AppID)
+	}
+	if !acr.IsRequest() || !acr.IsProxiable() {
+		t.Errorf("expected request and proxiable flags to be set, got flags (%#02x)", acr.Flags)
+	}
+	if !acr.IsAccountingRequest() {
+		t.Errorf("expected IsAccountingRequest() to be true")
+	}
+
+	expectedAvps := []*diameter.AVP{
+		diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1;1"),
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "client.example.com"),
+		diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+		diameter.NewTypedAVP(283, 0, true, diameter.DiamIdent, "server.example.com"),
+		diameter.NewTypedAVP(480, 0, true, diameter.Enumerated, int32(1)),
+		diameter.NewTypedAVP(485, 0, true, diameter.Unsigned32, uint32(0)),
+		diameter.NewTypedAVP(259, 0, true, diameter.Unsigned32, uint32(3)),
+	}
+
+	if len(acr.Avps) != len(expectedAvps) {
+		t.Fatalf("expected (%d) AVPs, got (%d)", len(expectedAvps), len(acr.Avps))
+	}
+	for i := range expectedAvps {
+		if !acr.Avps[i].Equal(expectedAvps[i]) {
+			t.Errorf("AVP (%d) expected code (%d), got AVP with code (%d) or differing value", i, expectedAvps[i].Code, acr.Avps[i].Code)
+		}
+	}
+
+	if ccr := diameter.NewCreditControlRequest("s", "h", "r", "d", diameter.CreditControlEventRequest, 0); ccr.IsAccountingRequest() {
+		t.Errorf("expected IsAccountingRequest() to be false for a CCR")
+	}
+}
+
+func TestAccountingSessionRecordProgression(t *testing.T) {
+	session := diameter.NewAccountingSession("client.example.com;1;1", "client.example.com", "example.com", "server.example.com")
+
+	if _, err := session.Interim(); err == nil {
+		t.Errorf("expected error on Interim() before Start(), got none")
+	}
+	if _, err := session.Stop(); err == nil {
+		t.Errorf("expected error on Stop() before Start(), got none")
+	}
+
+	start, err := session.Start()
+	if err != nil {
+		t.Fatalf("expected no error on Start(), got = (%s)", err)
+	}
+	if _, err := session.Start(); err == nil {
+		t.Errorf("expected error on second Start(), got none")
+	}
+
+	firstInterim, err := session.Interim()
+	if err != nil {
+		t.Fatalf("expected no error on first Interim(), got = (%s)", err)
+	}
+	secondInterim, err := session.Interim()
+	if err != nil {
+		t.Fatalf("expected no error on second Interim(), got = (%s)", err)
+	}
+
+	stop, err := session.Stop()
+	if err != nil {
+		t.Fatalf("expected no error on Stop(), got = (%s)", err)
+	}
+
+	if _, err := session.Interim(); err == nil {
+		t.Errorf("expected error on Interim() after Stop(), got none")
+	}
+	if _, err := session.Stop(); err == nil {
+		t.Errorf("expected error on second Stop(), got none")
+	}
+
+	testCases := []struct {
+		message              *diameter.Message
+		expectedRecordType   int32
+		expectedRecordNumber uint32
+	}{
+		{start, diameter.AccountingStartRecord, 0},
+		{firstInterim, diameter.AccountingInterimRecord, 1},
+		{secondInterim, diameter.AccountingInterimRecord, 2},
+		{stop, diameter.AccountingStopRecord, 3},
+	}
+
+	for i, testCase := range testCases {
+		if !testCase.message.IsAccountingRequest() {
+			t.Errorf("(test case %d) expected an Accounting-Request", i+1)
+			continue
+		}
+
+		recordType, recordNumber := accountingRecordTypeAndNumber(t, testCase.message)
+		if recordType != testCase.expectedRecordType || recordNumber != testCase.expectedRecordNumber {
+			t.Errorf("(test case %d) expected record type (%d) and number (%d), got type (%d) and number (%d)", i+1, testCase.expectedRecordType, testCase.expectedRecordNumber, recordType, recordNumber)
+		}
+	}
+}
+
+func TestNewAccountingAnswer(t *testing.T) {
+	acr := diameter.NewAccountingRequest("client.example.com;1;1", "client.example.com", "example.com", "server.example.com", diameter.AccountingInterimRecord, 7)
+	acr.HopByHopID, acr.EndToEndID = 10, 20
+
+	aca, err := diameter.NewAccountingAnswer(acr, 2001, "server.example.com", "example.com")
+	if err != nil {
+		t.Fatalf("expected no error on NewAccountingAnswer(), got = (%s)", err)
+	}
+
+	if aca.IsRequest() || aca.Code != 271 || aca.AppID != 3 || aca.HopByHopID != 10 || aca.EndToEndID != 20 {
+		t.Errorf("expected ACA matching the ACR, got code (%d), appId (%d), hop-by-hop-id (%d), end-to-end-id (%d)", aca.Code, aca.AppID, aca.HopByHopID, aca.EndToEndID)
+	}
+
+	expectedAvps := []*diameter.AVP{
+		diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1;1"),
+		diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2001)),
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "server.example.com"),
+		diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+		diameter.NewTypedAVP(480, 0, true, diameter.Enumerated, int32(3)),
+		diameter.NewTypedAVP(485, 0, true, diameter.Unsigned32, uint32(7)),
+	}
+
+	if len(aca.Avps) != len(expectedAvps) {
+		t.Fatalf("expected (%d) AVPs, got (%d)", len(expectedAvps), len(aca.Avps))
+	}
+	for i := range expectedAvps {
+		if !aca.Avps[i].Equal(expectedAvps[i]) {
+			t.Errorf("AVP (%d) expected code (%d), got AVP with code (%d) or differing value", i, expectedAvps[i].Code, aca.Avps[i].Code)
+		}
+	}
+
+	if _, err := diameter.NewAccountingAnswer(aca, 2001, "server.example.com", "example.com"); err == nil {
+		t.Errorf("expected error on NewAccountingAnswer() for an answer, got none")
+	}
+}
+
+func TestAccountingRealtimeRequired(t *testing.T) {
+	if diameter.AccountingRealtimeDeliverAndGrant != 1 || diameter.AccountingRealtimeGrantAndStore != 2 || diameter.AccountingRealtimeGrantAndLose != 3 {
+		t.Errorf("expected Accounting-Realtime-Required values (1, 2, 3), got (%d, %d, %d)", diameter.AccountingRealtimeDeliverAndGrant, diameter.AccountingRealtimeGrantAndStore, diameter.AccountingRealtimeGrantAndLose)
+	}
+
+	testCases := []struct {
+		avps          []*diameter.AVP
+		expectedValue int32
+		expectedOk    bool
+	}{
+		{[]*diameter.AVP{diameter.NewAccountingRealtimeRequired(diameter.AccountingRealtimeDeliverAndGrant)}, 1, true},
+		{[]*diameter.AVP{diameter.NewAccountingRealtimeRequired(diameter.AccountingRealtimeGrantAndStore)}, 2, true},
+		{[]*diameter.AVP{
+			diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1;1"),
+			diameter.NewAccountingRealtimeRequired(diameter.AccountingRealtimeGrantAndLose),
+			diameter.NewAccountingRealtimeRequired(diameter.AccountingRealtimeDeliverAndGrant),
+		}, 3, true},
+		{[]*diameter.AVP{diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1;1")}, 0, false},
+		{[]*diameter.AVP{diameter.NewAVP(483, 0, true, []byte{0, 1})}, 0, false},
+	}
+
+	for i, testCase := range testCases {
+		m := diameter.NewMessage(diameter.MsgFlagRequest, diameter.AccountingCode, diameter.BaseAccountingApplicationId, 1, 1, testCase.avps, nil)
+
+		value, ok := m.AccountingRealtimeRequired()
+		if value != testCase.expectedValue || ok != testCase.expectedOk {
+			t.Errorf("(test case %d) expected (%d, %t), got (%d, %t)", i+1, testCase.expectedValue, testCase.expectedOk, value, ok)
+		}
+	}
+
+	avp := diameter.NewAccountingRealtimeRequired(diameter.AccountingRealtimeGrantAndStore)
+	if avp.Code != 483 || avp.VendorID != 0 || !avp.Mandatory {
+		t.Errorf("expected Accounting-Realtime-Required AVP with code (483), vendor-id (0) and M-bit set, got code (%d), vendor-id (%d), mandatory (%t)", avp.Code, avp.VendorID, avp.Mandatory)
+	}
+}
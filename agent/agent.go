@@ -3,13 +3,33 @@ package agent
 import (
 	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/blorticus-go/diameter"
 )
 
+// AgentReceiver is a listener on which an Agent accepts transport connections from peers.  Each
+// connection accepted on Listener asserts IdentityToAssert during the Capabilities-Exchange.  If
+// IdentityToAssert has no HostIPAddresses, the local IP address of each accepted connection is used.
+// To serve more than one Diameter identity (e.g., a different realm on each of several addresses),
+// provide one AgentReceiver per listening address, each with its own identity.  If MaxConcurrentPeers
+// is greater than zero, then at most that many connections accepted on Listener are managed at once.
+// Connections accepted beyond that are closed immediately and a ConnectionRejectedEvent is raised.
+// If AcceptPeer is not nil, it is consulted for each peer after its Capabilities-Exchange Request is
+// received (see PeerStateManager.SetPeerAcceptance()).  If RejectUnsupportedApplications is true,
+// requests for an application that IdentityToAssert does not support are answered automatically (see
+// PeerStateManager.SetRejectUnsupportedApplications()).  If LocalCapabilitiesForPeer is not nil, it
+// chooses the capabilities advertised to each accepted peer in place of those of IdentityToAssert (see
+// PeerStateManager.SetLocalCapabilitiesForPeer()).
 type AgentReceiver struct {
-	Listener         net.Listener
-	IdentityToAssert *DiameterEntity
+	Listener                      net.Listener
+	IdentityToAssert              *DiameterEntity
+	MaxConcurrentPeers            int
+	AcceptPeer                    PeerAcceptanceFunc
+	RejectUnsupportedApplications bool
+	LocalCapabilitiesForPeer      LocalCapabilitiesFunc
 }
 
 type AgentEvent struct {
@@ -19,29 +39,256 @@ type AgentEvent struct {
 	Message    *diameter.Message
 	Connection net.Conn
 	Receiver   *AgentReceiver
+	// DisconnectCause is set on a PeerInitiatedDisconnectEvent and a DiameterConnectionClosedEvent if
+	// the peer sent a Disconnect-Peer Request with a Disconnect-Cause.  Its ReconnectionPolicy()
+	// advises whether, and how soon, the application should re-establish the transport to the peer.
+	DisconnectCause *DisconnectCause
+	// UpdatedCapabilities is set on a PeerCapabilitiesUpdatedEvent.  Otherwise, it is nil.
+	UpdatedCapabilities *PeerCapabilities
 }
 
 type Agent struct {
 	outgoingEventChannel             chan *AgentEvent
 	peerHandlersIncomingEventChannel chan *PeerStateEvent
+	writeTimeout                     time.Duration
+	logger                           Logger
+	duplicateRequestCache            *DuplicateRequestCache
+	acceptCapabilitiesUpdates        bool
+	rejectReservedHeaderFlags        bool
+
+	runningStateMutex sync.Mutex
+	receivers         []*AgentReceiver
+	peerStateManagers map[*PeerStateManager]struct{}
+	isShuttingDown    bool
+	// initiatedConnectionPeerOriginHosts is the peer Origin-Host for each manager started by
+	// EstablishDiameterConnectionToPeer(), used to detect connection collisions
+	initiatedConnectionPeerOriginHosts map[*PeerStateManager]string
 }
 
 func New() *Agent {
 	return &Agent{
 		outgoingEventChannel:             make(chan *AgentEvent, 20),
 		peerHandlersIncomingEventChannel: make(chan *PeerStateEvent, 100),
+		writeTimeout:                     DefaultWriteTimeout,
+		logger:                           noopLogger{},
+		peerStateManagers:                make(map[*PeerStateManager]struct{}),
+
+		initiatedConnectionPeerOriginHosts: make(map[*PeerStateManager]string),
 	}
 }
 
+// SetLogger sets the Logger for the agent and for the PeerStateManager of each peer connection
+// subsequently established or accepted by the agent.  If logger is nil, nothing is logged, which
+// is the default.
+func (agent *Agent) SetLogger(logger Logger) *Agent {
+	agent.logger = loggerOrNoop(logger)
+	return agent
+}
+
+// SetWriteTimeout sets the write timeout for the PeerStateManager of each peer connection
+// subsequently established or accepted by the agent.  See PeerStateManager.SetWriteTimeout().
+func (agent *Agent) SetWriteTimeout(timeout time.Duration) *Agent {
+	agent.writeTimeout = timeout
+	return agent
+}
+
+// SetDuplicateRequestCache enables detection of retransmitted requests for every peer connection
+// subsequently established or accepted by the agent.  A single cache of at most maxEntries requests,
+// each kept for at most ttl, is shared by all peers, so that a request retransmitted to the agent
+// through a different peer is detected.  See PeerStateManager.SetDuplicateRequestCache().
+func (agent *Agent) SetDuplicateRequestCache(maxEntries int, ttl time.Duration) *Agent {
+	agent.duplicateRequestCache = NewDuplicateRequestCache(maxEntries, ttl)
+	return agent
+}
+
+// SetAcceptCapabilitiesUpdates sets whether a Capabilities-Exchange Request from a connected peer is
+// accepted as an update of the capabilities of the peer, for each peer connection subsequently
+// established or accepted by the agent.  The updated capabilities are reported only in the
+// UpdatedCapabilities of the PeerCapabilitiesUpdatedEvent; the Peer keeps those of the initial
+// Capabilities-Exchange.  See PeerStateManager.SetAcceptCapabilitiesUpdates().
+func (agent *Agent) SetAcceptCapabilitiesUpdates(accept bool) *Agent {
+	agent.acceptCapabilitiesUpdates = accept
+	return agent
+}
+
+// SetRejectReservedHeaderFlags sets whether messages with reserved header flag bits set are discarded,
+// with an ErrorEvent, for each peer connection subsequently established or accepted by the agent.  See
+// PeerStateManager.SetRejectReservedHeaderFlags().
+func (agent *Agent) SetRejectReservedHeaderFlags(reject bool) *Agent {
+	agent.rejectReservedHeaderFlags = reject
+	return agent
+}
+
 func (agent *Agent) EstablishDiameterConnectionTo(conn net.Conn, assertIdentity *DiameterEntity) {
-	go NewInitiatorPeerStateManager(assertIdentity, conn, agent.peerHandlersIncomingEventChannel).NewRun()
+	agent.startPeerStateManager(NewInitiatorPeerStateManager(assertIdentity, conn, agent.peerHandlersIncomingEventChannel).SetWriteTimeout(agent.writeTimeout).SetLogger(agent.logger).SetDuplicateRequestCache(agent.duplicateRequestCache).SetAcceptCapabilitiesUpdates(agent.acceptCapabilitiesUpdates).SetRejectReservedHeaderFlags(agent.rejectReservedHeaderFlags), nil)
+}
+
+// EstablishDiameterConnectionToPeer is the same as EstablishDiameterConnectionTo, except that the
+// Origin-Host of the peer is known, so that a connection collision can be detected.  If, before the
+// peer answers the Capabilities-Exchange Request sent on conn, the peer sends a Capabilities-Exchange
+// Request on a transport accepted by the agent, the collision is resolved by an election (RFC 6733
+// section 5.6.4).  The local entity wins if the Origin-Host it asserts on the accepted transport is
+// greater than peerOriginHost, compared octet by octet, in which case conn is closed and the accepted
+// transport is kept.  Otherwise, the Capabilities-Exchange Request is answered with
+// DIAMETER_ELECTION_LOST (4003) and the accepted transport is closed.  Either way, a
+// ConnectionCollisionResolvedEvent is raised for the transport that is closed.
+func (agent *Agent) EstablishDiameterConnectionToPeer(conn net.Conn, assertIdentity *DiameterEntity, peerOriginHost string) {
+	manager := NewInitiatorPeerStateManager(assertIdentity, conn, agent.peerHandlersIncomingEventChannel).SetWriteTimeout(agent.writeTimeout).SetLogger(agent.logger).SetDuplicateRequestCache(agent.duplicateRequestCache).SetAcceptCapabilitiesUpdates(agent.acceptCapabilitiesUpdates).SetRejectReservedHeaderFlags(agent.rejectReservedHeaderFlags)
+
+	agent.runningStateMutex.Lock()
+	agent.initiatedConnectionPeerOriginHosts[manager] = peerOriginHost
+	agent.runningStateMutex.Unlock()
+
+	agent.startPeerStateManager(manager, func() {
+		agent.runningStateMutex.Lock()
+		delete(agent.initiatedConnectionPeerOriginHosts, manager)
+		agent.runningStateMutex.Unlock()
+	})
 }
 
 func (agent *Agent) AcceptDiameterConnectionFrom(conn net.Conn, assertIdentity *DiameterEntity) {
-	go NewInitiatedPeerStateManager(assertIdentity, conn, agent.peerHandlersIncomingEventChannel).NewRun()
+	agent.startPeerStateManager(NewInitiatedPeerStateManager(assertIdentity, conn, agent.peerHandlersIncomingEventChannel).SetWriteTimeout(agent.writeTimeout).SetLogger(agent.logger).SetDuplicateRequestCache(agent.duplicateRequestCache).SetAcceptCapabilitiesUpdates(agent.acceptCapabilitiesUpdates).SetRejectReservedHeaderFlags(agent.rejectReservedHeaderFlags).SetConnectionElection(agent.connectionElectionFor(assertIdentity)), nil)
+}
+
+// connectionElectionFor returns the ConnectionElectionFunc for a transport accepted by the agent, on
+// which localIdentity is asserted.  See EstablishDiameterConnectionToPeer().
+func (agent *Agent) connectionElectionFor(localIdentity *DiameterEntity) ConnectionElectionFunc {
+	return func(peer *DiameterEntity) bool {
+		agent.runningStateMutex.Lock()
+		defer agent.runningStateMutex.Unlock()
+
+		var collidingManagers []*PeerStateManager
+		for manager, peerOriginHost := range agent.initiatedConnectionPeerOriginHosts {
+			if strings.EqualFold(peerOriginHost, peer.OriginHost) && !manager.capabilitiesExchangeHasEnded() {
+				collidingManagers = append(collidingManagers, manager)
+			}
+		}
+
+		if len(collidingManagers) == 0 {
+			return true
+		}
+
+		if localIdentity.OriginHost <= peer.OriginHost {
+			agent.logger.Info("lost connection election, closing the transport opened by the peer", "originHost", localIdentity.OriginHost, "peerOriginHost", peer.OriginHost)
+			return false
+		}
+
+		agent.logger.Info("won connection election, closing the transport opened toward the peer", "originHost", localIdentity.OriginHost, "peerOriginHost", peer.OriginHost)
+		for _, manager := range collidingManagers {
+			manager.discardBecauseOfElection()
+		}
+
+		return true
+	}
+}
+
+// startPeerStateManager tracks the manager, so that Shutdown() can reach it, then runs it in a new
+// goroutine.  If the agent is shutting down, the manager's transport is closed instead.  If afterRun
+// is not nil, it is called once the manager is no longer running.
+func (agent *Agent) startPeerStateManager(manager *PeerStateManager, afterRun func()) {
+	agent.runningStateMutex.Lock()
+	defer agent.runningStateMutex.Unlock()
+
+	if agent.isShuttingDown {
+		manager.transport.Close()
+		if afterRun != nil {
+			afterRun()
+		}
+		return
+	}
+
+	agent.peerStateManagers[manager] = struct{}{}
+
+	go func() {
+		manager.NewRun()
+
+		agent.runningStateMutex.Lock()
+		delete(agent.peerStateManagers, manager)
+		agent.runningStateMutex.Unlock()
+
+		if afterRun != nil {
+			afterRun()
+		}
+	}()
 }
 
+// Shutdown stops the agent.  It first stops accepting connections on the receivers provided to Run(),
+// then sends a Disconnect-Peer Request with the provided cause to every peer, and waits for each peer
+// to answer it.  Once all peers have answered, or timeout has elapsed, the transport to each peer is
+// closed.  Returns an error if any peer did not answer within timeout.
+func (agent *Agent) Shutdown(cause DisconnectCause, timeout time.Duration) error {
+	agent.runningStateMutex.Lock()
+	agent.isShuttingDown = true
+	receivers := agent.receivers
+	managers := make([]*PeerStateManager, 0, len(agent.peerStateManagers))
+	for manager := range agent.peerStateManagers {
+		managers = append(managers, manager)
+	}
+	agent.runningStateMutex.Unlock()
+
+	agent.logger.Info("shutting down agent", "peers", len(managers))
+
+	for _, receiver := range receivers {
+		receiver.Listener.Close()
+	}
+
+	abandon := make(chan struct{})
+	abandonTimer := time.AfterFunc(timeout, func() { close(abandon) })
+	defer abandonTimer.Stop()
+
+	var waitGroup sync.WaitGroup
+	var numberOfPeersThatDidNotAnswer int
+	var numberOfPeersThatDidNotAnswerMutex sync.Mutex
+
+	for _, manager := range managers {
+		waitGroup.Add(1)
+		go func(manager *PeerStateManager) {
+			defer waitGroup.Done()
+
+			if err := manager.initiateDisconnectWithCause(cause, abandon); err == nil {
+				select {
+				case <-manager.runHasEndedChannel:
+					return
+				case <-abandon:
+				}
+			} else {
+				select {
+				case <-manager.runHasEndedChannel:
+					return
+				default:
+				}
+			}
+
+			numberOfPeersThatDidNotAnswerMutex.Lock()
+			numberOfPeersThatDidNotAnswer++
+			numberOfPeersThatDidNotAnswerMutex.Unlock()
+		}(manager)
+	}
+
+	waitGroup.Wait()
+
+	for _, manager := range managers {
+		manager.transport.Close()
+	}
+
+	if numberOfPeersThatDidNotAnswer > 0 {
+		return fmt.Errorf("%d of %d peers did not answer the Disconnect-Peer Request within %s", numberOfPeersThatDidNotAnswer, len(managers), timeout)
+	}
+
+	return nil
+}
+
+// Run starts accepting connections on each of the receivers, then delivers events for all peers
+// (whether from receivers or from EstablishDiameterConnectionTo() and AcceptDiameterConnectionFrom())
+// to the single channel returned by EventChannel().  Each peer connection is managed independently,
+// so a peer is only ever associated with the identity of the receiver that accepted it.  Events can be
+// related to a receiver by the Connection (e.g., its LocalAddr()).  The ListenerAcceptedTransportEvent
+// also carries the Receiver.  Run does not return.
 func (agent *Agent) Run(receiver []*AgentReceiver) {
+	agent.runningStateMutex.Lock()
+	agent.receivers = append(agent.receivers, receiver...)
+	agent.runningStateMutex.Unlock()
+
 	for _, r := range receiver {
 		go agent.runReceiverHandler(r)
 	}
@@ -49,11 +296,13 @@ func (agent *Agent) Run(receiver []*AgentReceiver) {
 	for {
 		peerHandlerEvent := <-agent.peerHandlersIncomingEventChannel
 		agent.outgoingEventChannel <- &AgentEvent{
-			Type:       peerHandlerEvent.Type,
-			Peer:       peerHandlerEvent.Peer,
-			Error:      peerHandlerEvent.Error,
-			Message:    peerHandlerEvent.Message,
-			Connection: peerHandlerEvent.Conn,
+			Type:                peerHandlerEvent.Type,
+			Peer:                peerHandlerEvent.Peer,
+			Error:               peerHandlerEvent.Error,
+			Message:             peerHandlerEvent.Message,
+			Connection:          peerHandlerEvent.Conn,
+			DisconnectCause:     peerHandlerEvent.DisconnectCause,
+			UpdatedCapabilities: peerHandlerEvent.UpdatedCapabilities,
 		}
 	}
 }
@@ -72,14 +321,31 @@ func extractIPFromNetConn(c net.Conn) net.IP {
 }
 
 func (agent *Agent) runReceiverHandler(receiver *AgentReceiver) {
+	var peerSlots chan struct{}
+	if receiver.MaxConcurrentPeers > 0 {
+		peerSlots = make(chan struct{}, receiver.MaxConcurrentPeers)
+	}
+
 	for {
 		c, err := receiver.Listener.Accept()
 		if err != nil {
-			agent.notifyOfReceiverError(receiver, c, err)
+			if !agent.shutdownHasBegun() {
+				agent.notifyOfReceiverError(receiver, c, err)
+			}
 			return
 		}
 
-		agent.notifyOfIncomingTransportConnectionOnListener(c)
+		if peerSlots != nil {
+			select {
+			case peerSlots <- struct{}{}:
+			default:
+				c.Close()
+				agent.notifyOfRejectedConnection(receiver, c)
+				continue
+			}
+		}
+
+		agent.notifyOfIncomingTransportConnectionOnListener(receiver, c)
 
 		identityToAssert := *receiver.IdentityToAssert
 		if len(identityToAssert.HostIPAddresses) == 0 {
@@ -93,11 +359,23 @@ func (agent *Agent) runReceiverHandler(receiver *AgentReceiver) {
 			identityToAssert.HostIPAddresses = []*net.IP{&hostAddr}
 		}
 
-		go NewInitiatedPeerStateManager(&identityToAssert, c, agent.peerHandlersIncomingEventChannel).NewRun()
+		var releasePeerSlot func()
+		if peerSlots != nil {
+			releasePeerSlot = func() { <-peerSlots }
+		}
+
+		agent.startPeerStateManager(NewInitiatedPeerStateManager(&identityToAssert, c, agent.peerHandlersIncomingEventChannel).SetWriteTimeout(agent.writeTimeout).SetLogger(agent.logger).SetPeerAcceptance(receiver.AcceptPeer).SetRejectUnsupportedApplications(receiver.RejectUnsupportedApplications).SetDuplicateRequestCache(agent.duplicateRequestCache).SetAcceptCapabilitiesUpdates(agent.acceptCapabilitiesUpdates).SetRejectReservedHeaderFlags(agent.rejectReservedHeaderFlags).SetConnectionElection(agent.connectionElectionFor(&identityToAssert)).SetLocalCapabilitiesForPeer(receiver.LocalCapabilitiesForPeer), releasePeerSlot)
 	}
 }
 
+func (agent *Agent) shutdownHasBegun() bool {
+	agent.runningStateMutex.Lock()
+	defer agent.runningStateMutex.Unlock()
+	return agent.isShuttingDown
+}
+
 func (agent *Agent) notifyOfReceiverError(receiver *AgentReceiver, connection net.Conn, err error) {
+	agent.logger.Error("receiver error", "listenerAddress", receiver.Listener.Addr().String(), "error", err)
 	agent.outgoingEventChannel <- &AgentEvent{
 		Type:       ErrorEvent,
 		Error:      NewReceiverError(err),
@@ -106,9 +384,19 @@ func (agent *Agent) notifyOfReceiverError(receiver *AgentReceiver, connection ne
 	}
 }
 
-func (agent *Agent) notifyOfIncomingTransportConnectionOnListener(connection net.Conn) {
+func (agent *Agent) notifyOfIncomingTransportConnectionOnListener(receiver *AgentReceiver, connection net.Conn) {
 	agent.outgoingEventChannel <- &AgentEvent{
 		Type:       ListenerAcceptedTransportEvent,
 		Connection: connection,
+		Receiver:   receiver,
+	}
+}
+
+func (agent *Agent) notifyOfRejectedConnection(receiver *AgentReceiver, connection net.Conn) {
+	agent.logger.Warn("rejected connection because the receiver has reached its maximum concurrent peers", "listenerAddress", receiver.Listener.Addr().String(), "remoteAddress", connection.RemoteAddr().String(), "maxConcurrentPeers", receiver.MaxConcurrentPeers)
+	agent.outgoingEventChannel <- &AgentEvent{
+		Type:       ConnectionRejectedEvent,
+		Connection: connection,
+		Receiver:   receiver,
 	}
 }
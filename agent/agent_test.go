@@ -0,0 +1,519 @@
+package agent
+
+import (
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/blorticus-go/diameter"
+)
+
+func listenOnLoopback(t *testing.T) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen on loopback: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	return listener
+}
+
+// nextAgentEventOfType reads from the agent event channel, discarding events, until an event of
+// the requested type arrives.  It fails the test if that takes longer than one second.
+func nextAgentEventOfType(t *testing.T, eventChannel <-chan *AgentEvent, eventType PeerEventType) *AgentEvent {
+	t.Helper()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-eventChannel:
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for agent event of type (%d)", eventType)
+			return nil
+		}
+	}
+}
+
+func connectClientTo(t *testing.T, listener net.Listener, clientEntity *DiameterEntity) (*Peer, <-chan *PeerStateEvent) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to (%s): %s", listener.Addr().String(), err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	clientEvents := make(chan *PeerStateEvent, 100)
+	go NewInitiatorPeerStateManager(clientEntity, conn, clientEvents).NewRun()
+
+	return nextEventOfType(t, clientEvents, DiameterConnectionEstablishedEvent).Peer, clientEvents
+}
+
+func TestAgentWithTwoReceiversAssertsTheIdentityOfEachReceiver(t *testing.T) {
+	listenerForRealmA := listenOnLoopback(t)
+	listenerForRealmB := listenOnLoopback(t)
+
+	receiverForRealmA := &AgentReceiver{
+		Listener:         listenerForRealmA,
+		IdentityToAssert: &DiameterEntity{OriginHost: "dra.realm-a.example.com", OriginRealm: "realm-a.example.com", ProductName: "test"},
+	}
+	receiverForRealmB := &AgentReceiver{
+		Listener:         listenerForRealmB,
+		IdentityToAssert: &DiameterEntity{OriginHost: "dra.realm-b.example.com", OriginRealm: "realm-b.example.com", ProductName: "test"},
+	}
+
+	agent := New()
+	go agent.Run([]*AgentReceiver{receiverForRealmA, receiverForRealmB})
+
+	clientA := testClientEntity()
+	clientA.OriginHost, clientA.OriginRealm = "client.realm-a.example.com", "realm-a.example.com"
+	clientB := testClientEntity()
+	clientB.OriginHost, clientB.OriginRealm = "client.realm-b.example.com", "realm-b.example.com"
+
+	peerSeenByClientA, _ := connectClientTo(t, listenerForRealmA, clientA)
+	if peerSeenByClientA.Identity.OriginHost != "dra.realm-a.example.com" || peerSeenByClientA.Identity.OriginRealm != "realm-a.example.com" {
+		t.Errorf("expected client A to see identity of receiver A, got Origin-Host (%s), Origin-Realm (%s)", peerSeenByClientA.Identity.OriginHost, peerSeenByClientA.Identity.OriginRealm)
+	}
+
+	acceptedEvent := nextAgentEventOfType(t, agent.EventChannel(), ListenerAcceptedTransportEvent)
+	if acceptedEvent.Receiver != receiverForRealmA {
+		t.Errorf("expected ListenerAcceptedTransportEvent for client A to carry receiver A")
+	}
+	establishedEvent := nextAgentEventOfType(t, agent.EventChannel(), DiameterConnectionEstablishedEvent)
+	if establishedEvent.Peer.Identity.OriginHost != "client.realm-a.example.com" {
+		t.Errorf("expected established peer on agent to be client A, got (%s)", establishedEvent.Peer.Identity.OriginHost)
+	}
+	if establishedEvent.Connection.LocalAddr().String() != listenerForRealmA.Addr().String() {
+		t.Errorf("expected connection for client A on (%s), got (%s)", listenerForRealmA.Addr().String(), establishedEvent.Connection.LocalAddr().String())
+	}
+
+	peerSeenByClientB, _ := connectClientTo(t, listenerForRealmB, clientB)
+	if peerSeenByClientB.Identity.OriginHost != "dra.realm-b.example.com" || peerSeenByClientB.Identity.OriginRealm != "realm-b.example.com" {
+		t.Errorf("expected client B to see identity of receiver B, got Origin-Host (%s), Origin-Realm (%s)", peerSeenByClientB.Identity.OriginHost, peerSeenByClientB.Identity.OriginRealm)
+	}
+
+	acceptedEvent = nextAgentEventOfType(t, agent.EventChannel(), ListenerAcceptedTransportEvent)
+	if acceptedEvent.Receiver != receiverForRealmB {
+		t.Errorf("expected ListenerAcceptedTransportEvent for client B to carry receiver B")
+	}
+	establishedEvent = nextAgentEventOfType(t, agent.EventChannel(), DiameterConnectionEstablishedEvent)
+	if establishedEvent.Peer.Identity.OriginHost != "client.realm-b.example.com" {
+		t.Errorf("expected established peer on agent to be client B, got (%s)", establishedEvent.Peer.Identity.OriginHost)
+	}
+
+	if err := peerSeenByClientB.SendMessage(testCreditControlRequest()); err != nil {
+		t.Fatalf("expected no error on SendMessage(), got = (%s)", err)
+	}
+
+	messageEvent := nextAgentEventOfType(t, agent.EventChannel(), MessageReceivedFromPeerEvent)
+	if messageEvent.Peer.Identity.OriginHost != "client.realm-b.example.com" {
+		t.Errorf("expected message from client B to be associated with client B, got (%s)", messageEvent.Peer.Identity.OriginHost)
+	}
+	if messageEvent.Connection.LocalAddr().String() != listenerForRealmB.Addr().String() {
+		t.Errorf("expected message from client B on (%s), got (%s)", listenerForRealmB.Addr().String(), messageEvent.Connection.LocalAddr().String())
+	}
+}
+
+func TestReceiverRejectsConnectionsBeyondMaxConcurrentPeers(t *testing.T) {
+	listener := listenOnLoopback(t)
+	receiver := &AgentReceiver{
+		Listener:           listener,
+		IdentityToAssert:   testServerEntity(),
+		MaxConcurrentPeers: 2,
+	}
+
+	agent := New()
+	go agent.Run([]*AgentReceiver{receiver})
+
+	connectClientTo(t, listener, testClientEntity())
+	connectClientTo(t, listener, testClientEntity())
+
+	for i := 0; i < 2; i++ {
+		excessConn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect to (%s): %s", listener.Addr().String(), err)
+		}
+		defer excessConn.Close()
+
+		rejectedEvent := nextAgentEventOfType(t, agent.EventChannel(), ConnectionRejectedEvent)
+		if rejectedEvent.Receiver != receiver {
+			t.Errorf("expected ConnectionRejectedEvent to carry the receiver")
+		}
+		if rejectedEvent.Connection.RemoteAddr().String() != excessConn.LocalAddr().String() {
+			t.Errorf("expected rejected connection from (%s), got (%s)", excessConn.LocalAddr().String(), rejectedEvent.Connection.RemoteAddr().String())
+		}
+
+		excessConn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := excessConn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("expected excess connection (%d) to be closed by the agent, got read error = (%v)", i+1, err)
+		}
+	}
+}
+
+func TestAgentShutdownSendsDPRToEveryPeer(t *testing.T) {
+	listener := listenOnLoopback(t)
+	receiver := &AgentReceiver{
+		Listener:         listener,
+		IdentityToAssert: testServerEntity(),
+	}
+
+	agent := New()
+	go agent.Run([]*AgentReceiver{receiver})
+
+	firstClient := testClientEntity()
+	firstClient.OriginHost = "client-1.example.com"
+	secondClient := testClientEntity()
+	secondClient.OriginHost = "client-2.example.com"
+
+	_, firstClientEvents := connectClientTo(t, listener, firstClient)
+	_, secondClientEvents := connectClientTo(t, listener, secondClient)
+
+	nextAgentEventOfType(t, agent.EventChannel(), DiameterConnectionEstablishedEvent)
+	nextAgentEventOfType(t, agent.EventChannel(), DiameterConnectionEstablishedEvent)
+
+	go func() {
+		for range agent.EventChannel() {
+		}
+	}()
+
+	shutdownResult := make(chan error, 1)
+	go func() {
+		shutdownResult <- agent.Shutdown(DisconnectCauseRebooting, time.Second)
+	}()
+
+	for i, clientEvents := range []<-chan *PeerStateEvent{firstClientEvents, secondClientEvents} {
+		dpr := nextEventOfType(t, clientEvents, StateMachineMessageReceivedFromPeerEvent).Message
+		if dpr.Code != DisconnectPeerCode || !dpr.IsRequest() {
+			t.Fatalf("expected client (%d) to receive a DPR, got message with code (%d)", i+1, dpr.Code)
+		}
+		expectExactlyOneAvpWithValue(t, dpr, 273, diameter.Enumerated, int32(DisconnectCauseRebooting))
+
+		dpa := nextEventOfType(t, clientEvents, StateMachineMessageSentToPeerEvent).Message
+		if dpa.Code != DisconnectPeerCode || dpa.IsRequest() {
+			t.Errorf("expected client (%d) to answer with a DPA, got message with code (%d)", i+1, dpa.Code)
+		}
+	}
+
+	select {
+	case err := <-shutdownResult:
+		if err != nil {
+			t.Errorf("expected no error on Shutdown(), got = (%s)", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Shutdown() did not return")
+	}
+
+	if conn, err := net.DialTimeout("tcp", listener.Addr().String(), 100*time.Millisecond); err == nil {
+		conn.Close()
+		t.Errorf("expected listener to be closed after Shutdown()")
+	}
+}
+
+func TestAgentShutdownReturnsErrorWhenPeerDoesNotAnswer(t *testing.T) {
+	listener := listenOnLoopback(t)
+	agent := New()
+	go agent.Run([]*AgentReceiver{{Listener: listener, IdentityToAssert: testServerEntity()}})
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to (%s): %s", listener.Addr().String(), err)
+	}
+	defer conn.Close()
+
+	nextAgentEventOfType(t, agent.EventChannel(), ListenerAcceptedTransportEvent)
+
+	// the connection never sends a CER, so the peer can never answer a DPR
+	if err := agent.Shutdown(DisconnectCauseBusy, 100*time.Millisecond); err == nil {
+		t.Errorf("expected error on Shutdown() when the peer does not answer, got none")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected transport to be closed after Shutdown(), got read error = (%v)", err)
+	}
+}
+
+func TestReceiverAcceptPeerIsConsultedForAcceptedConnections(t *testing.T) {
+	listener := listenOnLoopback(t)
+	agent := New()
+	go agent.Run([]*AgentReceiver{{
+		Listener:         listener,
+		IdentityToAssert: testServerEntity(),
+		AcceptPeer: func(peer *DiameterEntity) (bool, uint32) {
+			return false, 0
+		},
+	}})
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to (%s): %s", listener.Addr().String(), err)
+	}
+	defer conn.Close()
+
+	go NewInitiatorPeerStateManager(testClientEntity(), conn, make(chan *PeerStateEvent, 100)).NewRun()
+
+	errorEvent := nextAgentEventOfType(t, agent.EventChannel(), ErrorEvent)
+	if rejectedError, isRejectedError := errorEvent.Error.(*PeerRejectedError); !isRejectedError || rejectedError.ResultCode != 3010 {
+		t.Errorf("expected *PeerRejectedError with Result-Code (3010), got = (%T) %s", errorEvent.Error, errorEvent.Error)
+	}
+}
+
+// nextAgentEventsOfTypes reads from the agent event channel until an event of each of the requested
+// types has arrived, in any order, and returns the first event of each type.  Other events are
+// discarded.  It fails the test if that takes longer than one second.
+func nextAgentEventsOfTypes(t *testing.T, eventChannel <-chan *AgentEvent, eventTypes ...PeerEventType) map[PeerEventType]*AgentEvent {
+	t.Helper()
+
+	events := make(map[PeerEventType]*AgentEvent)
+	timeout := time.After(time.Second)
+	for len(events) < len(eventTypes) {
+		select {
+		case event := <-eventChannel:
+			if _, alreadySeen := events[event.Type]; !alreadySeen && slices.Contains(eventTypes, event.Type) {
+				events[event.Type] = event
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for agent events of types (%v), got (%d) of them", eventTypes, len(events))
+			return nil
+		}
+	}
+
+	return events
+}
+
+// connectionCollision is an agent that has opened a transport toward a peer, and has accepted a transport
+// opened by the same peer, on which the peer has sent a CER.  The peer has not answered the CER that the
+// agent sent on the transport that the agent opened.
+type connectionCollision struct {
+	agent                *Agent
+	initiatedLocalEnd    net.Conn
+	initiatedPeerEnd     net.Conn
+	fromAgentOnInitiated <-chan *diameter.Message
+	cerFromAgent         *diameter.Message
+	acceptedLocalEnd     net.Conn
+	fromAgentOnAccepted  <-chan *diameter.Message
+}
+
+func startConnectionCollision(t *testing.T, localEntity *DiameterEntity, peerEntity *DiameterEntity) *connectionCollision {
+	t.Helper()
+
+	collision := &connectionCollision{agent: New()}
+	go collision.agent.Run(nil)
+
+	var acceptedPeerEnd net.Conn
+	collision.initiatedLocalEnd, collision.initiatedPeerEnd = net.Pipe()
+	collision.acceptedLocalEnd, acceptedPeerEnd = net.Pipe()
+	t.Cleanup(func() {
+		for _, conn := range []net.Conn{collision.initiatedLocalEnd, collision.initiatedPeerEnd, collision.acceptedLocalEnd, acceptedPeerEnd} {
+			conn.Close()
+		}
+	})
+
+	collision.fromAgentOnInitiated = messagesReadFrom(collision.initiatedPeerEnd)
+	collision.agent.EstablishDiameterConnectionToPeer(collision.initiatedLocalEnd, localEntity, peerEntity.OriginHost)
+	if collision.cerFromAgent = nextMessageFromServer(t, collision.fromAgentOnInitiated); collision.cerFromAgent.Code != CapabilitiesExchangeCode || !collision.cerFromAgent.IsRequest() {
+		t.Fatalf("expected CER from agent, got message with code (%d)", collision.cerFromAgent.Code)
+	}
+
+	collision.fromAgentOnAccepted = messagesReadFrom(acceptedPeerEnd)
+	collision.agent.AcceptDiameterConnectionFrom(collision.acceptedLocalEnd, localEntity)
+	if _, err := acceptedPeerEnd.Write(capabilitiesExchangeRequestFrom(peerEntity, 1).Encode()); err != nil {
+		t.Fatalf("expected no error writing CER, got = (%s)", err)
+	}
+
+	return collision
+}
+
+func expectTransportToBeClosed(t *testing.T, messages <-chan *diameter.Message) {
+	t.Helper()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-messages:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for transport to be closed")
+		}
+	}
+}
+
+func TestConnectionCollisionWonByLocalEntityKeepsTransportOpenedByPeer(t *testing.T) {
+	localEntity, peerEntity := testServerEntity(), testClientEntity()
+	localEntity.OriginHost, peerEntity.OriginHost = "peer-b.example.com", "peer-a.example.com"
+
+	collision := startConnectionCollision(t, localEntity, peerEntity)
+
+	cea := nextMessageFromServer(t, collision.fromAgentOnAccepted)
+	expectExactlyOneAvpWithValue(t, cea, 268, diameter.Unsigned32, uint32(2001))
+
+	events := nextAgentEventsOfTypes(t, collision.agent.EventChannel(), ConnectionCollisionResolvedEvent, DiameterConnectionEstablishedEvent)
+	if event := events[ConnectionCollisionResolvedEvent]; event.Connection != collision.initiatedLocalEnd || event.Message != nil {
+		t.Errorf("expected ConnectionCollisionResolvedEvent for the transport opened by the agent, with no message")
+	}
+	if event := events[DiameterConnectionEstablishedEvent]; event.Connection != collision.acceptedLocalEnd || event.Peer.Identity.OriginHost != "peer-a.example.com" {
+		t.Errorf("expected diameter connection to (peer-a.example.com) on the transport opened by the peer")
+	}
+
+	expectTransportToBeClosed(t, collision.fromAgentOnInitiated)
+}
+
+func TestConnectionCollisionLostByLocalEntityKeepsTransportOpenedTowardPeer(t *testing.T) {
+	localEntity, peerEntity := testServerEntity(), testClientEntity()
+	localEntity.OriginHost, peerEntity.OriginHost = "peer-a.example.com", "peer-b.example.com"
+
+	collision := startConnectionCollision(t, localEntity, peerEntity)
+
+	cea := nextMessageFromServer(t, collision.fromAgentOnAccepted)
+	expectExactlyOneAvpWithValue(t, cea, 268, diameter.Unsigned32, uint32(4003))
+	if cea.IsError() {
+		t.Errorf("expected E-bit not to be set on CEA with Result-Code (4003)")
+	}
+	expectTransportToBeClosed(t, collision.fromAgentOnAccepted)
+
+	ceaFromPeer := collision.cerFromAgent.GenerateMatchingResponseWithAvps(peerEntity.CapabilitiesExchangeMandatoryAvpsWithResultCode(cachedResponseCode2001), peerEntity.CapabilitiesExchangeOptionalAvps())
+	if _, err := collision.initiatedPeerEnd.Write(ceaFromPeer.Encode()); err != nil {
+		t.Fatalf("expected no error writing CEA, got = (%s)", err)
+	}
+
+	events := nextAgentEventsOfTypes(t, collision.agent.EventChannel(), ConnectionCollisionResolvedEvent, DiameterConnectionEstablishedEvent)
+	if event := events[ConnectionCollisionResolvedEvent]; event.Connection != collision.acceptedLocalEnd || event.Message == nil || !event.Message.IsRequest() {
+		t.Errorf("expected ConnectionCollisionResolvedEvent for the transport opened by the peer, with its CER")
+	}
+	if event := events[DiameterConnectionEstablishedEvent]; event.Connection != collision.initiatedLocalEnd || event.Peer.Identity.OriginHost != "peer-b.example.com" {
+		t.Errorf("expected diameter connection to (peer-b.example.com) on the transport opened by the agent")
+	}
+}
+
+func TestCapabilitiesExchangeAnswerWithElectionLostClosesTransport(t *testing.T) {
+	agent := New()
+	go agent.Run(nil)
+
+	localEnd, peerEnd := net.Pipe()
+	t.Cleanup(func() {
+		localEnd.Close()
+		peerEnd.Close()
+	})
+
+	fromAgent := messagesReadFrom(peerEnd)
+	agent.EstablishDiameterConnectionTo(localEnd, testClientEntity())
+	cer := nextMessageFromServer(t, fromAgent)
+
+	resultCode := diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(4003))
+	if _, err := peerEnd.Write(cer.GenerateMatchingResponseWithAvps(testServerEntity().CapabilitiesExchangeMandatoryAvpsWithResultCode(resultCode), nil).Encode()); err != nil {
+		t.Fatalf("expected no error writing CEA, got = (%s)", err)
+	}
+
+	if event := nextAgentEventOfType(t, agent.EventChannel(), ConnectionCollisionResolvedEvent); event.Connection != localEnd || event.Message == nil || event.Message.IsRequest() {
+		t.Errorf("expected ConnectionCollisionResolvedEvent with the CEA")
+	}
+	expectTransportToBeClosed(t, fromAgent)
+}
+
+func TestReceiverAdvertisesLocalCapabilitiesChosenForEachPeer(t *testing.T) {
+	listener := listenOnLoopback(t)
+	agent := New()
+	go agent.Run([]*AgentReceiver{{
+		Listener:         listener,
+		IdentityToAssert: testServerEntity(),
+		LocalCapabilitiesForPeer: func(peer *DiameterEntity) *DiameterEntity {
+			capabilities := &DiameterEntity{OriginHost: "server.example.com", OriginRealm: "example.com", ProductName: "test-server"}
+			switch peer.OriginRealm {
+			case "realm-a.example.com":
+				capabilities.AuthApplicationIDs = []uint32{4}
+			case "realm-b.example.com":
+				capabilities.AuthApplicationIDs = []uint32{16777251}
+			default:
+				return nil
+			}
+			return capabilities
+		},
+	}})
+
+	for _, testCase := range []struct {
+		peerRealm                  string
+		expectedAuthApplicationIDs []uint32
+	}{
+		{peerRealm: "realm-a.example.com", expectedAuthApplicationIDs: []uint32{4}},
+		{peerRealm: "realm-b.example.com", expectedAuthApplicationIDs: []uint32{16777251}},
+		{peerRealm: "realm-c.example.com", expectedAuthApplicationIDs: nil},
+	} {
+		client := testClientEntity()
+		client.OriginHost, client.OriginRealm = "client."+testCase.peerRealm, testCase.peerRealm
+		client.AuthApplicationIDs = []uint32{4, 16777251}
+
+		peerSeenByClient, _ := connectClientTo(t, listener, client)
+		if !slices.Equal(peerSeenByClient.Identity.AuthApplicationIDs, testCase.expectedAuthApplicationIDs) {
+			t.Errorf("[%s] expected client to see Auth-Application-Ids (%v), got (%v)", testCase.peerRealm, testCase.expectedAuthApplicationIDs, peerSeenByClient.Identity.AuthApplicationIDs)
+		}
+		if len(peerSeenByClient.Identity.HostIPAddresses) != 1 || !peerSeenByClient.Identity.HostIPAddresses[0].Equal(net.ParseIP("10.0.0.2")) {
+			t.Errorf("[%s] expected client to see Host-IP-Address of the receiver identity (10.0.0.2), got (%v)", testCase.peerRealm, peerSeenByClient.Identity.HostIPAddresses)
+		}
+
+		establishedEvent := nextAgentEventOfType(t, agent.EventChannel(), DiameterConnectionEstablishedEvent)
+		if !slices.Equal(establishedEvent.Peer.CommonAuthApplicationIDs, testCase.expectedAuthApplicationIDs) {
+			t.Errorf("[%s] expected agent peer CommonAuthApplicationIDs (%v), got (%v)", testCase.peerRealm, testCase.expectedAuthApplicationIDs, establishedEvent.Peer.CommonAuthApplicationIDs)
+		}
+	}
+}
+
+func TestReceiverDoesNotChangeTheSharedEntityChosenForEachPeer(t *testing.T) {
+	shared := &DiameterEntity{OriginHost: "server.example.com", OriginRealm: "example.com", ProductName: "test-server", AuthApplicationIDs: []uint32{4}}
+
+	listener := listenOnLoopback(t)
+	agent := New()
+	go agent.Run([]*AgentReceiver{{
+		Listener:                 listener,
+		IdentityToAssert:         testServerEntity(),
+		LocalCapabilitiesForPeer: func(peer *DiameterEntity) *DiameterEntity { return shared },
+	}})
+
+	for _, peerRealm := range []string{"realm-a.example.com", "realm-b.example.com"} {
+		client := testClientEntity()
+		client.OriginHost, client.OriginRealm = "client."+peerRealm, peerRealm
+		client.AuthApplicationIDs = []uint32{4}
+
+		peerSeenByClient, _ := connectClientTo(t, listener, client)
+		if len(peerSeenByClient.Identity.HostIPAddresses) != 1 || !peerSeenByClient.Identity.HostIPAddresses[0].Equal(net.ParseIP("10.0.0.2")) {
+			t.Errorf("[%s] expected client to see Host-IP-Address of the receiver identity (10.0.0.2), got (%v)", peerRealm, peerSeenByClient.Identity.HostIPAddresses)
+		}
+		nextAgentEventOfType(t, agent.EventChannel(), DiameterConnectionEstablishedEvent)
+	}
+
+	if len(shared.HostIPAddresses) != 0 {
+		t.Errorf("expected shared entity HostIPAddresses to be unchanged, got (%v)", shared.HostIPAddresses)
+	}
+}
+
+func TestAgentRejectsReservedHeaderFlagsWhenSet(t *testing.T) {
+	listener := listenOnLoopback(t)
+	agent := New().SetRejectReservedHeaderFlags(true)
+	go agent.Run([]*AgentReceiver{{Listener: listener, IdentityToAssert: testServerEntity()}})
+
+	client, clientEvents := connectClientTo(t, listener, testClientEntity())
+	nextAgentEventOfType(t, agent.EventChannel(), DiameterConnectionEstablishedEvent)
+
+	request := testCreditControlRequest()
+	request.Flags |= 0x01
+	if err := client.SendMessage(request); err != nil {
+		t.Fatalf("expected no error on SendMessage(), got = (%s)", err)
+	}
+
+	errorEvent := nextAgentEventOfType(t, agent.EventChannel(), ErrorEvent)
+	if !errors.Is(errorEvent.Error, diameter.ErrInvalidHeaderBits) {
+		t.Errorf("expected agent error event wrapping ErrInvalidHeaderBits, got = (%v)", errorEvent.Error)
+	}
+
+	answer := nextEventOfType(t, clientEvents, MessageReceivedFromPeerEvent).Message
+	expectExactlyOneAvpWithValue(t, answer, 268, diameter.Unsigned32, uint32(3008))
+}
@@ -0,0 +1,194 @@
+package agent
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/blorticus-go/diameter"
+)
+
+// DuplicateRequestCache remembers the answers sent for requests received from peers, so that a
+// retransmitted request can be answered again without delivering it to the application.  A request
+// is identified by its Origin-Host and End-to-End-ID (RFC 6733 section 6.2).  A request with the
+// T-bit set that matches a request that has already been answered is answered with the cached answer
+// (with the Hop-by-Hop-ID of the retransmitted request).  An entry is kept until ttl elapses, or until
+// it is the oldest entry and room is needed for a new one.  A cache may be shared by the
+// PeerStateManagers for more than one peer, so that a request retransmitted to an alternate peer
+// (e.g., after a failover) is detected.
+type DuplicateRequestCache struct {
+	maxEntries int
+	ttl        time.Duration
+	now        func() time.Time
+
+	mutex          sync.Mutex
+	entriesInOrder *list.List
+	entryByRequest map[duplicateRequestKey]*list.Element
+	entryByHop     map[duplicateRequestHopKey]*list.Element
+}
+
+// duplicateRequestKey identifies a request across retransmissions.
+type duplicateRequestKey struct {
+	originHost string
+	endToEndID uint32
+}
+
+// duplicateRequestHopKey identifies a request on a single connection, which is how an answer is
+// matched to the request it answers.  owner identifies the connection.
+type duplicateRequestHopKey struct {
+	owner      any
+	hopByHopID uint32
+}
+
+// duplicateRequestCacheEntry is a request that has been delivered to the application.  answer is nil
+// until the answer is sent.
+type duplicateRequestCacheEntry struct {
+	requestKey duplicateRequestKey
+	hopKey     duplicateRequestHopKey
+	answer     *diameter.Message
+	expires    time.Time
+}
+
+// NewDuplicateRequestCache creates a DuplicateRequestCache that holds at most maxEntries requests,
+// each for at most ttl.  Requests that are waiting for an answer count toward maxEntries.
+func NewDuplicateRequestCache(maxEntries int, ttl time.Duration) *DuplicateRequestCache {
+	return &DuplicateRequestCache{
+		maxEntries:     maxEntries,
+		ttl:            ttl,
+		now:            time.Now,
+		entriesInOrder: list.New(),
+		entryByRequest: make(map[duplicateRequestKey]*list.Element),
+		entryByHop:     make(map[duplicateRequestHopKey]*list.Element),
+	}
+}
+
+// Len returns the number of requests in the cache, including those that have expired but have not yet
+// been removed.
+func (cache *DuplicateRequestCache) Len() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return cache.entriesInOrder.Len()
+}
+
+// recordRequest adds request, received on the connection identified by owner, to the cache, so that
+// the answer for it can be recorded by recordAnswer().  A request without an Origin-Host is not added.
+func (cache *DuplicateRequestCache) recordRequest(owner any, request *diameter.Message) {
+	requestKey, ok := duplicateRequestKeyFor(request)
+	if !ok || cache.maxEntries <= 0 {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.removeExpiredEntries()
+
+	if element, isInCache := cache.entryByRequest[requestKey]; isInCache {
+		cache.removeEntry(element)
+	}
+
+	for cache.entriesInOrder.Len() >= cache.maxEntries {
+		cache.removeEntry(cache.entriesInOrder.Front())
+	}
+
+	entry := &duplicateRequestCacheEntry{
+		requestKey: requestKey,
+		hopKey:     duplicateRequestHopKey{owner, request.HopByHopID},
+		expires:    cache.now().Add(cache.ttl),
+	}
+
+	element := cache.entriesInOrder.PushBack(entry)
+	cache.entryByRequest[entry.requestKey] = element
+	cache.entryByHop[entry.hopKey] = element
+}
+
+// recordAnswer stores answer, sent on the connection identified by owner, for the request that it
+// answers.  If that request was not recorded by recordRequest(), or it has been removed, the answer
+// is not stored.
+func (cache *DuplicateRequestCache) recordAnswer(owner any, answer *diameter.Message) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, isInCache := cache.entryByHop[duplicateRequestHopKey{owner, answer.HopByHopID}]
+	if !isInCache {
+		return
+	}
+
+	entry := element.Value.(*duplicateRequestCacheEntry)
+	if entry.requestKey.endToEndID != answer.EndToEndID {
+		return
+	}
+
+	delete(cache.entryByHop, entry.hopKey)
+	entry.answer = answer
+	entry.expires = cache.now().Add(cache.ttl)
+	cache.entriesInOrder.MoveToBack(element)
+}
+
+// answerForRetransmittedRequest returns the cached answer for request, with the Hop-by-Hop-ID of
+// request, if request has the T-bit set and the request it duplicates has been answered.  Otherwise,
+// it returns nil.
+func (cache *DuplicateRequestCache) answerForRetransmittedRequest(request *diameter.Message) *diameter.Message {
+	if !request.IsPotentiallyRetransmitted() {
+		return nil
+	}
+
+	requestKey, ok := duplicateRequestKeyFor(request)
+	if !ok {
+		return nil
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.removeExpiredEntries()
+
+	element, isInCache := cache.entryByRequest[requestKey]
+	if !isInCache {
+		return nil
+	}
+
+	entry := element.Value.(*duplicateRequestCacheEntry)
+	if entry.answer == nil {
+		return nil
+	}
+
+	answer := entry.answer.Clone()
+	answer.HopByHopID = request.HopByHopID
+
+	return answer
+}
+
+// removeExpiredEntries removes entries whose ttl has elapsed.  Since every entry has the same ttl, and
+// an entry is moved to the back when its expiry is extended, the entries expire in list order.  The
+// mutex must be held.
+func (cache *DuplicateRequestCache) removeExpiredEntries() {
+	now := cache.now()
+	for element := cache.entriesInOrder.Front(); element != nil && !now.Before(element.Value.(*duplicateRequestCacheEntry).expires); element = cache.entriesInOrder.Front() {
+		cache.removeEntry(element)
+	}
+}
+
+// removeEntry removes element from the list and from both indexes.  The mutex must be held.
+func (cache *DuplicateRequestCache) removeEntry(element *list.Element) {
+	entry := cache.entriesInOrder.Remove(element).(*duplicateRequestCacheEntry)
+	delete(cache.entryByRequest, entry.requestKey)
+	if hopElement, isInCache := cache.entryByHop[entry.hopKey]; isInCache && hopElement == element {
+		delete(cache.entryByHop, entry.hopKey)
+	}
+}
+
+func duplicateRequestKeyFor(request *diameter.Message) (duplicateRequestKey, bool) {
+	originHostAvp := request.FirstAvpMatching(0, 264)
+	if originHostAvp == nil {
+		return duplicateRequestKey{}, false
+	}
+
+	originHost, err := diameter.ConvertAVPDataToTypedData(originHostAvp.Data, diameter.DiamIdent)
+	if err != nil {
+		return duplicateRequestKey{}, false
+	}
+
+	return duplicateRequestKey{originHost.(string), request.EndToEndID}, true
+}
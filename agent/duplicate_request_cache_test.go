@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blorticus-go/diameter"
+)
+
+func TestRetransmittedRequestIsAnsweredFromCache(t *testing.T) {
+	clientEvents, serverEvents := runManagerPair(t, testServerEntity(), func(server *PeerStateManager) {
+		server.SetDuplicateRequestCache(NewDuplicateRequestCache(10, time.Minute))
+	})
+
+	client := nextEventOfType(t, clientEvents, DiameterConnectionEstablishedEvent).Peer
+	server := nextEventOfType(t, serverEvents, DiameterConnectionEstablishedEvent).Peer
+
+	request := testCreditControlRequest()
+	if err := client.SendMessage(request); err != nil {
+		t.Fatalf("expected no error on SendMessage(), got = (%s)", err)
+	}
+
+	receivedRequest := nextEventOfType(t, serverEvents, MessageReceivedFromPeerEvent).Message
+	if err := server.SendAnswer(receivedRequest, []*diameter.AVP{diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2001))}, nil); err != nil {
+		t.Fatalf("expected no error on SendAnswer(), got = (%s)", err)
+	}
+	nextEventOfType(t, clientEvents, MessageReceivedFromPeerEvent)
+
+	retransmission := testCreditControlRequest()
+	retransmission.EndToEndID = request.EndToEndID
+	retransmission.SetPotentialRetransmitFlag(true)
+	if err := client.SendMessage(retransmission); err != nil {
+		t.Fatalf("expected no error on SendMessage() for retransmission, got = (%s)", err)
+	}
+
+	cachedAnswer := nextEventOfType(t, clientEvents, MessageReceivedFromPeerEvent).Message
+	if cachedAnswer.IsRequest() || cachedAnswer.HopByHopID != retransmission.HopByHopID || cachedAnswer.EndToEndID != request.EndToEndID {
+		t.Errorf("expected answer matching the retransmission, got hop-by-hop-id (%d), end-to-end-id (%d)", cachedAnswer.HopByHopID, cachedAnswer.EndToEndID)
+	}
+	expectExactlyOneAvpWithValue(t, cachedAnswer, 268, diameter.Unsigned32, uint32(2001))
+
+	answeredEvent := nextEventOfType(t, serverEvents, RetransmittedRequestAnsweredFromCacheEvent)
+	if answeredEvent.Message.HopByHopID != retransmission.HopByHopID {
+		t.Errorf("expected event to carry the retransmitted request")
+	}
+
+	for {
+		select {
+		case event := <-serverEvents:
+			if event.Type == MessageReceivedFromPeerEvent {
+				t.Fatalf("expected retransmitted request not to be delivered to the application")
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestRequestWithoutTBitIsNotAnsweredFromCache(t *testing.T) {
+	clientEvents, serverEvents := runManagerPair(t, testServerEntity(), func(server *PeerStateManager) {
+		server.SetDuplicateRequestCache(NewDuplicateRequestCache(10, time.Minute))
+	})
+
+	client := nextEventOfType(t, clientEvents, DiameterConnectionEstablishedEvent).Peer
+	server := nextEventOfType(t, serverEvents, DiameterConnectionEstablishedEvent).Peer
+
+	request := testCreditControlRequest()
+	if err := client.SendMessage(request); err != nil {
+		t.Fatalf("expected no error on SendMessage(), got = (%s)", err)
+	}
+	receivedRequest := nextEventOfType(t, serverEvents, MessageReceivedFromPeerEvent).Message
+	if err := server.SendAnswer(receivedRequest, []*diameter.AVP{diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2001))}, nil); err != nil {
+		t.Fatalf("expected no error on SendAnswer(), got = (%s)", err)
+	}
+
+	duplicate := testCreditControlRequest()
+	duplicate.EndToEndID = request.EndToEndID
+	if err := client.SendMessage(duplicate); err != nil {
+		t.Fatalf("expected no error on SendMessage() for duplicate, got = (%s)", err)
+	}
+
+	if received := nextEventOfType(t, serverEvents, MessageReceivedFromPeerEvent).Message; received.HopByHopID != duplicate.HopByHopID {
+		t.Errorf("expected duplicate without T-bit to be delivered to the application")
+	}
+}
+
+func TestDuplicateRequestCacheExpiresAndEvictsEntries(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cache := NewDuplicateRequestCache(2, 10*time.Second)
+	cache.now = func() time.Time { return now }
+
+	requestWithEndToEndID := func(endToEndID uint32) *diameter.Message {
+		request := testCreditControlRequest()
+		request.EndToEndID, request.HopByHopID = endToEndID, endToEndID+100
+		return request
+	}
+	retransmissionOf := func(request *diameter.Message) *diameter.Message {
+		retransmission := request.Clone()
+		retransmission.SetPotentialRetransmitFlag(true)
+		return retransmission
+	}
+
+	first, second, third := requestWithEndToEndID(1), requestWithEndToEndID(2), requestWithEndToEndID(3)
+	for _, request := range []*diameter.Message{first, second} {
+		cache.recordRequest("conn", request)
+		if cache.answerForRetransmittedRequest(retransmissionOf(request)) != nil {
+			t.Errorf("expected no cached answer before the answer is recorded")
+		}
+		cache.recordAnswer("conn", request.GenerateMatchingResponseWithAvps(nil, nil))
+	}
+
+	if cache.answerForRetransmittedRequest(first) != nil {
+		t.Errorf("expected no cached answer for a request without the T-bit")
+	}
+	if cache.answerForRetransmittedRequest(retransmissionOf(first)) == nil {
+		t.Errorf("expected cached answer for the first request")
+	}
+	if cache.answerForRetransmittedRequest(retransmissionOf(second)) == nil {
+		t.Errorf("expected cached answer for the second request")
+	}
+
+	cache.recordRequest("conn", third)
+	if cache.Len() != 2 {
+		t.Errorf("expected cache to hold (2) entries, got (%d)", cache.Len())
+	}
+	if cache.answerForRetransmittedRequest(retransmissionOf(first)) != nil {
+		t.Errorf("expected the oldest entry to be evicted when the cache is full")
+	}
+
+	cache.recordAnswer("other-conn", third.GenerateMatchingResponseWithAvps(nil, nil))
+	if cache.answerForRetransmittedRequest(retransmissionOf(third)) != nil {
+		t.Errorf("expected an answer sent on a different connection not to be recorded")
+	}
+
+	now = now.Add(10 * time.Second)
+	if cache.answerForRetransmittedRequest(retransmissionOf(second)) != nil {
+		t.Errorf("expected the cached answer to expire after the ttl")
+	}
+	if cache.Len() != 0 {
+		t.Errorf("expected expired entries to be removed, got (%d) entries", cache.Len())
+	}
+}
@@ -1,7 +1,9 @@
 package agent
 
 import (
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/blorticus-go/diameter"
 )
@@ -19,6 +21,15 @@ const (
 	StateMachineMessageSentToPeerEvent
 	MessageReceivedFromPeerEvent
 	ErrorEvent
+	UnsolicitedDWAReceivedEvent
+	ConnectionRejectedEvent
+	UnsupportedApplicationRequestRejectedEvent
+	RetransmittedRequestAnsweredFromCacheEvent
+	PeerCapabilitiesUpdatedEvent
+	PeerInitiatedDisconnectEvent
+	RequestRejectedWhilePausedEvent
+	ConnectionCollisionResolvedEvent
+	AnswerToCancelledRequestDiscardedEvent
 )
 
 type PeerStateEvent struct {
@@ -29,20 +40,63 @@ type PeerStateEvent struct {
 	Message     *diameter.Message
 	PeerHandler *PeerStateManager
 	Peer        *Peer
+	// DisconnectCause is set on a PeerInitiatedDisconnectEvent and a DiameterConnectionClosedEvent if
+	// the peer sent a Disconnect-Peer Request with a Disconnect-Cause.  Otherwise, it is nil.
+	DisconnectCause *DisconnectCause
+	// UpdatedCapabilities is set on a PeerCapabilitiesUpdatedEvent.  Otherwise, it is nil.
+	UpdatedCapabilities *PeerCapabilities
+}
+
+// PeerCapabilities are the capabilities of a connected peer advertised in a Capabilities-Exchange
+// Request received after the diameter connection was established (see
+// PeerStateManager.SetAcceptCapabilitiesUpdates()).  The Peer itself is not changed, because the
+// application may read its exported fields concurrently, so its Identity and common application IDs
+// remain those of the initial Capabilities-Exchange.  An application that needs the current
+// capabilities should keep these (e.g., with Peer.SetUserData()).
+type PeerCapabilities struct {
+	Identity *DiameterEntity
+	// CommonAuthApplicationIDs are the Auth-Application-Ids advertised by both the local entity and
+	// the peer.
+	CommonAuthApplicationIDs []uint32
+	// CommonAcctApplicationIDs are the Acct-Application-Ids advertised by both the local entity and
+	// the peer.
+	CommonAcctApplicationIDs []uint32
 }
 
 type PeerStateNotifier struct {
-	eventChannel chan<- *PeerStateEvent
-	transport    net.Conn
-	peer         *Peer
+	eventChannel        chan<- *PeerStateEvent
+	transport           net.Conn
+	peer                *Peer
+	logger              Logger
+	peerDisconnectCause *DisconnectCause
 }
 
 func NewPeerStateNotifier(eventChannel chan<- *PeerStateEvent) *PeerStateNotifier {
 	return &PeerStateNotifier{
 		eventChannel: eventChannel,
+		logger:       noopLogger{},
 	}
 }
 
+// SetLogger sets the Logger used when connection state changes and errors are notified.  If
+// logger is nil, nothing is logged.
+func (n *PeerStateNotifier) SetLogger(logger Logger) *PeerStateNotifier {
+	n.logger = loggerOrNoop(logger)
+	return n
+}
+
+// logKeysAndValues returns the keys and values that identify the peer connection in log entries.
+func (n *PeerStateNotifier) logKeysAndValues(additional ...any) []any {
+	keysAndValues := make([]any, 0, 4+len(additional))
+	if n.transport != nil {
+		keysAndValues = append(keysAndValues, "remoteAddress", n.transport.RemoteAddr().String())
+	}
+	if n.peer != nil {
+		keysAndValues = append(keysAndValues, "peer", n.peer.Identity.OriginHost)
+	}
+	return append(keysAndValues, additional...)
+}
+
 func (n *PeerStateNotifier) SetPeer(p *Peer) *PeerStateNotifier {
 	n.peer = p
 	return n
@@ -53,6 +107,13 @@ func (n *PeerStateNotifier) SetTransport(c net.Conn) *PeerStateNotifier {
 	return n
 }
 
+// SetPeerDisconnectCause records the Disconnect-Cause sent by the peer in a Disconnect-Peer Request.
+// It is included in the DiameterConnectionClosedEvent.
+func (n *PeerStateNotifier) SetPeerDisconnectCause(cause DisconnectCause) *PeerStateNotifier {
+	n.peerDisconnectCause = &cause
+	return n
+}
+
 func (n *PeerStateNotifier) NotifyThatListenerAcceptedTransportFromAPeer(c net.Conn) {
 	n.SetTransport(c)
 	n.eventChannel <- &PeerStateEvent{
@@ -63,6 +124,7 @@ func (n *PeerStateNotifier) NotifyThatListenerAcceptedTransportFromAPeer(c net.C
 }
 
 func (n *PeerStateNotifier) NotifyThatThePeerClosedTheTransport() {
+	n.logger.Info("peer closed the transport", n.logKeysAndValues()...)
 	n.eventChannel <- &PeerStateEvent{
 		Type: PeerClosedTransportEvent,
 		Conn: n.transport,
@@ -71,6 +133,7 @@ func (n *PeerStateNotifier) NotifyThatThePeerClosedTheTransport() {
 }
 
 func (n *PeerStateNotifier) ThatTheTransportToThePeerWasClosed() {
+	n.logger.Info("closed transport to peer", n.logKeysAndValues()...)
 	n.eventChannel <- &PeerStateEvent{
 		Type: ClosedTransportToPeerEvent,
 		Conn: n.transport,
@@ -79,6 +142,7 @@ func (n *PeerStateNotifier) ThatTheTransportToThePeerWasClosed() {
 }
 
 func (n *PeerStateNotifier) NotifyThatDiameterConnectionHasBeenEstablished() {
+	n.logger.Info("diameter connection established", n.logKeysAndValues()...)
 	n.eventChannel <- &PeerStateEvent{
 		Type: DiameterConnectionEstablishedEvent,
 		Conn: n.transport,
@@ -87,14 +151,21 @@ func (n *PeerStateNotifier) NotifyThatDiameterConnectionHasBeenEstablished() {
 }
 
 func (n *PeerStateNotifier) NotifyThatDiameterConnectionHasBeenClosed() {
+	if n.peerDisconnectCause != nil {
+		n.logger.Info("diameter connection closed", n.logKeysAndValues("disconnectCause", int32(*n.peerDisconnectCause))...)
+	} else {
+		n.logger.Info("diameter connection closed", n.logKeysAndValues()...)
+	}
 	n.eventChannel <- &PeerStateEvent{
-		Type: DiameterConnectionClosedEvent,
-		Conn: n.transport,
-		Peer: n.peer,
+		Type:            DiameterConnectionClosedEvent,
+		Conn:            n.transport,
+		Peer:            n.peer,
+		DisconnectCause: n.peerDisconnectCause,
 	}
 }
 
 func (n *PeerStateNotifier) NotifyThatAnErrorOccurred(err error) {
+	n.logger.Error("peer connection error", n.logKeysAndValues("error", err)...)
 	n.eventChannel <- &PeerStateEvent{
 		Type:  ErrorEvent,
 		Conn:  n.transport,
@@ -130,6 +201,111 @@ func (n *PeerStateNotifier) NotifyThatAMessageWasReceivedFromThePeer(m *diameter
 	}
 }
 
+// NotifyThatAnUnsolicitedDWAWasReceived signals that a DWA arrived whose Hop-by-Hop-ID does not match
+// any DWR sent to the peer that is awaiting an answer.
+func (n *PeerStateNotifier) NotifyThatAnUnsolicitedDWAWasReceived(m *diameter.Message) {
+	n.logger.Warn("received DWA that does not match an outstanding DWR", n.logKeysAndValues("hopByHopId", m.HopByHopID)...)
+	n.eventChannel <- &PeerStateEvent{
+		Type:    UnsolicitedDWAReceivedEvent,
+		Conn:    n.transport,
+		Peer:    n.peer,
+		Message: m,
+	}
+}
+
+// NotifyThatAnUnsupportedApplicationRequestWasRejected signals that the request m, for an application
+// that the local entity does not support, was answered with DIAMETER_APPLICATION_UNSUPPORTED.
+func (n *PeerStateNotifier) NotifyThatAnUnsupportedApplicationRequestWasRejected(m *diameter.Message) {
+	n.logger.Warn("rejected request for unsupported application", n.logKeysAndValues("applicationId", m.AppID, "code", m.Code)...)
+	n.eventChannel <- &PeerStateEvent{
+		Type:    UnsupportedApplicationRequestRejectedEvent,
+		Conn:    n.transport,
+		Peer:    n.peer,
+		Message: m,
+	}
+}
+
+// NotifyThatARequestWasRejectedWhilePaused signals that the request m was answered with
+// DIAMETER_TOO_BUSY because the peer is paused (see Peer.Pause()).
+func (n *PeerStateNotifier) NotifyThatARequestWasRejectedWhilePaused(m *diameter.Message) {
+	n.logger.Debug("rejected request while peer is paused", n.logKeysAndValues("applicationId", m.AppID, "code", m.Code)...)
+	n.eventChannel <- &PeerStateEvent{
+		Type:    RequestRejectedWhilePausedEvent,
+		Conn:    n.transport,
+		Peer:    n.peer,
+		Message: m,
+	}
+}
+
+// NotifyThatAnAnswerToACancelledRequestWasDiscarded signals that the answer m arrived for a request that
+// was cancelled (see Peer.CancelRequest()), so it was not delivered.
+func (n *PeerStateNotifier) NotifyThatAnAnswerToACancelledRequestWasDiscarded(m *diameter.Message) {
+	n.logger.Debug("discarded answer to cancelled request", n.logKeysAndValues("hopByHopId", m.HopByHopID)...)
+	n.eventChannel <- &PeerStateEvent{
+		Type:    AnswerToCancelledRequestDiscardedEvent,
+		Conn:    n.transport,
+		Peer:    n.peer,
+		Message: m,
+	}
+}
+
+// NotifyThatAConnectionCollisionWasResolvedByClosingTheTransport signals that the transport is being closed
+// because the local entity and the peer each opened a transport to the other, and a connection election
+// (RFC 6733 section 5.6.4) kept the other transport.  m is the Capabilities-Exchange message that
+// ended the exchange on this transport (a Request answered with DIAMETER_ELECTION_LOST, or an Answer
+// with that Result-Code), or nil if the local entity won the election before the peer answered.
+func (n *PeerStateNotifier) NotifyThatAConnectionCollisionWasResolvedByClosingTheTransport(m *diameter.Message) {
+	n.logger.Info("closing transport after connection election", n.logKeysAndValues()...)
+	n.eventChannel <- &PeerStateEvent{
+		Type:    ConnectionCollisionResolvedEvent,
+		Conn:    n.transport,
+		Message: m,
+	}
+}
+
+// NotifyThatARetransmittedRequestWasAnsweredFromCache signals that the request m, which duplicates a
+// request that has already been answered, was answered with the cached answer.
+func (n *PeerStateNotifier) NotifyThatARetransmittedRequestWasAnsweredFromCache(m *diameter.Message) {
+	n.logger.Info("answered retransmitted request from cache", n.logKeysAndValues("endToEndId", m.EndToEndID, "hopByHopId", m.HopByHopID)...)
+	n.eventChannel <- &PeerStateEvent{
+		Type:    RetransmittedRequestAnsweredFromCacheEvent,
+		Conn:    n.transport,
+		Peer:    n.peer,
+		Message: m,
+	}
+}
+
+// NotifyThatThePeerInitiatedADisconnect signals that the peer sent the Disconnect-Peer Request m
+// while connected, so that the diameter connection is being closed gracefully rather than because the
+// transport was lost.  It is sent before the DiameterConnectionClosedEvent.
+func (n *PeerStateNotifier) NotifyThatThePeerInitiatedADisconnect(m *diameter.Message) {
+	if n.peerDisconnectCause != nil {
+		n.logger.Info("peer initiated disconnect", n.logKeysAndValues("disconnectCause", int32(*n.peerDisconnectCause))...)
+	} else {
+		n.logger.Info("peer initiated disconnect", n.logKeysAndValues()...)
+	}
+	n.eventChannel <- &PeerStateEvent{
+		Type:            PeerInitiatedDisconnectEvent,
+		Conn:            n.transport,
+		Peer:            n.peer,
+		Message:         m,
+		DisconnectCause: n.peerDisconnectCause,
+	}
+}
+
+// NotifyThatThePeerCapabilitiesWereUpdated signals that the peer sent the Capabilities-Exchange Request
+// m while connected, advertising the capabilities updated.
+func (n *PeerStateNotifier) NotifyThatThePeerCapabilitiesWereUpdated(m *diameter.Message, updated *PeerCapabilities) {
+	n.logger.Info("peer capabilities updated by Capabilities-Exchange Request", n.logKeysAndValues()...)
+	n.eventChannel <- &PeerStateEvent{
+		Type:                PeerCapabilitiesUpdatedEvent,
+		Conn:                n.transport,
+		Peer:                n.peer,
+		Message:             m,
+		UpdatedCapabilities: updated,
+	}
+}
+
 type ConnectionError struct {
 	errStr string
 }
@@ -200,3 +376,52 @@ func NewConnectionTimedOutError(c net.Conn) *DiameterConnectionTimedOutError {
 func (e *DiameterConnectionTimedOutError) Error() string {
 	return "diameter connection timed out"
 }
+
+type WriteTimedOutError struct {
+	timeout time.Duration
+}
+
+func NewWriteTimedOutError(timeout time.Duration) *WriteTimedOutError {
+	return &WriteTimedOutError{timeout}
+}
+
+func (e *WriteTimedOutError) Error() string {
+	return fmt.Sprintf("write to transport did not complete within %s", e.timeout)
+}
+
+// InvalidHeaderBitsError is raised when a message received from a connected peer has a combination of
+// header flags that is not permitted (see diameter.Message.ValidateHeaderFlags()), or has reserved bits
+// set and the manager rejects them (see PeerStateManager.SetRejectReservedHeaderFlags()).  The message,
+// whether a request or an answer, is not delivered.  If it is a request, it is answered with
+// DIAMETER_INVALID_HDR_BITS (3008).  Err wraps diameter.ErrInvalidHeaderBits.
+type InvalidHeaderBitsError struct {
+	Message *diameter.Message
+	Err     error
+}
+
+func NewInvalidHeaderBitsError(m *diameter.Message, err error) *InvalidHeaderBitsError {
+	return &InvalidHeaderBitsError{m, err}
+}
+
+func (e *InvalidHeaderBitsError) Error() string {
+	return fmt.Sprintf("discarded message (code %d) from peer: %s", e.Message.Code, e.Err)
+}
+
+func (e *InvalidHeaderBitsError) Unwrap() error {
+	return e.Err
+}
+
+// PeerRejectedError is raised when a peer is rejected by a PeerAcceptanceFunc after it sends a
+// Capabilities-Exchange Request.
+type PeerRejectedError struct {
+	OriginHost string
+	ResultCode uint32
+}
+
+func NewPeerRejectedError(originHost string, resultCode uint32) *PeerRejectedError {
+	return &PeerRejectedError{originHost, resultCode}
+}
+
+func (e *PeerRejectedError) Error() string {
+	return fmt.Sprintf("rejected peer (%s) with Result-Code (%d)", e.OriginHost, e.ResultCode)
+}
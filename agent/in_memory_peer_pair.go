@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const inMemoryPeerPairHandshakeTimeout = 5 * time.Second
+
+// InMemoryPeerPair is a pair of Diameter peers that are connected to each other over an
+// in-memory transport (a net.Pipe).  It is intended to simplify the testing of applications
+// that use the agent, since no sockets are required.  ClientPeer is the local view of the
+// server entity from the client side, and ServerPeer is the local view of the client entity
+// from the server side.  The events for each side are delivered to ClientEvents and
+// ServerEvents, respectively.  The caller must read from both event channels, otherwise the
+// peer state managers will eventually block.
+type InMemoryPeerPair struct {
+	ClientPeer   *Peer
+	ServerPeer   *Peer
+	ClientEvents <-chan *PeerStateEvent
+	ServerEvents <-chan *PeerStateEvent
+
+	clientTransport net.Conn
+	serverTransport net.Conn
+}
+
+// NewInMemoryPeerPair creates a client and server peer state manager connected by a net.Pipe,
+// and runs the Capabilities-Exchange between them.  It returns when the Diameter connection
+// is established on both sides.  Any events that occur before the connection is established
+// are consumed.  Both entities must have at least one Host-IP-Address.  Returns an error if
+// the Capabilities-Exchange fails on either side.
+func NewInMemoryPeerPair(clientEntity *DiameterEntity, serverEntity *DiameterEntity) (*InMemoryPeerPair, error) {
+	clientTransport, serverTransport := net.Pipe()
+
+	clientEvents := make(chan *PeerStateEvent, 100)
+	serverEvents := make(chan *PeerStateEvent, 100)
+
+	go NewInitiatedPeerStateManager(serverEntity, serverTransport, serverEvents).NewRun()
+	go NewInitiatorPeerStateManager(clientEntity, clientTransport, clientEvents).NewRun()
+
+	pair := &InMemoryPeerPair{
+		ClientEvents:    clientEvents,
+		ServerEvents:    serverEvents,
+		clientTransport: clientTransport,
+		serverTransport: serverTransport,
+	}
+
+	var err error
+	if pair.ClientPeer, err = waitForDiameterConnectionToBeEstablished(clientEvents); err != nil {
+		pair.Close()
+		return nil, fmt.Errorf("client side: %s", err)
+	}
+
+	if pair.ServerPeer, err = waitForDiameterConnectionToBeEstablished(serverEvents); err != nil {
+		pair.Close()
+		return nil, fmt.Errorf("server side: %s", err)
+	}
+
+	return pair, nil
+}
+
+// Close closes the transport for both sides, which causes both peer state managers to stop.
+func (pair *InMemoryPeerPair) Close() {
+	pair.clientTransport.Close()
+	pair.serverTransport.Close()
+}
+
+func waitForDiameterConnectionToBeEstablished(eventChannel <-chan *PeerStateEvent) (*Peer, error) {
+	timeout := time.After(inMemoryPeerPairHandshakeTimeout)
+
+	for {
+		select {
+		case event := <-eventChannel:
+			switch event.Type {
+			case DiameterConnectionEstablishedEvent:
+				return event.Peer, nil
+			case ErrorEvent:
+				return nil, event.Error
+			case PeerClosedTransportEvent, ClosedTransportToPeerEvent:
+				return nil, fmt.Errorf("transport closed before the diameter connection was established")
+			}
+
+		case <-timeout:
+			return nil, fmt.Errorf("timed out waiting for the diameter connection to be established")
+		}
+	}
+}
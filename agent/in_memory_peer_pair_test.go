@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blorticus-go/diameter"
+)
+
+func testClientEntity() *DiameterEntity {
+	ip := net.ParseIP("10.0.0.1")
+	return &DiameterEntity{
+		OriginHost:      "client.example.com",
+		OriginRealm:     "example.com",
+		HostIPAddresses: []*net.IP{&ip},
+		ProductName:     "test-client",
+	}
+}
+
+func testServerEntity() *DiameterEntity {
+	ip := net.ParseIP("10.0.0.2")
+	return &DiameterEntity{
+		OriginHost:      "server.example.com",
+		OriginRealm:     "example.com",
+		HostIPAddresses: []*net.IP{&ip},
+		ProductName:     "test-server",
+	}
+}
+
+func testCreditControlRequest() *diameter.Message {
+	return diameter.NewMessage(diameter.MsgFlagRequest|diameter.MsgFlagProxiable, 272, 4, 0, 0, []*diameter.AVP{
+		diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1;1"),
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "client.example.com"),
+		diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+		diameter.NewTypedAVP(283, 0, true, diameter.DiamIdent, "example.com"),
+		diameter.NewTypedAVP(258, 0, true, diameter.Unsigned32, uint32(4)),
+		diameter.NewTypedAVP(416, 0, true, diameter.Enumerated, int32(1)),
+		diameter.NewTypedAVP(415, 0, true, diameter.Unsigned32, uint32(0)),
+	}, nil)
+}
+
+// nextEventOfType reads from the event channel, discarding events, until an event of
+// the requested type arrives.  It fails the test if that takes longer than one second.
+func nextEventOfType(t *testing.T, eventChannel <-chan *PeerStateEvent, eventType PeerEventType) *PeerStateEvent {
+	t.Helper()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-eventChannel:
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for event of type (%d)", eventType)
+			return nil
+		}
+	}
+}
+
+func TestInMemoryPeerPairExchangesCreditControl(t *testing.T) {
+	pair, err := NewInMemoryPeerPair(testClientEntity(), testServerEntity())
+	if err != nil {
+		t.Fatalf("expected no error on NewInMemoryPeerPair(), got = (%s)", err)
+	}
+	defer pair.Close()
+
+	if pair.ClientPeer.Identity.OriginHost != "server.example.com" {
+		t.Errorf("expected client side peer Origin-Host = (server.example.com), got = (%s)", pair.ClientPeer.Identity.OriginHost)
+	}
+	if pair.ServerPeer.Identity.OriginHost != "client.example.com" {
+		t.Errorf("expected server side peer Origin-Host = (client.example.com), got = (%s)", pair.ServerPeer.Identity.OriginHost)
+	}
+
+	ccr := testCreditControlRequest()
+	if err := pair.ClientPeer.SendMessage(ccr); err != nil {
+		t.Fatalf("expected no error on SendMessage(ccr), got = (%s)", err)
+	}
+
+	receivedCcr := nextEventOfType(t, pair.ServerEvents, MessageReceivedFromPeerEvent).Message
+	if receivedCcr.Code != 272 || receivedCcr.AppID != 4 || !receivedCcr.IsRequest() {
+		t.Fatalf("expected CCR on server side, got message with code (%d), appId (%d)", receivedCcr.Code, receivedCcr.AppID)
+	}
+
+	cca := receivedCcr.GenerateMatchingResponseWithAvps([]*diameter.AVP{
+		receivedCcr.FirstAvpMatching(0, 263),
+		diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2001)),
+	}, nil)
+	if err := pair.ServerPeer.SendMessage(cca); err != nil {
+		t.Fatalf("expected no error on SendMessage(cca), got = (%s)", err)
+	}
+
+	receivedCca := nextEventOfType(t, pair.ClientEvents, MessageReceivedFromPeerEvent).Message
+	if receivedCca.IsRequest() || receivedCca.HopByHopID != ccr.HopByHopID || receivedCca.EndToEndID != ccr.EndToEndID {
+		t.Errorf("expected CCA matching the CCR, got answer with hop-by-hop-id (%d) and end-to-end-id (%d)", receivedCca.HopByHopID, receivedCca.EndToEndID)
+	}
+}
+
+func TestInMemoryPeerPairShutsDownBothSidesWhenOneSideDisconnects(t *testing.T) {
+	pair, err := NewInMemoryPeerPair(testClientEntity(), testServerEntity())
+	if err != nil {
+		t.Fatalf("expected no error on NewInMemoryPeerPair(), got = (%s)", err)
+	}
+
+	pair.clientTransport.Close()
+
+	nextEventOfType(t, pair.ClientEvents, ClosedTransportToPeerEvent)
+	nextEventOfType(t, pair.ServerEvents, ClosedTransportToPeerEvent)
+}
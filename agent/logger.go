@@ -0,0 +1,27 @@
+package agent
+
+// Logger is an optional logging interface used by the agent and the PeerStateManager at key points
+// in the life of a peer connection (e.g., Diameter connection state changes, watchdogs, disconnects
+// and errors).  This is in addition to the events delivered on the event channel.  Each method takes
+// a message and a list of alternating keys and values, so a *slog.Logger satisfies this interface.
+type Logger interface {
+	Debug(msg string, keysAndValues ...any)
+	Info(msg string, keysAndValues ...any)
+	Warn(msg string, keysAndValues ...any)
+	Error(msg string, keysAndValues ...any)
+}
+
+type noopLogger struct{}
+
+func (noopLogger) Debug(msg string, keysAndValues ...any) {}
+func (noopLogger) Info(msg string, keysAndValues ...any)  {}
+func (noopLogger) Warn(msg string, keysAndValues ...any)  {}
+func (noopLogger) Error(msg string, keysAndValues ...any) {}
+
+// loggerOrNoop returns logger, or a Logger that discards everything if logger is nil.
+func loggerOrNoop(logger Logger) Logger {
+	if logger == nil {
+		return noopLogger{}
+	}
+	return logger
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+type capturedLogEntry struct {
+	level         string
+	msg           string
+	keysAndValues []any
+}
+
+type capturingLogger struct {
+	mutex   sync.Mutex
+	entries []capturedLogEntry
+}
+
+func (l *capturingLogger) capture(level string, msg string, keysAndValues []any) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, capturedLogEntry{level, msg, keysAndValues})
+}
+
+func (l *capturingLogger) Debug(msg string, keysAndValues ...any) {
+	l.capture("debug", msg, keysAndValues)
+}
+
+func (l *capturingLogger) Info(msg string, keysAndValues ...any) {
+	l.capture("info", msg, keysAndValues)
+}
+
+func (l *capturingLogger) Warn(msg string, keysAndValues ...any) {
+	l.capture("warn", msg, keysAndValues)
+}
+
+func (l *capturingLogger) Error(msg string, keysAndValues ...any) {
+	l.capture("error", msg, keysAndValues)
+}
+
+// waitForEntry waits up to one second for an entry with the level and message to be captured,
+// and returns it.
+func (l *capturingLogger) waitForEntry(t *testing.T, level string, msg string) capturedLogEntry {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		l.mutex.Lock()
+		i := slices.IndexFunc(l.entries, func(e capturedLogEntry) bool { return e.level == level && e.msg == msg })
+		if i >= 0 {
+			entry := l.entries[i]
+			l.mutex.Unlock()
+			return entry
+		}
+		l.mutex.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("timed out waiting for log entry with level (%s) and msg (%s)", level, msg)
+	return capturedLogEntry{}
+}
+
+func valueForLogKey(keysAndValues []any, key string) string {
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		if keysAndValues[i] == key {
+			return fmt.Sprint(keysAndValues[i+1])
+		}
+	}
+	return ""
+}
+
+func TestPeerStateManagerLogsStateTransitions(t *testing.T) {
+	clientTransport, serverTransport := net.Pipe()
+	defer clientTransport.Close()
+	defer serverTransport.Close()
+
+	clientLogger, serverLogger := &capturingLogger{}, &capturingLogger{}
+	clientEvents := make(chan *PeerStateEvent, 100)
+	serverEvents := make(chan *PeerStateEvent, 100)
+
+	go NewInitiatedPeerStateManager(testServerEntity(), serverTransport, serverEvents).SetLogger(serverLogger).NewRun()
+	go NewInitiatorPeerStateManager(testClientEntity(), clientTransport, clientEvents).SetLogger(clientLogger).NewRun()
+
+	peer := nextEventOfType(t, clientEvents, DiameterConnectionEstablishedEvent).Peer
+
+	entry := clientLogger.waitForEntry(t, "info", "diameter connection established")
+	if valueForLogKey(entry.keysAndValues, "peer") != "server.example.com" {
+		t.Errorf("expected established log entry to name peer (server.example.com), got = %v", entry.keysAndValues)
+	}
+	serverLogger.waitForEntry(t, "info", "diameter connection established")
+
+	if err := peer.InitiateDisconnect(); err != nil {
+		t.Fatalf("expected no error on InitiateDisconnect(), got = (%s)", err)
+	}
+
+	clientLogger.waitForEntry(t, "info", "initiating diameter disconnect")
+	entry = clientLogger.waitForEntry(t, "debug", "peer state changed")
+	if valueForLogKey(entry.keysAndValues, "from") != "connected" || valueForLogKey(entry.keysAndValues, "to") != "half-closed" {
+		t.Errorf("expected client state change from connected to half-closed, got = %v", entry.keysAndValues)
+	}
+
+	entry = serverLogger.waitForEntry(t, "debug", "peer state changed")
+	if valueForLogKey(entry.keysAndValues, "from") != "connected" || valueForLogKey(entry.keysAndValues, "to") != "disconnected" {
+		t.Errorf("expected server state change from connected to disconnected, got = %v", entry.keysAndValues)
+	}
+	serverLogger.waitForEntry(t, "info", "diameter connection closed")
+
+	nextEventOfType(t, clientEvents, ClosedTransportToPeerEvent)
+	clientLogger.waitForEntry(t, "info", "closed transport to peer")
+}
+
+func TestPeerStateManagerWithNilLoggerDoesNotPanic(t *testing.T) {
+	manager := newTestPeerStateManager(t, testClientEntity()).SetLogger(nil)
+	manager.logger.Info("this is discarded")
+}
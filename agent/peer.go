@@ -3,17 +3,26 @@ package agent
 import (
 	"fmt"
 	"net"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"sync/atomic"
 
 	"github.com/blorticus-go/diameter"
 )
 
 type diameterEntityCache struct {
-	OriginHost      *diameter.AVP
-	OriginRealm     *diameter.AVP
-	ResultCode      *diameter.AVP
-	HostIPAddresses []*diameter.AVP
-	VendorId        *diameter.AVP
-	ProductName     *diameter.AVP
+	OriginHost         *diameter.AVP
+	OriginRealm        *diameter.AVP
+	ResultCode         *diameter.AVP
+	HostIPAddresses    []*diameter.AVP
+	VendorId           *diameter.AVP
+	ProductName        *diameter.AVP
+	OriginStateId      *diameter.AVP
+	FirmwareRevision   *diameter.AVP
+	SupportedVendorIds []*diameter.AVP
+	AuthApplicationIds []*diameter.AVP
+	AcctApplicationIds []*diameter.AVP
 }
 
 const (
@@ -22,6 +31,87 @@ const (
 	DisconnectPeerCode       = 282
 )
 
+// DisconnectCause is a value for the Disconnect-Cause AVP (code 273) sent in a Disconnect-Peer Request.
+type DisconnectCause int32
+
+const (
+	DisconnectCauseRebooting            DisconnectCause = 0
+	DisconnectCauseBusy                 DisconnectCause = 1
+	DisconnectCauseDoNotWantToTalkToYou DisconnectCause = 2
+)
+
+// ReconnectionPolicy indicates whether, and how soon, the transport to a peer should be re-established
+// after the peer disconnects.  It is advisory: neither the Agent nor the PeerStateManager re-establishes
+// a transport, so an application that opens transports to peers (e.g., with
+// Agent.EstablishDiameterConnectionTo()) should honor it when it decides whether to reconnect.
+type ReconnectionPolicy int
+
+const (
+	// ReconnectNormally means that the transport may be re-established on the usual schedule.
+	ReconnectNormally ReconnectionPolicy = iota
+	// ReconnectAfterDelay means that the peer needs time before it can accept a new connection (e.g.,
+	// because it is rebooting), so the transport should not be re-established immediately.
+	ReconnectAfterDelay
+	// DoNotReconnect means that the peer does not want a connection, so the transport should not be
+	// re-established.
+	DoNotReconnect
+)
+
+// ReconnectionPolicy returns the ReconnectionPolicy for a peer that sent a Disconnect-Peer Request with
+// this cause, for an application that decides whether to reconnect to the peer.  A cause that is not
+// recognized produces ReconnectNormally.
+func (cause DisconnectCause) ReconnectionPolicy() ReconnectionPolicy {
+	switch cause {
+	case DisconnectCauseRebooting:
+		return ReconnectAfterDelay
+	case DisconnectCauseDoNotWantToTalkToYou:
+		return DoNotReconnect
+	default:
+		return ReconnectNormally
+	}
+}
+
+// DisconnectCauseFromDPR returns the value of the Disconnect-Cause AVP in the Disconnect-Peer Request m.
+// ok is false if m has no Disconnect-Cause, or if it cannot be decoded.
+func DisconnectCauseFromDPR(m *diameter.Message) (cause DisconnectCause, ok bool) {
+	disconnectCauseAvp := m.FirstAvpMatching(0, 273)
+	if disconnectCauseAvp == nil {
+		return 0, false
+	}
+
+	value, err := diameter.ConvertAVPDataToTypedData(disconnectCauseAvp.Data, diameter.Enumerated)
+	if err != nil {
+		return 0, false
+	}
+
+	return DisconnectCause(value.(int32)), true
+}
+
+// RelayApplicationId is the Application-Id advertised by a Diameter relay.  A relay
+// supports all applications.
+const RelayApplicationId = 0xffffffff
+
+// DefaultProductName is the Product-Name advertised in Capabilities-Exchange messages for a
+// DiameterEntity whose ProductName is empty.  It is "diameter-go/" followed by the version of this
+// module recorded in the build information of the program, or "diameter-go" if the version is not
+// known (e.g., when the module is built from a local checkout).  It may be changed by an application,
+// but only before any DiameterEntity is used.
+var DefaultProductName = defaultProductName()
+
+const diameterModulePath = "github.com/blorticus-go/diameter"
+
+func defaultProductName() string {
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, module := range append([]*debug.Module{&buildInfo.Main}, buildInfo.Deps...) {
+			if module.Path == diameterModulePath && module.Version != "" && module.Version != "(devel)" {
+				return "diameter-go/" + module.Version
+			}
+		}
+	}
+
+	return "diameter-go"
+}
+
 // A DiameterEntity provides identifying information about a diameter entity.  The first time an *Avp()
 // method is invoked, the AVP it returns is first cached.  Subsequent calls are returned from this cached
 // value.  This mechanism assumes the values of the AVPs in a DiameterEntity instance are not changed
@@ -33,9 +123,36 @@ type DiameterEntity struct {
 	VendorID        uint32
 	ProductName     string
 
+	// The following are optional.  A zero value (or an empty set) means that the
+	// corresponding AVP is not included in a Capabilities-Exchange message.
+	FirmwareRevision   uint32
+	OriginStateID      uint32
+	SupportedVendorIDs []uint32
+	AuthApplicationIDs []uint32
+	AcctApplicationIDs []uint32
+
 	cache diameterEntityCache
 }
 
+// DeriveOriginRealmIfUnset sets OriginRealm to the realm of OriginHost (see diameter.RealmFromIdentity()),
+// e.g., "example.com" for "host.example.com", if OriginRealm is empty.  If OriginRealm is not empty, it
+// is not changed.  Returns an error if OriginRealm is empty and OriginHost has no realm.  This must be
+// called before any *Avp() method.
+func (e *DiameterEntity) DeriveOriginRealmIfUnset() error {
+	if e.OriginRealm != "" {
+		return nil
+	}
+
+	realm := diameter.RealmFromIdentity(e.OriginHost)
+	if realm == "" {
+		return fmt.Errorf("cannot derive Origin-Realm from Origin-Host (%s), which has no realm", e.OriginHost)
+	}
+
+	e.OriginRealm = realm
+
+	return nil
+}
+
 // OriginHostAvp returns the OriginHost as an AVP.
 func (e *DiameterEntity) OriginHostAvp() *diameter.AVP {
 	if e.cache.OriginHost == nil {
@@ -48,7 +165,7 @@ func (e *DiameterEntity) OriginHostAvp() *diameter.AVP {
 // OriginRealmAvp returns the OriginRealm as an AVP.
 func (e *DiameterEntity) OriginRealmAvp() *diameter.AVP {
 	if e.cache.OriginRealm == nil {
-		e.cache.OriginRealm = diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, e.OriginHost)
+		e.cache.OriginRealm = diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, e.OriginRealm)
 	}
 
 	return e.cache.OriginRealm
@@ -63,10 +180,15 @@ func (e *DiameterEntity) VendorIdAVP() *diameter.AVP {
 	return e.cache.VendorId
 }
 
-// ProductNameAvp returns the ProductName as an AVP.
+// ProductNameAvp returns the ProductName as an AVP.  If ProductName is empty, DefaultProductName is
+// used.
 func (e *DiameterEntity) ProductNameAvp() *diameter.AVP {
 	if e.cache.ProductName == nil {
-		e.cache.ProductName = diameter.NewTypedAVP(269, 0, true, diameter.UTF8String, e.ProductName)
+		productName := e.ProductName
+		if productName == "" {
+			productName = DefaultProductName
+		}
+		e.cache.ProductName = diameter.NewTypedAVP(269, 0, true, diameter.UTF8String, productName)
 	}
 
 	return e.cache.ProductName
@@ -85,6 +207,60 @@ func (e *DiameterEntity) HostIpAddressAvps() []*diameter.AVP {
 	return e.cache.HostIPAddresses
 }
 
+// OriginStateIdAvp returns the OriginStateID as an AVP.
+func (e *DiameterEntity) OriginStateIdAvp() *diameter.AVP {
+	if e.cache.OriginStateId == nil {
+		e.cache.OriginStateId = diameter.NewTypedAVP(278, 0, true, diameter.Unsigned32, e.OriginStateID)
+	}
+
+	return e.cache.OriginStateId
+}
+
+// FirmwareRevisionAvp returns the FirmwareRevision as an AVP.  The M-bit is not set, since
+// RFC 6733 forbids it for Firmware-Revision.
+func (e *DiameterEntity) FirmwareRevisionAvp() *diameter.AVP {
+	if e.cache.FirmwareRevision == nil {
+		e.cache.FirmwareRevision = diameter.NewTypedAVP(267, 0, false, diameter.Unsigned32, e.FirmwareRevision)
+	}
+
+	return e.cache.FirmwareRevision
+}
+
+// SupportedVendorIdAvps returns the SupportedVendorIDs set as a set of AVPs.
+func (e *DiameterEntity) SupportedVendorIdAvps() []*diameter.AVP {
+	if len(e.cache.SupportedVendorIds) == 0 {
+		e.cache.SupportedVendorIds = unsigned32AvpsFrom(265, e.SupportedVendorIDs)
+	}
+
+	return e.cache.SupportedVendorIds
+}
+
+// AuthApplicationIdAvps returns the AuthApplicationIDs set as a set of AVPs.
+func (e *DiameterEntity) AuthApplicationIdAvps() []*diameter.AVP {
+	if len(e.cache.AuthApplicationIds) == 0 {
+		e.cache.AuthApplicationIds = unsigned32AvpsFrom(258, e.AuthApplicationIDs)
+	}
+
+	return e.cache.AuthApplicationIds
+}
+
+// AcctApplicationIdAvps returns the AcctApplicationIDs set as a set of AVPs.
+func (e *DiameterEntity) AcctApplicationIdAvps() []*diameter.AVP {
+	if len(e.cache.AcctApplicationIds) == 0 {
+		e.cache.AcctApplicationIds = unsigned32AvpsFrom(259, e.AcctApplicationIDs)
+	}
+
+	return e.cache.AcctApplicationIds
+}
+
+func unsigned32AvpsFrom(code uint32, values []uint32) []*diameter.AVP {
+	avps := make([]*diameter.AVP, len(values))
+	for i, v := range values {
+		avps[i] = diameter.NewTypedAVP(code, 0, true, diameter.Unsigned32, v)
+	}
+	return avps
+}
+
 // CapabilitiesExchangeMandatoryAvps generates the mandatory attributes required for
 // a Capabilities-Exchange request or answer based on the DiameterEntity values.
 func (e *DiameterEntity) CapabilitiesExchangeMandatoryAvps() []*diameter.AVP {
@@ -122,9 +298,57 @@ func (e *DiameterEntity) CapabilitiesExchangeMandatoryAvpsWithResultCode(resultC
 	)
 }
 
+// CapabilitiesExchangeOptionalAvps generates the optional attributes for a
+// Capabilities-Exchange request or answer based on the DiameterEntity values.  An
+// attribute is included only if the corresponding DiameterEntity value is set.
+func (e *DiameterEntity) CapabilitiesExchangeOptionalAvps() []*diameter.AVP {
+	avps := make([]*diameter.AVP, 0, 2+len(e.SupportedVendorIDs)+len(e.AuthApplicationIDs)+len(e.AcctApplicationIDs))
+
+	if e.OriginStateID != 0 {
+		avps = append(avps, e.OriginStateIdAvp())
+	}
+
+	avps = append(avps, e.SupportedVendorIdAvps()...)
+	avps = append(avps, e.AuthApplicationIdAvps()...)
+	avps = append(avps, e.AcctApplicationIdAvps()...)
+
+	if e.FirmwareRevision != 0 {
+		avps = append(avps, e.FirmwareRevisionAvp())
+	}
+
+	return avps
+}
+
+// ApplicationIDsInCommonWith returns the Auth-Application-Ids and Acct-Application-Ids
+// advertised by both this entity and the peer entity.  If either entity advertises
+// the relay Application-Id, then all applications advertised by the other are in common.
+func (e *DiameterEntity) ApplicationIDsInCommonWith(peer *DiameterEntity) (authApplicationIDs []uint32, acctApplicationIDs []uint32) {
+	return applicationIDsInCommon(e.AuthApplicationIDs, peer.AuthApplicationIDs), applicationIDsInCommon(e.AcctApplicationIDs, peer.AcctApplicationIDs)
+}
+
+func applicationIDsInCommon(local []uint32, remote []uint32) []uint32 {
+	if slices.Contains(local, RelayApplicationId) {
+		return slices.Clone(remote)
+	}
+	if slices.Contains(remote, RelayApplicationId) {
+		return slices.Clone(local)
+	}
+
+	common := make([]uint32, 0, len(local))
+	for _, id := range local {
+		if slices.Contains(remote, id) && !slices.Contains(common, id) {
+			common = append(common, id)
+		}
+	}
+
+	return common
+}
+
 // DiameterEntityFromCapabilitiesExchangeMessage reads a Capabilities-Exchange request or
 // answer and extracts the AVPs providing the DiameterEntity information.  Returns an
 // error if the message does not contain mandatory AVPs or if the AVPs are malformed.
+// The optional Firmware-Revision, Origin-State-Id, Supported-Vendor-Id, Auth-Application-Id
+// and Acct-Application-Id AVPs are extracted if they are present.
 func DiameterEntityFromCapabilitiesExchangeMessage(m *diameter.Message) (*DiameterEntity, error) {
 	for _, avpCode := range []diameter.Uint24{264, 296, 266, 269} {
 		if m.NumberOfTopLevelAvpsMatching(0, avpCode) != 1 {
@@ -172,15 +396,76 @@ func DiameterEntityFromCapabilitiesExchangeMessage(m *diameter.Message) (*Diamet
 		}
 	}
 
+	if firmwareRevisionAvp := m.FirstAvpMatching(0, 267); firmwareRevisionAvp != nil {
+		if firmwareRevision, err := diameter.ConvertAVPDataToTypedData(firmwareRevisionAvp.Data, diameter.Unsigned32); err != nil {
+			return nil, fmt.Errorf("Firmware-Revision AVP cannot be properly decoded: %s", err)
+		} else {
+			e.FirmwareRevision = firmwareRevision.(uint32)
+		}
+	}
+
+	if originStateIdAvp := m.FirstAvpMatching(0, 278); originStateIdAvp != nil {
+		if originStateId, err := diameter.ConvertAVPDataToTypedData(originStateIdAvp.Data, diameter.Unsigned32); err != nil {
+			return nil, fmt.Errorf("Origin-State-Id AVP cannot be properly decoded: %s", err)
+		} else {
+			e.OriginStateID = originStateId.(uint32)
+		}
+	}
+
+	var err error
+	if e.SupportedVendorIDs, err = unsigned32ValuesFromAvps(m.TopLevelAvpsMatching(0, 265)); err != nil {
+		return nil, fmt.Errorf("Supported-Vendor-Id AVP cannot be properly decoded: %s", err)
+	}
+	if e.AuthApplicationIDs, err = unsigned32ValuesFromAvps(m.TopLevelAvpsMatching(0, 258)); err != nil {
+		return nil, fmt.Errorf("Auth-Application-Id AVP cannot be properly decoded: %s", err)
+	}
+	if e.AcctApplicationIDs, err = unsigned32ValuesFromAvps(m.TopLevelAvpsMatching(0, 259)); err != nil {
+		return nil, fmt.Errorf("Acct-Application-Id AVP cannot be properly decoded: %s", err)
+	}
+
 	return e, nil
 }
 
+func unsigned32ValuesFromAvps(avps []*diameter.AVP) ([]uint32, error) {
+	values := make([]uint32, len(avps))
+	for i, avp := range avps {
+		v, err := diameter.ConvertAVPDataToTypedData(avp.Data, diameter.Unsigned32)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v.(uint32)
+	}
+
+	return values, nil
+}
+
 // Peer represents a diameter peer.  It provides peer identity information and methods
-// for sending messages to the peer.
+// for sending messages to the peer.  The identity information is that of the initial
+// Capabilities-Exchange and is not changed by a later capabilities update (see PeerCapabilities).
 type Peer struct {
-	Identity                     DiameterEntity
+	Identity DiameterEntity
+	// CommonAuthApplicationIDs are the Auth-Application-Ids advertised by both the
+	// local entity and the peer during the Capabilities-Exchange.
+	CommonAuthApplicationIDs []uint32
+	// CommonAcctApplicationIDs are the Acct-Application-Ids advertised by both the
+	// local entity and the peer during the Capabilities-Exchange.
+	CommonAcctApplicationIDs []uint32
+
 	sendMessageMethod            func(m *diameter.Message) error
+	sendCancellableRequestMethod func(m *diameter.Message) error
 	initiatePeerDisconnectMethod func() error
+	transport                    net.Conn
+
+	userDataMutex sync.Mutex
+	userData      map[string]interface{}
+
+	paused atomic.Bool
+
+	// outstandingRequests maps the Hop-by-Hop-ID of each request sent through SendCancellableRequest()
+	// that has not been answered to whether it was cancelled (see CancelRequest()).  It is maintained
+	// by the PeerStateManager.
+	outstandingRequestsMutex sync.Mutex
+	outstandingRequests      map[uint32]bool
 }
 
 func NewPeer(entityInformation *DiameterEntity, sendMessageMethod func(m *diameter.Message) error, initiatePeerDisconnectMethod func() error) *Peer {
@@ -198,6 +483,141 @@ func (peer *Peer) SendMessage(m *diameter.Message) error {
 	return peer.sendMessageMethod(m)
 }
 
+// SendCancellableRequest is the same as SendMessage(), but the request m is recorded as outstanding
+// until its answer arrives, so that it can be cancelled with CancelRequest().  Requests sent with
+// SendMessage() are not recorded, so an application (e.g., a proxy) that never cancels requests does not
+// accumulate a record of each request that the peer never answers.  Returns an error if m is not a
+// request, or if the Peer does not support cancellation because it was not created by a
+// PeerStateManager (e.g., it was created with NewPeer()).
+func (peer *Peer) SendCancellableRequest(m *diameter.Message) error {
+	if peer.sendCancellableRequestMethod == nil {
+		return fmt.Errorf("this peer does not support cancellable requests")
+	}
+
+	return peer.sendCancellableRequestMethod(m)
+}
+
+// CancelRequest cancels the outstanding request sent through SendCancellableRequest() with the
+// Hop-by-Hop-ID hopByHopID (e.g., because the application no longer waits for its answer).  If the answer
+// arrives later, it is discarded and an AnswerToCancelledRequestDiscardedEvent is raised instead of a
+// MessageReceivedFromPeerEvent.  The record of a cancelled request is kept until its answer arrives or the
+// connection ends.  Returns false if there is no such outstanding request, because it was not sent with
+// SendCancellableRequest(), has been answered, or was already cancelled.  This is safe to call from
+// multiple goroutines.
+func (peer *Peer) CancelRequest(hopByHopID uint32) bool {
+	peer.outstandingRequestsMutex.Lock()
+	defer peer.outstandingRequestsMutex.Unlock()
+
+	if cancelled, isOutstanding := peer.outstandingRequests[hopByHopID]; !isOutstanding || cancelled {
+		return false
+	}
+
+	peer.outstandingRequests[hopByHopID] = true
+	return true
+}
+
+func (peer *Peer) recordOutstandingRequest(hopByHopID uint32) {
+	peer.outstandingRequestsMutex.Lock()
+	defer peer.outstandingRequestsMutex.Unlock()
+
+	if peer.outstandingRequests == nil {
+		peer.outstandingRequests = make(map[uint32]bool)
+	}
+
+	peer.outstandingRequests[hopByHopID] = false
+}
+
+// removeOutstandingRequest removes the outstanding request with the Hop-by-Hop-ID hopByHopID, such as
+// when its answer is received.  Returns true if the request was cancelled.
+func (peer *Peer) removeOutstandingRequest(hopByHopID uint32) (wasCancelled bool) {
+	peer.outstandingRequestsMutex.Lock()
+	defer peer.outstandingRequestsMutex.Unlock()
+
+	wasCancelled = peer.outstandingRequests[hopByHopID]
+	delete(peer.outstandingRequests, hopByHopID)
+
+	return wasCancelled
+}
+
+// SendAnswer builds an answer to the request and sends it to the peer.  The answer has the same
+// code, application-id, hop-by-hop-id and end-to-end-id as the request, and the same flags except
+// that the request flag is cleared.  If the request has a Session-Id and mandatoryAvps does not
+// contain one, the Session-Id from the request is added as the first AVP of the answer.  Returns
+// an error if request is not a request, or if delivery fails (see SendMessage).
+func (peer *Peer) SendAnswer(request *diameter.Message, mandatoryAvps []*diameter.AVP, optionalAvps []*diameter.AVP) error {
+	if !request.IsRequest() {
+		return fmt.Errorf("cannot send an answer to a message that is not a request")
+	}
+
+	if sessionId := request.FirstAvpMatching(0, 263); sessionId != nil && !slices.ContainsFunc(mandatoryAvps, func(avp *diameter.AVP) bool { return avp.Code == 263 && avp.VendorID == 0 }) {
+		mandatoryAvps = append([]*diameter.AVP{sessionId}, mandatoryAvps...)
+	}
+
+	return peer.SendMessage(request.GenerateMatchingResponseWithAvps(mandatoryAvps, optionalAvps))
+}
+
+// SetUserData associates the application value v with key for this peer, replacing any value
+// previously set for key.  This is safe to call from multiple goroutines.
+func (peer *Peer) SetUserData(key string, v interface{}) {
+	peer.userDataMutex.Lock()
+	defer peer.userDataMutex.Unlock()
+
+	if peer.userData == nil {
+		peer.userData = make(map[string]interface{})
+	}
+
+	peer.userData[key] = v
+}
+
+// UserData returns the application value set for key by SetUserData().  ok is false if no value
+// has been set for key.  This is safe to call from multiple goroutines.
+func (peer *Peer) UserData(key string) (v interface{}, ok bool) {
+	peer.userDataMutex.Lock()
+	defer peer.userDataMutex.Unlock()
+
+	v, ok = peer.userData[key]
+	return v, ok
+}
+
+// Pause causes requests from the peer, other than Diameter connection state messages (e.g.,
+// Device-Watchdog Requests), to be answered with DIAMETER_TOO_BUSY (3004) rather than delivered in a
+// MessageReceivedFromPeerEvent, until Resume() is called.  A RequestRejectedWhilePausedEvent is raised
+// for each such request.  Answers from the peer are delivered as usual.  This is useful for shedding
+// load, or during maintenance, without closing the diameter connection.  This is safe to call from
+// multiple goroutines.
+func (peer *Peer) Pause() {
+	peer.paused.Store(true)
+}
+
+// Resume ends the effect of Pause(), so that requests from the peer are again delivered.  This is
+// safe to call from multiple goroutines.
+func (peer *Peer) Resume() {
+	peer.paused.Store(false)
+}
+
+// IsPaused returns true if Pause() has been called and Resume() has not since been called.
+func (peer *Peer) IsPaused() bool {
+	return peer.paused.Load()
+}
+
+// LocalAddr returns the local address of the transport to the peer, or nil if the Peer has no
+// transport (e.g., because it was created with NewPeer()).
+func (peer *Peer) LocalAddr() net.Addr {
+	if peer.transport == nil {
+		return nil
+	}
+	return peer.transport.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the transport to the peer, or nil if the Peer has no
+// transport (e.g., because it was created with NewPeer()).
+func (peer *Peer) RemoteAddr() net.Addr {
+	if peer.transport == nil {
+		return nil
+	}
+	return peer.transport.RemoteAddr()
+}
+
 // InitiateDisconnect start the Disconnect Peer procedure by sending a Disconnect-Peer
 // request to the peer.
 func (peer *Peer) InitiateDisconnect() error {
@@ -221,7 +641,9 @@ func (peer *Peer) IsDisconnected() bool {
 // the details of the callback methods.
 type PeerFactory struct {
 	sendMessageMethod            func(m *diameter.Message) error
+	sendCancellableRequestMethod func(m *diameter.Message) error
 	initiatePeerDisconnectMethod func() error
+	transport                    net.Conn
 }
 
 // NewPeerFactory creates a new PeerFactory
@@ -232,7 +654,24 @@ func NewPeerFactory(sendMessageMethod func(m *diameter.Message) error, initiateP
 	}
 }
 
+// SetTransport sets the transport to the peer, whose addresses are returned by the LocalAddr() and
+// RemoteAddr() methods of each Peer created by the factory.
+func (f *PeerFactory) SetTransport(c net.Conn) *PeerFactory {
+	f.transport = c
+	return f
+}
+
+// withCancellableRequestSender sets the method used by the SendCancellableRequest() method of each Peer
+// created by the factory.
+func (f *PeerFactory) withCancellableRequestSender(sendCancellableRequestMethod func(m *diameter.Message) error) *PeerFactory {
+	f.sendCancellableRequestMethod = sendCancellableRequestMethod
+	return f
+}
+
 // NewPeerFromDiameterEntity returns a new Peer using the supplied DiameterEntity
 func (f *PeerFactory) NewPeerFromDiameterEntity(entity *DiameterEntity) *Peer {
-	return NewPeer(entity, f.sendMessageMethod, f.initiatePeerDisconnectMethod)
+	peer := NewPeer(entity, f.sendMessageMethod, f.initiatePeerDisconnectMethod)
+	peer.sendCancellableRequestMethod = f.sendCancellableRequestMethod
+	peer.transport = f.transport
+	return peer
 }
@@ -5,6 +5,7 @@ import (
 	"io"
 	"math/rand"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/blorticus-go/diameter"
@@ -12,8 +13,29 @@ import (
 
 var cachedResponseCode2001 = diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, 2001)
 
+// DefaultWriteTimeout is the default maximum amount of time that a PeerStateManager will wait
+// for a single message write to the transport to complete.
+const DefaultWriteTimeout = 10 * time.Second
+
+// DefaultDisconnectTimeout is the default maximum amount of time that PeerStateManager.InitiateDisconnect()
+// will wait for the state machine to send the Disconnect-Peer Request.
+const DefaultDisconnectTimeout = 10 * time.Second
+
+// outgoingMessageQueueLength is the number of messages that may wait for the writer of a
+// PeerStateManager before senders block.
+const outgoingMessageQueueLength = 100
+
+// outgoingMessage is a message waiting for the writer of a PeerStateManager.  The result of the write
+// is sent to resultChannel.
+type outgoingMessage struct {
+	message       *diameter.Message
+	writeTimeout  time.Duration
+	resultChannel chan error
+}
+
 type disconnectInitiation struct {
 	returnChannel chan<- error
+	cause         DisconnectCause
 }
 
 type PeerStateManager struct {
@@ -25,9 +47,71 @@ type PeerStateManager struct {
 	cachedAVPs                    *diameterEntityCache
 	sequenceGenerator             *diameter.SequenceGenerator
 	quitChannel                   chan bool
+	runHasEndedChannel            chan struct{}
 	peer                          *Peer
 	initialState                  InitialPeerState
-}
+	writeTimeout                  time.Duration
+	disconnectTimeout             time.Duration
+	logger                        Logger
+	outstandingDWRHopByHopIDs     map[uint32]struct{}
+	acceptPeer                    PeerAcceptanceFunc
+	rejectUnsupportedApplications bool
+	rejectReservedHeaderFlags     bool
+	outgoingMessageQueue          chan *outgoingMessage
+	duplicateRequestCache         *DuplicateRequestCache
+	acceptCapabilitiesUpdates     bool
+	stateTransitionCallback       PeerStateTransitionFunc
+	electConnection               ConnectionElectionFunc
+	localCapabilitiesForPeer      LocalCapabilitiesFunc
+	// advertisedLocalIdentity is the local entity advertised in the Capabilities-Exchange Answer, which
+	// is localIdentity unless localCapabilitiesForPeer returns another
+	advertisedLocalIdentity *DiameterEntity
+
+	// capabilitiesExchangeHasEndedChannel is closed once the initial state has been executed
+	capabilitiesExchangeHasEndedChannel chan struct{}
+	// discardedByElectionChannel is closed to end the Capabilities-Exchange on a transport opened
+	// toward the peer when that transport loses a connection election
+	discardedByElectionChannel chan struct{}
+	discardedByElectionOnce    sync.Once
+}
+
+// PeerAcceptanceFunc decides whether to accept a peer that has sent a Capabilities-Exchange Request,
+// based on the identity it advertised.  resultCode is the Result-Code for the Capabilities-Exchange
+// Answer.  If resultCode is 0, then DIAMETER_SUCCESS (2001) is used when the peer is accepted, and
+// DIAMETER_UNKNOWN_PEER (3010) is used when it is rejected.
+type PeerAcceptanceFunc func(peer *DiameterEntity) (accept bool, resultCode uint32)
+
+// ConnectionElectionFunc resolves a connection collision (RFC 6733 section 5.6.4) when a peer that has
+// sent a Capabilities-Exchange Request is one to which a transport is also being opened.  It returns
+// true if the transport on which the request arrived should be kept, and false if it should be closed
+// after answering with DIAMETER_ELECTION_LOST (4003).
+type ConnectionElectionFunc func(peer *DiameterEntity) (keepConnection bool)
+
+// LocalCapabilitiesFunc returns the local entity whose capabilities (e.g., AuthApplicationIDs and
+// AcctApplicationIDs) are advertised in the Capabilities-Exchange Answer sent to peer, which is the
+// identity advertised in the peer's Capabilities-Exchange Request.  If it returns nil, the local entity
+// of the PeerStateManager is advertised.
+type LocalCapabilitiesFunc func(peer *DiameterEntity) *DiameterEntity
+
+// PeerStateTransitionFunc is called by a PeerStateManager each time the state of the diameter connection
+// to peer changes.  from and to are PeerStateName* values.
+type PeerStateTransitionFunc func(peer *Peer, from string, to string)
+
+// Names of the states of the diameter connection to a peer, as provided to a PeerStateTransitionFunc.
+const (
+	PeerStateNameConnected    = "connected"
+	PeerStateNameHalfClosed   = "half-closed"
+	PeerStateNameDisconnected = "disconnected"
+)
+
+const (
+	resultCodeDiameterSuccess                uint32 = 2001
+	resultCodeDiameterTooBusy                uint32 = 3004
+	resultCodeDiameterApplicationUnsupported uint32 = 3007
+	resultCodeDiameterInvalidHdrBits         uint32 = 3008
+	resultCodeDiameterUnknownPeer            uint32 = 3010
+	resultCodeDiameterElectionLost           uint32 = 4003
+)
 
 func NewInitiatorPeerStateManager(localIdentity *DiameterEntity, conn net.Conn, eventChannel chan<- *PeerStateEvent) *PeerStateManager {
 	return newPeerStateManager(localIdentity, PeerStateStartsWithTransportOpenedTowardPeer(), conn, eventChannel)
@@ -49,10 +133,14 @@ func newPeerStateManager(localIdentity *DiameterEntity, initialState InitialPeer
 	}
 
 	messageReaderChannel := make(chan *messageReaderEvent)
-	go incomingMessageStreamReceiver(conn, messageReaderChannel)
+	runHasEndedChannel := make(chan struct{})
+	outgoingMessageQueue := make(chan *outgoingMessage, outgoingMessageQueueLength)
+	go incomingMessageStreamReceiver(conn, messageReaderChannel, runHasEndedChannel)
+	go outgoingMessageWriter(conn, outgoingMessageQueue, runHasEndedChannel)
 
 	return &PeerStateManager{
 		localIdentity:                 localIdentity,
+		advertisedLocalIdentity:       localIdentity,
 		transport:                     conn,
 		eventChannel:                  eventChannel,
 		messageReaderChannel:          messageReaderChannel,
@@ -61,57 +149,227 @@ func newPeerStateManager(localIdentity *DiameterEntity, initialState InitialPeer
 			ResultCode:      diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2000)),
 			OriginHost:      diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, localIdentity.OriginHost),
 			OriginRealm:     diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, localIdentity.OriginRealm),
-			HostIPAddresses: []*diameter.AVP{diameter.NewTypedAVP(257, 0, true, diameter.Address, localIdentity.HostIPAddresses[0])},
+			HostIPAddresses: localIdentity.HostIpAddressAvps(),
 			VendorId:        diameter.NewTypedAVP(266, 0, true, diameter.Unsigned32, localIdentity.VendorID),
-			ProductName:     diameter.NewTypedAVP(269, 0, true, diameter.UTF8String, localIdentity.ProductName),
+			ProductName:     localIdentity.ProductNameAvp(),
 		},
-		sequenceGenerator: diameter.NewSequenceGeneratorSet(),
-		quitChannel:       make(chan bool),
-		initialState:      initialState,
+		sequenceGenerator:         diameter.NewSequenceGeneratorSet(),
+		quitChannel:               make(chan bool),
+		runHasEndedChannel:        runHasEndedChannel,
+		initialState:              initialState,
+		writeTimeout:              DefaultWriteTimeout,
+		disconnectTimeout:         DefaultDisconnectTimeout,
+		logger:                    noopLogger{},
+		outstandingDWRHopByHopIDs: make(map[uint32]struct{}),
+		outgoingMessageQueue:      outgoingMessageQueue,
+
+		capabilitiesExchangeHasEndedChannel: make(chan struct{}),
+		discardedByElectionChannel:          make(chan struct{}),
 	}
 }
 
-func incomingMessageStreamReceiver(conn net.Conn, messageReaderChannel chan<- *messageReaderEvent) {
+// SetLogger sets the Logger to which the manager logs state changes, watchdogs, disconnects and
+// errors.  If logger is nil, nothing is logged, which is the default.  This must be called before
+// NewRun().
+func (manager *PeerStateManager) SetLogger(logger Logger) *PeerStateManager {
+	manager.logger = loggerOrNoop(logger)
+	return manager
+}
+
+// SetWriteTimeout sets the maximum amount of time that the manager will wait for a single message
+// write to the transport to complete.  If a write exceeds this, a WriteTimedOutError is raised and the
+// transport is closed.  A timeout of zero means that writes never time out.  The default is
+// DefaultWriteTimeout.  This must be called before NewRun().
+func (manager *PeerStateManager) SetWriteTimeout(timeout time.Duration) *PeerStateManager {
+	manager.writeTimeout = timeout
+	return manager
+}
+
+// SetDisconnectTimeout sets the maximum amount of time that InitiateDisconnect() waits for the state
+// machine to send the Disconnect-Peer Request.  The state machine cannot do so until the
+// Capabilities-Exchange has completed.  If timeout is zero or less, InitiateDisconnect() waits until the
+// request is sent or the manager stops running.  The default is DefaultDisconnectTimeout.  This must be
+// called before NewRun().
+func (manager *PeerStateManager) SetDisconnectTimeout(timeout time.Duration) *PeerStateManager {
+	manager.disconnectTimeout = timeout
+	return manager
+}
+
+// SetPeerAcceptance sets the function that decides whether to accept the peer after its
+// Capabilities-Exchange Request is received.  If the peer is rejected, the Capabilities-Exchange Answer
+// carries the Result-Code returned by accept, and the transport is then closed.  This applies only to
+// a manager created with NewInitiatedPeerStateManager().  If accept is nil, which is the default, every
+// peer is accepted.  This must be called before NewRun().
+func (manager *PeerStateManager) SetPeerAcceptance(accept PeerAcceptanceFunc) *PeerStateManager {
+	manager.acceptPeer = accept
+	return manager
+}
+
+// SetRejectUnsupportedApplications sets whether the manager automatically answers requests for an
+// application that the local entity does not support.  If reject is true, a request with an
+// Application-Id other than 0 that is not among the local AuthApplicationIDs or AcctApplicationIDs is
+// answered with DIAMETER_APPLICATION_UNSUPPORTED (3007), and an UnsupportedApplicationRequestRejectedEvent
+// is raised instead of a MessageReceivedFromPeerEvent.  If the local entity advertises the relay
+// Application-Id (0xffffffff), every application is supported.  The default is false, so that every
+// request is delivered (e.g., for a proxy).  This must be called before NewRun().
+func (manager *PeerStateManager) SetRejectUnsupportedApplications(reject bool) *PeerStateManager {
+	manager.rejectUnsupportedApplications = reject
+	return manager
+}
+
+// SetRejectReservedHeaderFlags sets whether the manager discards messages from the peer that have any
+// reserved header flag bit set (see diameter.Message.ValidateReservedHeaderFlags()).  If reject is true,
+// such a message, whether a request or an answer, is not delivered and an InvalidHeaderBitsError is
+// raised; a request is also answered with DIAMETER_INVALID_HDR_BITS (3008).  The default is false,
+// because RFC 6733 section 3 requires a receiver to ignore the reserved bits.  A request with the E-bit
+// set is discarded in the same way regardless of this setting.  Header flags are checked only once the
+// diameter connection is established, so the Capabilities-Exchange Request and Answer that establish it
+// are not checked.  This must be called before NewRun().
+func (manager *PeerStateManager) SetRejectReservedHeaderFlags(reject bool) *PeerStateManager {
+	manager.rejectReservedHeaderFlags = reject
+	return manager
+}
+
+// SetDuplicateRequestCache sets the cache used to detect retransmitted requests.  Each request delivered
+// to the application is recorded in cache, as is the answer sent for it through the Peer.  A request with
+// the T-bit set that duplicates an answered request is answered from cache, and a
+// RetransmittedRequestAnsweredFromCacheEvent is raised instead of a MessageReceivedFromPeerEvent.  If
+// cache is nil, which is the default, duplicate requests are not detected.  This must be called before
+// NewRun().
+func (manager *PeerStateManager) SetDuplicateRequestCache(cache *DuplicateRequestCache) *PeerStateManager {
+	manager.duplicateRequestCache = cache
+	return manager
+}
+
+// SetAcceptCapabilitiesUpdates sets whether a Capabilities-Exchange Request received from a connected
+// peer is treated as an update of its capabilities.  RFC 6733 does not allow a CER once the peer is
+// connected, so by default (accept is false) the manager disconnects from the peer.  If accept is true, a
+// CER with the same Origin-Host as the peer is answered with a Capabilities-Exchange Answer, and a
+// PeerCapabilitiesUpdatedEvent is raised whose UpdatedCapabilities carry the identity and the common
+// application IDs advertised in the CER.  The Peer is not changed, since the application may be using it
+// concurrently.  A CER with a different Origin-Host, or that is not a valid CER, still causes a
+// disconnect.  This must be called before NewRun().
+func (manager *PeerStateManager) SetAcceptCapabilitiesUpdates(accept bool) *PeerStateManager {
+	manager.acceptCapabilitiesUpdates = accept
+	return manager
+}
+
+// SetStateTransitionCallback sets a function that is called each time the state of the diameter
+// connection changes once it is established: from connected to half-closed when the local side sends a
+// Disconnect-Peer Request, and to disconnected when the connection is closed for any reason (including
+// a transport that is closed abruptly or a write that times out).  This is intended for testing and
+// monitoring.  The callback is called synchronously by the goroutine running the state machine, so it must
+// return quickly and must not call methods of the manager (or the Peer) that wait for the state machine,
+// such as InitiateDisconnect() or SendMessage().  If callback is nil, which is the default, no function is
+// called.  This must be called before NewRun().
+func (manager *PeerStateManager) SetStateTransitionCallback(callback PeerStateTransitionFunc) *PeerStateManager {
+	manager.stateTransitionCallback = callback
+	return manager
+}
+
+// SetConnectionElection sets the function used to resolve a connection collision when the peer opened
+// the transport.  It is called after a Capabilities-Exchange Request is received, before the
+// PeerAcceptanceFunc (see SetPeerAcceptance()).  If it returns false, the request is answered with
+// DIAMETER_ELECTION_LOST (4003), a ConnectionCollisionResolvedEvent is raised, and the transport is
+// closed.  If elect is nil, which is the default, no election is held.  The Agent provides an election
+// for transports opened by EstablishDiameterConnectionToPeer().  This must be called before NewRun().
+func (manager *PeerStateManager) SetConnectionElection(elect ConnectionElectionFunc) *PeerStateManager {
+	manager.electConnection = elect
+	return manager
+}
+
+// SetLocalCapabilitiesForPeer sets the function that chooses the local capabilities to advertise in the
+// Capabilities-Exchange Answer to a peer that opened the transport, based on the peer's identity.  It is
+// called only for a peer that is accepted (see SetPeerAcceptance()); a Capabilities-Exchange Answer that
+// rejects the peer advertises the local entity of the manager.  The returned entity is then used for the
+// rest of the connection where the local capabilities matter: the application IDs in common with the peer,
+// the rejection of unsupported applications (see SetRejectUnsupportedApplications()) and the answer to a
+// capabilities update (see SetAcceptCapabilitiesUpdates()).  If the returned entity has no HostIPAddresses,
+// those of the local entity of the manager are advertised.  The returned entity is copied for the
+// connection and is not changed, so the same entity may be returned for many peers.  If capabilitiesForPeer
+// is nil, which is the default, the local entity of the manager is always advertised.  This applies only to a
+// manager created with NewInitiatedPeerStateManager() and must be called before NewRun().
+func (manager *PeerStateManager) SetLocalCapabilitiesForPeer(capabilitiesForPeer LocalCapabilitiesFunc) *PeerStateManager {
+	manager.localCapabilitiesForPeer = capabilitiesForPeer
+	return manager
+}
+
+// capabilitiesExchangeHasEnded returns true once the Capabilities-Exchange has completed or failed.
+func (manager *PeerStateManager) capabilitiesExchangeHasEnded() bool {
+	select {
+	case <-manager.capabilitiesExchangeHasEndedChannel:
+		return true
+	default:
+		return false
+	}
+}
+
+// discardBecauseOfElection ends the Capabilities-Exchange on a transport opened toward the peer, because
+// the local entity won a connection election and so keeps the transport opened by the peer.  A
+// ConnectionCollisionResolvedEvent is raised and the transport is closed.  It has no effect once the
+// Capabilities-Exchange has ended.
+func (manager *PeerStateManager) discardBecauseOfElection() {
+	manager.discardedByElectionOnce.Do(func() { close(manager.discardedByElectionChannel) })
+}
+
+// incomingMessageStreamReceiver reads messages from conn and delivers them to messageReaderChannel.
+// It stops when a read error occurs or when runHasEndedChannel is closed (because no one will
+// read from messageReaderChannel after that).
+func incomingMessageStreamReceiver(conn net.Conn, messageReaderChannel chan<- *messageReaderEvent, runHasEndedChannel <-chan struct{}) {
 	messageStreamReader := diameter.NewMessageStreamReader(conn)
 
 	for {
 		msg, err := messageStreamReader.ReadNextMessage()
-		if err != nil {
-			messageReaderChannel <- &messageReaderEvent{
-				IncomingMessage: msg,
-				Error:           err,
-			}
+
+		select {
+		case messageReaderChannel <- &messageReaderEvent{IncomingMessage: msg, Error: err}:
+		case <-runHasEndedChannel:
 			return
 		}
 
-		messageReaderChannel <- &messageReaderEvent{
-			IncomingMessage: msg,
+		if err != nil {
+			return
 		}
 	}
 }
 
+// injectIncomingForTest delivers m to the manager as if it had been read from the transport, so that
+// tests can drive the state machine without encoding messages onto the transport.  Returns an error if
+// the manager's run has ended.
+func (manager *PeerStateManager) injectIncomingForTest(m *diameter.Message) error {
+	select {
+	case manager.messageReaderChannel <- &messageReaderEvent{IncomingMessage: m}:
+		return nil
+	case <-manager.runHasEndedChannel:
+		return fmt.Errorf("peer state manager is no longer running")
+	}
+}
+
 func (manager *PeerStateManager) NewRun() {
+	notifier := NewPeerStateNotifier(manager.eventChannel).SetTransport(manager.transport).SetLogger(manager.logger)
+
 	defer func() {
+		close(manager.runHasEndedChannel)
 		manager.transport.Close()
-		manager.eventChannel <- &PeerStateEvent{
-			Type: ClosedTransportToPeerEvent,
-			Conn: manager.transport,
-			Peer: manager.peer,
-		}
+		notifier.ThatTheTransportToThePeerWasClosed()
 	}()
 
 	watchdogTimer := StartNewWatchdogIntervalTimer(30)
 
-	notifier := NewPeerStateNotifier(manager.eventChannel).SetTransport(manager.transport)
-
 	peer, aFatalErrorOccured := manager.initialState.Execute(&InitialPeerStateBuilder{
-		LocalEntity:             manager.localIdentity,
-		PeerMessageEventChannel: manager.messageReaderChannel,
-		Transport:               manager.transport,
-		Notifier:                notifier,
-		PeerFactory:             NewPeerFactory(manager.SendMessageViaPeer, manager.InitiateDisconnect),
-		SequenceGenerator:       manager.sequenceGenerator,
+		LocalEntity:              manager.localIdentity,
+		PeerMessageEventChannel:  manager.messageReaderChannel,
+		Transport:                manager.transport,
+		Notifier:                 notifier,
+		PeerFactory:              NewPeerFactory(manager.SendMessageViaPeer, manager.InitiateDisconnect).SetTransport(manager.transport).withCancellableRequestSender(manager.sendCancellableRequestViaPeer),
+		SequenceGenerator:        manager.sequenceGenerator,
+		WriteTimeout:             manager.writeTimeout,
+		AcceptPeer:               manager.acceptPeer,
+		ElectConnection:          manager.electConnection,
+		DiscardedByElection:      manager.discardedByElectionChannel,
+		LocalCapabilitiesForPeer: manager.recordingAdvertisedLocalIdentity(manager.localCapabilitiesForPeer),
 	})
+	close(manager.capabilitiesExchangeHasEndedChannel)
 
 	if aFatalErrorOccured {
 		return
@@ -130,7 +388,28 @@ func (manager *PeerStateManager) NewRun() {
 	notifier.SetPeer(peer)
 	notifier.NotifyThatDiameterConnectionHasBeenEstablished()
 
-	nextState := PeerState(NewPeerStateConnected(notifier, manager.transport, peer))
+	connectedState := NewPeerStateConnected(notifier, manager.transport, peer)
+	if manager.acceptCapabilitiesUpdates {
+		connectedState.capabilitiesUpdateLocalEntity = manager.advertisedLocalIdentity
+	}
+
+	nextState := PeerState(connectedState)
+	currentStateName := peerStateName(nextState)
+	noteTransitionTo := func(nextStateName string) {
+		if nextStateName != currentStateName {
+			manager.logger.Debug("peer state changed", notifier.logKeysAndValues("from", currentStateName, "to", nextStateName)...)
+			if manager.stateTransitionCallback != nil {
+				manager.stateTransitionCallback(peer, currentStateName, nextStateName)
+			}
+			currentStateName = nextStateName
+		}
+	}
+	noteStateChange := func() {
+		noteTransitionTo(peerStateName(nextState))
+	}
+
+	// however the run ends (e.g., the transport is closed abruptly), the connection is then disconnected
+	defer noteTransitionTo(PeerStateNameDisconnected)
 
 	for {
 		var messageToSend *diameter.Message
@@ -140,11 +419,13 @@ func (manager *PeerStateManager) NewRun() {
 		case disconnectInitiated := <-manager.disconnectNotificationChannel:
 			switch nextState.CanInitiateDisconnectInThisState() {
 			case true:
-				if err := manager.SendStateMachineMessage(manager.generateDPR()); err != nil {
+				manager.logger.Info("initiating diameter disconnect", notifier.logKeysAndValues()...)
+				if err := manager.SendStateMachineMessage(manager.generateDPRWithCause(disconnectInitiated.cause)); err != nil {
 					disconnectInitiated.returnChannel <- err
 					return
 				}
 				nextState = NewPeerStateHalfClosed(notifier, manager.transport, manager.peer)
+				noteStateChange()
 				disconnectInitiated.returnChannel <- nil
 
 			case false:
@@ -163,6 +444,17 @@ func (manager *PeerStateManager) NewRun() {
 
 			watchdogTimer.StopAndRestart()
 
+			if err := manager.validateHeaderFlags(messageReaderEvent.IncomingMessage); err != nil {
+				if messageReaderEvent.IncomingMessage.IsRequest() {
+					if err := manager.sendMessage(manager.generateProtocolErrorAnswer(messageReaderEvent.IncomingMessage, resultCodeDiameterInvalidHdrBits)); err != nil {
+						notifier.NotifyThatAnErrorOccurred(err)
+						return
+					}
+				}
+				notifier.NotifyThatAnErrorOccurred(NewInvalidHeaderBitsError(messageReaderEvent.IncomingMessage, err))
+				continue
+			}
+
 			if messageType := stateMachineMessageTypeForMessage(messageReaderEvent.IncomingMessage); messageType != notAStateMachineMessage {
 				notifier.NotifyThatAStateMachineMessageWasReceivedFromThePeer(messageReaderEvent.IncomingMessage)
 
@@ -174,17 +466,60 @@ func (manager *PeerStateManager) NewRun() {
 				case dwr:
 					nextState, messageToSend, psErr = nextState.ProcessIncomingDWR(messageReaderEvent.IncomingMessage, messageBuilder)
 				case dwa:
+					if !manager.dwaMatchesAnOutstandingDWR(messageReaderEvent.IncomingMessage) {
+						notifier.NotifyThatAnUnsolicitedDWAWasReceived(messageReaderEvent.IncomingMessage)
+					}
 					nextState, messageToSend, psErr = nextState.ProcessIncomingDWA(messageReaderEvent.IncomingMessage, messageBuilder)
 				case dpr:
+					if cause, ok := DisconnectCauseFromDPR(messageReaderEvent.IncomingMessage); ok {
+						notifier.SetPeerDisconnectCause(cause)
+					}
 					nextState, messageToSend, psErr = nextState.ProcessIncomingDPR(messageReaderEvent.IncomingMessage, messageBuilder)
 				case dpa:
 					nextState, messageToSend, psErr = nextState.ProcessIncomingDPA(messageReaderEvent.IncomingMessage, messageBuilder)
 				}
+			} else if messageReaderEvent.IncomingMessage.IsAnswer() && peer.removeOutstandingRequest(messageReaderEvent.IncomingMessage.HopByHopID) {
+				nextState, psErr = nextState.ProcessIncomingNonStateMachineMessage(messageReaderEvent.IncomingMessage)
+				if psErr == nil {
+					notifier.NotifyThatAnAnswerToACancelledRequestWasDiscarded(messageReaderEvent.IncomingMessage)
+				}
+			} else if cachedAnswer := manager.cachedAnswerForRetransmittedRequest(messageReaderEvent.IncomingMessage); cachedAnswer != nil {
+				nextState, psErr = nextState.ProcessIncomingNonStateMachineMessage(messageReaderEvent.IncomingMessage)
+				if psErr == nil {
+					if err := manager.sendMessage(cachedAnswer); err != nil {
+						notifier.NotifyThatAnErrorOccurred(err)
+						return
+					}
+					notifier.NotifyThatARetransmittedRequestWasAnsweredFromCache(messageReaderEvent.IncomingMessage)
+				}
+			} else if manager.shouldRejectAsUnsupportedApplication(messageReaderEvent.IncomingMessage) {
+				nextState, psErr = nextState.ProcessIncomingNonStateMachineMessage(messageReaderEvent.IncomingMessage)
+				if psErr == nil {
+					if err := manager.sendMessage(manager.generateProtocolErrorAnswer(messageReaderEvent.IncomingMessage, resultCodeDiameterApplicationUnsupported)); err != nil {
+						notifier.NotifyThatAnErrorOccurred(err)
+						return
+					}
+					notifier.NotifyThatAnUnsupportedApplicationRequestWasRejected(messageReaderEvent.IncomingMessage)
+				}
+			} else if peer.IsPaused() && messageReaderEvent.IncomingMessage.IsRequest() {
+				nextState, psErr = nextState.ProcessIncomingNonStateMachineMessage(messageReaderEvent.IncomingMessage)
+				if psErr == nil {
+					if err := manager.sendMessage(manager.generateProtocolErrorAnswer(messageReaderEvent.IncomingMessage, resultCodeDiameterTooBusy)); err != nil {
+						notifier.NotifyThatAnErrorOccurred(err)
+						return
+					}
+					notifier.NotifyThatARequestWasRejectedWhilePaused(messageReaderEvent.IncomingMessage)
+				}
 			} else {
+				if manager.duplicateRequestCache != nil && messageReaderEvent.IncomingMessage.IsRequest() {
+					manager.duplicateRequestCache.recordRequest(manager, messageReaderEvent.IncomingMessage)
+				}
 				notifier.NotifyThatAMessageWasReceivedFromThePeer(messageReaderEvent.IncomingMessage)
 				nextState, psErr = nextState.ProcessIncomingNonStateMachineMessage(messageReaderEvent.IncomingMessage)
 			}
 
+			noteStateChange()
+
 			if psErr != nil {
 				notifier.NotifyThatAnErrorOccurred(psErr.Error)
 				if psErr.initiateDisconnectPeer {
@@ -207,9 +542,15 @@ func (manager *PeerStateManager) NewRun() {
 			}
 
 		case <-watchdogTimer.C:
+			manager.logger.Debug("watchdog interval expired, sending DWR", notifier.logKeysAndValues()...)
 			dwr := manager.generateDWR()
 			if err := manager.SendStateMachineMessage(dwr); err != nil {
 				notifier.NotifyThatAnErrorOccurred(err)
+				if _, writeTimedOut := err.(*WriteTimedOutError); writeTimedOut {
+					return
+				}
+			} else {
+				manager.recordOutstandingDWR(dwr)
 			}
 			watchdogTimer.Restart()
 
@@ -219,17 +560,79 @@ func (manager *PeerStateManager) NewRun() {
 	}
 }
 
+// InitiateDisconnect starts the Disconnect Peer procedure by sending a Disconnect-Peer Request, with the
+// Disconnect-Cause DO_NOT_WANT_TO_TALK_TO_YOU, to the peer.  Returns an error if the request cannot be
+// sent in the current state, if the manager is no longer running (e.g., because the transport was
+// closed), or if the state machine does not send the request within the disconnect timeout (see
+// SetDisconnectTimeout()).
 func (manager *PeerStateManager) InitiateDisconnect() error {
+	if manager.disconnectTimeout <= 0 {
+		return manager.initiateDisconnectWithCause(DisconnectCauseDoNotWantToTalkToYou, nil)
+	}
+
+	abandon := make(chan struct{})
+	abandonTimer := time.AfterFunc(manager.disconnectTimeout, func() { close(abandon) })
+	defer abandonTimer.Stop()
+
+	return manager.initiateDisconnectWithCause(DisconnectCauseDoNotWantToTalkToYou, abandon)
+}
+
+// initiateDisconnectWithCause asks the running state machine to send a DPR with the provided
+// Disconnect-Cause, and returns the result.  It returns an error without waiting if the run has ended
+// or if abandon is closed before the state machine accepts the request.  A nil abandon channel is
+// never closed.
+func (manager *PeerStateManager) initiateDisconnectWithCause(cause DisconnectCause, abandon <-chan struct{}) error {
 	c := make(chan error, 2)
 
-	manager.disconnectNotificationChannel <- &disconnectInitiation{
-		returnChannel: c,
+	select {
+	case manager.disconnectNotificationChannel <- &disconnectInitiation{returnChannel: c, cause: cause}:
+		return <-c
+	case <-manager.runHasEndedChannel:
+		return fmt.Errorf("peer state manager is no longer running")
+	case <-abandon:
+		return fmt.Errorf("abandoned disconnect before the peer state manager accepted it")
 	}
-
-	return <-c
 }
 
 func (manager *PeerStateManager) SendMessageViaPeer(msg *diameter.Message) error {
+	if err := manager.prepareMessageFromPeer(msg); err != nil {
+		return err
+	}
+
+	// the answer is recorded before it is sent, so that it is in the cache before the peer can
+	// retransmit the request
+	if manager.duplicateRequestCache != nil && !msg.IsRequest() {
+		manager.duplicateRequestCache.recordAnswer(manager, msg)
+	}
+
+	return manager.sendMessage(msg)
+}
+
+// sendCancellableRequestViaPeer is SendMessageViaPeer() for a request that the Peer may cancel (see
+// Peer.SendCancellableRequest()).
+func (manager *PeerStateManager) sendCancellableRequestViaPeer(msg *diameter.Message) error {
+	if !msg.IsRequest() {
+		return fmt.Errorf("only a request can be cancelled")
+	}
+
+	if err := manager.prepareMessageFromPeer(msg); err != nil {
+		return err
+	}
+
+	// the request is recorded as outstanding before it is sent, so that it is recorded before the peer
+	// can answer it
+	manager.peer.recordOutstandingRequest(msg.HopByHopID)
+	if err := manager.sendMessage(msg); err != nil {
+		manager.peer.removeOutstandingRequest(msg.HopByHopID)
+		return err
+	}
+
+	return nil
+}
+
+// prepareMessageFromPeer checks that msg may be sent through the Peer, and sets its End-to-End-ID and
+// Hop-by-Hop-ID if they are zero.
+func (manager *PeerStateManager) prepareMessageFromPeer(msg *diameter.Message) error {
 	if MessageIsADiameterConnectionStateMessage(msg) {
 		return fmt.Errorf("diameter connection state machine messages cannot be sent directly from client")
 	}
@@ -241,7 +644,7 @@ func (manager *PeerStateManager) SendMessageViaPeer(msg *diameter.Message) error
 		msg.HopByHopID = manager.sequenceGenerator.NextHopByHopId()
 	}
 
-	return manager.sendMessage(msg)
+	return nil
 }
 
 func (manager *PeerStateManager) SendStateMachineMessage(msg *diameter.Message) error {
@@ -259,9 +662,19 @@ func (manager *PeerStateManager) SendStateMachineMessage(msg *diameter.Message)
 	return nil
 }
 
+// sendMessage queues msg for the writer and waits for the result of the write.  Because every message
+// sent by the manager passes through the single writer, messages from concurrent senders are never
+// interleaved on the transport, and they are written in the order in which they are queued.  If the
+// queue is full, sendMessage blocks until there is room.
 func (manager *PeerStateManager) sendMessage(msg *diameter.Message) error {
-	_, err := manager.transport.Write(msg.Encode())
+	err := manager.queueMessageAndWaitForWrite(msg)
 	if err != nil {
+		if _, writeTimedOut := err.(*WriteTimedOutError); writeTimedOut {
+			// part of the message may have been written, so the stream can no longer be trusted
+			manager.transport.Close()
+			return err
+		}
+
 		if err == io.EOF {
 			manager.eventChannel <- &PeerStateEvent{
 				Type: PeerClosedTransportEvent,
@@ -277,6 +690,129 @@ func (manager *PeerStateManager) sendMessage(msg *diameter.Message) error {
 	return nil
 }
 
+func (manager *PeerStateManager) queueMessageAndWaitForWrite(msg *diameter.Message) error {
+	queued := &outgoingMessage{
+		message:       msg,
+		writeTimeout:  manager.writeTimeout,
+		resultChannel: make(chan error, 1),
+	}
+
+	select {
+	case manager.outgoingMessageQueue <- queued:
+	case <-manager.runHasEndedChannel:
+		return fmt.Errorf("peer state manager is no longer running")
+	}
+
+	select {
+	case err := <-queued.resultChannel:
+		return err
+	case <-manager.runHasEndedChannel:
+		return fmt.Errorf("peer state manager is no longer running")
+	}
+}
+
+// outgoingMessageWriter writes each message in outgoingMessageQueue to conn, in order, and delivers the
+// result to the sender.  It stops when runHasEndedChannel is closed.
+func outgoingMessageWriter(conn net.Conn, outgoingMessageQueue <-chan *outgoingMessage, runHasEndedChannel <-chan struct{}) {
+	for {
+		select {
+		case queued := <-outgoingMessageQueue:
+			queued.resultChannel <- writeMessageToTransport(conn, queued.message, queued.writeTimeout)
+		case <-runHasEndedChannel:
+			return
+		}
+	}
+}
+
+// writeMessageToTransport writes the encoded message to conn.  If writeTimeout is non-zero, a write
+// deadline is set before the write and cleared after it.  If the write exceeds the deadline, a
+// *WriteTimedOutError is returned.
+func writeMessageToTransport(conn net.Conn, msg *diameter.Message, writeTimeout time.Duration) error {
+	if writeTimeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+			return err
+		}
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+
+	encoded, err := msg.EncodeErrorable()
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(encoded); err != nil {
+		if netErr, isANetError := err.(net.Error); isANetError && netErr.Timeout() {
+			return NewWriteTimedOutError(writeTimeout)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// preferHostIPAddressOfTransport moves the Host-IP-Address AVP in avps, the AVPs of a Capabilities-Exchange
+// message, that matches the local IP address of conn ahead of the other Host-IP-Address AVPs, so that a
+// multi-homed local entity advertises first the address that the transport actually uses.  The other AVPs
+// keep their order.  avps is reordered in place and returned.  If no Host-IP-Address matches, or the local
+// address of conn is not an IP address, avps is unchanged.
+func preferHostIPAddressOfTransport(avps []*diameter.AVP, conn net.Conn) []*diameter.AVP {
+	localIP := extractIPFromNetConn(conn)
+	if localIP == nil {
+		return avps
+	}
+
+	firstHostIPAddressIndex := -1
+	for i, avp := range avps {
+		if avp.Code != 257 || avp.VendorSpecific {
+			continue
+		}
+
+		if firstHostIPAddressIndex < 0 {
+			firstHostIPAddressIndex = i
+		}
+
+		if address, err := avp.ConvertDataToTypedData(diameter.Address); err == nil && localIP.Equal(address.(net.IP)) {
+			copy(avps[firstHostIPAddressIndex+1:i+1], avps[firstHostIPAddressIndex:i])
+			avps[firstHostIPAddressIndex] = avp
+			return avps
+		}
+	}
+
+	return avps
+}
+
+// recordOutstandingDWR records the Hop-by-Hop-ID of a DWR sent to the peer, so that the DWA answering
+// it can be correlated.
+func (manager *PeerStateManager) recordOutstandingDWR(dwr *diameter.Message) {
+	manager.outstandingDWRHopByHopIDs[dwr.HopByHopID] = struct{}{}
+}
+
+// dwaMatchesAnOutstandingDWR returns true if the Hop-by-Hop-ID of the DWA matches a DWR sent to the
+// peer that has not yet been answered.  When it matches, all outstanding DWRs are considered answered,
+// since the peer is evidently responsive.  Returns false for an unsolicited or mismatched DWA.
+func (manager *PeerStateManager) dwaMatchesAnOutstandingDWR(dwa *diameter.Message) bool {
+	if _, isOutstanding := manager.outstandingDWRHopByHopIDs[dwa.HopByHopID]; !isOutstanding {
+		return false
+	}
+
+	clear(manager.outstandingDWRHopByHopIDs)
+	return true
+}
+
+// peerStateName returns the PeerStateName* value for the state.
+func peerStateName(state PeerState) string {
+	switch state.(type) {
+	case *PeerStateConnected:
+		return PeerStateNameConnected
+	case *PeerStateHalfClosed:
+		return PeerStateNameHalfClosed
+	case *PeerStateDisconnected:
+		return PeerStateNameDisconnected
+	default:
+		return "unknown"
+	}
+}
+
 type stateMachineMessageType int
 
 const (
@@ -322,14 +858,14 @@ func (manager *PeerStateManager) generateCER() *diameter.Message {
 		0,
 		manager.sequenceGenerator.NextHopByHopId(),
 		manager.sequenceGenerator.NextEndToEndId(),
-		manager.localIdentity.CapabilitiesExchangeMandatoryAvps(),
-		nil)
+		preferHostIPAddressOfTransport(manager.localIdentity.CapabilitiesExchangeMandatoryAvps(), manager.transport),
+		manager.localIdentity.CapabilitiesExchangeOptionalAvps())
 }
 
 func (manager *PeerStateManager) generateCEA(forCER *diameter.Message) *diameter.Message {
 	return forCER.GenerateMatchingResponseWithAvps(
-		manager.localIdentity.CapabilitiesExchangeMandatoryAvpsWithResultCode(cachedResponseCode2001),
-		nil,
+		preferHostIPAddressOfTransport(manager.advertisedLocalIdentity.CapabilitiesExchangeMandatoryAvpsWithResultCode(cachedResponseCode2001), manager.transport),
+		manager.advertisedLocalIdentity.CapabilitiesExchangeOptionalAvps(),
 	)
 }
 
@@ -342,9 +878,9 @@ func (manager *PeerStateManager) generateDWR() *diameter.Message {
 		manager.sequenceGenerator.NextEndToEndId(),
 		[]*diameter.AVP{
 			manager.localIdentity.OriginHostAvp(),
-			manager.localIdentity.OriginHostAvp(),
+			manager.localIdentity.OriginRealmAvp(),
 		},
-		nil)
+		manager.watchdogOptionalAvps())
 }
 
 func (manager *PeerStateManager) generateDWA(forDWR *diameter.Message) *diameter.Message {
@@ -352,28 +888,128 @@ func (manager *PeerStateManager) generateDWA(forDWR *diameter.Message) *diameter
 		[]*diameter.AVP{
 			cachedResponseCode2001,
 			manager.localIdentity.OriginHostAvp(),
-			manager.localIdentity.OriginHostAvp(),
+			manager.localIdentity.OriginRealmAvp(),
 		},
-		nil,
+		manager.watchdogOptionalAvps(),
 	)
 }
 
+// watchdogOptionalAvps returns the optional AVPs for a DWR or DWA, which is the Origin-State-Id
+// if the local entity has a non-zero OriginStateID.
+func (manager *PeerStateManager) watchdogOptionalAvps() []*diameter.AVP {
+	if manager.localIdentity.OriginStateID == 0 {
+		return nil
+	}
+
+	return []*diameter.AVP{manager.localIdentity.OriginStateIdAvp()}
+}
+
 func (manager *PeerStateManager) generateDPR() *diameter.Message {
+	return manager.generateDPRWithCause(DisconnectCauseDoNotWantToTalkToYou)
+}
+
+func (manager *PeerStateManager) generateDPRWithCause(cause DisconnectCause) *diameter.Message {
 	return diameter.NewMessage(diameter.MsgFlagRequest, DisconnectPeerCode, 0, manager.sequenceGenerator.NextHopByHopId(), manager.sequenceGenerator.NextEndToEndId(),
 		[]*diameter.AVP{
 			manager.localIdentity.OriginHostAvp(),
-			manager.localIdentity.OriginHostAvp(),
-			diameter.NewTypedAVP(273, 0, true, diameter.Enumerated, int32(2)),
+			manager.localIdentity.OriginRealmAvp(),
+			diameter.NewTypedAVP(273, 0, true, diameter.Enumerated, int32(cause)),
 		},
 		nil)
 }
 
+// validateHeaderFlags returns an error if the header flags of m are not permitted, including reserved
+// bits that are set when the manager rejects them (see SetRejectReservedHeaderFlags()).
+func (manager *PeerStateManager) validateHeaderFlags(m *diameter.Message) error {
+	if err := m.ValidateHeaderFlags(); err != nil {
+		return err
+	}
+
+	if manager.rejectReservedHeaderFlags {
+		return m.ValidateReservedHeaderFlags()
+	}
+
+	return nil
+}
+
+// recordingAdvertisedLocalIdentity wraps capabilitiesForPeer so that a copy of the entity it returns, with
+// the HostIPAddresses of the local entity if it has none, is returned and recorded as the
+// advertisedLocalIdentity.  The entity is copied because it may be shared by other connections, and its
+// AVPs are cached on first use.  Returns nil if capabilitiesForPeer is nil.
+func (manager *PeerStateManager) recordingAdvertisedLocalIdentity(capabilitiesForPeer LocalCapabilitiesFunc) LocalCapabilitiesFunc {
+	if capabilitiesForPeer == nil {
+		return nil
+	}
+
+	return func(peer *DiameterEntity) *DiameterEntity {
+		returned := capabilitiesForPeer(peer)
+		if returned == nil {
+			return nil
+		}
+
+		advertised := *returned
+		if len(advertised.HostIPAddresses) == 0 {
+			advertised.HostIPAddresses = manager.localIdentity.HostIPAddresses
+		}
+		manager.advertisedLocalIdentity = &advertised
+
+		return &advertised
+	}
+}
+
+// cachedAnswerForRetransmittedRequest returns the answer to send for m if duplicate detection is enabled
+// and m is a retransmission of a request that has already been answered.  Otherwise, it returns nil.
+func (manager *PeerStateManager) cachedAnswerForRetransmittedRequest(m *diameter.Message) *diameter.Message {
+	if manager.duplicateRequestCache == nil || !m.IsRequest() {
+		return nil
+	}
+
+	return manager.duplicateRequestCache.answerForRetransmittedRequest(m)
+}
+
+// shouldRejectAsUnsupportedApplication returns true if rejection of unsupported applications is enabled
+// and m is a request for an application that the local entity does not support.
+func (manager *PeerStateManager) shouldRejectAsUnsupportedApplication(m *diameter.Message) bool {
+	if !manager.rejectUnsupportedApplications || !m.IsRequest() || m.AppID == 0 {
+		return false
+	}
+
+	for _, appIDs := range [][]uint32{manager.advertisedLocalIdentity.AuthApplicationIDs, manager.advertisedLocalIdentity.AcctApplicationIDs} {
+		for _, appID := range appIDs {
+			if appID == m.AppID || appID == RelayApplicationId {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// generateProtocolErrorAnswer generates the answer for the request forRequest with the protocol error
+// resultCode (e.g., DIAMETER_APPLICATION_UNSUPPORTED).  The E-bit is set (RFC 6733 section 7.1.3).
+func (manager *PeerStateManager) generateProtocolErrorAnswer(forRequest *diameter.Message, resultCode uint32) *diameter.Message {
+	avps := make([]*diameter.AVP, 0, 4)
+	if sessionId := forRequest.FirstAvpMatching(0, 263); sessionId != nil {
+		avps = append(avps, sessionId)
+	}
+	avps = append(avps,
+		diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, resultCode),
+		manager.localIdentity.OriginHostAvp(),
+		manager.localIdentity.OriginRealmAvp(),
+	)
+
+	answer := forRequest.GenerateMatchingResponseWithAvps(avps, nil)
+	answer.SetErrorFlag(true)
+
+	return answer
+}
+
 func (manager *PeerStateManager) generateDPA(forDPR *diameter.Message) *diameter.Message {
 	return forDPR.GenerateMatchingResponseWithAvps(
 		[]*diameter.AVP{
 			cachedResponseCode2001,
 			manager.localIdentity.OriginHostAvp(),
-			manager.localIdentity.OriginHostAvp(),
+			manager.localIdentity.OriginRealmAvp(),
 		},
 		nil,
 	)
@@ -394,6 +1030,16 @@ type InitialPeerStateBuilder struct {
 	Notifier                *PeerStateNotifier
 	PeerFactory             *PeerFactory
 	SequenceGenerator       *diameter.SequenceGenerator
+	WriteTimeout            time.Duration
+	AcceptPeer              PeerAcceptanceFunc
+	// ElectConnection, if not nil, resolves a connection collision on a transport opened by the peer
+	ElectConnection ConnectionElectionFunc
+	// DiscardedByElection is closed if a transport opened toward the peer loses a connection election
+	DiscardedByElection <-chan struct{}
+	// LocalCapabilitiesForPeer, if not nil, chooses the local entity advertised to an accepted peer that
+	// opened the transport, instead of LocalEntity.  The returned entity is advertised as is; the
+	// PeerStateManager supplies a function that returns a per-connection copy with HostIPAddresses set
+	LocalCapabilitiesForPeer LocalCapabilitiesFunc
 }
 
 type MessageBuilder struct {
@@ -464,16 +1110,56 @@ func (s *InitialPeerStatePeerOpenedTransport) Execute(b *InitialPeerStateBuilder
 		return nil, true
 	}
 
-	peer := b.PeerFactory.NewPeerFromDiameterEntity(peerIdentity)
+	peerIsAccepted, resultCode := true, resultCodeDiameterSuccess
+	if b.ElectConnection != nil && !b.ElectConnection(peerIdentity) {
+		peerIsAccepted, resultCode = false, resultCodeDiameterElectionLost
+	} else if b.AcceptPeer != nil {
+		var returnedResultCode uint32
+		if peerIsAccepted, returnedResultCode = b.AcceptPeer(peerIdentity); returnedResultCode != 0 {
+			resultCode = returnedResultCode
+		} else if !peerIsAccepted {
+			resultCode = resultCodeDiameterUnknownPeer
+		}
+	}
+
+	localEntity := b.LocalEntity
+	if peerIsAccepted && b.LocalCapabilitiesForPeer != nil {
+		if advertised := b.LocalCapabilitiesForPeer(peerIdentity); advertised != nil {
+			localEntity = advertised
+		}
+	}
+
+	resultCodeAvp := cachedResponseCode2001
+	if resultCode != resultCodeDiameterSuccess {
+		resultCodeAvp = diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, resultCode)
+	}
 
-	cea := m.GenerateMatchingResponseWithAvps(b.LocalEntity.CapabilitiesExchangeMandatoryAvpsWithResultCode(cachedResponseCode2001), nil)
-	if _, err := b.Transport.Write(cea.Encode()); err != nil {
+	cea := m.GenerateMatchingResponseWithAvps(preferHostIPAddressOfTransport(localEntity.CapabilitiesExchangeMandatoryAvpsWithResultCode(resultCodeAvp), b.Transport), localEntity.CapabilitiesExchangeOptionalAvps())
+	if diameter.ResultCode(resultCode).IsProtocolError() {
+		// protocol errors are signaled with the E-bit (RFC 6733 section 7.1.3)
+		cea.SetErrorFlag(true)
+	}
+
+	if err := writeMessageToTransport(b.Transport, cea, b.WriteTimeout); err != nil {
 		b.Notifier.NotifyThatAnErrorOccurred(fmt.Errorf("failed to write Capabilities-Exchange Answer: %s", err))
 		return nil, true
 	}
 
 	b.Notifier.NotifyThatAStateMachineMessageWasSentToThePeer(cea)
 
+	if resultCode == resultCodeDiameterElectionLost {
+		b.Notifier.NotifyThatAConnectionCollisionWasResolvedByClosingTheTransport(m)
+		return nil, true
+	}
+
+	if !peerIsAccepted {
+		b.Notifier.NotifyThatAnErrorOccurred(NewPeerRejectedError(peerIdentity.OriginHost, resultCode))
+		return nil, true
+	}
+
+	peer := b.PeerFactory.NewPeerFromDiameterEntity(peerIdentity)
+	peer.CommonAuthApplicationIDs, peer.CommonAcctApplicationIDs = localEntity.ApplicationIDsInCommonWith(peerIdentity)
+
 	return peer, false
 }
 
@@ -484,16 +1170,23 @@ func PeerStateStartsWithTransportOpenedTowardPeer() *InitialPeerStatePeerTranspo
 }
 
 func (s *InitialPeerStatePeerTransportWasOpenedLocally) Execute(b *InitialPeerStateBuilder) (connectedPeer *Peer, aFatalErrorOccurred bool) {
-	cer := diameter.NewMessage(diameter.MsgFlagRequest, CapabilitiesExchangeCode, 0, b.SequenceGenerator.NextHopByHopId(), b.SequenceGenerator.NextEndToEndId(), b.LocalEntity.CapabilitiesExchangeMandatoryAvps(), nil)
+	cer := diameter.NewMessage(diameter.MsgFlagRequest, CapabilitiesExchangeCode, 0, b.SequenceGenerator.NextHopByHopId(), b.SequenceGenerator.NextEndToEndId(), preferHostIPAddressOfTransport(b.LocalEntity.CapabilitiesExchangeMandatoryAvps(), b.Transport), b.LocalEntity.CapabilitiesExchangeOptionalAvps())
 
-	if _, err := b.Transport.Write(cer.Encode()); err != nil {
+	if err := writeMessageToTransport(b.Transport, cer, b.WriteTimeout); err != nil {
 		b.Notifier.NotifyThatAnErrorOccurred(err)
 		return nil, true
 	}
 
 	b.Notifier.NotifyThatAStateMachineMessageWasSentToThePeer(cer)
 
-	messageReaderEvent := <-b.PeerMessageEventChannel
+	var messageReaderEvent *messageReaderEvent
+	select {
+	case messageReaderEvent = <-b.PeerMessageEventChannel:
+	case <-b.DiscardedByElection:
+		b.Notifier.NotifyThatAConnectionCollisionWasResolvedByClosingTheTransport(nil)
+		return nil, true
+	}
+
 	if messageReaderEvent.Error != nil {
 		if messageReaderEvent.Error == io.EOF {
 			b.Notifier.NotifyThatThePeerClosedTheTransport()
@@ -516,6 +1209,12 @@ func (s *InitialPeerStatePeerTransportWasOpenedLocally) Execute(b *InitialPeerSt
 		return nil, true
 	}
 
+	if resultCode, ok := m.ResultCode(); ok && resultCode == diameter.ResultCode(resultCodeDiameterElectionLost) {
+		// the peer lost a connection election, so it keeps the transport that it opened toward us
+		b.Notifier.NotifyThatAConnectionCollisionWasResolvedByClosingTheTransport(m)
+		return nil, true
+	}
+
 	peerIdentity, err := DiameterEntityFromCapabilitiesExchangeMessage(m)
 	if err != nil {
 		b.Notifier.NotifyThatAnErrorOccurred(err)
@@ -523,6 +1222,7 @@ func (s *InitialPeerStatePeerTransportWasOpenedLocally) Execute(b *InitialPeerSt
 	}
 
 	peer := b.PeerFactory.NewPeerFromDiameterEntity(peerIdentity)
+	peer.CommonAuthApplicationIDs, peer.CommonAcctApplicationIDs = b.LocalEntity.ApplicationIDsInCommonWith(peerIdentity)
 
 	return peer, false
 }
@@ -531,6 +1231,10 @@ type PeerStateConnected struct {
 	notifier  *PeerStateNotifier
 	transport net.Conn
 	peer      *Peer
+
+	// capabilitiesUpdateLocalEntity is the local entity if a CER is accepted as a capabilities update
+	// (see PeerStateManager.SetAcceptCapabilitiesUpdates()), and nil otherwise.
+	capabilitiesUpdateLocalEntity *DiameterEntity
 }
 
 func NewPeerStateConnected(notifier *PeerStateNotifier, transport net.Conn, peer *Peer) *PeerStateConnected {
@@ -549,7 +1253,19 @@ func (s *PeerStateConnected) CanInitiateDisconnectInThisState() bool {
 	return true
 }
 
+// ProcessIncomingCER disconnects from the peer, unless capabilities updates are accepted and the CER is
+// from the same Origin-Host as the peer.  In that case, the peer is updated from the CER, which is
+// answered with a CEA.
 func (s *PeerStateConnected) ProcessIncomingCER(m *diameter.Message, b *MessageBuilder) (nextState PeerState, messageToSend *diameter.Message, err *PeerStateError) {
+	if s.capabilitiesUpdateLocalEntity != nil {
+		if updatedIdentity, err := DiameterEntityFromCapabilitiesExchangeMessage(m); err == nil && updatedIdentity.OriginHost == s.peer.Identity.OriginHost {
+			updated := &PeerCapabilities{Identity: updatedIdentity}
+			updated.CommonAuthApplicationIDs, updated.CommonAcctApplicationIDs = s.capabilitiesUpdateLocalEntity.ApplicationIDsInCommonWith(updatedIdentity)
+			s.notifier.NotifyThatThePeerCapabilitiesWereUpdated(m, updated)
+			return s, b.CEA(m), nil
+		}
+	}
+
 	return NewPeerStateDisconnected(s.notifier, s.transport, s.peer), nil, &PeerStateError{fmt.Errorf("received Capabilities-Exchange Request on peer that is already connected"), true}
 }
 func (s *PeerStateConnected) ProcessIncomingCEA(m *diameter.Message, b *MessageBuilder) (nextState PeerState, messageToSend *diameter.Message, err *PeerStateError) {
@@ -562,6 +1278,7 @@ func (s *PeerStateConnected) ProcessIncomingDWA(m *diameter.Message, b *MessageB
 	return s, nil, nil
 }
 func (s *PeerStateConnected) ProcessIncomingDPR(m *diameter.Message, b *MessageBuilder) (nextState PeerState, messageToSend *diameter.Message, err *PeerStateError) {
+	s.notifier.NotifyThatThePeerInitiatedADisconnect(m)
 	return NewPeerStateDisconnected(s.notifier, s.transport, s.peer), b.DPA(m), nil
 }
 func (s *PeerStateConnected) ProcessIncomingDPA(m *diameter.Message, b *MessageBuilder) (nextState PeerState, messageToSend *diameter.Message, err *PeerStateError) {
@@ -600,8 +1317,11 @@ func (s *PeerStateHalfClosed) ProcessIncomingCER(m *diameter.Message, b *Message
 func (s *PeerStateHalfClosed) ProcessIncomingCEA(m *diameter.Message, b *MessageBuilder) (nextState PeerState, messageToSend *diameter.Message, err *PeerStateError) {
 	return NewPeerStateDisconnected(s.notifier, s.transport, s.peer), nil, &PeerStateError{fmt.Errorf("received Capabilities-Exchange Answer on peer connection that is half-closed"), false}
 }
+
+// ProcessIncomingDWR answers the DWR.  The peer may continue to send watchdogs until it answers
+// the DPR, and if these are not answered, the peer may treat the transport as failed (RFC 3539).
 func (s *PeerStateHalfClosed) ProcessIncomingDWR(m *diameter.Message, b *MessageBuilder) (nextState PeerState, messageToSend *diameter.Message, err *PeerStateError) {
-	return s, nil, nil
+	return s, b.DWA(m), nil
 }
 func (s *PeerStateHalfClosed) ProcessIncomingDWA(m *diameter.Message, b *MessageBuilder) (nextState PeerState, messageToSend *diameter.Message, err *PeerStateError) {
 	return s, nil, nil
@@ -0,0 +1,1226 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/blorticus-go/diameter"
+)
+
+// newTestPeerStateManager creates a PeerStateManager that is not running, using one side of a
+// net.Pipe as its transport.  The transport is closed when the test completes.
+func newTestPeerStateManager(t *testing.T, localIdentity *DiameterEntity) *PeerStateManager {
+	t.Helper()
+
+	localTransport, remoteTransport := net.Pipe()
+	t.Cleanup(func() {
+		localTransport.Close()
+		remoteTransport.Close()
+	})
+
+	return NewInitiatorPeerStateManager(localIdentity, localTransport, make(chan *PeerStateEvent, 10))
+}
+
+func expectExactlyOneAvpWithValue(t *testing.T, m *diameter.Message, code diameter.Uint24, avpType diameter.AVPDataType, expectedValue any) {
+	t.Helper()
+
+	matchingAvps := m.TopLevelAvpsMatching(0, code)
+	if len(matchingAvps) != 1 {
+		t.Errorf("expected exactly one AVP with code (%d), got (%d)", code, len(matchingAvps))
+		return
+	}
+
+	value, err := diameter.ConvertAVPDataToTypedData(matchingAvps[0].Data, avpType)
+	if err != nil {
+		t.Errorf("failed to convert AVP with code (%d) to typed data: %s", code, err)
+		return
+	}
+
+	if value != expectedValue {
+		t.Errorf("expected AVP with code (%d) to have value (%v), got (%v)", code, expectedValue, value)
+	}
+}
+
+func TestGeneratedDWRHasOneOriginHostAndOneOriginRealm(t *testing.T) {
+	manager := newTestPeerStateManager(t, testClientEntity())
+
+	dwr := manager.generateDWR()
+
+	if !dwr.IsRequest() || dwr.Code != DeviceWatchdogCode {
+		t.Fatalf("expected DWR, got message with code (%d)", dwr.Code)
+	}
+
+	expectExactlyOneAvpWithValue(t, dwr, 264, diameter.DiamIdent, "client.example.com")
+	expectExactlyOneAvpWithValue(t, dwr, 296, diameter.DiamIdent, "example.com")
+
+	if len(dwr.TopLevelAvpsMatching(0, 278)) != 0 {
+		t.Errorf("expected no Origin-State-Id when local OriginStateID is 0")
+	}
+}
+
+func TestGeneratedDWAHasOneOriginHostAndOneOriginRealmAndOriginStateId(t *testing.T) {
+	localIdentity := testServerEntity()
+	localIdentity.OriginStateID = 1700000000
+
+	manager := newTestPeerStateManager(t, localIdentity)
+
+	dwr := diameter.NewMessage(diameter.MsgFlagRequest, DeviceWatchdogCode, 0, 1, 1, []*diameter.AVP{
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "client.example.com"),
+		diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+	}, nil)
+
+	dwa := manager.generateDWA(dwr)
+
+	expectExactlyOneAvpWithValue(t, dwa, 268, diameter.Unsigned32, uint32(2001))
+	expectExactlyOneAvpWithValue(t, dwa, 264, diameter.DiamIdent, "server.example.com")
+	expectExactlyOneAvpWithValue(t, dwa, 296, diameter.DiamIdent, "example.com")
+	expectExactlyOneAvpWithValue(t, dwa, 278, diameter.Unsigned32, uint32(1700000000))
+}
+
+func TestSendMessageTimesOutWhenPeerDoesNotDrainTheTransport(t *testing.T) {
+	manager := newTestPeerStateManager(t, testClientEntity()).SetWriteTimeout(50 * time.Millisecond)
+
+	err := manager.sendMessage(testCreditControlRequest())
+	if err == nil {
+		t.Fatalf("expected error on sendMessage(), got none")
+	}
+	if _, isWriteTimeout := err.(*WriteTimedOutError); !isWriteTimeout {
+		t.Fatalf("expected *WriteTimedOutError, got = (%T) %s", err, err)
+	}
+
+	if err := manager.sendMessage(testCreditControlRequest()); err == nil {
+		t.Errorf("expected the transport to be closed after a write timeout, but a subsequent send succeeded")
+	}
+}
+
+func TestPeerStateManagerRunEndsWhenCapabilitiesExchangeWriteTimesOut(t *testing.T) {
+	localTransport, remoteTransport := net.Pipe()
+	defer remoteTransport.Close()
+
+	eventChannel := make(chan *PeerStateEvent, 10)
+	go NewInitiatorPeerStateManager(testClientEntity(), localTransport, eventChannel).SetWriteTimeout(50 * time.Millisecond).NewRun()
+
+	errorEvent := nextEventOfType(t, eventChannel, ErrorEvent)
+	if _, isWriteTimeout := errorEvent.Error.(*WriteTimedOutError); !isWriteTimeout {
+		t.Errorf("expected *WriteTimedOutError, got = (%T) %s", errorEvent.Error, errorEvent.Error)
+	}
+
+	nextEventOfType(t, eventChannel, ClosedTransportToPeerEvent)
+}
+
+func TestHalfClosedStateAnswersDWR(t *testing.T) {
+	manager := newTestPeerStateManager(t, testServerEntity())
+	messageBuilder := &MessageBuilder{DWA: manager.generateDWA}
+
+	state := NewPeerStateHalfClosed(NewPeerStateNotifier(make(chan *PeerStateEvent, 10)), manager.transport, nil)
+
+	dwr := diameter.NewMessage(diameter.MsgFlagRequest, DeviceWatchdogCode, 0, 10, 20, []*diameter.AVP{
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "client.example.com"),
+		diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+	}, nil)
+
+	nextState, messageToSend, err := state.ProcessIncomingDWR(dwr, messageBuilder)
+	if err != nil {
+		t.Fatalf("expected no error on ProcessIncomingDWR(), got = (%s)", err.Error)
+	}
+	if nextState != state {
+		t.Errorf("expected state to remain half-closed, got = (%s)", peerStateName(nextState))
+	}
+	if messageToSend == nil {
+		t.Fatalf("expected a DWA, got nil")
+	}
+	if messageToSend.IsRequest() || messageToSend.Code != DeviceWatchdogCode || messageToSend.HopByHopID != 10 || messageToSend.EndToEndID != 20 {
+		t.Errorf("expected DWA matching the DWR, got message with code (%d), hop-by-hop-id (%d), end-to-end-id (%d)", messageToSend.Code, messageToSend.HopByHopID, messageToSend.EndToEndID)
+	}
+	expectExactlyOneAvpWithValue(t, messageToSend, 268, diameter.Unsigned32, uint32(2001))
+}
+
+func TestDWAIsCorrelatedToOutstandingDWR(t *testing.T) {
+	manager := newTestPeerStateManager(t, testClientEntity())
+
+	dwr := manager.generateDWR()
+	manager.recordOutstandingDWR(dwr)
+
+	mismatchedDwa := diameter.NewMessage(0, DeviceWatchdogCode, 0, dwr.HopByHopID+1, dwr.EndToEndID, nil, nil)
+	if manager.dwaMatchesAnOutstandingDWR(mismatchedDwa) {
+		t.Errorf("expected DWA with mismatched Hop-by-Hop-ID not to match an outstanding DWR")
+	}
+
+	dwa := manager.generateDWA(dwr)
+	if !manager.dwaMatchesAnOutstandingDWR(dwa) {
+		t.Errorf("expected DWA for sent DWR to match an outstanding DWR")
+	}
+
+	if manager.dwaMatchesAnOutstandingDWR(dwa) {
+		t.Errorf("expected a second DWA for the same DWR not to match an outstanding DWR")
+	}
+}
+
+func TestUnsolicitedDWAProducesEvent(t *testing.T) {
+	pair, err := NewInMemoryPeerPair(testClientEntity(), testServerEntity())
+	if err != nil {
+		t.Fatalf("expected no error on NewInMemoryPeerPair(), got = (%s)", err)
+	}
+	defer pair.Close()
+
+	unsolicitedDwa := diameter.NewMessage(0, DeviceWatchdogCode, 0, 0xdeadbeef, 0xfeedface, []*diameter.AVP{
+		diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2001)),
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "client.example.com"),
+		diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+	}, nil)
+
+	if _, err := pair.clientTransport.Write(unsolicitedDwa.Encode()); err != nil {
+		t.Fatalf("expected no error writing DWA to transport, got = (%s)", err)
+	}
+
+	event := nextEventOfType(t, pair.ServerEvents, UnsolicitedDWAReceivedEvent)
+	if event.Message == nil || event.Message.HopByHopID != 0xdeadbeef {
+		t.Errorf("expected event to carry the DWA with Hop-by-Hop-ID (0xdeadbeef)")
+	}
+}
+
+// runManagerPairWithPeerAcceptance runs an initiator manager for testClientEntity() and an initiated
+// manager for testServerEntity() over a net.Pipe, with accept set on the initiated side.
+func runManagerPairWithPeerAcceptance(t *testing.T, accept PeerAcceptanceFunc) (clientEvents <-chan *PeerStateEvent, serverEvents <-chan *PeerStateEvent) {
+	t.Helper()
+
+	return runManagerPair(t, testServerEntity(), func(server *PeerStateManager) {
+		server.SetPeerAcceptance(accept)
+	})
+}
+
+// runManagerPair runs an initiator manager for testClientEntity() and an initiated manager for
+// serverEntity over a net.Pipe.  configureServer is called on the initiated manager before it runs.
+func runManagerPair(t *testing.T, serverEntity *DiameterEntity, configureServer func(server *PeerStateManager)) (clientEvents <-chan *PeerStateEvent, serverEvents <-chan *PeerStateEvent) {
+	t.Helper()
+
+	clientTransport, serverTransport := net.Pipe()
+	t.Cleanup(func() {
+		clientTransport.Close()
+		serverTransport.Close()
+	})
+
+	clientEventChannel := make(chan *PeerStateEvent, 100)
+	serverEventChannel := make(chan *PeerStateEvent, 100)
+
+	serverManager := NewInitiatedPeerStateManager(serverEntity, serverTransport, serverEventChannel)
+	configureServer(serverManager)
+
+	go serverManager.NewRun()
+	go NewInitiatorPeerStateManager(testClientEntity(), clientTransport, clientEventChannel).NewRun()
+
+	return clientEventChannel, serverEventChannel
+}
+
+func TestPeerAcceptanceCallbackAcceptsPeer(t *testing.T) {
+	identitySeenByCallback := make(chan *DiameterEntity, 1)
+	clientEvents, serverEvents := runManagerPairWithPeerAcceptance(t, func(peer *DiameterEntity) (bool, uint32) {
+		identitySeenByCallback <- peer
+		return true, 0
+	})
+
+	cea := nextEventOfType(t, clientEvents, StateMachineMessageReceivedFromPeerEvent).Message
+	expectExactlyOneAvpWithValue(t, cea, 268, diameter.Unsigned32, uint32(2001))
+	if cea.IsError() {
+		t.Errorf("expected E-bit not to be set on CEA for accepted peer")
+	}
+
+	nextEventOfType(t, serverEvents, DiameterConnectionEstablishedEvent)
+
+	if peer := <-identitySeenByCallback; peer.OriginHost != "client.example.com" {
+		t.Errorf("expected callback to see Origin-Host (client.example.com), got (%s)", peer.OriginHost)
+	}
+}
+
+func TestPeerAcceptanceCallbackRejectsPeer(t *testing.T) {
+	clientEvents, serverEvents := runManagerPairWithPeerAcceptance(t, func(peer *DiameterEntity) (bool, uint32) {
+		return peer.OriginHost == "known.example.com", 0
+	})
+
+	cea := nextEventOfType(t, clientEvents, StateMachineMessageReceivedFromPeerEvent).Message
+	expectExactlyOneAvpWithValue(t, cea, 268, diameter.Unsigned32, uint32(3010))
+	if !cea.IsError() {
+		t.Errorf("expected E-bit to be set on CEA with Result-Code (3010)")
+	}
+
+	errorEvent := nextEventOfType(t, serverEvents, ErrorEvent)
+	rejectedError, isRejectedError := errorEvent.Error.(*PeerRejectedError)
+	if !isRejectedError {
+		t.Fatalf("expected *PeerRejectedError, got = (%T) %s", errorEvent.Error, errorEvent.Error)
+	}
+	if rejectedError.OriginHost != "client.example.com" || rejectedError.ResultCode != 3010 {
+		t.Errorf("expected rejection of (client.example.com) with (3010), got (%s) with (%d)", rejectedError.OriginHost, rejectedError.ResultCode)
+	}
+
+	nextEventOfType(t, serverEvents, ClosedTransportToPeerEvent)
+}
+
+func TestPeerAcceptanceCallbackResultCodeIsUsedInCEA(t *testing.T) {
+	clientEvents, serverEvents := runManagerPairWithPeerAcceptance(t, func(peer *DiameterEntity) (bool, uint32) {
+		return false, 5010
+	})
+
+	cea := nextEventOfType(t, clientEvents, StateMachineMessageReceivedFromPeerEvent).Message
+	expectExactlyOneAvpWithValue(t, cea, 268, diameter.Unsigned32, uint32(5010))
+	if cea.IsError() {
+		t.Errorf("expected E-bit not to be set on CEA with Result-Code (5010)")
+	}
+
+	nextEventOfType(t, serverEvents, ClosedTransportToPeerEvent)
+}
+
+func TestMessageDecodeFailureProducesErrorWithTheUndecodableBytes(t *testing.T) {
+	pair, err := NewInMemoryPeerPair(testClientEntity(), testServerEntity())
+	if err != nil {
+		t.Fatalf("expected no error on NewInMemoryPeerPair(), got = (%s)", err)
+	}
+	defer pair.Close()
+
+	// a DWR containing an AVP that claims to be longer than the message
+	malformed := []byte{
+		0x01, 0x00, 0x00, 0x1c, 0x80, 0x00, 0x01, 0x18, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1,
+		0x00, 0x00, 0x01, 0x08, 0x40, 0x00, 0x00, 0x64,
+	}
+
+	if _, err := pair.clientTransport.Write(malformed); err != nil {
+		t.Fatalf("expected no error writing malformed message to transport, got = (%s)", err)
+	}
+
+	event := nextEventOfType(t, pair.ServerEvents, ErrorEvent)
+
+	var decodeError *diameter.MessageDecodeError
+	if !errors.As(event.Error, &decodeError) {
+		t.Fatalf("expected *diameter.MessageDecodeError, got = (%T) %v", event.Error, event.Error)
+	}
+	if !bytes.Equal(decodeError.Bytes, malformed) {
+		t.Errorf("expected captured bytes (% x), got (% x)", malformed, decodeError.Bytes)
+	}
+}
+
+func TestInjectedMessagesDriveCreditControlExchange(t *testing.T) {
+	serverTransport, remoteTransport := net.Pipe()
+	defer serverTransport.Close()
+	defer remoteTransport.Close()
+
+	serverEvents := make(chan *PeerStateEvent, 100)
+	serverManager := NewInitiatedPeerStateManager(testServerEntity(), serverTransport, serverEvents)
+	go serverManager.NewRun()
+
+	// the only thing read from the remote side of the transport are the messages sent by the server
+	messagesSentByServer := make(chan *diameter.Message, 10)
+	go func() {
+		reader := diameter.NewMessageStreamReader(remoteTransport)
+		for {
+			m, err := reader.ReadNextMessage()
+			if err != nil {
+				return
+			}
+			messagesSentByServer <- m
+		}
+	}()
+
+	nextSentMessage := func() *diameter.Message {
+		t.Helper()
+		select {
+		case m := <-messagesSentByServer:
+			return m
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for the server to send a message")
+			return nil
+		}
+	}
+
+	cer := newTestPeerStateManager(t, testClientEntity()).generateCER()
+	if err := serverManager.injectIncomingForTest(cer); err != nil {
+		t.Fatalf("expected no error injecting CER, got = (%s)", err)
+	}
+
+	if cea := nextSentMessage(); cea.Code != CapabilitiesExchangeCode || cea.IsRequest() {
+		t.Fatalf("expected server to send a CEA, got message with code (%d)", cea.Code)
+	}
+	nextEventOfType(t, serverEvents, DiameterConnectionEstablishedEvent)
+
+	ccr := testCreditControlRequest()
+	ccr.HopByHopID, ccr.EndToEndID = 100, 200
+	if err := serverManager.injectIncomingForTest(ccr); err != nil {
+		t.Fatalf("expected no error injecting CCR, got = (%s)", err)
+	}
+
+	receivedEvent := nextEventOfType(t, serverEvents, MessageReceivedFromPeerEvent)
+	if receivedEvent.Message != ccr {
+		t.Fatalf("expected MessageReceivedFromPeerEvent to carry the injected CCR")
+	}
+
+	if err := receivedEvent.Peer.SendMessage(ccr.GenerateMatchingResponseWithAvps([]*diameter.AVP{
+		diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1;1"),
+		diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2001)),
+	}, nil)); err != nil {
+		t.Fatalf("expected no error on SendMessage(), got = (%s)", err)
+	}
+
+	cca := nextSentMessage()
+	if cca.Code != 272 || cca.IsRequest() || cca.HopByHopID != 100 || cca.EndToEndID != 200 {
+		t.Errorf("expected CCA matching the injected CCR, got code (%d), request (%t), hop-by-hop-id (%d), end-to-end-id (%d)", cca.Code, cca.IsRequest(), cca.HopByHopID, cca.EndToEndID)
+	}
+
+	serverTransport.Close()
+	nextEventOfType(t, serverEvents, ClosedTransportToPeerEvent)
+	if err := serverManager.injectIncomingForTest(ccr); err == nil {
+		t.Errorf("expected error injecting into a manager that is no longer running, got none")
+	}
+}
+
+func TestUnsupportedApplicationRequestsAreRejected(t *testing.T) {
+	testCases := []struct {
+		authApplicationIDs []uint32
+		acctApplicationIDs []uint32
+		rejectUnsupported  bool
+		requestAppID       uint32
+		expectRejection    bool
+	}{
+		{[]uint32{4}, nil, true, 4, false},
+		{nil, []uint32{3}, true, 3, false},
+		{[]uint32{4}, []uint32{3}, true, 16777238, true},
+		{nil, nil, true, 4, true},
+		{[]uint32{RelayApplicationId}, nil, true, 16777238, false},
+		{[]uint32{4}, nil, false, 16777238, false},
+	}
+
+	for i, testCase := range testCases {
+		serverEntity := testServerEntity()
+		serverEntity.AuthApplicationIDs, serverEntity.AcctApplicationIDs = testCase.authApplicationIDs, testCase.acctApplicationIDs
+
+		clientEvents, serverEvents := runManagerPair(t, serverEntity, func(server *PeerStateManager) {
+			server.SetRejectUnsupportedApplications(testCase.rejectUnsupported)
+		})
+
+		client := nextEventOfType(t, clientEvents, DiameterConnectionEstablishedEvent).Peer
+		nextEventOfType(t, serverEvents, DiameterConnectionEstablishedEvent)
+
+		request := testCreditControlRequest()
+		request.AppID = testCase.requestAppID
+		if err := client.SendMessage(request); err != nil {
+			t.Fatalf("(test case %d) expected no error on SendMessage(), got = (%s)", i+1, err)
+		}
+
+		if !testCase.expectRejection {
+			if received := nextEventOfType(t, serverEvents, MessageReceivedFromPeerEvent).Message; received.AppID != testCase.requestAppID {
+				t.Errorf("(test case %d) expected server to receive request with appId (%d), got appId (%d)", i+1, testCase.requestAppID, received.AppID)
+			}
+			continue
+		}
+
+		if rejected := nextEventOfType(t, serverEvents, UnsupportedApplicationRequestRejectedEvent).Message; rejected.AppID != testCase.requestAppID {
+			t.Errorf("(test case %d) expected rejected request with appId (%d), got appId (%d)", i+1, testCase.requestAppID, rejected.AppID)
+		}
+
+		answer := nextEventOfType(t, clientEvents, MessageReceivedFromPeerEvent).Message
+		if answer.IsRequest() || !answer.IsError() || answer.AppID != testCase.requestAppID || answer.HopByHopID != request.HopByHopID {
+			t.Errorf("(test case %d) expected error answer matching the request, got flags (%#02x), appId (%d), hop-by-hop-id (%d)", i+1, answer.Flags, answer.AppID, answer.HopByHopID)
+		}
+		expectExactlyOneAvpWithValue(t, answer, 268, diameter.Unsigned32, uint32(3007))
+		expectExactlyOneAvpWithValue(t, answer, 263, diameter.UTF8String, "client.example.com;1;1")
+		expectExactlyOneAvpWithValue(t, answer, 264, diameter.DiamIdent, "server.example.com")
+	}
+}
+
+// chunkingConn is a net.Conn that writes each buffer to the underlying connection in small pieces,
+// so that concurrent unsynchronized writes would be interleaved.
+type chunkingConn struct {
+	net.Conn
+}
+
+func (c *chunkingConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := c.Conn.Write(b[written:min(written+7, len(b))])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func TestRequestsAreAnsweredWithTooBusyWhilePeerIsPaused(t *testing.T) {
+	clientEvents, serverEvents := runManagerPair(t, testServerEntity(), func(server *PeerStateManager) {})
+
+	client := nextEventOfType(t, clientEvents, DiameterConnectionEstablishedEvent).Peer
+	server := nextEventOfType(t, serverEvents, DiameterConnectionEstablishedEvent).Peer
+
+	server.Pause()
+	if !server.IsPaused() {
+		t.Fatalf("expected IsPaused() to be true after Pause()")
+	}
+
+	request := testCreditControlRequest()
+	if err := client.SendMessage(request); err != nil {
+		t.Fatalf("expected no error on SendMessage(), got = (%s)", err)
+	}
+
+	if rejected := nextEventOfType(t, serverEvents, RequestRejectedWhilePausedEvent).Message; rejected.HopByHopID != request.HopByHopID {
+		t.Errorf("expected rejected request with hop-by-hop-id (%d), got (%d)", request.HopByHopID, rejected.HopByHopID)
+	}
+
+	answer := nextEventOfType(t, clientEvents, MessageReceivedFromPeerEvent).Message
+	if answer.IsRequest() || !answer.IsError() || answer.HopByHopID != request.HopByHopID {
+		t.Errorf("expected error answer matching the request, got flags (%#02x), hop-by-hop-id (%d)", answer.Flags, answer.HopByHopID)
+	}
+	expectExactlyOneAvpWithValue(t, answer, 268, diameter.Unsigned32, uint32(3004))
+	expectExactlyOneAvpWithValue(t, answer, 263, diameter.UTF8String, "client.example.com;1;1")
+
+	server.Resume()
+
+	request = testCreditControlRequest()
+	request.HopByHopID++
+	if err := client.SendMessage(request); err != nil {
+		t.Fatalf("expected no error on SendMessage(), got = (%s)", err)
+	}
+
+	if received := nextEventOfType(t, serverEvents, MessageReceivedFromPeerEvent).Message; received.HopByHopID != request.HopByHopID {
+		t.Errorf("expected request with hop-by-hop-id (%d) after Resume(), got (%d)", request.HopByHopID, received.HopByHopID)
+	}
+}
+
+func TestLateAnswerToACancelledRequestIsDiscarded(t *testing.T) {
+	clientEvents, serverEvents := runManagerPair(t, testServerEntity(), func(server *PeerStateManager) {})
+
+	client := nextEventOfType(t, clientEvents, DiameterConnectionEstablishedEvent).Peer
+	server := nextEventOfType(t, serverEvents, DiameterConnectionEstablishedEvent).Peer
+
+	if client.CancelRequest(1) {
+		t.Errorf("expected CancelRequest() to be false for a request that was never sent")
+	}
+
+	cancelled := testCreditControlRequest()
+	if err := client.SendCancellableRequest(cancelled); err != nil {
+		t.Fatalf("expected no error on SendCancellableRequest(), got = (%s)", err)
+	}
+	receivedCancelled := nextEventOfType(t, serverEvents, MessageReceivedFromPeerEvent).Message
+
+	if !client.CancelRequest(cancelled.HopByHopID) {
+		t.Errorf("expected CancelRequest() to be true for an outstanding request")
+	}
+	if client.CancelRequest(cancelled.HopByHopID) {
+		t.Errorf("expected CancelRequest() to be false for a request that was already cancelled")
+	}
+
+	if err := server.SendAnswer(receivedCancelled, []*diameter.AVP{diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2001))}, nil); err != nil {
+		t.Fatalf("expected no error on SendAnswer(), got = (%s)", err)
+	}
+	if discarded := nextEventOfType(t, clientEvents, AnswerToCancelledRequestDiscardedEvent).Message; discarded.HopByHopID != cancelled.HopByHopID {
+		t.Errorf("expected discarded answer with hop-by-hop-id (%d), got (%d)", cancelled.HopByHopID, discarded.HopByHopID)
+	}
+
+	// an answer to a request that was not cancelled is still delivered, and is the next one delivered
+	answered := testCreditControlRequest()
+	answered.HopByHopID++
+	if err := client.SendCancellableRequest(answered); err != nil {
+		t.Fatalf("expected no error on SendCancellableRequest(), got = (%s)", err)
+	}
+	receivedAnswered := nextEventOfType(t, serverEvents, MessageReceivedFromPeerEvent).Message
+	if err := server.SendAnswer(receivedAnswered, []*diameter.AVP{diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2001))}, nil); err != nil {
+		t.Fatalf("expected no error on SendAnswer(), got = (%s)", err)
+	}
+	if answer := nextEventOfType(t, clientEvents, MessageReceivedFromPeerEvent).Message; answer.IsRequest() || answer.HopByHopID != answered.HopByHopID {
+		t.Errorf("expected answer with hop-by-hop-id (%d), got request flag (%t), hop-by-hop-id (%d)", answered.HopByHopID, answer.IsRequest(), answer.HopByHopID)
+	}
+
+	if client.CancelRequest(answered.HopByHopID) {
+		t.Errorf("expected CancelRequest() to be false for a request that was answered")
+	}
+}
+
+func TestRequestsThatAreNotCancellableAreNotRecorded(t *testing.T) {
+	clientEvents, serverEvents := runManagerPair(t, testServerEntity(), func(server *PeerStateManager) {})
+
+	client := nextEventOfType(t, clientEvents, DiameterConnectionEstablishedEvent).Peer
+	nextEventOfType(t, serverEvents, DiameterConnectionEstablishedEvent)
+
+	// the server never answers these requests
+	for i := 0; i < 10; i++ {
+		request := testCreditControlRequest()
+		request.HopByHopID = uint32(100 + i)
+		if err := client.SendMessage(request); err != nil {
+			t.Fatalf("expected no error on SendMessage(), got = (%s)", err)
+		}
+		nextEventOfType(t, serverEvents, MessageReceivedFromPeerEvent)
+
+		if client.CancelRequest(request.HopByHopID) {
+			t.Errorf("expected CancelRequest() to be false for a request sent with SendMessage()")
+		}
+	}
+
+	client.outstandingRequestsMutex.Lock()
+	outstandingRequests := len(client.outstandingRequests)
+	client.outstandingRequestsMutex.Unlock()
+	if outstandingRequests != 0 {
+		t.Errorf("expected no outstanding requests to be recorded, got (%d)", outstandingRequests)
+	}
+
+	if err := client.SendCancellableRequest(testCreditControlRequest().GenerateMatchingResponseWithAvps(nil, nil)); err == nil {
+		t.Errorf("expected error on SendCancellableRequest() for an answer, got none")
+	}
+}
+
+func TestMessagesWithInvalidHeaderBitsAreDiscarded(t *testing.T) {
+	for i, testCase := range []struct {
+		name                string
+		flags               uint8
+		rejectReservedFlags bool
+		expectErrorAnswer   bool
+		expectDelivered     bool
+	}{
+		{name: "request with reserved bits", flags: diameter.MsgFlagRequest | diameter.MsgFlagProxiable | 0x01, expectDelivered: true},
+		{name: "answer with reserved bits", flags: 0x08, expectDelivered: true},
+		{name: "request with E-bit", flags: diameter.MsgFlagRequest | diameter.MsgFlagError, expectErrorAnswer: true},
+		{name: "request with reserved bits rejected", flags: diameter.MsgFlagRequest | diameter.MsgFlagProxiable | 0x01, rejectReservedFlags: true, expectErrorAnswer: true},
+		{name: "answer with reserved bits rejected", flags: 0x08, rejectReservedFlags: true},
+	} {
+		clientEvents, serverEvents := runManagerPair(t, testServerEntity(), func(server *PeerStateManager) {
+			server.SetRejectReservedHeaderFlags(testCase.rejectReservedFlags)
+		})
+
+		client := nextEventOfType(t, clientEvents, DiameterConnectionEstablishedEvent).Peer
+		nextEventOfType(t, serverEvents, DiameterConnectionEstablishedEvent)
+
+		message := testCreditControlRequest()
+		message.HopByHopID = uint32(100 + i)
+		message.Flags = testCase.flags
+		if err := client.SendMessage(message); err != nil {
+			t.Fatalf("[%s] expected no error on SendMessage(), got = (%s)", testCase.name, err)
+		}
+
+		if testCase.expectDelivered {
+			if received := nextEventOfType(t, serverEvents, MessageReceivedFromPeerEvent).Message; received.HopByHopID != message.HopByHopID {
+				t.Errorf("[%s] expected delivered message to have hop-by-hop-id (%d), got (%d)", testCase.name, message.HopByHopID, received.HopByHopID)
+			}
+			continue
+		}
+
+		errorEvent := nextEventOfType(t, serverEvents, ErrorEvent)
+		var invalidHeaderBitsError *InvalidHeaderBitsError
+		if !errors.As(errorEvent.Error, &invalidHeaderBitsError) || !errors.Is(errorEvent.Error, diameter.ErrInvalidHeaderBits) {
+			t.Errorf("[%s] expected *InvalidHeaderBitsError wrapping ErrInvalidHeaderBits, got = (%T) %s", testCase.name, errorEvent.Error, errorEvent.Error)
+		} else if invalidHeaderBitsError.Message.HopByHopID != message.HopByHopID {
+			t.Errorf("[%s] expected error for message with hop-by-hop-id (%d), got (%d)", testCase.name, message.HopByHopID, invalidHeaderBitsError.Message.HopByHopID)
+		}
+
+		if testCase.expectErrorAnswer {
+			answer := nextEventOfType(t, clientEvents, MessageReceivedFromPeerEvent).Message
+			if answer.IsRequest() || !answer.IsError() || answer.HopByHopID != message.HopByHopID {
+				t.Errorf("[%s] expected error answer matching the request, got flags (%#02x), hop-by-hop-id (%d)", testCase.name, answer.Flags, answer.HopByHopID)
+			}
+			expectExactlyOneAvpWithValue(t, answer, 268, diameter.Unsigned32, uint32(3008))
+		}
+
+		// the connection remains usable, and the discarded message is not delivered
+		valid := testCreditControlRequest()
+		valid.HopByHopID = uint32(200 + i)
+		if err := client.SendMessage(valid); err != nil {
+			t.Fatalf("[%s] expected no error on SendMessage(), got = (%s)", testCase.name, err)
+		}
+		if received := nextEventOfType(t, serverEvents, MessageReceivedFromPeerEvent).Message; received.HopByHopID != valid.HopByHopID {
+			t.Errorf("[%s] expected next delivered message to have hop-by-hop-id (%d), got (%d)", testCase.name, valid.HopByHopID, received.HopByHopID)
+		}
+	}
+}
+
+// connWithLocalAddr is a net.Conn with a fixed LocalAddr, to simulate a transport on a particular local
+// interface.
+type connWithLocalAddr struct {
+	net.Conn
+	localAddr net.Addr
+}
+
+func (c *connWithLocalAddr) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// hostIPAddressesIn returns the values of the Host-IP-Address AVPs in m, in order.
+func hostIPAddressesIn(t *testing.T, m *diameter.Message) []string {
+	t.Helper()
+
+	var addresses []string
+	for _, avp := range m.TopLevelAvpsMatching(0, 257) {
+		address, err := avp.ConvertDataToTypedData(diameter.Address)
+		if err != nil {
+			t.Fatalf("failed to convert Host-IP-Address: %s", err)
+		}
+		addresses = append(addresses, address.(net.IP).String())
+	}
+
+	return addresses
+}
+
+func TestCapabilitiesExchangeAdvertisesFirstTheHostIPAddressOfTheTransport(t *testing.T) {
+	multiHomedEntity := func() *DiameterEntity {
+		entity := testClientEntity()
+		first, second, third := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.1.1"), net.ParseIP("10.0.2.1")
+		entity.HostIPAddresses = []*net.IP{&first, &second, &third}
+		return entity
+	}
+
+	for _, testCase := range []struct {
+		name                    string
+		localAddr               net.Addr
+		expectedHostIPAddresses []string
+	}{
+		{
+			name:                    "CER on second address",
+			localAddr:               &net.TCPAddr{IP: net.ParseIP("10.0.1.1"), Port: 3868},
+			expectedHostIPAddresses: []string{"10.0.1.1", "10.0.0.1", "10.0.2.1"},
+		},
+		{
+			name:                    "CER on third address",
+			localAddr:               &net.TCPAddr{IP: net.ParseIP("10.0.2.1"), Port: 3868},
+			expectedHostIPAddresses: []string{"10.0.2.1", "10.0.0.1", "10.0.1.1"},
+		},
+		{
+			name:                    "CER on address that is not configured",
+			localAddr:               &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 3868},
+			expectedHostIPAddresses: []string{"10.0.0.1", "10.0.1.1", "10.0.2.1"},
+		},
+	} {
+		clientTransport, serverTransport := net.Pipe()
+		t.Cleanup(func() {
+			clientTransport.Close()
+			serverTransport.Close()
+		})
+
+		clientEvents := make(chan *PeerStateEvent, 100)
+		serverEvents := make(chan *PeerStateEvent, 100)
+		go NewInitiatedPeerStateManager(testServerEntity(), serverTransport, serverEvents).NewRun()
+		go NewInitiatorPeerStateManager(multiHomedEntity(), &connWithLocalAddr{clientTransport, testCase.localAddr}, clientEvents).NewRun()
+
+		cer := nextEventOfType(t, serverEvents, StateMachineMessageReceivedFromPeerEvent).Message
+		if addresses := hostIPAddressesIn(t, cer); !slices.Equal(addresses, testCase.expectedHostIPAddresses) {
+			t.Errorf("[%s] expected CER Host-IP-Addresses (%v), got (%v)", testCase.name, testCase.expectedHostIPAddresses, addresses)
+		}
+
+		nextEventOfType(t, clientEvents, DiameterConnectionEstablishedEvent)
+	}
+
+	clientTransport, serverTransport := net.Pipe()
+	t.Cleanup(func() {
+		clientTransport.Close()
+		serverTransport.Close()
+	})
+
+	clientEvents := make(chan *PeerStateEvent, 100)
+	go NewInitiatedPeerStateManager(multiHomedEntity(), &connWithLocalAddr{serverTransport, &net.TCPAddr{IP: net.ParseIP("10.0.1.1"), Port: 3868}}, make(chan *PeerStateEvent, 100)).NewRun()
+	go NewInitiatorPeerStateManager(testServerEntity(), clientTransport, clientEvents).NewRun()
+
+	cea := nextEventOfType(t, clientEvents, StateMachineMessageReceivedFromPeerEvent).Message
+	if addresses, expected := hostIPAddressesIn(t, cea), []string{"10.0.1.1", "10.0.0.1", "10.0.2.1"}; !slices.Equal(addresses, expected) {
+		t.Errorf("expected CEA Host-IP-Addresses (%v), got (%v)", expected, addresses)
+	}
+}
+
+func TestGeneratedCapabilitiesExchangeAdvertisesFirstTheHostIPAddressOfTheTransport(t *testing.T) {
+	entity := testServerEntity()
+	first, second := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.1.1")
+	entity.HostIPAddresses = []*net.IP{&first, &second}
+
+	localTransport, remoteTransport := net.Pipe()
+	t.Cleanup(func() {
+		localTransport.Close()
+		remoteTransport.Close()
+	})
+
+	manager := NewInitiatedPeerStateManager(entity, &connWithLocalAddr{localTransport, &net.TCPAddr{IP: second, Port: 3868}}, make(chan *PeerStateEvent, 10))
+
+	cer := manager.generateCER()
+	expected := []string{"10.0.1.1", "10.0.0.1"}
+	for name, m := range map[string]*diameter.Message{"CER": cer, "CEA": manager.generateCEA(cer)} {
+		if addresses := hostIPAddressesIn(t, m); !slices.Equal(addresses, expected) {
+			t.Errorf("expected %s Host-IP-Addresses (%v), got (%v)", name, expected, addresses)
+		}
+	}
+}
+
+// initiateDisconnectWithin calls manager.InitiateDisconnect() and returns its result, failing the test
+// if it does not return within one second.
+func initiateDisconnectWithin(t *testing.T, manager *PeerStateManager) error {
+	t.Helper()
+
+	result := make(chan error, 1)
+	go func() { result <- manager.InitiateDisconnect() }()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(time.Second):
+		t.Fatalf("InitiateDisconnect() did not return")
+		return nil
+	}
+}
+
+func TestInitiateDisconnectAfterTransportIsClosedReturnsError(t *testing.T) {
+	clientTransport, serverTransport := net.Pipe()
+	defer clientTransport.Close()
+
+	serverEvents := make(chan *PeerStateEvent, 100)
+	serverManager := NewInitiatedPeerStateManager(testServerEntity(), serverTransport, serverEvents)
+	go serverManager.NewRun()
+	go NewInitiatorPeerStateManager(testClientEntity(), clientTransport, make(chan *PeerStateEvent, 100)).NewRun()
+
+	nextEventOfType(t, serverEvents, DiameterConnectionEstablishedEvent)
+	clientTransport.Close()
+	nextEventOfType(t, serverEvents, ClosedTransportToPeerEvent)
+
+	if err := initiateDisconnectWithin(t, serverManager); err == nil {
+		t.Errorf("expected error on InitiateDisconnect() after the transport is closed, got none")
+	}
+}
+
+func TestInitiateDisconnectTimesOutDuringCapabilitiesExchange(t *testing.T) {
+	localTransport, peerTransport := net.Pipe()
+	defer localTransport.Close()
+	defer peerTransport.Close()
+
+	fromManager := messagesReadFrom(peerTransport)
+	manager := NewInitiatorPeerStateManager(testClientEntity(), localTransport, make(chan *PeerStateEvent, 100)).SetDisconnectTimeout(50 * time.Millisecond)
+	go manager.NewRun()
+
+	// the peer reads the CER but never answers it
+	nextMessageFromServer(t, fromManager)
+
+	if err := initiateDisconnectWithin(t, manager); err == nil {
+		t.Errorf("expected error on InitiateDisconnect() before the Capabilities-Exchange completes, got none")
+	}
+}
+
+func TestConcurrentSendersDoNotInterleaveMessages(t *testing.T) {
+	const numberOfSenders = 20
+	const messagesPerSender = 50
+
+	clientTransport, serverTransport := net.Pipe()
+	defer clientTransport.Close()
+	defer serverTransport.Close()
+
+	clientEvents := make(chan *PeerStateEvent, 100)
+	serverEvents := make(chan *PeerStateEvent, 100)
+
+	go NewInitiatedPeerStateManager(testServerEntity(), serverTransport, serverEvents).NewRun()
+	go NewInitiatorPeerStateManager(testClientEntity(), &chunkingConn{clientTransport}, clientEvents).NewRun()
+
+	client := nextEventOfType(t, clientEvents, DiameterConnectionEstablishedEvent).Peer
+	nextEventOfType(t, serverEvents, DiameterConnectionEstablishedEvent)
+
+	go func() {
+		for range clientEvents {
+		}
+	}()
+
+	sendErrors := make(chan error, numberOfSenders*messagesPerSender)
+	for sender := 0; sender < numberOfSenders; sender++ {
+		go func(sender int) {
+			for i := 0; i < messagesPerSender; i++ {
+				ccr := diameter.NewMessage(diameter.MsgFlagRequest, 272, 4, 0, 0, []*diameter.AVP{
+					diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, fmt.Sprintf("client.example.com;%d", sender)),
+					diameter.NewTypedAVP(415, 0, true, diameter.Unsigned32, uint32(i)),
+				}, nil)
+				sendErrors <- client.SendMessage(ccr)
+			}
+		}(sender)
+	}
+
+	nextSequenceNumberBySender := make(map[string]uint32)
+	for received := 0; received < numberOfSenders*messagesPerSender; received++ {
+		m := nextEventOfType(t, serverEvents, MessageReceivedFromPeerEvent).Message
+
+		sessionIdAvp, sequenceNumberAvp := m.FirstAvpMatching(0, 263), m.FirstAvpMatching(0, 415)
+		if m.Code != 272 || len(m.Avps) != 2 || sessionIdAvp == nil || sequenceNumberAvp == nil {
+			t.Fatalf("expected well-formed CCR, got message with code (%d) and (%d) AVPs", m.Code, len(m.Avps))
+		}
+
+		sessionId := string(sessionIdAvp.Data)
+		sequenceNumber := diameter.MustConvertAVPDataToTypedData(sequenceNumberAvp.Data, diameter.Unsigned32).(uint32)
+		if sequenceNumber != nextSequenceNumberBySender[sessionId] {
+			t.Fatalf("expected message (%d) from sender (%s), got message (%d)", nextSequenceNumberBySender[sessionId], sessionId, sequenceNumber)
+		}
+		nextSequenceNumberBySender[sessionId]++
+	}
+
+	for i := 0; i < numberOfSenders*messagesPerSender; i++ {
+		if err := <-sendErrors; err != nil {
+			t.Fatalf("expected no error on SendMessage(), got = (%s)", err)
+		}
+	}
+}
+
+func TestDisconnectCauseFromDPRIsIncludedInConnectionClosedEvent(t *testing.T) {
+	for _, cause := range []DisconnectCause{DisconnectCauseRebooting, DisconnectCauseBusy, DisconnectCauseDoNotWantToTalkToYou} {
+		pair, err := NewInMemoryPeerPair(testClientEntity(), testServerEntity())
+		if err != nil {
+			t.Fatalf("expected no error on NewInMemoryPeerPair(), got = (%s)", err)
+		}
+
+		dpr := diameter.NewMessage(diameter.MsgFlagRequest, DisconnectPeerCode, 0, 1, 1, []*diameter.AVP{
+			diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "client.example.com"),
+			diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+			diameter.NewTypedAVP(273, 0, true, diameter.Enumerated, int32(cause)),
+		}, nil)
+
+		if _, err := pair.clientTransport.Write(dpr.Encode()); err != nil {
+			t.Fatalf("expected no error writing DPR to transport, got = (%s)", err)
+		}
+
+		closedEvent := nextEventOfType(t, pair.ServerEvents, DiameterConnectionClosedEvent)
+		if closedEvent.DisconnectCause == nil {
+			t.Errorf("expected DiameterConnectionClosedEvent to carry Disconnect-Cause (%d), got nil", cause)
+		} else if *closedEvent.DisconnectCause != cause {
+			t.Errorf("expected DiameterConnectionClosedEvent to carry Disconnect-Cause (%d), got (%d)", cause, *closedEvent.DisconnectCause)
+		}
+
+		pair.Close()
+	}
+}
+
+func TestConnectionClosedEventHasNoDisconnectCauseWhenDPRHasNone(t *testing.T) {
+	pair, err := NewInMemoryPeerPair(testClientEntity(), testServerEntity())
+	if err != nil {
+		t.Fatalf("expected no error on NewInMemoryPeerPair(), got = (%s)", err)
+	}
+	defer pair.Close()
+
+	dpr := diameter.NewMessage(diameter.MsgFlagRequest, DisconnectPeerCode, 0, 1, 1, []*diameter.AVP{
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "client.example.com"),
+		diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+	}, nil)
+
+	if _, err := pair.clientTransport.Write(dpr.Encode()); err != nil {
+		t.Fatalf("expected no error writing DPR to transport, got = (%s)", err)
+	}
+
+	if closedEvent := nextEventOfType(t, pair.ServerEvents, DiameterConnectionClosedEvent); closedEvent.DisconnectCause != nil {
+		t.Errorf("expected no Disconnect-Cause on DiameterConnectionClosedEvent, got (%d)", *closedEvent.DisconnectCause)
+	}
+}
+
+func TestPeerInitiatedDisconnectEventPrecedesConnectionClosedEventOnDPR(t *testing.T) {
+	pair, err := NewInMemoryPeerPair(testClientEntity(), testServerEntity())
+	if err != nil {
+		t.Fatalf("expected no error on NewInMemoryPeerPair(), got = (%s)", err)
+	}
+	defer pair.Close()
+
+	dpr := diameter.NewMessage(diameter.MsgFlagRequest, DisconnectPeerCode, 0, 1, 1, []*diameter.AVP{
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "client.example.com"),
+		diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+		diameter.NewTypedAVP(273, 0, true, diameter.Enumerated, int32(DisconnectCauseDoNotWantToTalkToYou)),
+	}, nil)
+
+	if _, err := pair.clientTransport.Write(dpr.Encode()); err != nil {
+		t.Fatalf("expected no error writing DPR to transport, got = (%s)", err)
+	}
+
+	disconnectEvent := nextEventOfType(t, pair.ServerEvents, PeerInitiatedDisconnectEvent)
+	if disconnectEvent.DisconnectCause == nil || *disconnectEvent.DisconnectCause != DisconnectCauseDoNotWantToTalkToYou {
+		t.Errorf("expected PeerInitiatedDisconnectEvent to carry Disconnect-Cause (%d), got (%v)", DisconnectCauseDoNotWantToTalkToYou, disconnectEvent.DisconnectCause)
+	}
+	if disconnectEvent.Message == nil || disconnectEvent.Message.Code != DisconnectPeerCode {
+		t.Errorf("expected PeerInitiatedDisconnectEvent to carry the DPR")
+	}
+	if disconnectEvent.Peer != pair.ServerPeer {
+		t.Errorf("expected PeerInitiatedDisconnectEvent to carry the server side Peer")
+	}
+
+	nextEventOfType(t, pair.ServerEvents, DiameterConnectionClosedEvent)
+}
+
+func TestAbruptTransportCloseDoesNotRaisePeerInitiatedDisconnectEvent(t *testing.T) {
+	pair, err := NewInMemoryPeerPair(testClientEntity(), testServerEntity())
+	if err != nil {
+		t.Fatalf("expected no error on NewInMemoryPeerPair(), got = (%s)", err)
+	}
+	defer pair.Close()
+
+	pair.clientTransport.Close()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-pair.ServerEvents:
+			switch event.Type {
+			case PeerInitiatedDisconnectEvent:
+				t.Fatalf("expected no PeerInitiatedDisconnectEvent when the transport is closed abruptly")
+			case PeerClosedTransportEvent:
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for PeerClosedTransportEvent")
+		}
+	}
+}
+
+type peerStateTransition struct {
+	from string
+	to   string
+}
+
+// runManagerPairRecordingServerTransitions is runManagerPair with a state transition callback on the
+// server manager that sends each transition to the returned channel.
+func runManagerPairRecordingServerTransitions(t *testing.T) (clientEvents <-chan *PeerStateEvent, serverEvents <-chan *PeerStateEvent, serverTransitions <-chan peerStateTransition) {
+	t.Helper()
+
+	transitions := make(chan peerStateTransition, 10)
+	clientEvents, serverEvents = runManagerPair(t, testServerEntity(), func(server *PeerStateManager) {
+		server.SetStateTransitionCallback(func(peer *Peer, from string, to string) {
+			if peer == nil || peer.Identity.OriginHost != "client.example.com" {
+				t.Errorf("expected transition callback to receive the client Peer")
+			}
+			transitions <- peerStateTransition{from, to}
+		})
+	})
+
+	return clientEvents, serverEvents, transitions
+}
+
+func expectPeerStateTransitions(t *testing.T, transitions <-chan peerStateTransition, expected ...peerStateTransition) {
+	t.Helper()
+
+	for i, expectedTransition := range expected {
+		select {
+		case transition := <-transitions:
+			if transition != expectedTransition {
+				t.Errorf("expected transition (%d) to be (%s -> %s), got (%s -> %s)", i+1, expectedTransition.from, expectedTransition.to, transition.from, transition.to)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for transition (%d) (%s -> %s)", i+1, expectedTransition.from, expectedTransition.to)
+		}
+	}
+
+	select {
+	case transition := <-transitions:
+		t.Errorf("expected no further transitions, got (%s -> %s)", transition.from, transition.to)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStateTransitionCallbackWhenTheTransportIsClosedAbruptly(t *testing.T) {
+	clientEvents, serverEvents, serverTransitions := runManagerPairRecordingServerTransitions(t)
+
+	client := nextEventOfType(t, clientEvents, DiameterConnectionEstablishedEvent).Peer
+	nextEventOfType(t, serverEvents, DiameterConnectionEstablishedEvent)
+
+	client.transport.Close()
+
+	nextEventOfType(t, serverEvents, PeerClosedTransportEvent)
+	expectPeerStateTransitions(t, serverTransitions, peerStateTransition{PeerStateNameConnected, PeerStateNameDisconnected})
+}
+
+func TestStateTransitionCallbackOnDisconnectInitiatedByPeer(t *testing.T) {
+	clientEvents, serverEvents, serverTransitions := runManagerPairRecordingServerTransitions(t)
+
+	client := nextEventOfType(t, clientEvents, DiameterConnectionEstablishedEvent).Peer
+	nextEventOfType(t, serverEvents, DiameterConnectionEstablishedEvent)
+
+	if err := client.InitiateDisconnect(); err != nil {
+		t.Fatalf("expected no error on InitiateDisconnect(), got = (%s)", err)
+	}
+
+	expectPeerStateTransitions(t, serverTransitions, peerStateTransition{PeerStateNameConnected, PeerStateNameDisconnected})
+}
+
+func TestStateTransitionCallbackOnDisconnectInitiatedLocally(t *testing.T) {
+	clientEvents, serverEvents, serverTransitions := runManagerPairRecordingServerTransitions(t)
+
+	nextEventOfType(t, clientEvents, DiameterConnectionEstablishedEvent)
+	server := nextEventOfType(t, serverEvents, DiameterConnectionEstablishedEvent).Peer
+
+	if err := server.InitiateDisconnect(); err != nil {
+		t.Fatalf("expected no error on InitiateDisconnect(), got = (%s)", err)
+	}
+
+	expectPeerStateTransitions(t, serverTransitions,
+		peerStateTransition{PeerStateNameConnected, PeerStateNameHalfClosed},
+		peerStateTransition{PeerStateNameHalfClosed, PeerStateNameDisconnected},
+	)
+}
+
+func TestCapabilitiesExchangeIncludesEveryHostIPAddress(t *testing.T) {
+	entity := testClientEntity()
+	addresses := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("192.168.1.1"), net.ParseIP("172.16.0.1")}
+	entity.HostIPAddresses = []*net.IP{&addresses[0], &addresses[1], &addresses[2]}
+
+	manager := newTestPeerStateManager(t, entity)
+	if len(manager.cachedAVPs.HostIPAddresses) != len(addresses) {
+		t.Errorf("expected (%d) cached Host-IP-Address AVPs, got (%d)", len(addresses), len(manager.cachedAVPs.HostIPAddresses))
+	}
+
+	cer := manager.generateCER()
+	for name, m := range map[string]*diameter.Message{"CER": cer, "CEA": manager.generateCEA(cer)} {
+		hostIpAddressAvps := m.TopLevelAvpsMatching(0, 257)
+		if len(hostIpAddressAvps) != len(addresses) {
+			t.Errorf("expected (%d) Host-IP-Address AVPs in %s, got (%d)", len(addresses), name, len(hostIpAddressAvps))
+			continue
+		}
+
+		for i, avp := range hostIpAddressAvps {
+			if !bytes.Equal(avp.Data, diameter.NewAddressTypeFromIP(addresses[i])) {
+				t.Errorf("expected Host-IP-Address (%d) in %s to be (%s)", i+1, name, addresses[i])
+			}
+		}
+	}
+
+	peerIdentity, err := DiameterEntityFromCapabilitiesExchangeMessage(cer)
+	if err != nil {
+		t.Fatalf("expected no error on DiameterEntityFromCapabilitiesExchangeMessage(), got = (%s)", err)
+	}
+	if len(peerIdentity.HostIPAddresses) != len(addresses) {
+		t.Errorf("expected (%d) Host-IP-Addresses extracted from CER, got (%d)", len(addresses), len(peerIdentity.HostIPAddresses))
+	}
+}
+
+// runServerWithRawClient runs an initiated manager for serverEntity over a net.Pipe, and completes the
+// capabilities exchange from the other end of the pipe, without a manager, using clientEntity.  The
+// messages sent by the server after the CEA are delivered to the returned channel.
+func runServerWithRawClient(t *testing.T, serverEntity *DiameterEntity, clientEntity *DiameterEntity, configureServer func(server *PeerStateManager)) (clientTransport net.Conn, fromServer <-chan *diameter.Message, serverEvents <-chan *PeerStateEvent) {
+	t.Helper()
+
+	clientTransport, serverTransport := net.Pipe()
+	t.Cleanup(func() {
+		clientTransport.Close()
+		serverTransport.Close()
+	})
+
+	serverEventChannel := make(chan *PeerStateEvent, 100)
+	serverManager := NewInitiatedPeerStateManager(serverEntity, serverTransport, serverEventChannel)
+	configureServer(serverManager)
+	go serverManager.NewRun()
+
+	messagesFromServer := messagesReadFrom(clientTransport)
+
+	if _, err := clientTransport.Write(capabilitiesExchangeRequestFrom(clientEntity, 1).Encode()); err != nil {
+		t.Fatalf("expected no error writing CER, got = (%s)", err)
+	}
+	if cea := nextMessageFromServer(t, messagesFromServer); cea.Code != CapabilitiesExchangeCode || cea.IsRequest() {
+		t.Fatalf("expected CEA from server, got message with code (%d)", cea.Code)
+	}
+	nextEventOfType(t, serverEventChannel, DiameterConnectionEstablishedEvent)
+
+	return clientTransport, messagesFromServer, serverEventChannel
+}
+
+// messagesReadFrom reads messages from conn in a new goroutine and delivers them to the returned channel,
+// which is closed when a read fails (e.g., because conn is closed).
+func messagesReadFrom(conn net.Conn) <-chan *diameter.Message {
+	messages := make(chan *diameter.Message, 10)
+	go func() {
+		reader := diameter.NewMessageStreamReader(conn)
+		for {
+			m, err := reader.ReadNextMessage()
+			if err != nil {
+				close(messages)
+				return
+			}
+			messages <- m
+		}
+	}()
+
+	return messages
+}
+
+func capabilitiesExchangeRequestFrom(entity *DiameterEntity, hopByHopID uint32) *diameter.Message {
+	return diameter.NewMessage(diameter.MsgFlagRequest, CapabilitiesExchangeCode, 0, hopByHopID, hopByHopID, entity.CapabilitiesExchangeMandatoryAvps(), entity.CapabilitiesExchangeOptionalAvps())
+}
+
+func nextMessageFromServer(t *testing.T, messages <-chan *diameter.Message) *diameter.Message {
+	t.Helper()
+
+	select {
+	case m, ok := <-messages:
+		if !ok {
+			t.Fatalf("expected message from server, but the transport was closed")
+		}
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for message from server")
+	}
+
+	return nil
+}
+
+func TestCERFromConnectedPeerUpdatesCapabilitiesWhenAccepted(t *testing.T) {
+	serverEntity := testServerEntity()
+	serverEntity.AuthApplicationIDs = []uint32{4}
+
+	clientTransport, fromServer, serverEvents := runServerWithRawClient(t, serverEntity, testClientEntity(), func(server *PeerStateManager) {
+		server.SetAcceptCapabilitiesUpdates(true)
+	})
+
+	updatedClientEntity := testClientEntity()
+	updatedClientEntity.ProductName = "test-client-v2"
+	updatedClientEntity.AuthApplicationIDs = []uint32{4, 16777238}
+
+	if _, err := clientTransport.Write(capabilitiesExchangeRequestFrom(updatedClientEntity, 2).Encode()); err != nil {
+		t.Fatalf("expected no error writing second CER, got = (%s)", err)
+	}
+
+	cea := nextMessageFromServer(t, fromServer)
+	if cea.Code != CapabilitiesExchangeCode || cea.IsRequest() || cea.HopByHopID != 2 {
+		t.Fatalf("expected CEA answering the second CER, got code (%d), hop-by-hop-id (%d)", cea.Code, cea.HopByHopID)
+	}
+	expectExactlyOneAvpWithValue(t, cea, 268, diameter.Unsigned32, uint32(2001))
+
+	updatedEvent := nextEventOfType(t, serverEvents, PeerCapabilitiesUpdatedEvent)
+	updated := updatedEvent.UpdatedCapabilities
+	if updated == nil {
+		t.Fatalf("expected UpdatedCapabilities on PeerCapabilitiesUpdatedEvent, got nil")
+	}
+	if updated.Identity.ProductName != "test-client-v2" {
+		t.Errorf("expected updated peer Product-Name (test-client-v2), got (%s)", updated.Identity.ProductName)
+	}
+	if len(updated.CommonAuthApplicationIDs) != 1 || updated.CommonAuthApplicationIDs[0] != 4 {
+		t.Errorf("expected updated common Auth-Application-Ids ([4]), got (%v)", updated.CommonAuthApplicationIDs)
+	}
+	if updatedEvent.Peer.Identity.ProductName != testClientEntity().ProductName {
+		t.Errorf("expected Peer to be unchanged by the capabilities update, got Product-Name (%s)", updatedEvent.Peer.Identity.ProductName)
+	}
+
+	if _, err := clientTransport.Write(diameter.NewMessage(diameter.MsgFlagRequest, DeviceWatchdogCode, 0, 3, 3, []*diameter.AVP{
+		updatedClientEntity.OriginHostAvp(), updatedClientEntity.OriginRealmAvp(),
+	}, nil).Encode()); err != nil {
+		t.Fatalf("expected no error writing DWR, got = (%s)", err)
+	}
+	if dwa := nextMessageFromServer(t, fromServer); dwa.Code != DeviceWatchdogCode || dwa.IsRequest() {
+		t.Errorf("expected connection to remain up and DWR to be answered, got code (%d)", dwa.Code)
+	}
+}
+
+func TestCERFromConnectedPeerDisconnectsByDefault(t *testing.T) {
+	clientTransport, fromServer, serverEvents := runServerWithRawClient(t, testServerEntity(), testClientEntity(), func(server *PeerStateManager) {})
+
+	if _, err := clientTransport.Write(capabilitiesExchangeRequestFrom(testClientEntity(), 2).Encode()); err != nil {
+		t.Fatalf("expected no error writing second CER, got = (%s)", err)
+	}
+
+	if dpr := nextMessageFromServer(t, fromServer); dpr.Code != DisconnectPeerCode || !dpr.IsRequest() {
+		t.Errorf("expected DPR from server, got message with code (%d)", dpr.Code)
+	}
+	nextEventOfType(t, serverEvents, DiameterConnectionClosedEvent)
+}
+
+func TestCERWithDifferentOriginHostDisconnectsEvenWhenUpdatesAreAccepted(t *testing.T) {
+	clientTransport, fromServer, serverEvents := runServerWithRawClient(t, testServerEntity(), testClientEntity(), func(server *PeerStateManager) {
+		server.SetAcceptCapabilitiesUpdates(true)
+	})
+
+	otherEntity := testClientEntity()
+	otherEntity.OriginHost = "other.example.com"
+	if _, err := clientTransport.Write(capabilitiesExchangeRequestFrom(otherEntity, 2).Encode()); err != nil {
+		t.Fatalf("expected no error writing second CER, got = (%s)", err)
+	}
+
+	if dpr := nextMessageFromServer(t, fromServer); dpr.Code != DisconnectPeerCode || !dpr.IsRequest() {
+		t.Errorf("expected DPR from server, got message with code (%d)", dpr.Code)
+	}
+	nextEventOfType(t, serverEvents, DiameterConnectionClosedEvent)
+}
@@ -0,0 +1,369 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/blorticus-go/diameter"
+)
+
+func TestDiameterEntityFromRichCapabilitiesExchangeRequest(t *testing.T) {
+	cer := diameter.NewMessage(diameter.MsgFlagRequest, CapabilitiesExchangeCode, 0, 1, 1, []*diameter.AVP{
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "peer.example.com"),
+		diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+		diameter.NewTypedAVP(257, 0, true, diameter.Address, net.ParseIP("10.1.1.1")),
+		diameter.NewTypedAVP(266, 0, true, diameter.Unsigned32, uint32(10415)),
+		diameter.NewTypedAVP(269, 0, true, diameter.UTF8String, "peer-product"),
+	}, []*diameter.AVP{
+		diameter.NewTypedAVP(278, 0, true, diameter.Unsigned32, uint32(1700000000)),
+		diameter.NewTypedAVP(265, 0, true, diameter.Unsigned32, uint32(10415)),
+		diameter.NewTypedAVP(265, 0, true, diameter.Unsigned32, uint32(5535)),
+		diameter.NewTypedAVP(258, 0, true, diameter.Unsigned32, uint32(4)),
+		diameter.NewTypedAVP(258, 0, true, diameter.Unsigned32, uint32(16777238)),
+		diameter.NewTypedAVP(259, 0, true, diameter.Unsigned32, uint32(3)),
+		diameter.NewTypedAVP(267, 0, false, diameter.Unsigned32, uint32(102)),
+	})
+
+	decodedCer, err := diameter.DecodeMessage(cer.Encode())
+	if err != nil {
+		t.Fatalf("failed to decode CER: %s", err)
+	}
+
+	e, err := DiameterEntityFromCapabilitiesExchangeMessage(decodedCer)
+	if err != nil {
+		t.Fatalf("expected no error, got = (%s)", err)
+	}
+
+	if e.OriginHost != "peer.example.com" || e.OriginRealm != "example.com" || e.VendorID != 10415 || e.ProductName != "peer-product" {
+		t.Errorf("mandatory values not properly extracted: %+v", e)
+	}
+	if e.FirmwareRevision != 102 {
+		t.Errorf("expected FirmwareRevision = 102, got = %d", e.FirmwareRevision)
+	}
+	if e.OriginStateID != 1700000000 {
+		t.Errorf("expected OriginStateID = 1700000000, got = %d", e.OriginStateID)
+	}
+	if !slices.Equal(e.SupportedVendorIDs, []uint32{10415, 5535}) {
+		t.Errorf("expected SupportedVendorIDs = [10415 5535], got = %v", e.SupportedVendorIDs)
+	}
+	if !slices.Equal(e.AuthApplicationIDs, []uint32{4, 16777238}) {
+		t.Errorf("expected AuthApplicationIDs = [4 16777238], got = %v", e.AuthApplicationIDs)
+	}
+	if !slices.Equal(e.AcctApplicationIDs, []uint32{3}) {
+		t.Errorf("expected AcctApplicationIDs = [3], got = %v", e.AcctApplicationIDs)
+	}
+}
+
+func TestDiameterEntityFromCapabilitiesExchangeRequestWithoutOptionalAvps(t *testing.T) {
+	cer := diameter.NewMessage(diameter.MsgFlagRequest, CapabilitiesExchangeCode, 0, 1, 1, []*diameter.AVP{
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "peer.example.com"),
+		diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+		diameter.NewTypedAVP(257, 0, true, diameter.Address, net.ParseIP("10.1.1.1")),
+		diameter.NewTypedAVP(266, 0, true, diameter.Unsigned32, uint32(0)),
+		diameter.NewTypedAVP(269, 0, true, diameter.UTF8String, "peer-product"),
+	}, nil)
+
+	e, err := DiameterEntityFromCapabilitiesExchangeMessage(cer)
+	if err != nil {
+		t.Fatalf("expected no error, got = (%s)", err)
+	}
+
+	if e.FirmwareRevision != 0 || e.OriginStateID != 0 {
+		t.Errorf("expected FirmwareRevision and OriginStateID to be 0, got = %d and %d", e.FirmwareRevision, e.OriginStateID)
+	}
+	if len(e.SupportedVendorIDs) != 0 || len(e.AuthApplicationIDs) != 0 || len(e.AcctApplicationIDs) != 0 {
+		t.Errorf("expected no Supported-Vendor-Ids or Application-Ids, got = %+v", e)
+	}
+}
+
+func TestCapabilitiesExchangeOptionalAvpsIncludesFirmwareRevisionOnlyWhenSet(t *testing.T) {
+	withoutFirmwareRevision := testClientEntity()
+	for _, avp := range withoutFirmwareRevision.CapabilitiesExchangeOptionalAvps() {
+		if avp.Code == 267 {
+			t.Errorf("expected no Firmware-Revision when FirmwareRevision is 0")
+		}
+	}
+
+	withFirmwareRevision := testClientEntity()
+	withFirmwareRevision.FirmwareRevision = 102
+	withFirmwareRevision.AcctApplicationIDs = []uint32{3}
+
+	optionalAvps := withFirmwareRevision.CapabilitiesExchangeOptionalAvps()
+	if len(optionalAvps) != 2 {
+		t.Fatalf("expected 2 optional AVPs, got (%d)", len(optionalAvps))
+	}
+
+	firmwareRevisionAvp := optionalAvps[1]
+	if !firmwareRevisionAvp.Equal(diameter.NewTypedAVP(267, 0, false, diameter.Unsigned32, uint32(102))) {
+		t.Errorf("expected last optional AVP to be Firmware-Revision (102) without the M-bit, got AVP with code (%d)", firmwareRevisionAvp.Code)
+	}
+}
+
+func TestFirmwareRevisionIsExchangedInCapabilitiesExchange(t *testing.T) {
+	clientEntity := testClientEntity()
+	clientEntity.FirmwareRevision = 7
+	serverEntity := testServerEntity()
+	serverEntity.FirmwareRevision = 8
+
+	pair, err := NewInMemoryPeerPair(clientEntity, serverEntity)
+	if err != nil {
+		t.Fatalf("expected no error on NewInMemoryPeerPair(), got = (%s)", err)
+	}
+	defer pair.Close()
+
+	if pair.ClientPeer.Identity.FirmwareRevision != 8 {
+		t.Errorf("expected client side to see server FirmwareRevision = 8, got = %d", pair.ClientPeer.Identity.FirmwareRevision)
+	}
+	if pair.ServerPeer.Identity.FirmwareRevision != 7 {
+		t.Errorf("expected server side to see client FirmwareRevision = 7, got = %d", pair.ServerPeer.Identity.FirmwareRevision)
+	}
+}
+
+func TestDefaultProductNameIsUsedWhenProductNameIsEmpty(t *testing.T) {
+	if !strings.HasPrefix(DefaultProductName, "diameter-go") {
+		t.Errorf("expected DefaultProductName to start with diameter-go, got = (%s)", DefaultProductName)
+	}
+
+	clientEntity := testClientEntity()
+	clientEntity.ProductName = ""
+
+	for _, avp := range clientEntity.CapabilitiesExchangeMandatoryAvps() {
+		if avp.Code == 269 && !avp.Equal(diameter.NewTypedAVP(269, 0, true, diameter.UTF8String, DefaultProductName)) {
+			t.Errorf("expected Product-Name to be (%s), got = (%s)", DefaultProductName, string(avp.Data))
+		}
+	}
+
+	pair, err := NewInMemoryPeerPair(clientEntity, testServerEntity())
+	if err != nil {
+		t.Fatalf("expected no error on NewInMemoryPeerPair(), got = (%s)", err)
+	}
+	defer pair.Close()
+
+	if pair.ServerPeer.Identity.ProductName != DefaultProductName {
+		t.Errorf("expected server side to see client ProductName = (%s) in CER, got = (%s)", DefaultProductName, pair.ServerPeer.Identity.ProductName)
+	}
+	if pair.ClientPeer.Identity.ProductName != testServerEntity().ProductName {
+		t.Errorf("expected client side to see server ProductName = (%s) in CEA, got = (%s)", testServerEntity().ProductName, pair.ClientPeer.Identity.ProductName)
+	}
+}
+
+func TestDeriveOriginRealmIfUnset(t *testing.T) {
+	testCases := []struct {
+		originHost          string
+		originRealm         string
+		expectError         bool
+		expectedOriginRealm string
+	}{
+		{"host.example.com", "", false, "example.com"},
+		{"host.example.com", "other.example.com", false, "other.example.com"},
+		{"host", "example.com", false, "example.com"},
+		{"host", "", true, ""},
+		{"host.", "", true, ""},
+		{".example.com", "", true, ""},
+		{"", "", true, ""},
+	}
+
+	for i, testCase := range testCases {
+		entity := &DiameterEntity{OriginHost: testCase.originHost, OriginRealm: testCase.originRealm}
+
+		err := entity.DeriveOriginRealmIfUnset()
+		if testCase.expectError && err == nil {
+			t.Errorf("(test case %d) expected error for Origin-Host (%s), got none", i+1, testCase.originHost)
+		} else if !testCase.expectError && err != nil {
+			t.Errorf("(test case %d) expected no error, got = (%s)", i+1, err)
+		}
+
+		if entity.OriginRealm != testCase.expectedOriginRealm {
+			t.Errorf("(test case %d) expected OriginRealm = (%s), got = (%s)", i+1, testCase.expectedOriginRealm, entity.OriginRealm)
+		}
+	}
+
+	entity := &DiameterEntity{OriginHost: "host.example.com"}
+	if err := entity.DeriveOriginRealmIfUnset(); err != nil {
+		t.Fatalf("expected no error on DeriveOriginRealmIfUnset(), got = (%s)", err)
+	}
+	if !entity.OriginRealmAvp().Equal(diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com")) {
+		t.Errorf("expected Origin-Realm AVP with the derived realm (example.com)")
+	}
+}
+
+func TestApplicationIDsInCommonWith(t *testing.T) {
+	local := &DiameterEntity{AuthApplicationIDs: []uint32{4, 16777238}, AcctApplicationIDs: []uint32{3}}
+
+	auth, acct := local.ApplicationIDsInCommonWith(&DiameterEntity{AuthApplicationIDs: []uint32{16777238, 1}})
+	if !slices.Equal(auth, []uint32{16777238}) || len(acct) != 0 {
+		t.Errorf("expected auth = [16777238] and acct = [], got auth = %v, acct = %v", auth, acct)
+	}
+
+	auth, acct = local.ApplicationIDsInCommonWith(&DiameterEntity{AuthApplicationIDs: []uint32{RelayApplicationId}, AcctApplicationIDs: []uint32{RelayApplicationId}})
+	if !slices.Equal(auth, []uint32{4, 16777238}) || !slices.Equal(acct, []uint32{3}) {
+		t.Errorf("expected relay peer to share all local applications, got auth = %v, acct = %v", auth, acct)
+	}
+}
+
+func TestPeerSendAnswerCorrelatesToRequest(t *testing.T) {
+	pair, err := NewInMemoryPeerPair(testClientEntity(), testServerEntity())
+	if err != nil {
+		t.Fatalf("expected no error on NewInMemoryPeerPair(), got = (%s)", err)
+	}
+	defer pair.Close()
+
+	ccr := testCreditControlRequest()
+	if err := pair.ClientPeer.SendMessage(ccr); err != nil {
+		t.Fatalf("expected no error on SendMessage(ccr), got = (%s)", err)
+	}
+
+	receivedCcr := nextEventOfType(t, pair.ServerEvents, MessageReceivedFromPeerEvent).Message
+
+	if err := pair.ServerPeer.SendAnswer(receivedCcr, []*diameter.AVP{
+		diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2001)),
+	}, nil); err != nil {
+		t.Fatalf("expected no error on SendAnswer(), got = (%s)", err)
+	}
+
+	cca := nextEventOfType(t, pair.ClientEvents, MessageReceivedFromPeerEvent).Message
+
+	if cca.IsRequest() || cca.Code != ccr.Code || cca.AppID != ccr.AppID || cca.HopByHopID != ccr.HopByHopID || cca.EndToEndID != ccr.EndToEndID {
+		t.Errorf("expected answer correlated to CCR, got message with code (%d), appId (%d), hop-by-hop-id (%d), end-to-end-id (%d)", cca.Code, cca.AppID, cca.HopByHopID, cca.EndToEndID)
+	}
+	if len(cca.Avps) != 2 || cca.Avps[0].Code != 263 || string(cca.Avps[0].Data) != "client.example.com;1;1" {
+		t.Errorf("expected Session-Id from request as the first of two AVPs, got = %v", cca.Avps)
+	}
+
+	if err := pair.ServerPeer.SendAnswer(cca, nil, nil); err == nil {
+		t.Errorf("expected error on SendAnswer() for an answer message, got none")
+	}
+}
+
+func TestDisconnectCauseReconnectionPolicy(t *testing.T) {
+	testCases := []struct {
+		cause    DisconnectCause
+		expected ReconnectionPolicy
+	}{
+		{DisconnectCauseRebooting, ReconnectAfterDelay},
+		{DisconnectCauseBusy, ReconnectNormally},
+		{DisconnectCauseDoNotWantToTalkToYou, DoNotReconnect},
+		{DisconnectCause(100), ReconnectNormally},
+	}
+
+	for _, testCase := range testCases {
+		if policy := testCase.cause.ReconnectionPolicy(); policy != testCase.expected {
+			t.Errorf("expected ReconnectionPolicy() = (%d) for Disconnect-Cause (%d), got = (%d)", testCase.expected, testCase.cause, policy)
+		}
+	}
+}
+
+func TestDisconnectCauseFromDPR(t *testing.T) {
+	dpr := diameter.NewMessage(diameter.MsgFlagRequest, DisconnectPeerCode, 0, 1, 1, []*diameter.AVP{
+		diameter.NewTypedAVP(273, 0, true, diameter.Enumerated, int32(DisconnectCauseDoNotWantToTalkToYou)),
+	}, nil)
+
+	if cause, ok := DisconnectCauseFromDPR(dpr); !ok || cause != DisconnectCauseDoNotWantToTalkToYou {
+		t.Errorf("expected Disconnect-Cause (%d), got (%d) with ok = (%t)", DisconnectCauseDoNotWantToTalkToYou, cause, ok)
+	}
+
+	if _, ok := DisconnectCauseFromDPR(diameter.NewMessage(diameter.MsgFlagRequest, DisconnectPeerCode, 0, 1, 1, nil, nil)); ok {
+		t.Errorf("expected ok = false for DPR without Disconnect-Cause")
+	}
+
+	malformed := diameter.NewMessage(diameter.MsgFlagRequest, DisconnectPeerCode, 0, 1, 1, []*diameter.AVP{
+		diameter.NewAVP(273, 0, true, []byte{0, 1}),
+	}, nil)
+	if _, ok := DisconnectCauseFromDPR(malformed); ok {
+		t.Errorf("expected ok = false for DPR with malformed Disconnect-Cause")
+	}
+}
+
+func TestPeerUserData(t *testing.T) {
+	peer := NewPeer(testClientEntity(), nil, nil)
+
+	if _, ok := peer.UserData("sessions"); ok {
+		t.Errorf("expected no value before SetUserData()")
+	}
+
+	peer.SetUserData("sessions", 1)
+	peer.SetUserData("sessions", 2)
+	if v, ok := peer.UserData("sessions"); !ok || v != 2 {
+		t.Errorf("expected (2, true) from UserData(), got (%v, %t)", v, ok)
+	}
+
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			key := fmt.Sprintf("key-%d", i%5)
+			for j := 0; j < 100; j++ {
+				peer.SetUserData(key, j)
+				if _, ok := peer.UserData(key); !ok {
+					t.Errorf("expected a value for (%s) after SetUserData()", key)
+					return
+				}
+			}
+		}(i)
+	}
+	waitGroup.Wait()
+
+	for i := 0; i < 5; i++ {
+		if v, ok := peer.UserData(fmt.Sprintf("key-%d", i)); !ok || v != 99 {
+			t.Errorf("expected (99, true) for key-%d, got (%v, %t)", i, v, ok)
+		}
+	}
+}
+
+func TestPeerAddressesMatchTheTransport(t *testing.T) {
+	listener := listenOnLoopback(t)
+
+	serverConnChannel := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Errorf("failed to accept connection: %s", err)
+			close(serverConnChannel)
+			return
+		}
+		serverConnChannel <- conn
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to (%s): %s", listener.Addr().String(), err)
+	}
+	t.Cleanup(func() { clientConn.Close() })
+
+	serverConn := <-serverConnChannel
+	if serverConn == nil {
+		t.FailNow()
+	}
+	t.Cleanup(func() { serverConn.Close() })
+
+	clientEvents := make(chan *PeerStateEvent, 100)
+	serverEvents := make(chan *PeerStateEvent, 100)
+	go NewInitiatedPeerStateManager(testServerEntity(), serverConn, serverEvents).NewRun()
+	go NewInitiatorPeerStateManager(testClientEntity(), clientConn, clientEvents).NewRun()
+
+	for _, testCase := range []struct {
+		side string
+		peer *Peer
+		conn net.Conn
+	}{
+		{"client", nextEventOfType(t, clientEvents, DiameterConnectionEstablishedEvent).Peer, clientConn},
+		{"server", nextEventOfType(t, serverEvents, DiameterConnectionEstablishedEvent).Peer, serverConn},
+	} {
+		if testCase.peer.LocalAddr().String() != testCase.conn.LocalAddr().String() {
+			t.Errorf("[%s] expected LocalAddr() = (%s), got (%s)", testCase.side, testCase.conn.LocalAddr().String(), testCase.peer.LocalAddr().String())
+		}
+		if testCase.peer.RemoteAddr().String() != testCase.conn.RemoteAddr().String() {
+			t.Errorf("[%s] expected RemoteAddr() = (%s), got (%s)", testCase.side, testCase.conn.RemoteAddr().String(), testCase.peer.RemoteAddr().String())
+		}
+	}
+
+	peerWithoutTransport := NewPeer(testClientEntity(), nil, nil)
+	if peerWithoutTransport.LocalAddr() != nil || peerWithoutTransport.RemoteAddr() != nil {
+		t.Errorf("expected nil LocalAddr() and RemoteAddr() for Peer without a transport")
+	}
+}
@@ -0,0 +1,281 @@
+package agent
+
+import (
+	"container/heap"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blorticus-go/diameter"
+)
+
+// RedirectHostUsage is a value for the Redirect-Host-Usage AVP (code 261) in a redirect answer.  It
+// indicates which subsequent requests the redirect applies to (RFC 6733 section 6.13).
+type RedirectHostUsage int32
+
+// RedirectHostUsage values (RFC 6733 section 6.13).
+const (
+	RedirectHostUsageDontCache           RedirectHostUsage = 0
+	RedirectHostUsageAllSession          RedirectHostUsage = 1
+	RedirectHostUsageAllRealm            RedirectHostUsage = 2
+	RedirectHostUsageRealmAndApplication RedirectHostUsage = 3
+	RedirectHostUsageAllApplication      RedirectHostUsage = 4
+	RedirectHostUsageAllHost             RedirectHostUsage = 5
+	RedirectHostUsageAllUser             RedirectHostUsage = 6
+)
+
+// ResultCodeRedirectIndication is the Result-Code (3006, DIAMETER_REDIRECT_INDICATION) of an answer
+// from a redirect agent.
+const ResultCodeRedirectIndication uint32 = 3006
+
+// RedirectCache remembers the Redirect-Host targets in redirect answers for as long as the answer
+// allows (its Redirect-Max-Cache-Time), so that subsequent requests to which the redirect applies can
+// be sent directly to the targets, rather than to the redirect agent.  The requests to which a redirect
+// applies are set by the Redirect-Host-Usage in the answer: those with the same Session-Id,
+// Destination-Realm, Destination-Realm and Application-Id, Application-Id, Destination-Host or
+// User-Name as the request that was redirected.  A redirect is kept until its Redirect-Max-Cache-Time
+// elapses, or until it is the redirect that expires soonest and room is needed for a new one.  A
+// RedirectCache is safe for concurrent use.
+type RedirectCache struct {
+	maxEntries int
+	now        func() time.Time
+
+	mutex           sync.Mutex
+	entriesByKey    map[redirectCacheKey]*redirectCacheEntry
+	entriesByExpiry redirectCacheExpiryHeap
+}
+
+// redirectCacheKey identifies the requests to which a redirect applies.  Only the fields relevant to
+// usage are set.
+type redirectCacheKey struct {
+	usage         RedirectHostUsage
+	value         string
+	applicationID uint32
+}
+
+type redirectCacheEntry struct {
+	key     redirectCacheKey
+	targets []*diameter.DiameterURI
+	expires time.Time
+	// heapIndex is the index of the entry in RedirectCache.entriesByExpiry.
+	heapIndex int
+}
+
+// redirectCacheExpiryHeap orders redirect cache entries by expiry, soonest first.  It implements
+// heap.Interface.
+type redirectCacheExpiryHeap []*redirectCacheEntry
+
+func (h redirectCacheExpiryHeap) Len() int           { return len(h) }
+func (h redirectCacheExpiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+
+func (h redirectCacheExpiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex, h[j].heapIndex = i, j
+}
+
+func (h *redirectCacheExpiryHeap) Push(x any) {
+	entry := x.(*redirectCacheEntry)
+	entry.heapIndex = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *redirectCacheExpiryHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// NewRedirectCache creates an empty RedirectCache that holds at most maxEntries redirects.  If
+// maxEntries is zero or less, no redirect is cached.
+func NewRedirectCache(maxEntries int) *RedirectCache {
+	return &RedirectCache{
+		maxEntries:   maxEntries,
+		now:          time.Now,
+		entriesByKey: make(map[redirectCacheKey]*redirectCacheEntry),
+	}
+}
+
+// Len returns the number of redirects in the cache, including those that have expired but have not yet
+// been removed.
+func (cache *RedirectCache) Len() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return len(cache.entriesByKey)
+}
+
+// RecordRedirect adds the Redirect-Host targets in answer, which is the answer to request, to the cache
+// for Redirect-Max-Cache-Time (AVP code 262) seconds.  Returns true if the redirect was added.  It is not
+// added if the Result-Code of answer is not ResultCodeRedirectIndication; if answer has no Redirect-Host
+// that is a valid Diameter URI; if its Redirect-Host-Usage is absent or DONT_CACHE; if its
+// Redirect-Max-Cache-Time is absent or zero; or if request lacks the AVP (e.g., Session-Id) by which
+// the Redirect-Host-Usage identifies the requests to which the redirect applies.  A redirect replaces any
+// earlier redirect for the same requests.  If the cache is full, the redirect that expires soonest is
+// removed to make room.
+func (cache *RedirectCache) RecordRedirect(request *diameter.Message, answer *diameter.Message) bool {
+	if cache.maxEntries <= 0 {
+		return false
+	}
+
+	if resultCode, ok := answer.ResultCode(); !ok || resultCode != diameter.ResultCode(ResultCodeRedirectIndication) {
+		return false
+	}
+
+	usage, ok := enumeratedAvpValue(answer, 261)
+	if !ok || RedirectHostUsage(usage) == RedirectHostUsageDontCache {
+		return false
+	}
+
+	maxCacheTime, ok := unsigned32AvpValue(answer, 262)
+	if !ok || maxCacheTime == 0 {
+		return false
+	}
+
+	key, ok := redirectCacheKeyFor(request, RedirectHostUsage(usage))
+	if !ok {
+		return false
+	}
+
+	var targets []*diameter.DiameterURI
+	for _, redirectHostAvp := range answer.TopLevelAvpsMatching(0, 292) {
+		if target, err := diameter.ParseDiameterURI(string(redirectHostAvp.Data)); err == nil {
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		return false
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.removeExpiredEntries()
+
+	expires := cache.now().Add(time.Duration(maxCacheTime) * time.Second)
+
+	if entry, isInCache := cache.entriesByKey[key]; isInCache {
+		entry.targets, entry.expires = targets, expires
+		heap.Fix(&cache.entriesByExpiry, entry.heapIndex)
+		return true
+	}
+
+	for len(cache.entriesByExpiry) >= cache.maxEntries {
+		cache.removeSoonestExpiringEntry()
+	}
+
+	entry := &redirectCacheEntry{key: key, targets: targets, expires: expires}
+	heap.Push(&cache.entriesByExpiry, entry)
+	cache.entriesByKey[key] = entry
+
+	return true
+}
+
+// RedirectTargetsFor returns the Redirect-Host targets of the cached redirect that applies to request,
+// in the order in which they appear in the redirect answer.  If more than one cached redirect applies,
+// the most specific is used: one for the Session-Id of request, then for its User-Name, its
+// Destination-Host, its Destination-Realm and Application-Id, its Destination-Realm, and finally for
+// its Application-Id.  Returns nil if no unexpired redirect applies.
+func (cache *RedirectCache) RedirectTargetsFor(request *diameter.Message) []*diameter.DiameterURI {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.removeExpiredEntries()
+
+	for _, usage := range []RedirectHostUsage{
+		RedirectHostUsageAllSession,
+		RedirectHostUsageAllUser,
+		RedirectHostUsageAllHost,
+		RedirectHostUsageRealmAndApplication,
+		RedirectHostUsageAllRealm,
+		RedirectHostUsageAllApplication,
+	} {
+		if key, ok := redirectCacheKeyFor(request, usage); ok {
+			if entry, isInCache := cache.entriesByKey[key]; isInCache {
+				return entry.targets
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeExpiredEntries removes entries whose Redirect-Max-Cache-Time has elapsed.  Since the entries
+// are ordered by expiry, only the expired entries are visited.  The mutex must be held.
+func (cache *RedirectCache) removeExpiredEntries() {
+	now := cache.now()
+	for len(cache.entriesByExpiry) > 0 && !now.Before(cache.entriesByExpiry[0].expires) {
+		cache.removeSoonestExpiringEntry()
+	}
+}
+
+// removeSoonestExpiringEntry removes the entry that expires soonest from the heap and from the index.
+// The mutex must be held.
+func (cache *RedirectCache) removeSoonestExpiringEntry() {
+	entry := heap.Pop(&cache.entriesByExpiry).(*redirectCacheEntry)
+	delete(cache.entriesByKey, entry.key)
+}
+
+func redirectCacheKeyFor(request *diameter.Message, usage RedirectHostUsage) (redirectCacheKey, bool) {
+	var avpCode diameter.Uint24
+
+	switch usage {
+	case RedirectHostUsageAllApplication:
+		return redirectCacheKey{usage: usage, applicationID: request.AppID}, true
+	case RedirectHostUsageAllSession:
+		avpCode = 263
+	case RedirectHostUsageAllRealm, RedirectHostUsageRealmAndApplication:
+		avpCode = 283
+	case RedirectHostUsageAllHost:
+		avpCode = 293
+	case RedirectHostUsageAllUser:
+		avpCode = 1
+	default:
+		return redirectCacheKey{}, false
+	}
+
+	avp := request.FirstAvpMatching(0, avpCode)
+	if avp == nil {
+		return redirectCacheKey{}, false
+	}
+
+	key := redirectCacheKey{usage: usage, value: string(avp.Data)}
+	if avpCode == 283 || avpCode == 293 {
+		// Destination-Realm and Destination-Host are FQDNs, which are not case-sensitive
+		key.value = strings.ToLower(key.value)
+	}
+	if usage == RedirectHostUsageRealmAndApplication {
+		key.applicationID = request.AppID
+	}
+
+	return key, true
+}
+
+func unsigned32AvpValue(m *diameter.Message, code diameter.Uint24) (uint32, bool) {
+	avp := m.FirstAvpMatching(0, code)
+	if avp == nil {
+		return 0, false
+	}
+
+	value, err := diameter.ConvertAVPDataToTypedData(avp.Data, diameter.Unsigned32)
+	if err != nil {
+		return 0, false
+	}
+
+	return value.(uint32), true
+}
+
+func enumeratedAvpValue(m *diameter.Message, code diameter.Uint24) (int32, bool) {
+	avp := m.FirstAvpMatching(0, code)
+	if avp == nil {
+		return 0, false
+	}
+
+	value, err := diameter.ConvertAVPDataToTypedData(avp.Data, diameter.Enumerated)
+	if err != nil {
+		return 0, false
+	}
+
+	return value.(int32), true
+}
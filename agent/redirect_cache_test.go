@@ -0,0 +1,176 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blorticus-go/diameter"
+)
+
+func testRedirectAnswer(request *diameter.Message, usage RedirectHostUsage, maxCacheTime uint32, redirectHosts ...string) *diameter.Message {
+	avps := []*diameter.AVP{
+		diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, ResultCodeRedirectIndication),
+		diameter.NewTypedAVP(261, 0, true, diameter.Enumerated, int32(usage)),
+		diameter.NewTypedAVP(262, 0, true, diameter.Unsigned32, maxCacheTime),
+	}
+	for _, redirectHost := range redirectHosts {
+		avps = append(avps, diameter.NewTypedAVP(292, 0, true, diameter.DiamURI, redirectHost))
+	}
+
+	answer := request.GenerateMatchingResponseWithAvps(avps, nil)
+	answer.SetErrorFlag(true)
+
+	return answer
+}
+
+// withAvpReplaced returns a copy of m in which the first top-level AVP with the code of avp is replaced
+// by avp.
+func withAvpReplaced(m *diameter.Message, avp *diameter.AVP) *diameter.Message {
+	replaced := m.Clone()
+	for i, existing := range replaced.Avps {
+		if existing.Code == avp.Code {
+			replaced.Avps[i] = avp
+			break
+		}
+	}
+	replaced.RecomputeLength()
+
+	return replaced
+}
+
+func TestRedirectCacheHitWithinMaxCacheTimeAndMissAfterExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cache := NewRedirectCache(100)
+	cache.now = func() time.Time { return now }
+
+	request := testCreditControlRequest()
+	if !cache.RecordRedirect(request, testRedirectAnswer(request, RedirectHostUsageAllRealm, 30, "aaa://server1.example.com", "aaa://server2.example.com:3869")) {
+		t.Fatalf("expected redirect to be recorded")
+	}
+
+	laterRequest := withAvpReplaced(testCreditControlRequest(), diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1;2"))
+
+	now = now.Add(29 * time.Second)
+	targets := cache.RedirectTargetsFor(laterRequest)
+	if len(targets) != 2 || targets[0].FQDN != "server1.example.com" || targets[1].FQDN != "server2.example.com" || targets[1].Port != 3869 {
+		t.Fatalf("expected the two Redirect-Host targets within Redirect-Max-Cache-Time, got (%v)", targets)
+	}
+
+	now = now.Add(time.Second)
+	if targets := cache.RedirectTargetsFor(laterRequest); targets != nil {
+		t.Errorf("expected no targets after Redirect-Max-Cache-Time, got (%v)", targets)
+	}
+	if cache.Len() != 0 {
+		t.Errorf("expected expired redirect to be removed, got (%d) entries", cache.Len())
+	}
+}
+
+func TestRedirectCacheKeysByRedirectHostUsage(t *testing.T) {
+	request := testCreditControlRequest()
+
+	otherSession := withAvpReplaced(testCreditControlRequest(), diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1;2"))
+
+	otherRealm := withAvpReplaced(testCreditControlRequest(), diameter.NewTypedAVP(283, 0, true, diameter.DiamIdent, "other.example.com"))
+
+	sameRealmInOtherCase := withAvpReplaced(testCreditControlRequest(), diameter.NewTypedAVP(283, 0, true, diameter.DiamIdent, "EXAMPLE.com"))
+
+	otherApplication := testCreditControlRequest()
+	otherApplication.AppID = 16777238
+
+	for _, testCase := range []struct {
+		usage      RedirectHostUsage
+		hits       []*diameter.Message
+		misses     []*diameter.Message
+		isRecorded bool
+	}{
+		{RedirectHostUsageDontCache, nil, []*diameter.Message{request}, false},
+		{RedirectHostUsageAllSession, []*diameter.Message{request, otherRealm}, []*diameter.Message{otherSession}, true},
+		{RedirectHostUsageAllRealm, []*diameter.Message{otherSession, sameRealmInOtherCase, otherApplication}, []*diameter.Message{otherRealm}, true},
+		{RedirectHostUsageRealmAndApplication, []*diameter.Message{otherSession, sameRealmInOtherCase}, []*diameter.Message{otherRealm, otherApplication}, true},
+		{RedirectHostUsageAllApplication, []*diameter.Message{otherSession, otherRealm}, []*diameter.Message{otherApplication}, true},
+		{RedirectHostUsageAllHost, nil, []*diameter.Message{request}, false},
+	} {
+		cache := NewRedirectCache(100)
+
+		if recorded := cache.RecordRedirect(request, testRedirectAnswer(request, testCase.usage, 30, "aaa://server1.example.com")); recorded != testCase.isRecorded {
+			t.Errorf("usage (%d): expected RecordRedirect() = (%t), got (%t)", testCase.usage, testCase.isRecorded, recorded)
+		}
+
+		for i, hit := range testCase.hits {
+			if targets := cache.RedirectTargetsFor(hit); len(targets) != 1 {
+				t.Errorf("usage (%d): expected request (%d) to match the cached redirect", testCase.usage, i)
+			}
+		}
+		for i, miss := range testCase.misses {
+			if targets := cache.RedirectTargetsFor(miss); targets != nil {
+				t.Errorf("usage (%d): expected request (%d) not to match the cached redirect", testCase.usage, i)
+			}
+		}
+	}
+}
+
+func TestRedirectCacheIgnoresAnswersThatCannotBeCached(t *testing.T) {
+	request := testCreditControlRequest()
+	cache := NewRedirectCache(100)
+
+	notARedirect := withAvpReplaced(testRedirectAnswer(request, RedirectHostUsageAllRealm, 30, "aaa://server1.example.com"), diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2001)))
+
+	for name, answer := range map[string]*diameter.Message{
+		"Result-Code is not 3006":        notARedirect,
+		"Redirect-Max-Cache-Time is 0":   testRedirectAnswer(request, RedirectHostUsageAllRealm, 0, "aaa://server1.example.com"),
+		"no Redirect-Host":               testRedirectAnswer(request, RedirectHostUsageAllRealm, 30),
+		"Redirect-Host is not a DiamURI": testRedirectAnswer(request, RedirectHostUsageAllRealm, 30, "server1.example.com"),
+	} {
+		if cache.RecordRedirect(request, answer) {
+			t.Errorf("%s: expected redirect not to be recorded", name)
+		}
+	}
+
+	if cache.Len() != 0 {
+		t.Errorf("expected empty cache, got (%d) entries", cache.Len())
+	}
+}
+
+func TestRedirectCacheEvictsTheRedirectThatExpiresSoonestWhenFull(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cache := NewRedirectCache(2)
+	cache.now = func() time.Time { return now }
+
+	requestForSession := func(sessionID string) *diameter.Message {
+		return withAvpReplaced(testCreditControlRequest(), diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, sessionID))
+	}
+
+	first, second, third := requestForSession("client.example.com;1;1"), requestForSession("client.example.com;1;2"), requestForSession("client.example.com;1;3")
+
+	cache.RecordRedirect(first, testRedirectAnswer(first, RedirectHostUsageAllSession, 60, "aaa://server1.example.com"))
+	cache.RecordRedirect(second, testRedirectAnswer(second, RedirectHostUsageAllSession, 30, "aaa://server2.example.com"))
+	cache.RecordRedirect(third, testRedirectAnswer(third, RedirectHostUsageAllSession, 90, "aaa://server3.example.com"))
+
+	if cache.Len() != 2 {
+		t.Errorf("expected cache to hold (2) entries, got (%d)", cache.Len())
+	}
+	if cache.RedirectTargetsFor(second) != nil {
+		t.Errorf("expected the redirect that expires soonest to be evicted when the cache is full")
+	}
+	if cache.RedirectTargetsFor(first) == nil || cache.RedirectTargetsFor(third) == nil {
+		t.Errorf("expected the other redirects to remain in the cache")
+	}
+
+	// replacing a redirect changes its expiry
+	cache.RecordRedirect(first, testRedirectAnswer(first, RedirectHostUsageAllSession, 120, "aaa://server4.example.com"))
+	if targets := cache.RedirectTargetsFor(first); len(targets) != 1 || targets[0].FQDN != "server4.example.com" {
+		t.Errorf("expected the replaced redirect, got (%v)", targets)
+	}
+
+	now = now.Add(90 * time.Second)
+	if cache.RedirectTargetsFor(third) != nil {
+		t.Errorf("expected the third redirect to expire")
+	}
+	if cache.Len() != 1 || cache.RedirectTargetsFor(first) == nil {
+		t.Errorf("expected only the replaced redirect to remain, got (%d) entries", cache.Len())
+	}
+
+	if NewRedirectCache(0).RecordRedirect(first, testRedirectAnswer(first, RedirectHostUsageAllSession, 60, "aaa://server1.example.com")) {
+		t.Errorf("expected no redirect to be recorded by a cache with no entries")
+	}
+}
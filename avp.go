@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"net"
 	"time"
 	"unicode/utf8"
@@ -13,6 +14,7 @@ const (
 	avpProtectedFlag                 = 0x20
 	avpMandatoryFlag                 = 0x40
 	avpFlagVendorSpecific            = 0x80
+	avpReservedFlags                 = 0x1f
 	nonVendorSpecificAvpHeaderLength = 8
 	vendorSpecificAvpHeaderLength    = 12
 )
@@ -73,7 +75,8 @@ const (
 	DiamURI
 	// Grouped indicates AVP type for grouped (a set of AVPs).  The typed value is []*AVP.
 	Grouped
-	// IPFilterRule indicates AVP type for IP Filter Rule.  The typed value is []byte.
+	// IPFilterRule indicates AVP type for IP Filter Rule.  The typed value is string.
+	// Allowed source types: string, []byte.
 	IPFilterRule
 	// TypeOrAvpUnknown is used when a query is made for an unknown AVP or the dictionary
 	// contains an unknown type.  The typed value is []byte.
@@ -133,6 +136,67 @@ const (
 	MPLSNamespaces                     AddressFamilyNumber = 16399
 )
 
+var addressFamilyNumberNames = map[AddressFamilyNumber]string{
+	AddressFamilyNumberInvalid:         "AddressFamilyNumberInvalid",
+	IP4:                                "IP4",
+	IP6:                                "IP6",
+	NSAP:                               "NSAP",
+	HDLC:                               "HDLC",
+	BBN1822:                            "BBN1822",
+	Ethernet:                           "Ethernet",
+	E163:                               "E163",
+	E164:                               "E164",
+	F69:                                "F69",
+	X121:                               "X121",
+	IPX:                                "IPX",
+	Appletalk:                          "Appletalk",
+	DecnetIV:                           "DecnetIV",
+	BanyanVines:                        "BanyanVines",
+	E164withNSAP:                       "E164withNSAP",
+	DNS:                                "DNS",
+	DistinguishedName:                  "DistinguishedName",
+	ASNumber:                           "ASNumber",
+	XTPoverIP4:                         "XTPoverIP4",
+	XTPoverIP6:                         "XTPoverIP6",
+	XTPNativeMode:                      "XTPNativeMode",
+	FibreChannelPortName:               "FibreChannelPortName",
+	FibreChannelNodeName:               "FibreChannelNodeName",
+	GWID:                               "GWID",
+	AFIforL2VPN:                        "AFIforL2VPN",
+	MPLSTPSectionEndpointIdentifier:    "MPLSTPSectionEndpointIdentifier",
+	MPLSTPLSPEndpointIdentifier:        "MPLSTPLSPEndpointIdentifier",
+	MPLSTPPseudowireEndpointIdentifier: "MPLSTPPseudowireEndpointIdentifier",
+	MTIP4:                              "MTIP4",
+	MTIP6:                              "MTIP6",
+	BGPSFC:                             "BGPSFC",
+	EIGRPCommonServiceFamily:           "EIGRPCommonServiceFamily",
+	EIGRPIP4ServiceFamily:              "EIGRPIP4ServiceFamily",
+	EIGRPIPv6ServiceFamily:             "EIGRPIPv6ServiceFamily",
+	LISPCanonicalAddressFormat:         "LISPCanonicalAddressFormat",
+	BGPLS:                              "BGPLS",
+	MAC48Bit:                           "MAC48Bit",
+	MAC64Bit:                           "MAC64Bit",
+	OUI:                                "OUI",
+	MAC24:                              "MAC24",
+	MAC40:                              "MAC40",
+	IPv6_64:                            "IPv6_64",
+	RBridgePortID:                      "RBridgePortID",
+	TRILLNickname:                      "TRILLNickname",
+	UniversallyUniqueIdentifier:        "UniversallyUniqueIdentifier",
+	RoutingPolicyAFI:                   "RoutingPolicyAFI",
+	MPLSNamespaces:                     "MPLSNamespaces",
+}
+
+// String returns the name of the address family number, which is the name of the corresponding
+// constant (e.g., "IP4" or "MAC48Bit").  For a value with no named constant, it returns
+// "AddressFamilyNumber(n)", where n is the value.
+func (n AddressFamilyNumber) String() string {
+	if name, isKnown := addressFamilyNumberNames[n]; isKnown {
+		return name
+	}
+	return fmt.Sprintf("AddressFamilyNumber(%d)", uint16(n))
+}
+
 type AddressType []byte
 
 // NewAddressType is the same as NewAddressTypeErrorable but panics if an error occurs.
@@ -278,6 +342,13 @@ type AVP struct {
 	// The AVPExtendedAttributes, if they are includes.  If they are not included,
 	// this will be nil.
 	ExtendedAttributes *AVPExtendedAttributes
+
+	// reserved flag bits from a decoded AVP, retained so that a forwarded AVP is
+	// re-encoded exactly as it was received
+	reservedFlags uint8
+	// the bytes from which the AVP was decoded, including padding, if it was
+	// decoded by DecodeAVPRetainingRaw() or DecodeMessageRetainingRawAvps()
+	rawEncoded []byte
 }
 
 // NewAVP is an AVP constructor.  This will set the Vendor-Specific (V) flag if the
@@ -657,8 +728,23 @@ func NewTypedAVP(code uint32, vendorID uint32, mandatory bool, avpType AVPDataTy
 	return avp
 }
 
+// NewGroupedAVP creates a Grouped AVP whose data is the encoding of children, in order.  The vendor-specific
+// flag is set if vendorID is non-zero, and the mandatory flag is set if mandatory is true.  vendorID and
+// mandatory apply only to the Grouped AVP itself, not to its children: each child is encoded with its own
+// vendor-id and flags, and is not modified.  This is deliberate, because a vendor-specific Grouped AVP
+// commonly contains base protocol AVPs (with vendor-id 0), and the M-bit of each child is set by its own
+// definition.  This is the same as NewTypedAVP(code, vendorID, mandatory, Grouped, children).
+func NewGroupedAVP(code uint32, vendorID uint32, mandatory bool, children ...*AVP) *AVP {
+	if children == nil {
+		children = []*AVP{}
+	}
+
+	return NewTypedAVP(code, vendorID, mandatory, Grouped, children)
+}
+
 // ConvertAVPDataToTypedData attempts to convert the provided AVP data into a typed value,
-// according to the data type provided.  dataType cannot be TypeOrAvpUnknown.
+// according to the data type provided.  dataType cannot be TypeOrAvpUnknown.  Address data is
+// converted to a net.IP, and must be an IPv4 (6 bytes) or IPv6 (18 bytes) address.
 func ConvertAVPDataToTypedData(avpData []byte, dataType AVPDataType) (interface{}, error) {
 	switch dataType {
 	case Unsigned32:
@@ -694,14 +780,14 @@ func ConvertAVPDataToTypedData(avpData []byte, dataType AVPDataType) (interface{
 			return nil, fmt.Errorf("type Float32 requires exactly four bytes")
 		}
 
-		return float32(binary.BigEndian.Uint32(avpData)), nil
+		return math.Float32frombits(binary.BigEndian.Uint32(avpData)), nil
 
 	case Float64:
 		if len(avpData) != 8 {
 			return nil, fmt.Errorf("type Float64 requires exactly eight bytes")
 		}
 
-		return float64(binary.BigEndian.Uint64(avpData)), nil
+		return math.Float64frombits(binary.BigEndian.Uint64(avpData)), nil
 
 	case UTF8String:
 		return string(avpData), nil
@@ -721,7 +807,8 @@ func ConvertAVPDataToTypedData(avpData []byte, dataType AVPDataType) (interface{
 			return nil, fmt.Errorf("type time requires exactly four bytes")
 		}
 
-		return binary.BigEndian.Uint32(avpData), nil
+		t := diameterBaseTime.Add(time.Second * time.Duration(binary.BigEndian.Uint32(avpData)))
+		return &t, nil
 
 	case Address:
 		switch len(avpData) {
@@ -731,15 +818,16 @@ func ConvertAVPDataToTypedData(avpData []byte, dataType AVPDataType) (interface{
 			}
 			return net.IPv4(avpData[2], avpData[3], avpData[4], avpData[5]), nil
 
-		case 10:
+		case 18:
 			if binary.BigEndian.Uint16(avpData[:2]) != 2 {
 				return nil, fmt.Errorf("type Address must be for IPv4 or IPv6 address only")
 			}
-			ipAddr := net.IP(avpData[2:])
-			return &ipAddr, nil
+			ipAddr := make(net.IP, net.IPv6len)
+			copy(ipAddr, avpData[2:])
+			return ipAddr, nil
 
 		default:
-			return nil, fmt.Errorf("type Address requires exactly 6 bytes or 10 bytes")
+			return nil, fmt.Errorf("type Address requires exactly 6 bytes (IPv4) or 18 bytes (IPv6)")
 		}
 
 	case DiamIdent:
@@ -747,21 +835,23 @@ func ConvertAVPDataToTypedData(avpData []byte, dataType AVPDataType) (interface{
 
 	case Grouped:
 		groupedBytes := avpData
-		avpsInGroup := make([]*AVP, 10)
+		avpsInGroup := make([]*AVP, 0)
 
+		offset := 0
 		for len(groupedBytes) > 0 {
-			nextAvp, err := DecodeAVP(groupedBytes)
+			nextAvp, consumed, err := DecodeAVPWithConsumed(groupedBytes)
 			if err != nil {
-				return nil, fmt.Errorf("unable to decode AVP inside group: %s", err.Error())
+				return nil, fmt.Errorf("inside group: %w", newAvpDecodeError(groupedBytes, offset, err))
 			}
 			avpsInGroup = append(avpsInGroup, nextAvp)
-			groupedBytes = groupedBytes[nextAvp.PaddedLength+1:]
+			groupedBytes = groupedBytes[consumed:]
+			offset += consumed
 		}
 
 		return avpsInGroup, nil
 
 	case IPFilterRule:
-		return avpData[:], nil
+		return string(avpData), nil
 
 	default:
 		return nil, fmt.Errorf("type not valid for an AVP")
@@ -792,27 +882,58 @@ func (avp *AVP) ConvertDataToTypedData(dataType AVPDataType) (interface{}, error
 	return ConvertAVPDataToTypedData(avp.Data, dataType)
 }
 
-func appendUint32(avp *bytes.Buffer, dataUint32 uint32) {
-	data := make([]byte, 4)
-	binary.BigEndian.PutUint32(data, dataUint32)
-	err := binary.Write(avp, binary.LittleEndian, data)
-	if err != nil {
-		panic(fmt.Sprintf("binary.Write failed: %s", err))
+// Encode produces an octet stream in network byte order from this AVP.
+func (avp *AVP) Encode() []byte {
+	return avp.encodeWithLengthField(avp.Length)
+}
+
+// EncodeWithExplicitLength is the same as Encode, except that the Length field in the
+// AVP header is set to length rather than the computed AVP length.  Only the lower 24 bits
+// of length are used.  The data and padding are encoded exactly as they are by Encode.  This
+// is intended only for testing the robustness of peers (for example, in a fuzzing or
+// interoperability test harness), since the result is usually not a valid AVP.
+func (avp *AVP) EncodeWithExplicitLength(length int) []byte {
+	return avp.encodeWithLengthField(length)
+}
+
+// RawEncoded returns the bytes, including padding, from which this AVP was decoded, if it was
+// decoded by DecodeAVPRetainingRaw() or DecodeMessageRetainingRawAvps() and its data have not since
+// been changed by SetData().  Otherwise, it returns nil.  The returned slice must not be modified.
+func (avp *AVP) RawEncoded() []byte {
+	return avp.rawEncoded
+}
+
+// EncodeUsingRaw returns RawEncoded() if it is not nil, and Encode() otherwise.  This allows a
+// received AVP to be forwarded exactly as it was received (including, for example, the values of
+// its pad bytes), while its decoded fields are used for inspection.  The raw bytes are not updated
+// when the exported fields of the AVP are changed directly, so an AVP that is changed other than by
+// SetData() should be sent using Encode().
+func (avp *AVP) EncodeUsingRaw() []byte {
+	if avp.rawEncoded != nil {
+		return avp.rawEncoded
 	}
+
+	return avp.Encode()
 }
 
-func appendByteArray(avp *bytes.Buffer, dataBytes []byte) {
-	err := binary.Write(avp, binary.LittleEndian, dataBytes)
-	if err != nil {
-		panic(fmt.Sprintf("binary.Write failed: %s", err))
+func (avp *AVP) encodeWithLengthField(length int) []byte {
+	return avp.appendEncodingWithLengthField(make([]byte, 0, avp.encodedSize()), length)
+}
+
+// encodedSize returns the number of octets that Encode() produces for the AVP.  This is the
+// PaddedLength, unless the Length or PaddedLength is inconsistent with the Data.
+func (avp *AVP) encodedSize() int {
+	headerLength := nonVendorSpecificAvpHeaderLength
+	if avp.VendorSpecific {
+		headerLength = vendorSpecificAvpHeaderLength
 	}
+
+	return headerLength + len(avp.Data) + avp.PaddedLength - avp.Length
 }
 
-// Encode produces an octet stream in network byte order from this AVP.
-func (avp *AVP) Encode() []byte {
-	buf := new(bytes.Buffer)
-	padded := make([]byte, (avp.PaddedLength - avp.Length))
-	appendUint32(buf, avp.Code)
+// appendEncodingWithLengthField appends the encoding of the AVP, with length in the Length field of
+// the header, to buf and returns the extended buffer.
+func (avp *AVP) appendEncodingWithLengthField(buf []byte, length int) []byte {
 	flags := 0
 
 	if avp.VendorSpecific {
@@ -824,17 +945,18 @@ func (avp *AVP) Encode() []byte {
 	if avp.Protected {
 		flags |= 0x20
 	}
+	flags |= int(avp.reservedFlags & avpReservedFlags)
 
-	appendUint32(buf, ((uint32(flags) << 24) | (uint32(avp.Length) & 0x00ffffff)))
+	buf = binary.BigEndian.AppendUint32(buf, avp.Code)
+	buf = binary.BigEndian.AppendUint32(buf, (uint32(flags)<<24)|(uint32(length)&0x00ffffff))
 
 	if avp.VendorSpecific {
-		appendUint32(buf, avp.VendorID)
+		buf = binary.BigEndian.AppendUint32(buf, avp.VendorID)
 	}
 
-	appendByteArray(buf, avp.Data)
-	appendByteArray(buf, padded)
+	buf = append(buf, avp.Data...)
 
-	return buf.Bytes()
+	return append(buf, make([]byte, avp.PaddedLength-avp.Length)...)
 }
 
 func (avp *AVP) updatePaddedLength() {
@@ -846,6 +968,59 @@ func (avp *AVP) updatePaddedLength() {
 	}
 }
 
+// SetData sets the AVP Data to data, then recomputes Length and PaddedLength from it,
+// using the vendor-specific header length if VendorSpecific is true.  If ExtendedAttributes
+// is not nil, its TypedValue is set to nil because it no longer reflects Data.  The Name and
+// DataType are retained.  Any RawEncoded() bytes are discarded.
+func (avp *AVP) SetData(data []byte) {
+	avp.Data = data
+	avp.rawEncoded = nil
+
+	if avp.VendorSpecific {
+		avp.Length = vendorSpecificAvpHeaderLength + len(data)
+	} else {
+		avp.Length = nonVendorSpecificAvpHeaderLength + len(data)
+	}
+	avp.updatePaddedLength()
+
+	if avp.ExtendedAttributes != nil {
+		avp.ExtendedAttributes.TypedValue = nil
+	}
+}
+
+// FindNestedAvp walks a tree of Grouped AVPs, starting with this AVP, and returns the AVP
+// at the end of the path.  Each element of path is an AVP code.  The first code is matched against
+// the children of this AVP, the next against the children of that matched AVP, and so forth.  The
+// Vendor-Id is not considered when matching.  If more than one child matches a code, the first is
+// used.  If path is empty, this AVP is returned.  Returns an error if any AVP along the path (other
+// than the last) cannot be decoded as Grouped, or if a code in the path is not found.
+func (avp *AVP) FindNestedAvp(path ...Uint24) (*AVP, error) {
+	current := avp
+
+	for depth, code := range path {
+		children, err := ConvertAVPDataToTypedData(current.Data, Grouped)
+		if err != nil {
+			return nil, fmt.Errorf("AVP with code (%d) at path depth (%d) is not a valid Grouped AVP: %s", current.Code, depth, err)
+		}
+
+		var matchingChild *AVP
+		for _, child := range children.([]*AVP) {
+			if child.Code == uint32(code) {
+				matchingChild = child
+				break
+			}
+		}
+
+		if matchingChild == nil {
+			return nil, fmt.Errorf("no AVP with code (%d) at path depth (%d)", code, depth)
+		}
+
+		current = matchingChild
+	}
+
+	return current, nil
+}
+
 // Clone makes a copy of this AVP and returns it.  The source AVP
 // object must not be updated during the cloning process.
 func (avp *AVP) Clone() *AVP {
@@ -862,7 +1037,11 @@ func (avp *AVP) Equal(a *AVP) bool {
 		return false
 	}
 
-	if avp.Code != a.Code || avp.VendorSpecific != a.VendorSpecific || avp.Mandatory != a.Mandatory || avp.VendorID != a.VendorID || avp.Length != a.Length || avp.PaddedLength != a.PaddedLength {
+	if avp.Code != a.Code || avp.VendorSpecific != a.VendorSpecific || avp.Mandatory != a.Mandatory || avp.Protected != a.Protected || avp.reservedFlags != a.reservedFlags {
+		return false
+	}
+
+	if avp.VendorID != a.VendorID || avp.Length != a.Length || avp.PaddedLength != a.PaddedLength {
 		return false
 	}
 
@@ -882,55 +1061,97 @@ func (avp *AVP) Equal(a *AVP) bool {
 // DecodeAVP accepts a byte stream in network byte order and produces an AVP
 // object from it.
 func DecodeAVP(input []byte) (*AVP, error) {
-	avp := new(AVP)
-	buf := bytes.NewReader(input)
-	var code uint32
-	err := binary.Read(buf, binary.BigEndian, &code)
-	if err != nil {
-		return nil, fmt.Errorf("stream read failure: %s", err)
+	return decodeAVP(input, true)
+}
+
+// decodeAVP is DecodeAVP, except that if copyData is false, the Data of the AVP is a sub-slice of
+// input, with a capacity equal to its length.
+func decodeAVP(input []byte, copyData bool) (*AVP, error) {
+	if len(input) < nonVendorSpecificAvpHeaderLength {
+		return nil, fmt.Errorf("%w: input length (%d) is less than the AVP header size", ErrTruncatedAvp, len(input))
 	}
 
-	avp.Code = code
+	avp := new(AVP)
+	avp.Code = binary.BigEndian.Uint32(input[0:4])
 
-	var flagsAndLength uint32
-	err = binary.Read(buf, binary.BigEndian, &flagsAndLength)
-	if err != nil {
-		return nil, fmt.Errorf("stream read failure: %s", err)
-	}
+	flagsAndLength := binary.BigEndian.Uint32(input[4:8])
 	flags := byte((flagsAndLength & 0xFF000000) >> 24)
 	avp.Length = int(flagsAndLength & 0x00FFFFFF)
 
 	avp.Mandatory = bool((avpMandatoryFlag & flags) == avpMandatoryFlag)
 	avp.Protected = bool((avpProtectedFlag & flags) == avpProtectedFlag)
 	avp.VendorSpecific = bool((avpFlagVendorSpecific & flags) == avpFlagVendorSpecific)
+	avp.reservedFlags = flags & avpReservedFlags
 
 	if avp.Length > len(input) {
-		return nil, fmt.Errorf("length field in AVP header greater than encoded length")
+		return nil, fmt.Errorf("%w: length field in AVP header (%d) greater than encoded length (%d)", ErrAvpLengthExceedsMessage, avp.Length, len(input))
 	}
 
 	headerLength := nonVendorSpecificAvpHeaderLength
 
 	if avp.VendorSpecific {
-		err = binary.Read(buf, binary.BigEndian, &avp.VendorID)
-		if err != nil {
-			return nil, fmt.Errorf("stream read failure: %s", err)
+		if avp.Length < vendorSpecificAvpHeaderLength {
+			return nil, fmt.Errorf("%w: AVP has vendor-specific flag set but length field (%d) leaves no room for the Vendor-Id", ErrInvalidAvpLength, avp.Length)
 		}
+		// avp.Length is no greater than len(input), so the Vendor-Id is present
+		avp.VendorID = binary.BigEndian.Uint32(input[8:12])
 		headerLength = vendorSpecificAvpHeaderLength
+	} else if avp.Length < nonVendorSpecificAvpHeaderLength {
+		return nil, fmt.Errorf("%w: length field in AVP header is (%d)", ErrInvalidAvpLength, avp.Length)
 	}
 
-	avp.Data = make([]byte, avp.Length-headerLength)
+	if copyData {
+		avp.Data = make([]byte, avp.Length-headerLength)
+		copy(avp.Data, input[headerLength:avp.Length])
+	} else {
+		avp.Data = input[headerLength:avp.Length:avp.Length]
+	}
 
-	err = binary.Read(buf, binary.BigEndian, avp.Data)
+	avp.updatePaddedLength()
+
+	return avp, nil
+}
+
+// DecodeAVPWithConsumed is the same as DecodeAVP, except that it also returns the number of bytes
+// of input that the AVP occupies, including padding, which is the offset in input of the next AVP.
+// This is always the PaddedLength of the returned AVP.  Unlike DecodeAVP, an error is returned if
+// input is too short to contain the padding.
+func DecodeAVPWithConsumed(input []byte) (*AVP, int, error) {
+	return decodeAVPWithConsumed(input, true)
+}
 
+func decodeAVPWithConsumed(input []byte, copyData bool) (*AVP, int, error) {
+	avp, err := decodeAVP(input, copyData)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if avp.PaddedLength > len(input) {
+		return nil, 0, fmt.Errorf("%w: padded length of AVP (%d) exceeds the encoded length (%d)", ErrAvpLengthExceedsMessage, avp.PaddedLength, len(input))
+	}
+
+	return avp, avp.PaddedLength, nil
+}
+
+// DecodeAVPRetainingRaw is the same as DecodeAVP, except that the returned AVP also retains a copy
+// of the bytes from which it was decoded, including padding, which are returned by RawEncoded() and
+// EncodeUsingRaw().  If input ends before the padding, the missing pad bytes are retained as zeroes.
+func DecodeAVPRetainingRaw(input []byte) (*AVP, error) {
+	avp, err := DecodeAVP(input)
 	if err != nil {
 		return nil, err
 	}
 
-	avp.updatePaddedLength()
+	avp.retainRawEncodingFrom(input)
 
 	return avp, nil
 }
 
+func (avp *AVP) retainRawEncodingFrom(input []byte) {
+	avp.rawEncoded = make([]byte, avp.PaddedLength)
+	copy(avp.rawEncoded, input)
+}
+
 // AvpVendorIdAndCode is a union representing the vendor-id for an AVP and the code for an AVP.
 type AvpVendorIdAndCode struct {
 	VendorId uint32
@@ -3029,6 +3029,449 @@ var _ = Describe("AVP", func() {
 		})
 	})
 
+	Describe("setting the data for an existing AVP", func() {
+		When("the AVP is not vendor-specific and the new data is shorter", func() {
+			avp := diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "host.example.com")
+			avp.SetData([]byte("abcde"))
+
+			It("recomputes the lengths and encodes with padding", func() {
+				Expect(avp.Length).To(Equal(13))
+				Expect(avp.PaddedLength).To(Equal(16))
+				Expect(avp.Encode()).To(Equal([]byte{
+					0x00, 0x00, 0x01, 0x08, 0x40, 0x00, 0x00, 0x0d, 'a', 'b', 'c', 'd', 'e', 0x00, 0x00, 0x00,
+				}))
+			})
+
+			It("invalidates the typed value but retains the data type", func() {
+				Expect(avp.ExtendedAttributes.TypedValue).To(BeNil())
+				Expect(avp.ExtendedAttributes.DataType).To(Equal(diameter.DiamIdent))
+			})
+		})
+
+		When("the AVP is vendor-specific and the new data is longer", func() {
+			avp := diameter.NewAVP(1, 10415, false, []byte{0x01})
+			avp.SetData([]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06})
+
+			It("recomputes the lengths including the Vendor-Id", func() {
+				Expect(avp.Length).To(Equal(18))
+				Expect(avp.PaddedLength).To(Equal(20))
+				Expect(avp.Encode()).To(Equal([]byte{
+					0x00, 0x00, 0x00, 0x01, 0x80, 0x00, 0x00, 0x12, 0x00, 0x00, 0x28, 0xaf,
+					0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x00, 0x00,
+				}))
+			})
+		})
+
+		When("the new data is empty", func() {
+			avp := diameter.NewAVP(1, 0, false, []byte{0x01, 0x02, 0x03, 0x04})
+			avp.SetData([]byte{})
+
+			It("encodes only the header", func() {
+				Expect(avp.Length).To(Equal(8))
+				Expect(avp.PaddedLength).To(Equal(8))
+				Expect(avp.Encode()).To(Equal([]byte{0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x08}))
+			})
+		})
+	})
+
+	Describe("finding a nested AVP", func() {
+		mscc := diameter.NewTypedAVP(456, 0, true, diameter.Grouped, []*diameter.AVP{
+			diameter.NewTypedAVP(432, 0, true, diameter.Unsigned32, uint32(1)),
+			diameter.NewTypedAVP(446, 0, true, diameter.Grouped, []*diameter.AVP{
+				diameter.NewTypedAVP(420, 0, true, diameter.Unsigned32, uint32(60)),
+				diameter.NewTypedAVP(421, 0, true, diameter.Grouped, []*diameter.AVP{
+					diameter.NewTypedAVP(413, 0, true, diameter.Unsigned64, uint64(1000)),
+				}),
+			}),
+			diameter.NewTypedAVP(446, 0, true, diameter.Grouped, []*diameter.AVP{
+				diameter.NewTypedAVP(420, 0, true, diameter.Unsigned32, uint32(120)),
+			}),
+		})
+
+		When("the path resolves through three levels", func() {
+			It("returns the leaf AVP", func() {
+				leaf, err := mscc.FindNestedAvp(446, 421, 413)
+				Expect(err).To(BeNil())
+				Expect(leaf.Equal(diameter.NewTypedAVP(413, 0, true, diameter.Unsigned64, uint64(1000)))).To(BeTrue())
+			})
+		})
+
+		When("a code in the path matches more than one child", func() {
+			It("follows the first matching child", func() {
+				leaf, err := mscc.FindNestedAvp(446, 420)
+				Expect(err).To(BeNil())
+				Expect(leaf.Equal(diameter.NewTypedAVP(420, 0, true, diameter.Unsigned32, uint32(60)))).To(BeTrue())
+			})
+		})
+
+		When("the path is empty", func() {
+			It("returns the AVP itself", func() {
+				leaf, err := mscc.FindNestedAvp()
+				Expect(err).To(BeNil())
+				Expect(leaf).To(BeIdenticalTo(mscc))
+			})
+		})
+
+		When("a code in the path is not present", func() {
+			It("returns an error", func() {
+				_, err := mscc.FindNestedAvp(446, 448)
+				Expect(err).ToNot(BeNil())
+			})
+		})
+
+		When("the path continues past a non-Grouped AVP", func() {
+			It("returns an error", func() {
+				_, err := mscc.FindNestedAvp(446, 420, 1)
+				Expect(err).ToNot(BeNil())
+			})
+		})
+	})
+
+	Describe("encoding an AVP with an explicit length", func() {
+		avp := diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "host")
+
+		When("the explicit length is larger than the computed length", func() {
+			encoded := avp.EncodeWithExplicitLength(16)
+
+			It("sets the Length field to the explicit length but leaves data and padding unchanged", func() {
+				Expect(encoded).To(Equal([]byte{
+					0x00, 0x00, 0x01, 0x08, 0x40, 0x00, 0x00, 0x10, 'h', 'o', 's', 't',
+				}))
+			})
+
+			It("does not change normal encoding", func() {
+				Expect(avp.Encode()).To(Equal([]byte{
+					0x00, 0x00, 0x01, 0x08, 0x40, 0x00, 0x00, 0x0c, 'h', 'o', 's', 't',
+				}))
+			})
+		})
+
+		When("the explicit length is smaller than the header length", func() {
+			encoded := avp.EncodeWithExplicitLength(4)
+
+			It("produces an AVP that fails to decode", func() {
+				Expect(encoded[4:8]).To(Equal([]byte{0x40, 0x00, 0x00, 0x04}))
+				_, err := diameter.DecodeAVP(encoded)
+				Expect(err).ToNot(BeNil())
+			})
+		})
+	})
+
+	Describe("decoding an AVP with inconsistent flags and length", func() {
+		When("the V-bit is set but the length is 8", func() {
+			var err error
+
+			BeforeEach(func() {
+				_, err = diameter.DecodeAVP([]byte{
+					0x00, 0x00, 0x01, 0x0a, 0xc0, 0x00, 0x00, 0x08, 0x00, 0x00, 0x28, 0xaf,
+				})
+			})
+
+			It("returns an error", func() {
+				Expect(err).ToNot(BeNil())
+			})
+		})
+
+		When("the V-bit is not set and the length is less than 8", func() {
+			var err error
+
+			BeforeEach(func() {
+				_, err = diameter.DecodeAVP([]byte{
+					0x00, 0x00, 0x01, 0x0a, 0x40, 0x00, 0x00, 0x04,
+				})
+			})
+
+			It("returns an error", func() {
+				Expect(err).ToNot(BeNil())
+			})
+		})
+
+		When("the V-bit is set and the length includes the Vendor-Id", func() {
+			var avp *diameter.AVP
+			var err error
+
+			BeforeEach(func() {
+				avp, err = diameter.DecodeAVP([]byte{
+					0x00, 0x00, 0x01, 0x0a, 0xc0, 0x00, 0x00, 0x10, 0x00, 0x00, 0x28, 0xaf, 0x00, 0x00, 0x00, 0x01,
+				})
+			})
+
+			It("decodes the AVP", func() {
+				Expect(err).To(BeNil())
+				Expect(avp.VendorSpecific).To(BeTrue())
+				Expect(avp.VendorID).To(Equal(uint32(10415)))
+				Expect(avp.Data).To(Equal([]byte{0x00, 0x00, 0x00, 0x01}))
+			})
+		})
+	})
+
+	Describe("decoding an AVP with DecodeAVPWithConsumed", func() {
+		When("the AVP is followed by padding and another AVP", func() {
+			var avp *diameter.AVP
+			var consumed int
+			var err error
+
+			BeforeEach(func() {
+				avp, consumed, err = diameter.DecodeAVPWithConsumed([]byte{
+					0x00, 0x00, 0x01, 0x07, 0x40, 0x00, 0x00, 0x0d, 0x61, 0x3b, 0x62, 0x3b, 0x63, 0x00, 0x00, 0x00,
+					0x00, 0x00, 0x01, 0x0c, 0x40, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x07, 0xd1,
+				})
+			})
+
+			It("consumes the AVP and its padding", func() {
+				Expect(err).To(BeNil())
+				Expect(avp.Code).To(Equal(uint32(263)))
+				Expect(avp.Data).To(Equal([]byte("a;b;c")))
+				Expect(consumed).To(Equal(16))
+				Expect(consumed).To(Equal(avp.PaddedLength))
+			})
+		})
+
+		When("the AVP is vendor-specific and needs no padding", func() {
+			var avp *diameter.AVP
+			var consumed int
+			var err error
+
+			BeforeEach(func() {
+				avp, consumed, err = diameter.DecodeAVPWithConsumed([]byte{
+					0x00, 0x00, 0x01, 0x0a, 0xc0, 0x00, 0x00, 0x10, 0x00, 0x00, 0x28, 0xaf, 0x00, 0x00, 0x00, 0x01,
+				})
+			})
+
+			It("consumes exactly the AVP length", func() {
+				Expect(err).To(BeNil())
+				Expect(consumed).To(Equal(16))
+				Expect(consumed).To(Equal(avp.PaddedLength))
+			})
+		})
+
+		When("the input ends before the padding", func() {
+			var err error
+
+			BeforeEach(func() {
+				_, _, err = diameter.DecodeAVPWithConsumed([]byte{
+					0x00, 0x00, 0x01, 0x07, 0x40, 0x00, 0x00, 0x0d, 0x61, 0x3b, 0x62, 0x3b, 0x63,
+				})
+			})
+
+			It("returns an error", func() {
+				Expect(err).ToNot(BeNil())
+			})
+		})
+	})
+
+	Describe("decoding AVPs with no data", func() {
+		When("the AVP is an empty OctetString", func() {
+			var avp *diameter.AVP
+			var err error
+
+			BeforeEach(func() {
+				avp, err = diameter.DecodeAVP([]byte{0x00, 0x00, 0x01, 0xa7, 0x40, 0x00, 0x00, 0x08})
+			})
+
+			It("produces empty Data", func() {
+				Expect(err).To(BeNil())
+				Expect(avp.Length).To(Equal(8))
+				Expect(avp.PaddedLength).To(Equal(8))
+				Expect(avp.Data).ToNot(BeNil())
+				Expect(avp.Data).To(BeEmpty())
+			})
+
+			It("converts to an empty OctetString", func() {
+				Expect(diameter.ConvertAVPDataToTypedData(avp.Data, diameter.OctetString)).To(Equal([]byte{}))
+			})
+
+			It("matches the AVP created by NewTypedAVP with an empty value", func() {
+				Expect(avp.Equal(diameter.NewTypedAVP(423, 0, true, diameter.OctetString, []byte{}))).To(BeTrue())
+			})
+		})
+
+		When("the AVP is vendor-specific with no data", func() {
+			var avp *diameter.AVP
+			var consumed int
+			var err error
+
+			BeforeEach(func() {
+				avp, consumed, err = diameter.DecodeAVPWithConsumed([]byte{0x00, 0x00, 0x00, 0x01, 0xc0, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x28, 0xaf})
+			})
+
+			It("produces empty Data and consumes only the header", func() {
+				Expect(err).To(BeNil())
+				Expect(avp.VendorID).To(Equal(uint32(10415)))
+				Expect(avp.Data).ToNot(BeNil())
+				Expect(avp.Data).To(BeEmpty())
+				Expect(consumed).To(Equal(12))
+			})
+		})
+
+		When("the AVP is an empty Grouped", func() {
+			var avp *diameter.AVP
+			var err error
+			encoded := []byte{0x00, 0x00, 0x01, 0x04, 0x40, 0x00, 0x00, 0x08}
+
+			BeforeEach(func() {
+				avp, err = diameter.DecodeAVP(encoded)
+			})
+
+			It("converts to an empty, non-nil set of AVPs", func() {
+				Expect(err).To(BeNil())
+				children, err := diameter.ConvertAVPDataToTypedData(avp.Data, diameter.Grouped)
+				Expect(err).To(BeNil())
+				Expect(children).ToNot(BeNil())
+				Expect(children).To(Equal([]*diameter.AVP{}))
+			})
+
+			It("matches the AVP created by NewTypedAVP with an empty AVP set", func() {
+				Expect(avp.Equal(diameter.NewTypedAVP(260, 0, true, diameter.Grouped, []*diameter.AVP{}))).To(BeTrue())
+			})
+
+			It("re-encodes to the same bytes", func() {
+				Expect(avp.Encode()).To(Equal(encoded))
+			})
+		})
+
+		When("a Grouped AVP contains an AVP with no data", func() {
+			It("decodes the child with empty Data", func() {
+				children, err := diameter.ConvertAVPDataToTypedData([]byte{
+					0x00, 0x00, 0x01, 0xa7, 0x40, 0x00, 0x00, 0x08,
+					0x00, 0x00, 0x01, 0x0a, 0x40, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x28, 0xaf,
+				}, diameter.Grouped)
+				Expect(err).To(BeNil())
+				Expect(children).To(HaveLen(2))
+				Expect(children.([]*diameter.AVP)[0].Data).To(BeEmpty())
+				Expect(children.([]*diameter.AVP)[1].Code).To(Equal(uint32(266)))
+			})
+		})
+
+		When("the last AVP in a message has no data", func() {
+			It("decodes the message", func() {
+				m := diameter.NewMessage(0, 280, 0, 1, 1, []*diameter.AVP{
+					diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "host.example.com"),
+					diameter.NewTypedAVP(260, 0, true, diameter.Grouped, []*diameter.AVP{}),
+				}, nil)
+
+				decoded, err := diameter.DecodeMessage(m.Encode())
+				Expect(err).To(BeNil())
+				Expect(decoded.Avps).To(HaveLen(2))
+				Expect(decoded.Avps[1].Data).To(BeEmpty())
+				Expect(decoded.Length).To(Equal(m.Length))
+			})
+		})
+	})
+
+	Describe("comparing AVPs that differ only in flags", func() {
+		It("does not treat AVPs with different P flags as equal", func() {
+			unprotected := diameter.NewTypedAVP(1, 0, true, diameter.Unsigned32, uint32(1))
+			protected := diameter.NewTypedAVP(1, 0, true, diameter.Unsigned32, uint32(1)).MakeProtected()
+			Expect(unprotected.Equal(protected)).To(BeFalse())
+			Expect(protected.Equal(protected.Clone())).To(BeTrue())
+		})
+
+		It("does not treat AVPs with different reserved flag bits as equal", func() {
+			withReservedBits, err := diameter.DecodeAVP([]byte{0x00, 0x00, 0x00, 0x01, 0x41, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x01})
+			Expect(err).To(BeNil())
+			withoutReservedBits := diameter.NewTypedAVP(1, 0, true, diameter.Unsigned32, uint32(1))
+			Expect(withReservedBits.Equal(withoutReservedBits)).To(BeFalse())
+			Expect(withReservedBits.Clone().Encode()).To(Equal([]byte{0x00, 0x00, 0x00, 0x01, 0x41, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x01}))
+		})
+	})
+
+	Describe("creating a Grouped AVP with NewGroupedAVP", func() {
+		children := []*diameter.AVP{
+			diameter.NewTypedAVP(266, 0, true, diameter.Unsigned32, uint32(10415)),
+			diameter.NewTypedAVP(1, 10415, false, diameter.UTF8String, "abc"),
+		}
+
+		When("the group is vendor-specific and mandatory", func() {
+			grouped := diameter.NewGroupedAVP(260, 10415, true, children...)
+			expected := diameter.NewTypedAVP(260, 10415, true, diameter.Grouped, children)
+
+			It("matches the AVP created by NewTypedAVP with type Grouped", func() {
+				Expect(grouped.Equal(expected)).To(BeTrue())
+				Expect(grouped.Encode()).To(Equal(expected.Encode()))
+				Expect(grouped.VendorSpecific).To(BeTrue())
+				Expect(grouped.Mandatory).To(BeTrue())
+				Expect(grouped.Length).To(Equal(12 + 12 + 16))
+				Expect(grouped.ExtendedAttributes.TypedValue).To(Equal(children))
+			})
+
+			It("decodes to the same children", func() {
+				decoded, err := diameter.DecodeAVP(grouped.Encode())
+				Expect(err).To(BeNil())
+				typedChildren, err := decoded.ConvertDataToTypedData(diameter.Grouped)
+				Expect(err).To(BeNil())
+				Expect(typedChildren).To(HaveLen(2))
+				Expect(typedChildren.([]*diameter.AVP)[0].Equal(children[0])).To(BeTrue())
+				Expect(typedChildren.([]*diameter.AVP)[1].Equal(children[1])).To(BeTrue())
+			})
+
+			It("does not apply the vendor-id or the flags of the group to the children", func() {
+				Expect(children[0].VendorID).To(Equal(uint32(0)))
+				Expect(children[0].VendorSpecific).To(BeFalse())
+				Expect(children[1].Mandatory).To(BeFalse())
+			})
+		})
+
+		When("there are no children", func() {
+			grouped := diameter.NewGroupedAVP(260, 0, false)
+
+			It("matches the AVP created by NewTypedAVP with an empty slice", func() {
+				Expect(grouped.Encode()).To(Equal(diameter.NewTypedAVP(260, 0, false, diameter.Grouped, []*diameter.AVP{}).Encode()))
+				Expect(grouped.Length).To(Equal(8))
+			})
+		})
+	})
+
+	Describe("converting Address AVP data to typed data", func() {
+		It("converts 6 bytes with address family IP4 to the IPv4 net.IP", func() {
+			ip, err := diameter.ConvertAVPDataToTypedData([]byte{0x00, 0x01, 10, 254, 10, 1}, diameter.Address)
+			Expect(err).To(BeNil())
+			Expect(ip).To(BeAssignableToTypeOf(net.IP{}))
+			Expect(ip.(net.IP).Equal(net.ParseIP("10.254.10.1"))).To(BeTrue())
+		})
+
+		It("converts 18 bytes with address family IP6 to the IPv6 net.IP", func() {
+			data := []byte{0x00, 0x02, 0xfd, 0x00, 0xab, 0xcd, 0x00, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0, 0x00, 0x01}
+			ip, err := diameter.ConvertAVPDataToTypedData(data, diameter.Address)
+			Expect(err).To(BeNil())
+			Expect(ip).To(BeAssignableToTypeOf(net.IP{}))
+			Expect(ip.(net.IP).Equal(net.ParseIP("fd00:abcd:0:1::1"))).To(BeTrue())
+		})
+
+		It("converts an IPv6 Host-IP-Address created by NewTypedAVP back to the same address", func() {
+			avp := diameter.NewTypedAVP(257, 0, true, diameter.Address, net.ParseIP("2001:db8::25"))
+			Expect(diameter.ConvertAVPDataToTypedData(avp.Data, diameter.Address)).To(Equal(net.ParseIP("2001:db8::25")))
+		})
+
+		It("returns an error for 10 bytes", func() {
+			_, err := diameter.ConvertAVPDataToTypedData([]byte{0x00, 0x02, 0xfd, 0x00, 0xab, 0xcd, 0x00, 0x00, 0x00, 0x01}, diameter.Address)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("returns an error when the address family does not match the length", func() {
+			_, err := diameter.ConvertAVPDataToTypedData([]byte{0x00, 0x02, 10, 254, 10, 1}, diameter.Address)
+			Expect(err).ToNot(BeNil())
+			_, err = diameter.ConvertAVPDataToTypedData([]byte{0x00, 0x01, 0xfd, 0x00, 0xab, 0xcd, 0x00, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0, 0x00, 0x01}, diameter.Address)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("converting an AddressFamilyNumber to a string", func() {
+		It("returns the name for known values", func() {
+			Expect(diameter.IP4.String()).To(Equal("IP4"))
+			Expect(diameter.IP6.String()).To(Equal("IP6"))
+			Expect(diameter.E164.String()).To(Equal("E164"))
+			Expect(diameter.MAC48Bit.String()).To(Equal("MAC48Bit"))
+			Expect(diameter.MPLSNamespaces.String()).To(Equal("MPLSNamespaces"))
+			Expect(diameter.AddressFamilyNumberInvalid.String()).To(Equal("AddressFamilyNumberInvalid"))
+		})
+
+		It("returns the numeric value for unknown values", func() {
+			Expect(diameter.AddressFamilyNumber(65535).String()).To(Equal("AddressFamilyNumber(65535)"))
+			Expect(diameter.AddressFamilyNumber(32).String()).To(Equal("AddressFamilyNumber(32)"))
+		})
+	})
+
 	Describe("creating an AVP with an invalid type", func() {
 		_, err := diameter.NewTypedAVPErrorable(100, 100, true, diameter.AVPDataType(0xfefefefe), []byte{})
 
@@ -0,0 +1,100 @@
+package diameter
+
+// Diameter Credit-Control Application (RFC 4006) identifiers.
+const (
+	CreditControlApplicationId = 4
+	CreditControlCode          = Uint24(272)
+)
+
+// Values for the CC-Request-Type AVP (code 416).
+const (
+	CreditControlInitialRequest     int32 = 1
+	CreditControlUpdateRequest      int32 = 2
+	CreditControlTerminationRequest int32 = 3
+	CreditControlEventRequest       int32 = 4
+)
+
+// NewCreditControlRequest creates a Credit-Control Request skeleton, with the Application-Id set to 4,
+// the code set to 272 and the request and proxiable flags set.  The message contains, in order, the
+// Session-Id, Origin-Host, Origin-Realm, Destination-Realm, Auth-Application-Id (4), CC-Request-Type
+// and CC-Request-Number AVPs.  requestType should be one of the CreditControl*Request values.  The
+// hop-by-hop-id and end-to-end-id are zero.  The caller must add the Service-Context-Id and any
+// other service-specific AVPs.
+func NewCreditControlRequest(sessionId string, originHost string, originRealm string, destinationRealm string, requestType int32, requestNumber uint32) *Message {
+	return NewMessage(MsgFlagRequest|MsgFlagProxiable, CreditControlCode, CreditControlApplicationId, 0, 0, []*AVP{
+		NewTypedAVP(263, 0, true, UTF8String, sessionId),
+		NewTypedAVP(264, 0, true, DiamIdent, originHost),
+		NewTypedAVP(296, 0, true, DiamIdent, originRealm),
+		NewTypedAVP(283, 0, true, DiamIdent, destinationRealm),
+		NewTypedAVP(258, 0, true, Unsigned32, uint32(CreditControlApplicationId)),
+		NewTypedAVP(416, 0, true, Enumerated, requestType),
+		NewTypedAVP(415, 0, true, Unsigned32, requestNumber),
+	}, nil)
+}
+
+// Values for the Subscription-Id-Type AVP (code 450).
+const (
+	SubscriptionIdTypeEndUserE164    int32 = 0
+	SubscriptionIdTypeEndUserIMSI    int32 = 1
+	SubscriptionIdTypeEndUserSIPURI  int32 = 2
+	SubscriptionIdTypeEndUserNAI     int32 = 3
+	SubscriptionIdTypeEndUserPrivate int32 = 4
+)
+
+// SubscriptionId is the decoded content of a Subscription-Id AVP (code 443), which identifies the
+// subscription being charged (RFC 4006 section 8.46).
+type SubscriptionId struct {
+	// Type is the Subscription-Id-Type (code 450), one of the SubscriptionIdType* values
+	Type int32
+	// Data is the Subscription-Id-Data (code 444) (e.g., an E.164 number or an IMSI)
+	Data string
+}
+
+// NewSubscriptionId creates a Subscription-Id AVP (code 443) with the M-bit set, containing, in order,
+// a Subscription-Id-Type with the value subscriptionIdType and a Subscription-Id-Data with the value
+// data.  subscriptionIdType should be one of the SubscriptionIdType* values.
+func NewSubscriptionId(subscriptionIdType int32, data string) *AVP {
+	return NewGroupedAVP(443, 0, true,
+		NewTypedAVP(450, 0, true, Enumerated, subscriptionIdType),
+		NewTypedAVP(444, 0, true, UTF8String, data),
+	)
+}
+
+// SubscriptionIds returns the decoded top-level Subscription-Id AVPs in the message, in the order in
+// which they appear.  A Subscription-Id that cannot be decoded as a Grouped AVP, or that lacks a
+// well-formed Subscription-Id-Type or Subscription-Id-Data, is skipped.  Returns nil if the message has
+// no valid Subscription-Id.
+func (m *Message) SubscriptionIds() []SubscriptionId {
+	var subscriptionIds []SubscriptionId
+
+	for _, subscriptionIdAvp := range m.TopLevelAvpsMatching(0, 443) {
+		children, err := ConvertAVPDataToTypedData(subscriptionIdAvp.Data, Grouped)
+		if err != nil {
+			continue
+		}
+
+		var subscriptionIdTypeAvp, subscriptionIdDataAvp *AVP
+		for _, child := range children.([]*AVP) {
+			if child.VendorSpecific {
+				continue
+			}
+			switch {
+			case child.Code == 450 && subscriptionIdTypeAvp == nil:
+				subscriptionIdTypeAvp = child
+			case child.Code == 444 && subscriptionIdDataAvp == nil:
+				subscriptionIdDataAvp = child
+			}
+		}
+
+		if subscriptionIdTypeAvp == nil || len(subscriptionIdTypeAvp.Data) != 4 || subscriptionIdDataAvp == nil {
+			continue
+		}
+
+		subscriptionIds = append(subscriptionIds, SubscriptionId{
+			Type: MustConvertAVPDataToTypedData(subscriptionIdTypeAvp.Data, Enumerated).(int32),
+			Data: string(subscriptionIdDataAvp.Data),
+		})
+	}
+
+	return subscriptionIds
+}
@@ -0,0 +1,80 @@
+package diameter_test
+
+import (
+	"testing"
+
+	diameter "github.com/blorticus-go/diameter"
+)
+
+func TestNewCreditControlRequest(t *testing.T) {
+	ccr := diameter.NewCreditControlRequest("client.example.com;1;1", "client.example.com", "example.com", "server.example.com", diameter.CreditControlInitialRequest, 0)
+
+	if ccr.Code != 272 || ccr.AppID != 4 {
+		t.Errorf("expected code (272) and appId (4), got code (%d) and appId (%d)", ccr.Code, ccr.AppID)
+	}
+	if !ccr.IsRequest() || !ccr.IsProxiable() {
+		t.Errorf("expected request and proxiable flags to be set, got flags (%#02x)", ccr.Flags)
+	}
+
+	expectedAvps := []*diameter.AVP{
+		diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1;1"),
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "client.example.com"),
+		diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+		diameter.NewTypedAVP(283, 0, true, diameter.DiamIdent, "server.example.com"),
+		diameter.NewTypedAVP(258, 0, true, diameter.Unsigned32, uint32(4)),
+		diameter.NewTypedAVP(416, 0, true, diameter.Enumerated, int32(1)),
+		diameter.NewTypedAVP(415, 0, true, diameter.Unsigned32, uint32(0)),
+	}
+
+	if len(ccr.Avps) != len(expectedAvps) {
+		t.Fatalf("expected (%d) AVPs, got (%d)", len(expectedAvps), len(ccr.Avps))
+	}
+	for i := range expectedAvps {
+		if !ccr.Avps[i].Equal(expectedAvps[i]) {
+			t.Errorf("AVP (%d) expected code (%d), got AVP with code (%d) or differing value", i, expectedAvps[i].Code, ccr.Avps[i].Code)
+		}
+	}
+
+	decoded, err := diameter.DecodeMessage(ccr.Encode())
+	if err != nil {
+		t.Fatalf("expected no error on DecodeMessage(), got = (%s)", err)
+	}
+	if !decoded.Equals(ccr) {
+		t.Errorf("expected decoded CCR to equal the original, but it does not")
+	}
+}
+
+func TestSubscriptionIds(t *testing.T) {
+	ccr := diameter.NewCreditControlRequest("client.example.com;1;1", "client.example.com", "example.com", "server.example.com", diameter.CreditControlInitialRequest, 0)
+
+	if subscriptionIds := ccr.SubscriptionIds(); subscriptionIds != nil {
+		t.Errorf("expected nil SubscriptionIds() for message without Subscription-Id, got (%v)", subscriptionIds)
+	}
+
+	ccr.Avps = append(ccr.Avps,
+		diameter.NewSubscriptionId(diameter.SubscriptionIdTypeEndUserE164, "15551234567"),
+		diameter.NewGroupedAVP(443, 0, true, diameter.NewTypedAVP(444, 0, true, diameter.UTF8String, "no-type")),
+		diameter.NewSubscriptionId(diameter.SubscriptionIdTypeEndUserIMSI, "310150123456789"),
+	)
+	ccr.RecomputeLength()
+
+	decoded, err := diameter.DecodeMessage(ccr.Encode())
+	if err != nil {
+		t.Fatalf("expected no error on DecodeMessage(), got = (%s)", err)
+	}
+
+	expected := []diameter.SubscriptionId{
+		{Type: diameter.SubscriptionIdTypeEndUserE164, Data: "15551234567"},
+		{Type: diameter.SubscriptionIdTypeEndUserIMSI, Data: "310150123456789"},
+	}
+
+	subscriptionIds := decoded.SubscriptionIds()
+	if len(subscriptionIds) != len(expected) {
+		t.Fatalf("expected (%d) SubscriptionIds, got (%d): (%v)", len(expected), len(subscriptionIds), subscriptionIds)
+	}
+	for i := range expected {
+		if subscriptionIds[i] != expected[i] {
+			t.Errorf("SubscriptionId (%d): expected (%v), got (%v)", i, expected[i], subscriptionIds[i])
+		}
+	}
+}
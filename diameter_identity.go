@@ -0,0 +1,27 @@
+package diameter
+
+import "strings"
+
+// RealmFromIdentity returns the realm part of the DiameterIdentity identity (e.g., the value of an
+// Origin-Host AVP), which is the part after the first dot.  For example, the realm of
+// "host.example.com" is "example.com".  If identity has no dot, or the part before the first dot is
+// empty (e.g., ".example.com"), identity has no realm and the empty string is returned.
+func RealmFromIdentity(identity string) string {
+	host, realm, _ := strings.Cut(identity, ".")
+	if host == "" {
+		return ""
+	}
+
+	return realm
+}
+
+// DestinationRealm returns the value of the first top-level Destination-Realm AVP (code 283) in the
+// message.  If the message has no Destination-Realm AVP, or its value is empty, ok is false.
+func (m *Message) DestinationRealm() (realm string, ok bool) {
+	destinationRealmAvp := m.FirstAvpMatching(0, 283)
+	if destinationRealmAvp == nil || len(destinationRealmAvp.Data) == 0 {
+		return "", false
+	}
+
+	return string(destinationRealmAvp.Data), true
+}
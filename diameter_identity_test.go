@@ -0,0 +1,56 @@
+package diameter_test
+
+import (
+	"testing"
+
+	diameter "github.com/blorticus-go/diameter"
+)
+
+func TestRealmFromIdentity(t *testing.T) {
+	for _, testCase := range []struct {
+		identity      string
+		expectedRealm string
+	}{
+		{"host.example.com", "example.com"},
+		{"host.sub.example.com", "sub.example.com"},
+		{"example.com", "com"},
+		{"localhost", ""},
+		{"", ""},
+		{"host.", ""},
+		{".example.com", ""},
+	} {
+		if realm := diameter.RealmFromIdentity(testCase.identity); realm != testCase.expectedRealm {
+			t.Errorf("RealmFromIdentity(%q) expected (%q), got (%q)", testCase.identity, testCase.expectedRealm, realm)
+		}
+	}
+}
+
+func TestDestinationRealm(t *testing.T) {
+	m := diameter.NewMessage(diameter.MsgFlagRequest, 272, 4, 1, 1, []*diameter.AVP{
+		diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1;1"),
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "client.example.com"),
+		diameter.NewTypedAVP(283, 0, true, diameter.DiamIdent, "ocs.example.net"),
+	}, nil)
+
+	decoded, err := diameter.DecodeMessage(m.Encode())
+	if err != nil {
+		t.Fatalf("expected no error on DecodeMessage(), got = (%s)", err)
+	}
+
+	if realm, ok := decoded.DestinationRealm(); !ok || realm != "ocs.example.net" {
+		t.Errorf("expected DestinationRealm() = (ocs.example.net, true), got (%s, %t)", realm, ok)
+	}
+
+	for name, m := range map[string]*diameter.Message{
+		"no Destination-Realm": diameter.NewMessage(diameter.MsgFlagRequest, 272, 4, 1, 1, []*diameter.AVP{
+			diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "client.example.com"),
+		}, nil),
+		"empty Destination-Realm": diameter.NewMessage(diameter.MsgFlagRequest, 272, 4, 1, 1, []*diameter.AVP{
+			diameter.NewAVP(283, 0, true, []byte{}),
+		}, nil),
+	} {
+		if realm, ok := m.DestinationRealm(); ok {
+			t.Errorf("[%s] expected ok = false from DestinationRealm(), got (%s)", name, realm)
+		}
+	}
+}
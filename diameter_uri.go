@@ -0,0 +1,125 @@
+package diameter
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Default ports for DiameterURIs (RFC 6733 section 4.3.1).
+const (
+	DefaultDiameterPort       = 3868
+	DefaultSecureDiameterPort = 5658
+)
+
+// DiameterURI is a parsed Diameter URI (the value of a DiamURI type AVP, such as Redirect-Host),
+// of the form:
+//
+//	"aaa://" or "aaas://" FQDN [ ":" port ] [ ";transport=" transport ] [ ";protocol=" protocol ]
+//
+// Port is zero if it is not present in the URI, and Transport and Protocol are the empty string
+// if they are not present.
+type DiameterURI struct {
+	// Secure is true if the scheme is "aaas" (i.e., TLS or DTLS is required).
+	Secure    bool
+	FQDN      string
+	Port      uint16
+	Transport string
+	Protocol  string
+}
+
+// ParseDiameterURI parses a Diameter URI.  Returns an error if the scheme is not "aaa" or "aaas",
+// if the FQDN is missing, if the port is not a valid port number, or if a parameter is unknown or
+// has an unknown value.
+func ParseDiameterURI(uri string) (*DiameterURI, error) {
+	u := &DiameterURI{}
+
+	switch {
+	case strings.HasPrefix(uri, "aaa://"):
+		uri = uri[len("aaa://"):]
+	case strings.HasPrefix(uri, "aaas://"):
+		u.Secure = true
+		uri = uri[len("aaas://"):]
+	default:
+		return nil, fmt.Errorf("diameter URI scheme must be aaa or aaas")
+	}
+
+	parts := strings.Split(uri, ";")
+
+	hostAndPort := parts[0]
+	if i := strings.LastIndex(hostAndPort, ":"); i >= 0 && !strings.HasSuffix(hostAndPort, "]") {
+		port, err := strconv.ParseUint(hostAndPort[i+1:], 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("diameter URI port (%s) is not valid", hostAndPort[i+1:])
+		}
+		u.Port = uint16(port)
+		hostAndPort = hostAndPort[:i]
+	}
+
+	u.FQDN = strings.TrimSuffix(strings.TrimPrefix(hostAndPort, "["), "]")
+	if u.FQDN == "" {
+		return nil, fmt.Errorf("diameter URI has no FQDN")
+	}
+
+	for _, parameter := range parts[1:] {
+		name, value, hasValue := strings.Cut(parameter, "=")
+		if !hasValue {
+			return nil, fmt.Errorf("diameter URI parameter (%s) has no value", parameter)
+		}
+
+		switch name {
+		case "transport":
+			switch value {
+			case "tcp", "sctp", "udp":
+				u.Transport = value
+			default:
+				return nil, fmt.Errorf("diameter URI transport (%s) is not known", value)
+			}
+		case "protocol":
+			switch value {
+			case "diameter", "radius", "tacacs+":
+				u.Protocol = value
+			default:
+				return nil, fmt.Errorf("diameter URI protocol (%s) is not known", value)
+			}
+		default:
+			return nil, fmt.Errorf("diameter URI parameter (%s) is not known", name)
+		}
+	}
+
+	return u, nil
+}
+
+// DialTarget returns the network and address to use with net.Dial (or an equivalent for SCTP)
+// to reach the entity identified by the URI.  If the URI has no port, the default port for the
+// scheme is used (3868 for aaa, 5658 for aaas).  A tcp transport yields the network "tcp", and an
+// sctp transport yields the network "sctp", which is not supported by the standard net package.
+// If the URI has no transport, "tcp" is used.  Although RFC 6733 makes SCTP the default, TCP is
+// almost universally deployed.  Returns an error if the transport is udp or the protocol is
+// neither absent nor diameter, since the entity cannot then be reached by Diameter.
+func (u *DiameterURI) DialTarget() (network string, address string, err error) {
+	if u.Protocol != "" && u.Protocol != "diameter" {
+		return "", "", fmt.Errorf("diameter URI protocol (%s) is not diameter", u.Protocol)
+	}
+
+	switch u.Transport {
+	case "", "tcp":
+		network = "tcp"
+	case "sctp":
+		network = "sctp"
+	default:
+		return "", "", fmt.Errorf("diameter URI transport (%s) cannot be used for diameter", u.Transport)
+	}
+
+	port := u.Port
+	if port == 0 {
+		if u.Secure {
+			port = DefaultSecureDiameterPort
+		} else {
+			port = DefaultDiameterPort
+		}
+	}
+
+	return network, net.JoinHostPort(u.FQDN, strconv.Itoa(int(port))), nil
+}
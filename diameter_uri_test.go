@@ -0,0 +1,73 @@
+package diameter_test
+
+import (
+	"testing"
+
+	diameter "github.com/blorticus-go/diameter"
+)
+
+func TestDiameterURIDialTarget(t *testing.T) {
+	testCases := []struct {
+		uri             string
+		expectedNetwork string
+		expectedAddress string
+	}{
+		{"aaa://host.example.com", "tcp", "host.example.com:3868"},
+		{"aaas://host.example.com", "tcp", "host.example.com:5658"},
+		{"aaa://host.example.com:1813", "tcp", "host.example.com:1813"},
+		{"aaa://host.example.com;transport=tcp", "tcp", "host.example.com:3868"},
+		{"aaa://host.example.com:6666;transport=sctp", "sctp", "host.example.com:6666"},
+		{"aaa://host.example.com;transport=sctp;protocol=diameter", "sctp", "host.example.com:3868"},
+		{"aaas://host.example.com:6666;protocol=diameter;transport=tcp", "tcp", "host.example.com:6666"},
+		{"aaa://[2001:db8::1]:3869", "tcp", "[2001:db8::1]:3869"},
+	}
+
+	for _, testCase := range testCases {
+		u, err := diameter.ParseDiameterURI(testCase.uri)
+		if err != nil {
+			t.Errorf("(%s) expected no error on ParseDiameterURI(), got = (%s)", testCase.uri, err)
+			continue
+		}
+
+		network, address, err := u.DialTarget()
+		if err != nil {
+			t.Errorf("(%s) expected no error on DialTarget(), got = (%s)", testCase.uri, err)
+			continue
+		}
+
+		if network != testCase.expectedNetwork || address != testCase.expectedAddress {
+			t.Errorf("(%s) expected (%s, %s), got (%s, %s)", testCase.uri, testCase.expectedNetwork, testCase.expectedAddress, network, address)
+		}
+	}
+}
+
+func TestDiameterURIDialTargetErrors(t *testing.T) {
+	for _, uri := range []string{"aaa://host.example.com;transport=udp", "aaa://host.example.com;protocol=radius"} {
+		u, err := diameter.ParseDiameterURI(uri)
+		if err != nil {
+			t.Errorf("(%s) expected no error on ParseDiameterURI(), got = (%s)", uri, err)
+			continue
+		}
+
+		if _, _, err := u.DialTarget(); err == nil {
+			t.Errorf("(%s) expected error on DialTarget(), got none", uri)
+		}
+	}
+}
+
+func TestParseDiameterURIErrors(t *testing.T) {
+	for _, uri := range []string{
+		"http://host.example.com",
+		"aaa://",
+		"aaa://host.example.com:port",
+		"aaa://host.example.com:70000",
+		"aaa://host.example.com;transport=quic",
+		"aaa://host.example.com;protocol=ldap",
+		"aaa://host.example.com;color=blue",
+		"aaa://host.example.com;transport",
+	} {
+		if _, err := diameter.ParseDiameterURI(uri); err == nil {
+			t.Errorf("(%s) expected error on ParseDiameterURI(), got none", uri)
+		}
+	}
+}
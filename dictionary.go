@@ -2,6 +2,7 @@ package diameter
 
 import (
 	"fmt"
+	"io"
 	"os"
 
 	yaml "gopkg.in/yaml.v2"
@@ -26,13 +27,18 @@ type DictionaryYamlAvpEnumerationType struct {
 	Value uint32 `yaml:"Value"`
 }
 
-// DictionaryYamlAvpType is the type for AvpTypes in a Diameter YAML Dictionary
+// DictionaryYamlAvpType is the type for AvpTypes in a Diameter YAML Dictionary.  MaxOccurrences is
+// the maximum number of times the AVP may appear at the top level of a message.  If it is zero, there
+// is no limit.  MandatoryFlag is the rule for the M-bit of the AVP: "Must", "MustNot" or "May".  If it
+// is empty, the rule is "May".
 type DictionaryYamlAvpType struct {
-	Name        string                             `yaml:"Name"`
-	Code        uint32                             `yaml:"Code"`
-	Type        string                             `yaml:"Type"`
-	VendorID    uint32                             `yaml:"VendorId"`
-	Enumeration []DictionaryYamlAvpEnumerationType `yaml:"Enumeration"`
+	Name           string                             `yaml:"Name"`
+	Code           uint32                             `yaml:"Code"`
+	Type           string                             `yaml:"Type"`
+	VendorID       uint32                             `yaml:"VendorId,omitempty"`
+	Enumeration    []DictionaryYamlAvpEnumerationType `yaml:"Enumeration,omitempty"`
+	MaxOccurrences uint                               `yaml:"MaxOccurrences,omitempty"`
+	MandatoryFlag  string                             `yaml:"MandatoryFlag,omitempty"`
 }
 
 // DictionaryYamlMessageAbbreviation is the type for MessageTypes.Abbreviations in a Diameter YAML Dictionary
@@ -45,18 +51,38 @@ type DictionaryYamlMessageAbbreviation struct {
 type DictionaryYamlMessageType struct {
 	Basename      string                            `yaml:"Basename"`
 	Code          uint32                            `yaml:"Code"`
-	ApplicationID uint32                            `yaml:"ApplicationId"`
+	ApplicationID uint32                            `yaml:"ApplicationId,omitempty"`
 	Abbreviations DictionaryYamlMessageAbbreviation `yaml:"Abbreviations"`
 }
 
+// DictionaryYamlAvpGroupMemberType is an AVP in an AvpGroups entry of a Diameter YAML Dictionary.  Avp
+// is the name of the AVP.  If it has Children, Avp must be a Grouped AVP, and its value is built from the
+// Children.  Otherwise, Value is the key of the value for the AVP in the values provided to
+// Dictionary.Group().  If Value is empty, the key is the AVP name.
+type DictionaryYamlAvpGroupMemberType struct {
+	Avp      string                             `yaml:"Avp"`
+	Value    string                             `yaml:"Value,omitempty"`
+	Children []DictionaryYamlAvpGroupMemberType `yaml:"Children,omitempty"`
+}
+
+// DictionaryYamlAvpGroupType is the type for AvpGroups in a Diameter YAML Dictionary.  It names a
+// reusable structure for the Grouped AVP Avp, which is instantiated by Dictionary.Group().
+type DictionaryYamlAvpGroupType struct {
+	Name     string                             `yaml:"Name"`
+	Avp      string                             `yaml:"Avp"`
+	Children []DictionaryYamlAvpGroupMemberType `yaml:"Children"`
+}
+
 // DictionaryYaml represents a YAML dictionary containing Diameter message type and AVP definitions
 type DictionaryYaml struct {
-	AvpTypes     []DictionaryYamlAvpType     `yaml:"AvpTypes"`
-	MessageTypes []DictionaryYamlMessageType `yaml:"MessageTypes"`
+	AvpTypes     []DictionaryYamlAvpType      `yaml:"AvpTypes"`
+	MessageTypes []DictionaryYamlMessageType  `yaml:"MessageTypes"`
+	AvpGroups    []DictionaryYamlAvpGroupType `yaml:"AvpGroups,omitempty"`
 }
 
 type dictionaryMessageDescriptor struct {
 	name          string
+	basename      string
 	abbreviation  string
 	code          uint32
 	appID         uint32
@@ -69,13 +95,60 @@ type dictionaryAvpDescriptor struct {
 	isVendorSpecific bool
 	vendorID         uint32
 	dataType         AVPDataType
+	enumeration      []DictionaryYamlAvpEnumerationType
+	maxOccurrences   uint
+	mandatoryFlag    avpMandatoryFlagRule
 }
 
+// avpMandatoryFlagRule is the dictionary rule for the M-bit of an AVP.
+type avpMandatoryFlagRule int
+
+const (
+	mandatoryFlagMay avpMandatoryFlagRule = iota
+	mandatoryFlagMust
+	mandatoryFlagMustNot
+)
+
+var mapOfYamlMandatoryFlagStringToRule = map[string]avpMandatoryFlagRule{
+	"":        mandatoryFlagMay,
+	"May":     mandatoryFlagMay,
+	"Must":    mandatoryFlagMust,
+	"MustNot": mandatoryFlagMustNot,
+}
+
+func (rule avpMandatoryFlagRule) yamlString() string {
+	switch rule {
+	case mandatoryFlagMust:
+		return "Must"
+	case mandatoryFlagMustNot:
+		return "MustNot"
+	default:
+		return ""
+	}
+}
+
+// avpFullyQualifiedCodeType identifies an AVP type by vendor-id and code.  It should be created with
+// fullyQualifiedCodeOfAvp() or dictionaryAvpDescriptor.fullyQualifiedCode(), so that the key used to
+// store a descriptor is always built the same way as the key used to look it up.
 type avpFullyQualifiedCodeType struct {
 	vendorID uint32
 	code     uint32
 }
 
+func (descriptor *dictionaryAvpDescriptor) fullyQualifiedCode() avpFullyQualifiedCodeType {
+	return avpFullyQualifiedCodeType{vendorID: descriptor.vendorID, code: descriptor.code}
+}
+
+func fullyQualifiedCodeOfAvp(avp *AVP) avpFullyQualifiedCodeType {
+	return avpFullyQualifiedCodeType{vendorID: avp.VendorID, code: avp.Code}
+}
+
+// avpDescriptorForAvp returns the dictionary descriptor with the vendor-id and code of avp.
+func (dictionary *Dictionary) avpDescriptorForAvp(avp *AVP) (*dictionaryAvpDescriptor, bool) {
+	descriptor, isInMap := dictionary.avpDescriptorByFullyQualifiedCode[fullyQualifiedCodeOfAvp(avp)]
+	return descriptor, isInMap
+}
+
 type messageFullyQualifiedCodeType struct {
 	applicationID uint32
 	code          uint32
@@ -88,28 +161,62 @@ type Dictionary struct {
 	answerMessageDescriptorByCode         map[messageFullyQualifiedCodeType]*dictionaryMessageDescriptor
 	avpDescriptorByName                   map[string]*dictionaryAvpDescriptor
 	avpDescriptorByFullyQualifiedCode     map[avpFullyQualifiedCodeType]*dictionaryAvpDescriptor
+	avpGroupByName                        map[string]*dictionaryAvpGroup
+
+	// the descriptors in the order they were defined, used to serialize the dictionary
+	avpDescriptorsInOrder            []*dictionaryAvpDescriptor
+	requestMessageDescriptorsInOrder []*dictionaryMessageDescriptor
+	avpGroupsInOrder                 []*dictionaryAvpGroup
+
+	// 0 means DefaultMaxGroupedAvpNestingDepth
+	maxGroupedAvpNestingDepth int
+}
+
+// DefaultMaxGroupedAvpNestingDepth is the maximum depth to which a Dictionary decodes nested Grouped
+// AVPs, unless it is changed with SetMaxGroupedAvpNestingDepth().
+const DefaultMaxGroupedAvpNestingDepth = 16
+
+// SetMaxGroupedAvpNestingDepth sets the maximum depth to which Grouped AVPs are decoded by methods of
+// the dictionary that descend into Grouped AVPs (for example, TypeAnAvpRecursively()).  The children
+// of a top-level Grouped AVP are at depth 1, their children are at depth 2, and so forth.  This bounds
+// the work done for a message from an untrusted peer.  If depth is less than 1,
+// DefaultMaxGroupedAvpNestingDepth is used.
+func (dictionary *Dictionary) SetMaxGroupedAvpNestingDepth(depth int) *Dictionary {
+	dictionary.maxGroupedAvpNestingDepth = depth
+	return dictionary
+}
+
+func (dictionary *Dictionary) maxNestingDepth() int {
+	if dictionary.maxGroupedAvpNestingDepth < 1 {
+		return DefaultMaxGroupedAvpNestingDepth
+	}
+	return dictionary.maxGroupedAvpNestingDepth
 }
 
 var mapOfYamlAvpTypeStringToAVPDataType = map[string]AVPDataType{
-	"Unsigned32":  Unsigned32,
-	"Unsigned64":  Unsigned64,
-	"Integer32":   Integer32,
-	"Integer64":   Integer64,
-	"Enumerated":  Enumerated,
-	"OctetString": OctetString,
-	"UTF8String":  UTF8String,
-	"Grouped":     Grouped,
-	"Address":     Address,
-	"Time":        Time,
-	"DiamIdent":   DiamIdent,
-	"DiamURI":     DiamURI,
+	"Unsigned32":   Unsigned32,
+	"Unsigned64":   Unsigned64,
+	"Integer32":    Integer32,
+	"Integer64":    Integer64,
+	"Float32":      Float32,
+	"Float64":      Float64,
+	"Enumerated":   Enumerated,
+	"OctetString":  OctetString,
+	"UTF8String":   UTF8String,
+	"Grouped":      Grouped,
+	"Address":      Address,
+	"Time":         Time,
+	"DiamIdent":    DiamIdent,
+	"DiamURI":      DiamURI,
+	"IPFilterRule": IPFilterRule,
 }
 
 func convertYamlAvpToDictionaryAvpDescriptor(yamlAvp *DictionaryYamlAvpType) (*dictionaryAvpDescriptor, error) {
 	avpDescriptor := &dictionaryAvpDescriptor{
-		code:     yamlAvp.Code,
-		name:     yamlAvp.Name,
-		vendorID: yamlAvp.VendorID,
+		code:           yamlAvp.Code,
+		name:           yamlAvp.Name,
+		vendorID:       yamlAvp.VendorID,
+		maxOccurrences: yamlAvp.MaxOccurrences,
 	}
 
 	if avpDataType, typeStringIsRecognized := mapOfYamlAvpTypeStringToAVPDataType[yamlAvp.Type]; typeStringIsRecognized {
@@ -118,10 +225,21 @@ func convertYamlAvpToDictionaryAvpDescriptor(yamlAvp *DictionaryYamlAvpType) (*d
 		return nil, fmt.Errorf("provided Type (%s) invalid", yamlAvp.Type)
 	}
 
+	if rule, ruleIsRecognized := mapOfYamlMandatoryFlagStringToRule[yamlAvp.MandatoryFlag]; ruleIsRecognized {
+		avpDescriptor.mandatoryFlag = rule
+	} else {
+		return nil, fmt.Errorf("provided MandatoryFlag (%s) invalid", yamlAvp.MandatoryFlag)
+	}
+
 	if yamlAvp.VendorID != 0 {
 		avpDescriptor.isVendorSpecific = true
 	}
 
+	if len(yamlAvp.Enumeration) > 0 {
+		avpDescriptor.enumeration = make([]DictionaryYamlAvpEnumerationType, len(yamlAvp.Enumeration))
+		copy(avpDescriptor.enumeration, yamlAvp.Enumeration)
+	}
+
 	return avpDescriptor, nil
 }
 
@@ -134,6 +252,7 @@ func fromYamlForm(yamlForm *DictionaryYaml) (*Dictionary, error) {
 		answerMessageDescriptorByCode:         make(map[messageFullyQualifiedCodeType]*dictionaryMessageDescriptor),
 		avpDescriptorByName:                   make(map[string]*dictionaryAvpDescriptor),
 		avpDescriptorByFullyQualifiedCode:     make(map[avpFullyQualifiedCodeType]*dictionaryAvpDescriptor),
+		avpGroupByName:                        make(map[string]*dictionaryAvpGroup),
 	}
 
 	for _, yamlAvpType := range yamlForm.AvpTypes {
@@ -144,7 +263,8 @@ func fromYamlForm(yamlForm *DictionaryYaml) (*Dictionary, error) {
 		}
 
 		dictionary.avpDescriptorByName[yamlAvpType.Name] = avpDescriptor
-		dictionary.avpDescriptorByFullyQualifiedCode[avpFullyQualifiedCodeType{code: yamlAvpType.Code, vendorID: yamlAvpType.VendorID}] = avpDescriptor
+		dictionary.avpDescriptorByFullyQualifiedCode[avpDescriptor.fullyQualifiedCode()] = avpDescriptor
+		dictionary.avpDescriptorsInOrder = append(dictionary.avpDescriptorsInOrder, avpDescriptor)
 	}
 
 	for _, yamlMessageType := range yamlForm.MessageTypes {
@@ -152,6 +272,7 @@ func fromYamlForm(yamlForm *DictionaryYaml) (*Dictionary, error) {
 			code:          yamlMessageType.Code,
 			abbreviation:  yamlMessageType.Abbreviations.Request,
 			name:          yamlMessageType.Basename + "-Request",
+			basename:      yamlMessageType.Basename,
 			appID:         yamlMessageType.ApplicationID,
 			isRequestType: true,
 		}
@@ -159,11 +280,13 @@ func fromYamlForm(yamlForm *DictionaryYaml) (*Dictionary, error) {
 		dictionary.messageDescriptorByNameOrAbbreviation[yamlMessageType.Basename+"-Request"] = messageDescriptor
 		dictionary.messageDescriptorByNameOrAbbreviation[yamlMessageType.Abbreviations.Request] = messageDescriptor
 		dictionary.requestMessageDescriptorByCode[messageFullyQualifiedCodeType{yamlMessageType.ApplicationID, yamlMessageType.Code}] = messageDescriptor
+		dictionary.requestMessageDescriptorsInOrder = append(dictionary.requestMessageDescriptorsInOrder, messageDescriptor)
 
 		messageDescriptor = &dictionaryMessageDescriptor{
 			code:          yamlMessageType.Code,
 			abbreviation:  yamlMessageType.Abbreviations.Answer,
 			name:          yamlMessageType.Basename + "-Answer",
+			basename:      yamlMessageType.Basename,
 			appID:         yamlMessageType.ApplicationID,
 			isRequestType: false,
 		}
@@ -173,49 +296,169 @@ func fromYamlForm(yamlForm *DictionaryYaml) (*Dictionary, error) {
 		dictionary.answerMessageDescriptorByCode[messageFullyQualifiedCodeType{yamlMessageType.ApplicationID, yamlMessageType.Code}] = messageDescriptor
 	}
 
+	for _, yamlAvpGroup := range yamlForm.AvpGroups {
+		avpGroup, err := dictionary.convertYamlAvpGroupToDictionaryAvpGroup(&yamlAvpGroup)
+		if err != nil {
+			return nil, err
+		}
+
+		dictionary.avpGroupByName[avpGroup.name] = avpGroup
+		dictionary.avpGroupsInOrder = append(dictionary.avpGroupsInOrder, avpGroup)
+	}
+
 	return &dictionary, nil
 }
 
 // DictionaryFromYamlFile processes a file that should be a YAML formatted Diameter dictionary
 func DictionaryFromYamlFile(filepath string) (*Dictionary, error) {
-	contentsOfFileAsString, err := os.ReadFile(filepath)
+	contentsOfFile, err := os.ReadFile(filepath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file (%s): %s", filepath, err.Error())
 	}
 
-	return DictionaryFromYamlString(string(contentsOfFileAsString))
+	return dictionaryFromYamlBytes(contentsOfFile)
 }
 
 // DictionaryFromYamlString reads a string containing a Diameter dictionary in YAML format
 func DictionaryFromYamlString(yamlString string) (*Dictionary, error) {
-	dictionaryYaml := new(DictionaryYaml)
-	err := yaml.Unmarshal([]byte(yamlString), &dictionaryYaml)
+	return dictionaryFromYamlBytes([]byte(yamlString))
+}
 
+// DictionaryFromYamlReader reads a Diameter dictionary in YAML format from r (e.g., a file embedded
+// with go:embed, or the body of an HTTP response) until EOF.  An error returned by r is returned
+// (wrapped) unless it is io.EOF.
+func DictionaryFromYamlReader(r io.Reader) (*Dictionary, error) {
+	yamlBytes, err := io.ReadAll(r)
 	if err != nil {
+		return nil, fmt.Errorf("failed to read dictionary: %w", err)
+	}
+
+	return dictionaryFromYamlBytes(yamlBytes)
+}
+
+func dictionaryFromYamlBytes(yamlBytes []byte) (*Dictionary, error) {
+	dictionaryYaml := new(DictionaryYaml)
+	if err := yaml.Unmarshal(yamlBytes, dictionaryYaml); err != nil {
 		return nil, err
 	}
 
-	dictionary, err := fromYamlForm(dictionaryYaml)
+	return fromYamlForm(dictionaryYaml)
+}
 
+// ToYaml serializes the AVP, message type and AVP group definitions in the dictionary to the YAML dictionary
+// format, in the order in which they were defined.  If a name or code was defined more than once,
+// only the definition that is in effect is included.  Reading the result with DictionaryFromYamlString
+// produces an equivalent Dictionary.
+func (dictionary *Dictionary) ToYaml() ([]byte, error) {
+	yamlForm, err := dictionary.toYamlForm()
 	if err != nil {
 		return nil, err
 	}
 
-	return dictionary, nil
+	return yaml.Marshal(yamlForm)
+}
+
+func (dictionary *Dictionary) toYamlForm() (*DictionaryYaml, error) {
+	yamlTypeStringByAVPDataType := make(map[AVPDataType]string)
+	for typeString, dataType := range mapOfYamlAvpTypeStringToAVPDataType {
+		yamlTypeStringByAVPDataType[dataType] = typeString
+	}
+
+	yamlForm := &DictionaryYaml{
+		AvpTypes:     make([]DictionaryYamlAvpType, 0, len(dictionary.avpDescriptorsInOrder)),
+		MessageTypes: make([]DictionaryYamlMessageType, 0, len(dictionary.requestMessageDescriptorsInOrder)),
+	}
+
+	for _, avpDescriptor := range dictionary.avpDescriptorsInOrder {
+		if dictionary.avpDescriptorByName[avpDescriptor.name] != avpDescriptor {
+			continue
+		}
+
+		typeString, typeIsKnown := yamlTypeStringByAVPDataType[avpDescriptor.dataType]
+		if !typeIsKnown {
+			return nil, fmt.Errorf("AVP (%s) has a type that cannot be represented in YAML", avpDescriptor.name)
+		}
+
+		yamlForm.AvpTypes = append(yamlForm.AvpTypes, DictionaryYamlAvpType{
+			Name:           avpDescriptor.name,
+			Code:           avpDescriptor.code,
+			Type:           typeString,
+			VendorID:       avpDescriptor.vendorID,
+			Enumeration:    avpDescriptor.enumeration,
+			MaxOccurrences: avpDescriptor.maxOccurrences,
+			MandatoryFlag:  avpDescriptor.mandatoryFlag.yamlString(),
+		})
+	}
+
+	for _, requestDescriptor := range dictionary.requestMessageDescriptorsInOrder {
+		fullyQualifiedCode := messageFullyQualifiedCodeType{requestDescriptor.appID, requestDescriptor.code}
+		if dictionary.requestMessageDescriptorByCode[fullyQualifiedCode] != requestDescriptor {
+			continue
+		}
+
+		answerDescriptor := dictionary.answerMessageDescriptorByCode[fullyQualifiedCode]
+
+		yamlForm.MessageTypes = append(yamlForm.MessageTypes, DictionaryYamlMessageType{
+			Basename:      requestDescriptor.basename,
+			Code:          requestDescriptor.code,
+			ApplicationID: requestDescriptor.appID,
+			Abbreviations: DictionaryYamlMessageAbbreviation{
+				Request: requestDescriptor.abbreviation,
+				Answer:  answerDescriptor.abbreviation,
+			},
+		})
+	}
+
+	for _, avpGroup := range dictionary.avpGroupsInOrder {
+		if dictionary.avpGroupByName[avpGroup.name] != avpGroup {
+			continue
+		}
+
+		yamlForm.AvpGroups = append(yamlForm.AvpGroups, avpGroup.yamlForm())
+	}
+
+	return yamlForm, nil
 }
 
+// MessageCodeAsAString returns the full name of the message type for m (e.g., "Capabilities-Exchange-Request"),
+// or the empty string if the message type is not in the dictionary.
 func (dictionary *Dictionary) MessageCodeAsAString(m *Message) string {
+	name, _, _ := dictionary.MessageDescriptor(m.AppID, m.Code, m.IsRequest())
+	return name
+}
+
+// MessageCodeAsAStringOrDefault is the same as MessageCodeAsAString, except that if the message type is
+// not in the dictionary, it returns a description of the message type instead of the empty string:
+// "Unknown-Request(appID=X,code=Y)" or "Unknown-Answer(appID=X,code=Y)".  This is intended for logs.
+func (dictionary *Dictionary) MessageCodeAsAStringOrDefault(m *Message) string {
+	if name := dictionary.MessageCodeAsAString(m); name != "" {
+		return name
+	}
+
 	if m.IsRequest() {
-		if name := dictionary.requestMessageDescriptorByCode[messageFullyQualifiedCodeType{m.AppID, uint32(m.Code)}]; name != nil {
-			return name.name
-		}
+		return fmt.Sprintf("Unknown-Request(appID=%d,code=%d)", m.AppID, m.Code)
+	}
+	return fmt.Sprintf("Unknown-Answer(appID=%d,code=%d)", m.AppID, m.Code)
+}
+
+// MessageDescriptor looks up the message type with the provided application-id and code.  If isRequest
+// is true, the request type is looked up; otherwise, the answer type is looked up.  Returns the full name
+// (e.g., "Capabilities-Exchange-Request") and abbreviation (e.g., "CER") for the message type.  If the
+// message type is not in the dictionary, ok is false.
+func (dictionary *Dictionary) MessageDescriptor(appID uint32, code Uint24, isRequest bool) (name string, abbreviation string, ok bool) {
+	var descriptor *dictionaryMessageDescriptor
+
+	if isRequest {
+		descriptor, ok = dictionary.requestMessageDescriptorByCode[messageFullyQualifiedCodeType{appID, uint32(code)}]
 	} else {
-		if name := dictionary.answerMessageDescriptorByCode[messageFullyQualifiedCodeType{m.AppID, uint32(m.Code)}]; name != nil {
-			return name.name
-		}
+		descriptor, ok = dictionary.answerMessageDescriptorByCode[messageFullyQualifiedCodeType{appID, uint32(code)}]
 	}
 
-	return ""
+	if !ok {
+		return "", "", false
+	}
+
+	return descriptor.name, descriptor.abbreviation, true
 }
 
 // DataTypeForAVPNamed looks up the data type for the specific AVP
@@ -231,26 +474,120 @@ func (dictionary *Dictionary) DataTypeForAVPNamed(name string) (AVPDataType, err
 
 // DataTypeForAvp returns the AVPDataType for the AVP based on its vendor-id and code.  If the type is not in the dictionary, returns TypeOrAvpUnknown.
 func (dictionary *Dictionary) DataTypeForAvp(avp *AVP) AVPDataType {
-	if diameterType, isInMap := dictionary.avpDescriptorByFullyQualifiedCode[avpFullyQualifiedCodeType{avp.VendorID, avp.Code}]; isInMap {
+	if diameterType, isInMap := dictionary.avpDescriptorForAvp(avp); isInMap {
 		return diameterType.dataType
 	}
 
 	return TypeOrAvpUnknown
 }
 
+// DuplicateUniqueAvps returns the vendor-id and code of each top-level AVP in the message that appears
+// more times than the MaxOccurrences for the AVP in the dictionary (e.g., a second Session-Id).  They
+// are returned in the order in which the first excess occurrence of each appears in the message.  AVPs
+// that are not in the dictionary, or that have no MaxOccurrences, are not checked.  Returns nil if no
+// AVP appears too many times.
+func (dictionary *Dictionary) DuplicateUniqueAvps(m *Message) []AvpVendorIdAndCode {
+	var duplicates []AvpVendorIdAndCode
+	occurrences := make(map[avpFullyQualifiedCodeType]uint)
+
+	for _, avp := range m.Avps {
+		fullyQualifiedCode := fullyQualifiedCodeOfAvp(avp)
+
+		descriptor, isInMap := dictionary.avpDescriptorByFullyQualifiedCode[fullyQualifiedCode]
+		if !isInMap || descriptor.maxOccurrences == 0 {
+			continue
+		}
+
+		occurrences[fullyQualifiedCode]++
+		if occurrences[fullyQualifiedCode] == descriptor.maxOccurrences+1 {
+			duplicates = append(duplicates, AvpVendorIdAndCode{avp.VendorID, avp.Code})
+		}
+	}
+
+	return duplicates
+}
+
+// GroupedAvpFlagViolation is an AVP inside a Grouped AVP whose M-bit is not consistent with the
+// dictionary or with the Grouped AVP that contains it.  Group is the Grouped AVP that directly contains
+// the AVP, which may itself be inside another Grouped AVP.
+type GroupedAvpFlagViolation struct {
+	Group  AvpVendorIdAndCode
+	Child  AvpVendorIdAndCode
+	Reason string
+}
+
+// GroupedAvpFlagViolations checks the M-bit of every AVP inside each Grouped AVP in the message, at
+// any depth.  A violation is returned for a child whose M-bit is clear when its MandatoryFlag in the
+// dictionary is "Must", or set when it is "MustNot"; and for a child whose M-bit is set when the M-bit
+// of the Grouped AVP is clear, which RFC 6733 section 4.4 forbids.  The violations are returned in the
+// order in which the children appear in the message.  AVPs are Grouped if they are Grouped in the
+// dictionary; Grouped AVPs whose data cannot be decoded, and AVPs beyond the maximum nesting depth
+// (see SetMaxGroupedAvpNestingDepth()), are not checked.  Returns nil if there are no violations.  This
+// is a strict check that is mostly useful for conformance testing.
+func (dictionary *Dictionary) GroupedAvpFlagViolations(m *Message) []GroupedAvpFlagViolation {
+	var violations []GroupedAvpFlagViolation
+
+	for _, avp := range m.Avps {
+		violations = dictionary.appendGroupedAvpFlagViolations(violations, avp, 0)
+	}
+
+	return violations
+}
+
+func (dictionary *Dictionary) appendGroupedAvpFlagViolations(violations []GroupedAvpFlagViolation, group *AVP, depth int) []GroupedAvpFlagViolation {
+	if dictionary.DataTypeForAvp(group) != Grouped || depth >= dictionary.maxNestingDepth() {
+		return violations
+	}
+
+	children, err := ConvertAVPDataToTypedData(group.Data, Grouped)
+	if err != nil {
+		return violations
+	}
+
+	groupID := AvpVendorIdAndCode{group.VendorID, group.Code}
+
+	for _, child := range children.([]*AVP) {
+		childID := AvpVendorIdAndCode{child.VendorID, child.Code}
+
+		if child.Mandatory && !group.Mandatory {
+			violations = append(violations, GroupedAvpFlagViolation{groupID, childID, "M-bit is set but the M-bit of the Grouped AVP is not"})
+		}
+
+		if descriptor, isInMap := dictionary.avpDescriptorForAvp(child); isInMap {
+			switch {
+			case descriptor.mandatoryFlag == mandatoryFlagMust && !child.Mandatory:
+				violations = append(violations, GroupedAvpFlagViolation{groupID, childID, fmt.Sprintf("M-bit is not set but (%s) must have it set", descriptor.name)})
+			case descriptor.mandatoryFlag == mandatoryFlagMustNot && child.Mandatory:
+				violations = append(violations, GroupedAvpFlagViolation{groupID, childID, fmt.Sprintf("M-bit is set but (%s) must not have it set", descriptor.name)})
+			}
+		}
+
+		violations = dictionary.appendGroupedAvpFlagViolations(violations, child, depth+1)
+	}
+
+	return violations
+}
+
 // AVPErrorable returns an AVP based on the dictionary definition.  If the name is not in
 // the dictionary, or the value type is incorrect based on the dictionary definition,
 // return an error.  This is Errorable because it may throw an error.  It is assumed
 // that this will be the uncommon case, because ordinarily, the value will be known in
 // advance by the application creating it.
 func (dictionary *Dictionary) AVPErrorable(name string, value interface{}) (*AVP, error) {
+	return dictionary.AVPWithFlags(name, false, value)
+}
+
+// AVPWithFlags is the same as AVPErrorable, except that the mandatory flag of the returned
+// AVP is set to the value of mandatory.  The vendor-id and type still come from the
+// dictionary definition.
+func (dictionary *Dictionary) AVPWithFlags(name string, mandatory bool, value interface{}) (*AVP, error) {
 	descriptor, isInMap := dictionary.avpDescriptorByName[name]
 
 	if !isInMap {
 		return nil, fmt.Errorf("no AVP named (%s) in the dictionary", name)
 	}
 
-	return NewTypedAVPErrorable(descriptor.code, descriptor.vendorID, false, descriptor.dataType, value)
+	return NewTypedAVPErrorable(descriptor.code, descriptor.vendorID, mandatory, descriptor.dataType, value)
 }
 
 // AVP is the same as AVPErrorable, except that, if an error occurs, panic() is invoked
@@ -265,13 +602,51 @@ func (dictionary *Dictionary) AVP(name string, value interface{}) *AVP {
 	return avp
 }
 
+// AvpFactory creates AVPs of a single type from a dictionary.  The dictionary definition is resolved
+// once, when the factory is created, so this is cheaper than repeated calls to Dictionary.AVP() when
+// many AVPs of the same type are created.
+type AvpFactory struct {
+	descriptor *dictionaryAvpDescriptor
+}
+
+// AvpFactory returns an AvpFactory for the AVP named name in the dictionary.  Returns an error if the
+// name is not in the dictionary.
+func (dictionary *Dictionary) AvpFactory(name string) (*AvpFactory, error) {
+	descriptor, isInMap := dictionary.avpDescriptorByName[name]
+
+	if !isInMap {
+		return nil, fmt.Errorf("no AVP named (%s) in the dictionary", name)
+	}
+
+	return &AvpFactory{descriptor: descriptor}, nil
+}
+
+// NewErrorable returns an AVP with the value, which is the same as the result of
+// Dictionary.AVPErrorable() for the AVP name used to create the factory.  Returns an error if the
+// value type is incorrect based on the dictionary definition.
+func (factory *AvpFactory) NewErrorable(value interface{}) (*AVP, error) {
+	return NewTypedAVPErrorable(factory.descriptor.code, factory.descriptor.vendorID, false, factory.descriptor.dataType, value)
+}
+
+// New is the same as NewErrorable, except that, if an error occurs, panic() is invoked with the
+// error string.
+func (factory *AvpFactory) New(value interface{}) *AVP {
+	avp, err := factory.NewErrorable(value)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return avp
+}
+
 // TypeAnAvp attempts to provide the ExtendedAttributes for the provided AVP.  If the AVP type
 // is not found in the dictionary, the ExtendedAttributes for untypedAvp is set to nil and the
 // untypedAvp is returned.  If an error occurs when attempting to conver the AVP's data to the
 // type in the dictionary, return (nil, err).  Otherwise, return untypedAvp with its
 // ExtendedAttributes set.
 func (dictionary *Dictionary) TypeAnAvp(untypedAvp *AVP) (*AVP, error) {
-	avpInfo, isInMap := dictionary.avpDescriptorByFullyQualifiedCode[avpFullyQualifiedCodeType{untypedAvp.VendorID, untypedAvp.Code}]
+	avpInfo, isInMap := dictionary.avpDescriptorForAvp(untypedAvp)
 
 	if !isInMap || avpInfo.dataType == TypeOrAvpUnknown {
 		untypedAvp.ExtendedAttributes = nil
@@ -292,11 +667,72 @@ func (dictionary *Dictionary) TypeAnAvp(untypedAvp *AVP) (*AVP, error) {
 	return untypedAvp, nil
 }
 
+// TypeAnAvpRecursively is the same as TypeAnAvp, except that if the AVP is Grouped, each AVP in its
+// TypedValue is also typed, as are the AVPs in any Grouped AVP inside it, and so forth.  Returns an
+// error wrapping ErrGroupedAvpNestingTooDeep if the Grouped AVPs are nested more deeply than the
+// maximum nesting depth (see SetMaxGroupedAvpNestingDepth()).
+func (dictionary *Dictionary) TypeAnAvpRecursively(untypedAvp *AVP) (*AVP, error) {
+	return dictionary.typeAnAvpAtDepth(untypedAvp, 0)
+}
+
+func (dictionary *Dictionary) typeAnAvpAtDepth(untypedAvp *AVP, depth int) (*AVP, error) {
+	typedAvp, err := dictionary.TypeAnAvp(untypedAvp)
+	if err != nil {
+		return nil, err
+	}
+
+	children, isGrouped := typedAvp.AsGrouped()
+	if !isGrouped {
+		return typedAvp, nil
+	}
+
+	if depth >= dictionary.maxNestingDepth() {
+		return nil, fmt.Errorf("%w: Grouped AVP with code (%d) at depth (%d) has children beyond the maximum depth (%d)", ErrGroupedAvpNestingTooDeep, typedAvp.Code, depth, dictionary.maxNestingDepth())
+	}
+
+	for _, child := range children {
+		if _, err := dictionary.typeAnAvpAtDepth(child, depth+1); err != nil {
+			return nil, err
+		}
+	}
+
+	return typedAvp, nil
+}
+
+// TypedEnumValue decodes the value of an Enumerated AVP and looks it up in the enumeration for the AVP
+// in the dictionary.  If the value is defined in the enumeration, name is the name of the value and known
+// is true.  Otherwise, name is the empty string and known is false.  Returns an error if the AVP is not
+// in the dictionary, if its dictionary type is not Enumerated, or if its data cannot be decoded.
+func (dictionary *Dictionary) TypedEnumValue(avp *AVP) (value int32, name string, known bool, err error) {
+	avpInfo, isInMap := dictionary.avpDescriptorForAvp(avp)
+	if !isInMap {
+		return 0, "", false, fmt.Errorf("no AVP with vendor-id (%d) and code (%d) in the dictionary", avp.VendorID, avp.Code)
+	}
+
+	if avpInfo.dataType != Enumerated {
+		return 0, "", false, fmt.Errorf("AVP (%s) is not Enumerated", avpInfo.name)
+	}
+
+	typedData, err := ConvertAVPDataToTypedData(avp.Data, Enumerated)
+	if err != nil {
+		return 0, "", false, err
+	}
+
+	value = typedData.(int32)
+	for _, enumeratedValue := range avpInfo.enumeration {
+		if int32(enumeratedValue.Value) == value {
+			return value, enumeratedValue.Name, true, nil
+		}
+	}
+
+	return value, "", false, nil
+}
+
 // MessageFlags provides the Diameter Message flag types
 type MessageFlags struct {
-	Proxiable           bool
-	Error               bool
-	PotentialRetransmit bool
+	Proxiable           bool `yaml:"Proxiable"`
+	Error               bool `yaml:"Error"`
+	PotentialRetransmit bool `yaml:"PotentialRetransmit"`
 }
 
 // MessageErrorable returns a Message based on the dictionary definition.  If the name is
@@ -307,6 +743,48 @@ func (dictionary *Dictionary) MessageErrorable(name string, flags MessageFlags,
 		return nil, fmt.Errorf("message of type (%s) is not known", name)
 	}
 
+	return messageDescriptor.newMessage(messageDescriptor.appID, flags, mandatoryAVPs, additionalAVPs), nil
+}
+
+// Message is the same as MessageErrorable, except that, if an error occurs, panic() is
+// invoked with the error string
+func (dictionary *Dictionary) Message(name string, flags MessageFlags, mandatoryAVPs []*AVP, additionalAVPs []*AVP) *Message {
+	m, err := dictionary.MessageErrorable(name, flags, mandatoryAVPs, additionalAVPs)
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+// MessageForApplicationErrorable is the same as MessageErrorable, except that the Application-Id of the
+// message is appID rather than the Application-Id in the dictionary definition.  This is for applications
+// that reuse a message code defined for another application (e.g., a base protocol message).  Note that
+// the dictionary describes messages by Application-Id and code, so the returned message might not be
+// recognized by, for example, MessageDescriptor() or TypeAMessage().
+func (dictionary *Dictionary) MessageForApplicationErrorable(name string, appID uint32, flags MessageFlags, mandatoryAVPs []*AVP, additionalAVPs []*AVP) (*Message, error) {
+	messageDescriptor, messageTypeIsDefined := dictionary.messageDescriptorByNameOrAbbreviation[name]
+	if !messageTypeIsDefined {
+		return nil, fmt.Errorf("message of type (%s) is not known", name)
+	}
+
+	return messageDescriptor.newMessage(appID, flags, mandatoryAVPs, additionalAVPs), nil
+}
+
+// MessageForApplication is the same as MessageForApplicationErrorable, except that, if an error
+// occurs, panic() is invoked with the error string
+func (dictionary *Dictionary) MessageForApplication(name string, appID uint32, flags MessageFlags, mandatoryAVPs []*AVP, additionalAVPs []*AVP) *Message {
+	m, err := dictionary.MessageForApplicationErrorable(name, appID, flags, mandatoryAVPs, additionalAVPs)
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+// newMessage returns a message of the type described by the descriptor, with the Application-Id appID.
+// The request flag is set from the descriptor and the other flags from flags.
+func (messageDescriptor *dictionaryMessageDescriptor) newMessage(appID uint32, flags MessageFlags, mandatoryAVPs []*AVP, additionalAVPs []*AVP) *Message {
 	flagsEncoded := uint8(0)
 	if flags.PotentialRetransmit {
 		flagsEncoded |= MsgFlagPotentialRetransmit
@@ -322,18 +800,7 @@ func (dictionary *Dictionary) MessageErrorable(name string, flags MessageFlags,
 		flagsEncoded |= MsgFlagRequest
 	}
 
-	return NewMessage(flagsEncoded, Uint24(messageDescriptor.code), messageDescriptor.appID, 0, 0, mandatoryAVPs, additionalAVPs), nil
-}
-
-// Message is the same as MessageErrorable, except that, if an error occurs, panic() is
-// invoked with the error string
-func (dictionary *Dictionary) Message(name string, flags MessageFlags, mandatoryAVPs []*AVP, additionalAVPs []*AVP) *Message {
-	m, err := dictionary.MessageErrorable(name, flags, mandatoryAVPs, additionalAVPs)
-	if err != nil {
-		panic(err)
-	}
-
-	return m
+	return NewMessage(flagsEncoded, Uint24(messageDescriptor.code), appID, 0, 0, mandatoryAVPs, additionalAVPs)
 }
 
 // TypeAMessage attempts to provide ExendedAttribute information for the provided message based on a message
@@ -0,0 +1,214 @@
+package diameter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// dictionaryAvpGroup is a named structure for a Grouped AVP, defined in the AvpGroups of a YAML
+// dictionary.
+type dictionaryAvpGroup struct {
+	name string
+	root *dictionaryAvpGroupMember
+}
+
+// dictionaryAvpGroupMember is an AVP in a dictionaryAvpGroup.  If children is empty, the value of the
+// AVP is the value with the key valueKey.
+type dictionaryAvpGroupMember struct {
+	descriptor *dictionaryAvpDescriptor
+	valueKey   string
+	children   []*dictionaryAvpGroupMember
+}
+
+func (dictionary *Dictionary) convertYamlAvpGroupToDictionaryAvpGroup(yamlAvpGroup *DictionaryYamlAvpGroupType) (*dictionaryAvpGroup, error) {
+	if yamlAvpGroup.Name == "" {
+		return nil, fmt.Errorf("AVP group for AVP (%s) has no Name", yamlAvpGroup.Avp)
+	}
+
+	if len(yamlAvpGroup.Children) == 0 {
+		return nil, fmt.Errorf("AVP group (%s) has no Children", yamlAvpGroup.Name)
+	}
+
+	valueKeysInUse := make(map[string]bool)
+	root, err := dictionary.convertYamlAvpGroupMember(&DictionaryYamlAvpGroupMemberType{Avp: yamlAvpGroup.Avp, Children: yamlAvpGroup.Children}, valueKeysInUse)
+	if err != nil {
+		return nil, fmt.Errorf("AVP group (%s): %s", yamlAvpGroup.Name, err)
+	}
+
+	return &dictionaryAvpGroup{name: yamlAvpGroup.Name, root: root}, nil
+}
+
+func (dictionary *Dictionary) convertYamlAvpGroupMember(yamlMember *DictionaryYamlAvpGroupMemberType, valueKeysInUse map[string]bool) (*dictionaryAvpGroupMember, error) {
+	descriptor, isInMap := dictionary.avpDescriptorByName[yamlMember.Avp]
+	if !isInMap {
+		return nil, fmt.Errorf("no AVP named (%s) in the dictionary", yamlMember.Avp)
+	}
+
+	member := &dictionaryAvpGroupMember{descriptor: descriptor}
+
+	if len(yamlMember.Children) == 0 {
+		member.valueKey = yamlMember.Value
+		if member.valueKey == "" {
+			member.valueKey = yamlMember.Avp
+		}
+
+		if valueKeysInUse[member.valueKey] {
+			return nil, fmt.Errorf("value key (%s) is used more than once", member.valueKey)
+		}
+		valueKeysInUse[member.valueKey] = true
+
+		return member, nil
+	}
+
+	if descriptor.dataType != Grouped {
+		return nil, fmt.Errorf("AVP (%s) has Children but is not Grouped", yamlMember.Avp)
+	}
+	if yamlMember.Value != "" {
+		return nil, fmt.Errorf("AVP (%s) has both Children and a Value", yamlMember.Avp)
+	}
+
+	for i := range yamlMember.Children {
+		child, err := dictionary.convertYamlAvpGroupMember(&yamlMember.Children[i], valueKeysInUse)
+		if err != nil {
+			return nil, err
+		}
+		member.children = append(member.children, child)
+	}
+
+	return member, nil
+}
+
+func (group *dictionaryAvpGroup) yamlForm() DictionaryYamlAvpGroupType {
+	root := group.root.yamlForm()
+	return DictionaryYamlAvpGroupType{Name: group.name, Avp: root.Avp, Children: root.Children}
+}
+
+func (member *dictionaryAvpGroupMember) yamlForm() DictionaryYamlAvpGroupMemberType {
+	yamlMember := DictionaryYamlAvpGroupMemberType{Avp: member.descriptor.name}
+
+	if len(member.children) == 0 {
+		if member.valueKey != member.descriptor.name {
+			yamlMember.Value = member.valueKey
+		}
+		return yamlMember
+	}
+
+	for _, child := range member.children {
+		yamlMember.Children = append(yamlMember.Children, child.yamlForm())
+	}
+
+	return yamlMember
+}
+
+// Group returns the Grouped AVP described by the AVP group named name (in the AvpGroups section of the
+// YAML dictionary), using values for the AVPs in the group.  For example, given this AVP group:
+//
+//	AvpGroups:
+//	  - Name: "Money"
+//	    Avp: "CC-Money"
+//	    Children:
+//	      - Avp: "Unit-Value"
+//	        Children:
+//	          - Avp: "Value-Digits"
+//	          - Avp: "Exponent"
+//	      - Avp: "Currency-Code"
+//
+// Group("Money", map[string]interface{}{"Value-Digits": int64(1250), "Exponent": int32(-2), "Currency-Code": uint32(840)})
+// returns a CC-Money AVP containing a Unit-Value AVP (with the Value-Digits and Exponent AVPs) and a
+// Currency-Code AVP.  The key of the value for an AVP is its name, unless the AVP group provides a
+// different key with Value (which is necessary if the same AVP appears more than once in the group).
+// Each value must be acceptable to NewTypedAVPErrorable() for the type of the AVP; for an Enumerated AVP,
+// it may also be the name of an enumerated value.  An AVP with no value in values is omitted, as is a
+// Grouped AVP all of whose children are omitted.  The M-bit of each AVP is set if the dictionary requires
+// it (MandatoryFlag "Must").  Returns an error if there is no AVP group named name, if values has a key
+// that is not used by the group, if no AVP in the group has a value, or if a value cannot be converted
+// to the type of its AVP.
+func (dictionary *Dictionary) Group(name string, values map[string]interface{}) (*AVP, error) {
+	group, isInMap := dictionary.avpGroupByName[name]
+	if !isInMap {
+		return nil, fmt.Errorf("no AVP group named (%s) in the dictionary", name)
+	}
+
+	valueKeysUsed := make(map[string]bool)
+	avp, err := group.root.instantiate(values, valueKeysUsed)
+	if err != nil {
+		return nil, fmt.Errorf("AVP group (%s): %s", name, err)
+	}
+
+	var unusedValueKeys []string
+	for key := range values {
+		if !valueKeysUsed[key] {
+			unusedValueKeys = append(unusedValueKeys, key)
+		}
+	}
+	if len(unusedValueKeys) > 0 {
+		sort.Strings(unusedValueKeys)
+		return nil, fmt.Errorf("AVP group (%s) has no AVP for value keys (%s)", name, strings.Join(unusedValueKeys, ", "))
+	}
+
+	if avp == nil {
+		return nil, fmt.Errorf("AVP group (%s): no value is provided for any AVP", name)
+	}
+
+	return avp, nil
+}
+
+// instantiate returns the AVP for the member using values, or nil if no value is provided for it (or,
+// for a Grouped AVP, for any of its descendants).  The key of each value used is added to valueKeysUsed.
+func (member *dictionaryAvpGroupMember) instantiate(values map[string]interface{}, valueKeysUsed map[string]bool) (*AVP, error) {
+	descriptor := member.descriptor
+	mandatory := descriptor.mandatoryFlag == mandatoryFlagMust
+
+	if len(member.children) == 0 {
+		value, hasValue := values[member.valueKey]
+		if !hasValue {
+			return nil, nil
+		}
+		valueKeysUsed[member.valueKey] = true
+
+		if enumerationName, isString := value.(string); isString && descriptor.dataType == Enumerated {
+			enumeratedValue, isKnown := descriptor.enumeratedValueNamed(enumerationName)
+			if !isKnown {
+				return nil, fmt.Errorf("AVP (%s) has no enumerated value named (%s)", descriptor.name, enumerationName)
+			}
+			value = enumeratedValue
+		}
+
+		avp, err := NewTypedAVPErrorable(descriptor.code, descriptor.vendorID, mandatory, descriptor.dataType, value)
+		if err != nil {
+			return nil, fmt.Errorf("AVP (%s): %s", descriptor.name, err)
+		}
+
+		return avp, nil
+	}
+
+	children := make([]*AVP, 0, len(member.children))
+	for _, childMember := range member.children {
+		child, err := childMember.instantiate(values, valueKeysUsed)
+		if err != nil {
+			return nil, err
+		}
+		if child != nil {
+			children = append(children, child)
+		}
+	}
+
+	if len(children) == 0 {
+		return nil, nil
+	}
+
+	return NewTypedAVPErrorable(descriptor.code, descriptor.vendorID, mandatory, Grouped, children)
+}
+
+// enumeratedValueNamed returns the value of the enumeration entry named name.  known is false if there is
+// no such entry.
+func (descriptor *dictionaryAvpDescriptor) enumeratedValueNamed(name string) (value int32, known bool) {
+	for _, enumeratedValue := range descriptor.enumeration {
+		if enumeratedValue.Name == name {
+			return int32(enumeratedValue.Value), true
+		}
+	}
+
+	return 0, false
+}
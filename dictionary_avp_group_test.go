@@ -0,0 +1,210 @@
+package diameter_test
+
+import (
+	"strings"
+	"testing"
+
+	diameter "github.com/blorticus-go/diameter"
+)
+
+const avpGroupTestDictionary = `---
+AvpTypes:
+    - Name: "CC-Money"
+      Code: 413
+      Type: "Grouped"
+      MandatoryFlag: "Must"
+    - Name: "Unit-Value"
+      Code: 445
+      Type: "Grouped"
+      MandatoryFlag: "Must"
+    - Name: "Value-Digits"
+      Code: 447
+      Type: "Integer64"
+      MandatoryFlag: "Must"
+    - Name: "Exponent"
+      Code: 429
+      Type: "Integer32"
+      MandatoryFlag: "Must"
+    - Name: "Currency-Code"
+      Code: 425
+      Type: "Unsigned32"
+      MandatoryFlag: "Must"
+    - Name: "Used-Service-Unit"
+      Code: 446
+      Type: "Grouped"
+      MandatoryFlag: "Must"
+    - Name: "Tariff-Change-Usage"
+      Code: 452
+      Type: "Enumerated"
+      Enumeration:
+        - Name: "UNIT_BEFORE_TARIFF_CHANGE"
+          Value: 0
+        - Name: "UNIT_AFTER_TARIFF_CHANGE"
+          Value: 1
+        - Name: "UNIT_INDETERMINATE"
+          Value: 2
+AvpGroups:
+    - Name: "Money"
+      Avp: "CC-Money"
+      Children:
+        - Avp: "Unit-Value"
+          Children:
+            - Avp: "Value-Digits"
+            - Avp: "Exponent"
+        - Avp: "Currency-Code"
+    - Name: "Used-Money"
+      Avp: "Used-Service-Unit"
+      Children:
+        - Avp: "Tariff-Change-Usage"
+          Value: "Tariff"
+        - Avp: "CC-Money"
+          Children:
+            - Avp: "Unit-Value"
+              Children:
+                - Avp: "Value-Digits"
+                  Value: "UsedDigits"
+`
+
+func TestDictionaryGroup(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(avpGroupTestDictionary)
+	if err != nil {
+		t.Fatalf("DictionaryFromYamlString() error: %s", err)
+	}
+
+	for _, testCase := range []struct {
+		name        string
+		group       string
+		values      map[string]interface{}
+		expectedAvp *diameter.AVP
+	}{
+		{
+			name:   "every value provided",
+			group:  "Money",
+			values: map[string]interface{}{"Value-Digits": int64(1250), "Exponent": int32(-2), "Currency-Code": uint32(840)},
+			expectedAvp: diameter.NewGroupedAVP(413, 0, true,
+				diameter.NewGroupedAVP(445, 0, true,
+					diameter.NewTypedAVP(447, 0, true, diameter.Integer64, int64(1250)),
+					diameter.NewTypedAVP(429, 0, true, diameter.Integer32, int32(-2)),
+				),
+				diameter.NewTypedAVP(425, 0, true, diameter.Unsigned32, uint32(840)),
+			),
+		},
+		{
+			name:   "AVPs without values are omitted",
+			group:  "Money",
+			values: map[string]interface{}{"Value-Digits": int64(7)},
+			expectedAvp: diameter.NewGroupedAVP(413, 0, true,
+				diameter.NewGroupedAVP(445, 0, true,
+					diameter.NewTypedAVP(447, 0, true, diameter.Integer64, int64(7)),
+				),
+			),
+		},
+		{
+			name:   "value keys and enumeration names",
+			group:  "Used-Money",
+			values: map[string]interface{}{"Tariff": "UNIT_AFTER_TARIFF_CHANGE", "UsedDigits": int64(300)},
+			expectedAvp: diameter.NewGroupedAVP(446, 0, true,
+				diameter.NewTypedAVP(452, 0, false, diameter.Enumerated, int32(1)),
+				diameter.NewGroupedAVP(413, 0, true,
+					diameter.NewGroupedAVP(445, 0, true,
+						diameter.NewTypedAVP(447, 0, true, diameter.Integer64, int64(300)),
+					),
+				),
+			),
+		},
+	} {
+		avp, err := dictionary.Group(testCase.group, testCase.values)
+		if err != nil {
+			t.Errorf("[%s] Group() error: %s", testCase.name, err)
+			continue
+		}
+
+		if !avp.Equal(testCase.expectedAvp) {
+			t.Errorf("[%s] Group() returned AVP that does not match expected AVP", testCase.name)
+		}
+	}
+}
+
+func TestDictionaryGroupErrors(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(avpGroupTestDictionary)
+	if err != nil {
+		t.Fatalf("DictionaryFromYamlString() error: %s", err)
+	}
+
+	for _, testCase := range []struct {
+		name   string
+		group  string
+		values map[string]interface{}
+	}{
+		{name: "unknown group", group: "No-Such-Group", values: map[string]interface{}{"Value-Digits": int64(1)}},
+		{name: "no values", group: "Money", values: map[string]interface{}{}},
+		{name: "value key not in group", group: "Money", values: map[string]interface{}{"Value-Digits": int64(1), "Tariff": int32(0)}},
+		{name: "value of wrong type", group: "Money", values: map[string]interface{}{"Currency-Code": "USD"}},
+		{name: "unknown enumeration name", group: "Used-Money", values: map[string]interface{}{"Tariff": "UNIT_SOMETIMES"}},
+	} {
+		if _, err := dictionary.Group(testCase.group, testCase.values); err == nil {
+			t.Errorf("[%s] expected error from Group(), got none", testCase.name)
+		}
+	}
+}
+
+func TestDictionaryWithInvalidAvpGroups(t *testing.T) {
+	avpTypes := avpGroupTestDictionary[:strings.Index(avpGroupTestDictionary, "AvpGroups:")]
+
+	for _, testCase := range []struct {
+		name      string
+		avpGroups string
+	}{
+		{
+			name:      "unknown AVP",
+			avpGroups: "    - Name: \"G\"\n      Avp: \"CC-Money\"\n      Children:\n        - Avp: \"No-Such-Avp\"\n",
+		},
+		{
+			name:      "Children for AVP that is not Grouped",
+			avpGroups: "    - Name: \"G\"\n      Avp: \"Currency-Code\"\n      Children:\n        - Avp: \"Exponent\"\n",
+		},
+		{
+			name:      "no Children",
+			avpGroups: "    - Name: \"G\"\n      Avp: \"CC-Money\"\n",
+		},
+		{
+			name:      "value key used twice",
+			avpGroups: "    - Name: \"G\"\n      Avp: \"CC-Money\"\n      Children:\n        - Avp: \"Currency-Code\"\n        - Avp: \"Exponent\"\n          Value: \"Currency-Code\"\n",
+		},
+	} {
+		if _, err := diameter.DictionaryFromYamlString(avpTypes + "AvpGroups:\n" + testCase.avpGroups); err == nil {
+			t.Errorf("[%s] expected error from DictionaryFromYamlString(), got none", testCase.name)
+		}
+	}
+}
+
+func TestDictionaryToYamlIncludesAvpGroups(t *testing.T) {
+	original, err := diameter.DictionaryFromYamlString(avpGroupTestDictionary)
+	if err != nil {
+		t.Fatalf("DictionaryFromYamlString() error: %s", err)
+	}
+
+	serialized, err := original.ToYaml()
+	if err != nil {
+		t.Fatalf("ToYaml() error: %s", err)
+	}
+
+	reloaded, err := diameter.DictionaryFromYamlString(string(serialized))
+	if err != nil {
+		t.Fatalf("DictionaryFromYamlString() error for ToYaml() output: %s", err)
+	}
+
+	values := map[string]interface{}{"Tariff": int32(2), "UsedDigits": int64(12)}
+	originalAvp, err := original.Group("Used-Money", values)
+	if err != nil {
+		t.Fatalf("Group() error for original dictionary: %s", err)
+	}
+	reloadedAvp, err := reloaded.Group("Used-Money", values)
+	if err != nil {
+		t.Fatalf("Group() error for reloaded dictionary: %s", err)
+	}
+
+	if !reloadedAvp.Equal(originalAvp) {
+		t.Errorf("expected Group() from reloaded dictionary to match Group() from original dictionary")
+	}
+}
@@ -0,0 +1,73 @@
+package diameter
+
+// DictionaryAvpDefinition describes an AVP type as defined in a Dictionary.
+type DictionaryAvpDefinition struct {
+	Name     string
+	VendorID uint32
+	Code     uint32
+	DataType AVPDataType
+}
+
+// DictionaryAvpConflict is a pair of AVP definitions, one from each of two compared dictionaries,
+// that describe the same AVP but disagree about it.  Either they have the same vendor-id and code
+// but a different data type, or they have the same name but a different vendor-id or code.
+type DictionaryAvpConflict struct {
+	This  DictionaryAvpDefinition
+	Other DictionaryAvpDefinition
+}
+
+// DictionaryDiff is the result of Dictionary.Diff().  AVP types are identified by their vendor-id
+// and code.  Each set is in the order the AVP types are defined in the dictionary from which they
+// come.
+type DictionaryDiff struct {
+	// AVP types defined in the dictionary on which Diff() was invoked, but not in the other
+	AvpsOnlyInThis []DictionaryAvpDefinition
+	// AVP types defined in the other dictionary, but not in the one on which Diff() was invoked
+	AvpsOnlyInOther []DictionaryAvpDefinition
+	// AVP types defined in both dictionaries, but inconsistently
+	ConflictingAvps []DictionaryAvpConflict
+}
+
+// IsEmpty returns true if the compared dictionaries have no differences in their AVP types.
+func (diff *DictionaryDiff) IsEmpty() bool {
+	return len(diff.AvpsOnlyInThis) == 0 && len(diff.AvpsOnlyInOther) == 0 && len(diff.ConflictingAvps) == 0
+}
+
+// Diff compares the AVP types in this dictionary with those in other.  An AVP type with the same
+// vendor-id and code in both dictionaries conflicts if the data types differ.  An AVP type with
+// the same name in both dictionaries conflicts if the vendor-id or the code differs, in which case
+// the two definitions also appear in AvpsOnlyInThis and AvpsOnlyInOther, respectively.
+func (dictionary *Dictionary) Diff(other *Dictionary) *DictionaryDiff {
+	diff := &DictionaryDiff{}
+
+	for _, thisDescriptor := range dictionary.avpDescriptorsInOrder {
+		otherDescriptor, isInOther := other.avpDescriptorByFullyQualifiedCode[thisDescriptor.fullyQualifiedCode()]
+
+		if !isInOther {
+			diff.AvpsOnlyInThis = append(diff.AvpsOnlyInThis, thisDescriptor.definition())
+		} else if thisDescriptor.dataType != otherDescriptor.dataType {
+			diff.ConflictingAvps = append(diff.ConflictingAvps, DictionaryAvpConflict{thisDescriptor.definition(), otherDescriptor.definition()})
+		}
+
+		if otherDescriptor, isInOther := other.avpDescriptorByName[thisDescriptor.name]; isInOther && otherDescriptor.fullyQualifiedCode() != thisDescriptor.fullyQualifiedCode() {
+			diff.ConflictingAvps = append(diff.ConflictingAvps, DictionaryAvpConflict{thisDescriptor.definition(), otherDescriptor.definition()})
+		}
+	}
+
+	for _, otherDescriptor := range other.avpDescriptorsInOrder {
+		if _, isInThis := dictionary.avpDescriptorByFullyQualifiedCode[otherDescriptor.fullyQualifiedCode()]; !isInThis {
+			diff.AvpsOnlyInOther = append(diff.AvpsOnlyInOther, otherDescriptor.definition())
+		}
+	}
+
+	return diff
+}
+
+func (descriptor *dictionaryAvpDescriptor) definition() DictionaryAvpDefinition {
+	return DictionaryAvpDefinition{
+		Name:     descriptor.name,
+		VendorID: descriptor.vendorID,
+		Code:     descriptor.code,
+		DataType: descriptor.dataType,
+	}
+}
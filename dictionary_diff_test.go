@@ -0,0 +1,100 @@
+package diameter_test
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+
+	diameter "github.com/blorticus-go/diameter"
+)
+
+func TestDictionaryDiff(t *testing.T) {
+	this, err := diameter.DictionaryFromYamlString(`---
+AvpTypes:
+    - Name: "Origin-Host"
+      Code: 264
+      Type: DiamIdent
+    - Name: "Result-Code"
+      Code: 268
+      Type: Unsigned32
+    - Name: "Session-Id"
+      Code: 263
+      Type: UTF8String
+    - Name: "Only-In-This"
+      Code: 1000
+      Type: Integer32
+    - Name: "Vendor-Thing"
+      Code: 1
+      VendorId: 10415
+      Type: Unsigned32
+`)
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	other, err := diameter.DictionaryFromYamlString(`---
+AvpTypes:
+    - Name: "Origin-Host"
+      Code: 264
+      Type: DiamIdent
+    - Name: "Result-Code"
+      Code: 268
+      Type: Integer32
+    - Name: "Session-Id"
+      Code: 263
+      Type: UTF8String
+    - Name: "Vendor-Thing"
+      Code: 1
+      VendorId: 10
+      Type: Unsigned32
+    - Name: "Only-In-Other"
+      Code: 2000
+      Type: OctetString
+`)
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	resultCodeInThis := diameter.DictionaryAvpDefinition{Name: "Result-Code", Code: 268, DataType: diameter.Unsigned32}
+	resultCodeInOther := diameter.DictionaryAvpDefinition{Name: "Result-Code", Code: 268, DataType: diameter.Integer32}
+	vendorThingInThis := diameter.DictionaryAvpDefinition{Name: "Vendor-Thing", VendorID: 10415, Code: 1, DataType: diameter.Unsigned32}
+	vendorThingInOther := diameter.DictionaryAvpDefinition{Name: "Vendor-Thing", VendorID: 10, Code: 1, DataType: diameter.Unsigned32}
+
+	expected := &diameter.DictionaryDiff{
+		AvpsOnlyInThis: []diameter.DictionaryAvpDefinition{
+			{Name: "Only-In-This", Code: 1000, DataType: diameter.Integer32},
+			vendorThingInThis,
+		},
+		AvpsOnlyInOther: []diameter.DictionaryAvpDefinition{
+			vendorThingInOther,
+			{Name: "Only-In-Other", Code: 2000, DataType: diameter.OctetString},
+		},
+		ConflictingAvps: []diameter.DictionaryAvpConflict{
+			{This: resultCodeInThis, Other: resultCodeInOther},
+			{This: vendorThingInThis, Other: vendorThingInOther},
+		},
+	}
+
+	diff := this.Diff(other)
+	if d := deep.Equal(diff, expected); d != nil {
+		t.Errorf("Diff() does not match expected: %s", d)
+	}
+	if diff.IsEmpty() {
+		t.Errorf("expected IsEmpty() = false for dictionaries that differ")
+	}
+
+	reversed := other.Diff(this)
+	if d := deep.Equal(reversed.AvpsOnlyInThis, expected.AvpsOnlyInOther); d != nil {
+		t.Errorf("reversed Diff() AvpsOnlyInThis does not match: %s", d)
+	}
+	if d := deep.Equal(reversed.AvpsOnlyInOther, expected.AvpsOnlyInThis); d != nil {
+		t.Errorf("reversed Diff() AvpsOnlyInOther does not match: %s", d)
+	}
+	if len(reversed.ConflictingAvps) != 2 {
+		t.Errorf("expected 2 conflicts on reversed Diff(), got = (%d)", len(reversed.ConflictingAvps))
+	}
+
+	if diff := this.Diff(this); !diff.IsEmpty() {
+		t.Errorf("expected Diff() of a dictionary with itself to be empty, got = (%+v)", diff)
+	}
+}
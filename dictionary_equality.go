@@ -0,0 +1,120 @@
+package diameter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+)
+
+// Relative tolerances used by AvpsSemanticallyEqual() when comparing Float32 and Float64 values.
+const (
+	Float32EqualityTolerance = 1e-6
+	Float64EqualityTolerance = 1e-12
+)
+
+// AvpsSemanticallyEqual returns true if a and b have the same code and vendor-id and their data
+// represent the same value for the data type that the dictionary assigns to the AVP.  Unlike
+// AVP.Equal(), flags are ignored, and data that differ byte-wise may still be equal:
+//   - Address values are equal if they are the same IP address (an IPv4 address is equal to the
+//     same address in IPv4-mapped IPv6 form);
+//   - Float32 and Float64 values are equal if they are within Float32EqualityTolerance or
+//     Float64EqualityTolerance of each other (relative to the larger magnitude), and two NaNs are equal;
+//   - DiamIdent values are compared case-insensitively, because they are FQDNs;
+//   - Grouped values are equal if they contain the same number of AVPs, and each AVP is semantically
+//     equal to the AVP at the same position in the other group.
+//
+// For all other types, for an AVP that is not in the dictionary or whose data cannot be decoded as the
+// dictionary type, and for Grouped AVPs whose children are beyond the maximum nesting depth (see
+// SetMaxGroupedAvpNestingDepth()), the data are compared byte-wise.
+func (dictionary *Dictionary) AvpsSemanticallyEqual(a, b *AVP) bool {
+	return dictionary.avpsSemanticallyEqualAtDepth(a, b, 0)
+}
+
+func (dictionary *Dictionary) avpsSemanticallyEqualAtDepth(a, b *AVP, depth int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	if a.Code != b.Code || a.VendorID != b.VendorID {
+		return false
+	}
+
+	avpInfo, isInMap := dictionary.avpDescriptorForAvp(a)
+	if !isInMap {
+		return bytes.Equal(a.Data, b.Data)
+	}
+
+	if equal, comparable := dictionary.avpDataSemanticallyEqual(avpInfo.dataType, a.Data, b.Data, depth); comparable {
+		return equal
+	}
+
+	return bytes.Equal(a.Data, b.Data)
+}
+
+// avpDataSemanticallyEqual compares the data of two AVPs of dataType at depth.  comparable is false if
+// either cannot be decoded as dataType, or if dataType has no comparison other than byte-wise.
+func (dictionary *Dictionary) avpDataSemanticallyEqual(dataType AVPDataType, a []byte, b []byte, depth int) (equal bool, comparable bool) {
+	switch dataType {
+	case Float32:
+		if len(a) != 4 || len(b) != 4 {
+			return false, false
+		}
+		x, y := math.Float32frombits(binary.BigEndian.Uint32(a)), math.Float32frombits(binary.BigEndian.Uint32(b))
+		return floatsWithinTolerance(float64(x), float64(y), Float32EqualityTolerance), true
+
+	case Float64:
+		if len(a) != 8 || len(b) != 8 {
+			return false, false
+		}
+		x, y := math.Float64frombits(binary.BigEndian.Uint64(a)), math.Float64frombits(binary.BigEndian.Uint64(b))
+		return floatsWithinTolerance(x, y, Float64EqualityTolerance), true
+
+	case Address:
+		addressA, addressB := AddressType(a), AddressType(b)
+		x, y := addressA.ToIP(), addressB.ToIP()
+		if x == nil || y == nil {
+			return false, false
+		}
+		return x.Equal(*y), true
+
+	case DiamIdent:
+		return strings.EqualFold(string(a), string(b)), true
+
+	case Grouped:
+		if depth >= dictionary.maxNestingDepth() {
+			return false, false
+		}
+		x, err := ConvertAVPDataToTypedData(a, Grouped)
+		if err != nil {
+			return false, false
+		}
+		y, err := ConvertAVPDataToTypedData(b, Grouped)
+		if err != nil {
+			return false, false
+		}
+
+		xAvps, yAvps := x.([]*AVP), y.([]*AVP)
+		if len(xAvps) != len(yAvps) {
+			return false, true
+		}
+		for i := range xAvps {
+			if !dictionary.avpsSemanticallyEqualAtDepth(xAvps[i], yAvps[i], depth+1) {
+				return false, true
+			}
+		}
+		return true, true
+	}
+
+	return false, false
+}
+
+func floatsWithinTolerance(x float64, y float64, tolerance float64) bool {
+	if math.IsNaN(x) || math.IsNaN(y) {
+		return math.IsNaN(x) && math.IsNaN(y)
+	}
+	if x == y {
+		return true
+	}
+	return math.Abs(x-y) <= tolerance*math.Max(math.Abs(x), math.Abs(y))
+}
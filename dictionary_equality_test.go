@@ -0,0 +1,218 @@
+package diameter_test
+
+import (
+	"math"
+	"net"
+	"testing"
+
+	diameter "github.com/blorticus-go/diameter"
+)
+
+const semanticEqualityTestDictionaryYaml = `---
+AvpTypes:
+    - Name: "Host-IP-Address"
+      Code: 257
+      Type: Address
+    - Name: "Origin-Host"
+      Code: 264
+      Type: DiamIdent
+    - Name: "Result-Code"
+      Code: 268
+      Type: Unsigned32
+    - Name: "Vendor-Specific-Application-Id"
+      Code: 260
+      Type: Grouped
+    - Name: "Vendor-Id"
+      Code: 266
+      Type: Unsigned32
+`
+
+func TestAvpsSemanticallyEqual(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(semanticEqualityTestDictionaryYaml)
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	ipv4MappedIPv6 := make([]byte, 18)
+	ipv4MappedIPv6[1] = byte(diameter.IP6)
+	copy(ipv4MappedIPv6[2:], net.ParseIP("10.1.1.1").To16())
+
+	group := func(vendorIDs ...uint32) *diameter.AVP {
+		children := make([]*diameter.AVP, 0, len(vendorIDs))
+		for _, vendorID := range vendorIDs {
+			children = append(children, diameter.NewTypedAVP(266, 0, true, diameter.Unsigned32, vendorID))
+		}
+		return diameter.NewTypedAVP(260, 0, true, diameter.Grouped, children)
+	}
+
+	testCases := []struct {
+		description   string
+		a             *diameter.AVP
+		b             *diameter.AVP
+		expectedEqual bool
+	}{
+		{
+			description:   "IPv4 Address and same address in IPv4-mapped IPv6 form",
+			a:             diameter.NewTypedAVP(257, 0, true, diameter.Address, net.ParseIP("10.1.1.1")),
+			b:             diameter.NewAVP(257, 0, true, ipv4MappedIPv6),
+			expectedEqual: true,
+		},
+		{
+			description:   "Address built from net.IP and from AddressType",
+			a:             diameter.NewTypedAVP(257, 0, true, diameter.Address, net.ParseIP("2001:db8::1")),
+			b:             diameter.NewTypedAVP(257, 0, true, diameter.Address, diameter.NewAddressTypeFromIP(net.ParseIP("2001:db8::1"))),
+			expectedEqual: true,
+		},
+		{
+			description:   "different IPv4 Addresses",
+			a:             diameter.NewTypedAVP(257, 0, true, diameter.Address, net.ParseIP("10.1.1.1")),
+			b:             diameter.NewTypedAVP(257, 0, true, diameter.Address, net.ParseIP("10.1.1.2")),
+			expectedEqual: false,
+		},
+		{
+			description:   "DiamIdent values that differ only in case",
+			a:             diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "host.example.com"),
+			b:             diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "HOST.Example.com"),
+			expectedEqual: true,
+		},
+		{
+			description:   "same value with different M-bit",
+			a:             diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2001)),
+			b:             diameter.NewTypedAVP(268, 0, false, diameter.Unsigned32, uint32(2001)),
+			expectedEqual: true,
+		},
+		{
+			description:   "different Unsigned32 values",
+			a:             diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2001)),
+			b:             diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2002)),
+			expectedEqual: false,
+		},
+		{
+			description:   "identical data with different codes",
+			a:             diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(10415)),
+			b:             diameter.NewTypedAVP(266, 0, true, diameter.Unsigned32, uint32(10415)),
+			expectedEqual: false,
+		},
+		{
+			description:   "identical data with different vendor-ids",
+			a:             diameter.NewTypedAVP(266, 10415, true, diameter.Unsigned32, uint32(10415)),
+			b:             diameter.NewTypedAVP(266, 0, true, diameter.Unsigned32, uint32(10415)),
+			expectedEqual: false,
+		},
+		{
+			description:   "Grouped AVPs whose children differ only in M-bit",
+			a:             group(10415, 5535),
+			b:             diameter.NewTypedAVP(260, 0, true, diameter.Grouped, []*diameter.AVP{diameter.NewTypedAVP(266, 0, false, diameter.Unsigned32, uint32(10415)), diameter.NewTypedAVP(266, 0, true, diameter.Unsigned32, uint32(5535))}),
+			expectedEqual: true,
+		},
+		{
+			description:   "Grouped AVPs with children in different order",
+			a:             group(10415, 5535),
+			b:             group(5535, 10415),
+			expectedEqual: false,
+		},
+		{
+			description:   "Grouped AVPs with different number of children",
+			a:             group(10415),
+			b:             group(10415, 5535),
+			expectedEqual: false,
+		},
+		{
+			description:   "AVP not in dictionary with identical data",
+			a:             diameter.NewAVP(9999, 0, true, []byte{1, 2, 3}),
+			b:             diameter.NewAVP(9999, 0, false, []byte{1, 2, 3}),
+			expectedEqual: true,
+		},
+		{
+			description:   "AVP not in dictionary with different data",
+			a:             diameter.NewAVP(9999, 0, true, []byte{1, 2, 3}),
+			b:             diameter.NewAVP(9999, 0, true, []byte{1, 2, 4}),
+			expectedEqual: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		if equal := dictionary.AvpsSemanticallyEqual(testCase.a, testCase.b); equal != testCase.expectedEqual {
+			t.Errorf("(%s) expected AvpsSemanticallyEqual() = (%t), got (%t)", testCase.description, testCase.expectedEqual, equal)
+		}
+		if equal := dictionary.AvpsSemanticallyEqual(testCase.b, testCase.a); equal != testCase.expectedEqual {
+			t.Errorf("(%s) expected AvpsSemanticallyEqual() with arguments reversed = (%t), got (%t)", testCase.description, testCase.expectedEqual, equal)
+		}
+	}
+}
+
+func TestAvpsSemanticallyEqualForFloatAvps(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(`---
+AvpTypes:
+    - Name: "Float-Thing"
+      Code: 1
+      VendorId: 10415
+      Type: Float32
+    - Name: "Double-Thing"
+      Code: 2
+      VendorId: 10415
+      Type: Float64
+`)
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	testCases := []struct {
+		description   string
+		a             *diameter.AVP
+		b             *diameter.AVP
+		expectedEqual bool
+	}{
+		{
+			description:   "identical data with different vendor-ids",
+			a:             diameter.NewTypedAVP(1, 10415, true, diameter.Float32, float32(1.5)),
+			b:             diameter.NewTypedAVP(1, 0, true, diameter.Float32, float32(1.5)),
+			expectedEqual: false,
+		},
+		{
+			description:   "Float32 values within tolerance",
+			a:             diameter.NewTypedAVP(1, 10415, true, diameter.Float32, float32(1000.0)),
+			b:             diameter.NewTypedAVP(1, 10415, true, diameter.Float32, math.Nextafter32(1000.0, 2000.0)),
+			expectedEqual: true,
+		},
+		{
+			description:   "Float32 values outside tolerance",
+			a:             diameter.NewTypedAVP(1, 10415, true, diameter.Float32, float32(1000.0)),
+			b:             diameter.NewTypedAVP(1, 10415, true, diameter.Float32, float32(1000.1)),
+			expectedEqual: false,
+		},
+		{
+			description:   "Float32 NaN values with different bits",
+			a:             diameter.NewAVP(1, 10415, true, []byte{0x7f, 0xc0, 0x00, 0x00}),
+			b:             diameter.NewAVP(1, 10415, true, []byte{0x7f, 0xc0, 0x00, 0x01}),
+			expectedEqual: true,
+		},
+		{
+			description:   "Float64 values within tolerance",
+			a:             diameter.NewTypedAVP(2, 10415, true, diameter.Float64, 0.1+0.2),
+			b:             diameter.NewTypedAVP(2, 10415, true, diameter.Float64, 0.3),
+			expectedEqual: true,
+		},
+		{
+			description:   "Float64 values outside tolerance",
+			a:             diameter.NewTypedAVP(2, 10415, true, diameter.Float64, 0.3),
+			b:             diameter.NewTypedAVP(2, 10415, true, diameter.Float64, 0.3001),
+			expectedEqual: false,
+		},
+		{
+			description:   "Float64 positive and negative zero",
+			a:             diameter.NewTypedAVP(2, 10415, true, diameter.Float64, 0.0),
+			b:             diameter.NewTypedAVP(2, 10415, true, diameter.Float64, math.Copysign(0, -1)),
+			expectedEqual: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		if equal := dictionary.AvpsSemanticallyEqual(testCase.a, testCase.b); equal != testCase.expectedEqual {
+			t.Errorf("(%s) expected AvpsSemanticallyEqual() = (%t), got (%t)", testCase.description, testCase.expectedEqual, equal)
+		}
+		if equal := dictionary.AvpsSemanticallyEqual(testCase.b, testCase.a); equal != testCase.expectedEqual {
+			t.Errorf("(%s) expected AvpsSemanticallyEqual() with arguments reversed = (%t), got (%t)", testCase.description, testCase.expectedEqual, equal)
+		}
+	}
+}
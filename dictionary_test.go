@@ -1,10 +1,20 @@
 package diameter_test
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/go-test/deep"
+	yaml "gopkg.in/yaml.v2"
 
 	diameter "github.com/blorticus-go/diameter"
 )
@@ -392,3 +402,837 @@ AvpTypes:
 		t.Errorf("Expected error when AvpType.Type = Unsigned32, but no error")
 	}
 }
+
+func TestMessageDescriptor(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(`---
+MessageTypes:
+    - Basename: "Capabilities-Exchange"
+      Abbreviations:
+          Request: "CER"
+          Answer: "CEA"
+      Code: 257
+    - Basename: "Update-Location"
+      Abbreviations:
+          Request: "ULR"
+          Answer: "ULA"
+      Code: 316
+      ApplicationId: 16777251
+`)
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	testCases := []struct {
+		appID                uint32
+		code                 diameter.Uint24
+		isRequest            bool
+		expectOk             bool
+		expectedName         string
+		expectedAbbreviation string
+	}{
+		{0, 257, true, true, "Capabilities-Exchange-Request", "CER"},
+		{0, 257, false, true, "Capabilities-Exchange-Answer", "CEA"},
+		{16777251, 316, true, true, "Update-Location-Request", "ULR"},
+		{16777251, 316, false, true, "Update-Location-Answer", "ULA"},
+		{0, 316, true, false, "", ""},
+		{0, 280, false, false, "", ""},
+	}
+
+	for i, testCase := range testCases {
+		name, abbreviation, ok := dictionary.MessageDescriptor(testCase.appID, testCase.code, testCase.isRequest)
+		if ok != testCase.expectOk {
+			t.Errorf("(test case %d) expected ok = %t, got = %t", i+1, testCase.expectOk, ok)
+		}
+		if name != testCase.expectedName || abbreviation != testCase.expectedAbbreviation {
+			t.Errorf("(test case %d) expected name = (%s) and abbreviation = (%s), got name = (%s) and abbreviation = (%s)", i+1, testCase.expectedName, testCase.expectedAbbreviation, name, abbreviation)
+		}
+	}
+}
+
+func TestMessageForApplication(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(`---
+MessageTypes:
+    - Basename: "Re-Auth"
+      Abbreviations:
+          Request: "RAR"
+          Answer: "RAA"
+      Code: 258
+AvpTypes:
+    - Name: "Session-Id"
+      Code: 263
+      Type: "UTF8String"
+`)
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	sessionId := dictionary.AVP("Session-Id", "client.example.com;1;1")
+
+	for _, testCase := range []struct {
+		name      string
+		appID     uint32
+		isRequest bool
+	}{
+		{"RAR", 4, true},
+		{"Re-Auth-Request", 16777238, true},
+		{"RAA", 16777238, false},
+	} {
+		m, err := dictionary.MessageForApplicationErrorable(testCase.name, testCase.appID, diameter.MessageFlags{Proxiable: true}, []*diameter.AVP{sessionId}, nil)
+		if err != nil {
+			t.Errorf("[%s, %d] Error on MessageForApplicationErrorable(): %s", testCase.name, testCase.appID, err)
+			continue
+		}
+
+		if m.AppID != testCase.appID || m.Code != 258 || m.IsRequest() != testCase.isRequest || !m.IsProxiable() {
+			t.Errorf("[%s, %d] expected AppID (%d), Code (258), request (%t), proxiable; got AppID (%d), Code (%d), flags (0x%02x)", testCase.name, testCase.appID, testCase.appID, testCase.isRequest, m.AppID, m.Code, m.Flags)
+		}
+		if len(m.Avps) != 1 || !m.Avps[0].Equal(sessionId) {
+			t.Errorf("[%s, %d] expected message to contain only the Session-Id", testCase.name, testCase.appID)
+		}
+	}
+
+	if m := dictionary.Message("RAR", diameter.MessageFlags{}, nil, nil); m.AppID != 0 {
+		t.Errorf("expected Message() to use the dictionary Application-Id (0), got (%d)", m.AppID)
+	}
+
+	if _, err := dictionary.MessageForApplicationErrorable("XYZ", 4, diameter.MessageFlags{}, nil, nil); err == nil {
+		t.Errorf("expected error on MessageForApplicationErrorable() for unknown message name, got none")
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("expected MessageForApplication() to panic for unknown message name, but it did not")
+			}
+		}()
+		dictionary.MessageForApplication("XYZ", 4, diameter.MessageFlags{}, nil, nil)
+	}()
+}
+
+func TestMessageCodeAsAStringOrDefault(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(`---
+MessageTypes:
+    - Basename: "Update-Location"
+      Abbreviations:
+          Request: "ULR"
+          Answer: "ULA"
+      Code: 316
+      ApplicationId: 16777251
+`)
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	testCases := []struct {
+		appID        uint32
+		code         diameter.Uint24
+		flags        uint8
+		expectedName string
+	}{
+		{16777251, 316, diameter.MsgFlagRequest, "Update-Location-Request"},
+		{16777251, 316, 0, "Update-Location-Answer"},
+		{0, 316, diameter.MsgFlagRequest, "Unknown-Request(appID=0,code=316)"},
+		{16777238, 272, 0, "Unknown-Answer(appID=16777238,code=272)"},
+	}
+
+	for i, testCase := range testCases {
+		m := diameter.NewMessage(testCase.flags, testCase.code, testCase.appID, 1, 1, nil, nil)
+		if name := dictionary.MessageCodeAsAStringOrDefault(m); name != testCase.expectedName {
+			t.Errorf("(test case %d) expected name = (%s), got = (%s)", i+1, testCase.expectedName, name)
+		}
+	}
+}
+
+func TestDictionaryFromYamlReader(t *testing.T) {
+	dictionaryYaml := `---
+MessageTypes:
+    - Basename: "Credit-Control"
+      Abbreviations:
+          Request: "CCR"
+          Answer: "CCA"
+      Code: 272
+      ApplicationId: 4
+AvpTypes:
+    - Name: "CC-Request-Number"
+      Code: 415
+      Type: "Unsigned32"
+`
+
+	for readerName, reader := range map[string]io.Reader{
+		"strings.Reader": strings.NewReader(dictionaryYaml),
+		"bytes.Buffer":   bytes.NewBufferString(dictionaryYaml),
+	} {
+		dictionary, err := diameter.DictionaryFromYamlReader(reader)
+		if err != nil {
+			t.Errorf("[%s] Error on DictionaryFromYamlReader(): %s", readerName, err)
+			continue
+		}
+
+		if name, abbreviation, ok := dictionary.MessageDescriptor(4, 272, true); !ok || name != "Credit-Control-Request" || abbreviation != "CCR" {
+			t.Errorf("[%s] expected MessageDescriptor(4, 272, true) = (Credit-Control-Request, CCR, true), got (%s, %s, %t)", readerName, name, abbreviation, ok)
+		}
+
+		if dataType, err := dictionary.DataTypeForAVPNamed("CC-Request-Number"); err != nil || dataType != diameter.Unsigned32 {
+			t.Errorf("[%s] expected DataTypeForAVPNamed(CC-Request-Number) = Unsigned32, got (%v) with error (%v)", readerName, dataType, err)
+		}
+	}
+
+	if _, err := diameter.DictionaryFromYamlReader(strings.NewReader("AvpTypes: [")); err == nil {
+		t.Errorf("expected error on DictionaryFromYamlReader() with malformed YAML, got none")
+	}
+
+	readErr := errors.New("read failed")
+	if _, err := diameter.DictionaryFromYamlReader(iotest.ErrReader(readErr)); !errors.Is(err, readErr) {
+		t.Errorf("expected DictionaryFromYamlReader() error to wrap the reader error, got (%v)", err)
+	}
+
+	if _, err := diameter.DictionaryFromYamlReader(strings.NewReader("")); err != nil {
+		t.Errorf("expected no error on DictionaryFromYamlReader() with empty input, got (%s)", err)
+	}
+}
+
+func TestDictionaryToYamlRoundTrip(t *testing.T) {
+	_, testExecutingFilename, _, _ := runtime.Caller(0)
+	dictionaryFilePath := filepath.Join(filepath.Dir(testExecutingFilename), "dictionaries", "base_protocol.yaml")
+
+	original, err := diameter.DictionaryFromYamlFile(dictionaryFilePath)
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlFile(%s): %s", dictionaryFilePath, err)
+	}
+
+	serialized, err := original.ToYaml()
+	if err != nil {
+		t.Fatalf("Error on ToYaml(): %s", err)
+	}
+
+	reloaded, err := diameter.DictionaryFromYamlString(string(serialized))
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString() for ToYaml() output: %s", err)
+	}
+
+	originalYaml, err := os.ReadFile(dictionaryFilePath)
+	if err != nil {
+		t.Fatalf("Error reading (%s): %s", dictionaryFilePath, err)
+	}
+
+	var originalDefinitions, serializedDefinitions diameter.DictionaryYaml
+	if err := yaml.Unmarshal(originalYaml, &originalDefinitions); err != nil {
+		t.Fatalf("Error unmarshaling (%s): %s", dictionaryFilePath, err)
+	}
+	if err := yaml.Unmarshal(serialized, &serializedDefinitions); err != nil {
+		t.Fatalf("Error unmarshaling ToYaml() output: %s", err)
+	}
+
+	if diff := deep.Equal(serializedDefinitions.AvpTypes, originalDefinitions.AvpTypes); diff != nil {
+		t.Errorf("AvpTypes in ToYaml() output differ from source: %s", diff)
+	}
+	if diff := deep.Equal(serializedDefinitions.MessageTypes, originalDefinitions.MessageTypes); diff != nil {
+		t.Errorf("MessageTypes in ToYaml() output differ from source: %s", diff)
+	}
+
+	for _, avpType := range originalDefinitions.AvpTypes {
+		originalType, err := original.DataTypeForAVPNamed(avpType.Name)
+		if err != nil {
+			t.Errorf("Error on DataTypeForAVPNamed(%s) for original dictionary: %s", avpType.Name, err)
+			continue
+		}
+
+		reloadedType, err := reloaded.DataTypeForAVPNamed(avpType.Name)
+		if err != nil {
+			t.Errorf("Error on DataTypeForAVPNamed(%s) for reloaded dictionary: %s", avpType.Name, err)
+			continue
+		}
+
+		if reloadedType != originalType {
+			t.Errorf("for AVP (%s) expected type (%d) after reload, got (%d)", avpType.Name, originalType, reloadedType)
+		}
+	}
+
+	for _, messageType := range originalDefinitions.MessageTypes {
+		for _, isRequest := range []bool{true, false} {
+			originalName, originalAbbreviation, _ := original.MessageDescriptor(messageType.ApplicationID, diameter.Uint24(messageType.Code), isRequest)
+			reloadedName, reloadedAbbreviation, ok := reloaded.MessageDescriptor(messageType.ApplicationID, diameter.Uint24(messageType.Code), isRequest)
+			if !ok || reloadedName != originalName || reloadedAbbreviation != originalAbbreviation {
+				t.Errorf("for message (%s) expected (%s, %s) after reload, got (%s, %s)", messageType.Basename, originalName, originalAbbreviation, reloadedName, reloadedAbbreviation)
+			}
+		}
+	}
+
+	reserialized, err := reloaded.ToYaml()
+	if err != nil {
+		t.Fatalf("Error on ToYaml() for reloaded dictionary: %s", err)
+	}
+
+	if string(reserialized) != string(serialized) {
+		t.Errorf("expected ToYaml() output for reloaded dictionary to match the first serialization")
+	}
+}
+
+func TestDictionaryFloatAndIPFilterRuleTypes(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(`---
+AvpTypes:
+    - Name: "Origin-Host"
+      Code: 264
+      Type: DiamIdent
+    - Name: "Packet-Filter-Content"
+      Code: 1059
+      VendorId: 10415
+      Type: IPFilterRule
+    - Name: "Float-Thing"
+      Code: 1
+      VendorId: 10415
+      Type: Float32
+    - Name: "Double-Thing"
+      Code: 2
+      VendorId: 10415
+      Type: Float64
+MessageTypes:
+    - Basename: Credit-Control
+      Abbreviations:
+        Request: CCR
+        Answer: CCA
+      Code: 272
+      ApplicationId: 4
+`)
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	rule := "permit out 17 from 10.0.0.0/8 to assigned 53"
+	sent := dictionary.Message("CCR", diameter.MessageFlags{}, nil, []*diameter.AVP{
+		dictionary.AVP("Origin-Host", "client.example.com"),
+		dictionary.AVP("Packet-Filter-Content", rule),
+		dictionary.AVP("Float-Thing", float32(-1234.5678)),
+		dictionary.AVP("Double-Thing", float64(0.1)),
+	})
+
+	decoded, err := diameter.DecodeMessage(sent.Encode())
+	if err != nil {
+		t.Fatalf("Error on DecodeMessage(): %s", err)
+	}
+	if _, err := dictionary.TypeAMessage(decoded); err != nil {
+		t.Fatalf("Error on TypeAMessage(): %s", err)
+	}
+
+	for i, avp := range decoded.Avps {
+		if diff := deep.Equal(avp.ExtendedAttributes.TypedValue, sent.Avps[i].ExtendedAttributes.TypedValue); diff != nil {
+			t.Errorf("typed value of decoded AVP (%s) does not match the sent AVP: %s", avp.ExtendedAttributes.Name, diff)
+		}
+	}
+
+	if v, ok := decoded.Avps[1].AsString(); !ok || v != rule {
+		t.Errorf("expected Packet-Filter-Content = (%s), got (%s, %t)", rule, v, ok)
+	}
+	if v, ok := decoded.Avps[2].AsFloat32(); !ok || v != float32(-1234.5678) {
+		t.Errorf("expected Float-Thing = (-1234.5678), got (%f, %t)", v, ok)
+	}
+	if v, ok := decoded.Avps[3].AsFloat64(); !ok || v != 0.1 {
+		t.Errorf("expected Double-Thing = (0.1), got (%f, %t)", v, ok)
+	}
+}
+
+func TestDictionaryTimeTypeRoundTrip(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(`---
+AvpTypes:
+    - Name: "Event-Timestamp"
+      Code: 55
+      Type: Time
+`)
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	eventTime := time.Date(2024, time.March, 9, 16, 30, 5, 0, time.UTC)
+
+	decodedAvp, err := diameter.DecodeAVP(dictionary.AVP("Event-Timestamp", eventTime).Encode())
+	if err != nil {
+		t.Fatalf("Error on DecodeAVP(): %s", err)
+	}
+
+	typedAvp, err := dictionary.TypeAnAvp(decodedAvp)
+	if err != nil {
+		t.Fatalf("Error on TypeAnAvp(): %s", err)
+	}
+
+	if v, ok := typedAvp.AsTime(); !ok || !v.Equal(eventTime) {
+		t.Errorf("expected Event-Timestamp = (%s), got (%v, %t)", eventTime, v, ok)
+	}
+
+	if v, err := diameter.ConvertAVPDataToTypedData([]byte{0, 0, 0, 0}, diameter.Time); err != nil || !v.(*time.Time).Equal(time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected zero Time data to decode to the Diameter epoch, got (%v, %v)", v, err)
+	}
+}
+
+func TestTypeAnAvpRecursivelyLimitsNestingDepth(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(`---
+AvpTypes:
+    - Name: "Nest"
+      Code: 1
+      Type: Grouped
+    - Name: "Leaf"
+      Code: 2
+      Type: UTF8String
+`)
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	nestedAvp := func(levels int) *diameter.AVP {
+		avp := diameter.NewTypedAVP(2, 0, false, diameter.UTF8String, "leaf")
+		for i := 0; i < levels; i++ {
+			avp = diameter.NewGroupedAVP(1, 0, false, avp)
+		}
+		decoded, err := diameter.DecodeAVP(avp.Encode())
+		if err != nil {
+			t.Fatalf("Error on DecodeAVP() of AVP nested (%d) levels: %s", levels, err)
+		}
+		return decoded
+	}
+
+	typedAvp, err := dictionary.TypeAnAvpRecursively(nestedAvp(diameter.DefaultMaxGroupedAvpNestingDepth))
+	if err != nil {
+		t.Fatalf("expected no error on TypeAnAvpRecursively() at the maximum depth, got = (%s)", err)
+	}
+	for depth := 0; depth < diameter.DefaultMaxGroupedAvpNestingDepth; depth++ {
+		children, ok := typedAvp.AsGrouped()
+		if !ok || len(children) != 1 {
+			t.Fatalf("expected typed Grouped AVP with one child at depth (%d)", depth)
+		}
+		typedAvp = children[0]
+	}
+	if v, ok := typedAvp.AsString(); !ok || v != "leaf" {
+		t.Errorf("expected innermost AVP to be typed as (leaf), got (%s, %t)", v, ok)
+	}
+
+	for _, levels := range []int{diameter.DefaultMaxGroupedAvpNestingDepth + 1, 1000} {
+		if _, err := dictionary.TypeAnAvpRecursively(nestedAvp(levels)); !errors.Is(err, diameter.ErrGroupedAvpNestingTooDeep) {
+			t.Errorf("expected ErrGroupedAvpNestingTooDeep for AVP nested (%d) levels, got = (%v)", levels, err)
+		}
+	}
+
+	dictionary.SetMaxGroupedAvpNestingDepth(4)
+	if _, err := dictionary.TypeAnAvpRecursively(nestedAvp(4)); err != nil {
+		t.Errorf("expected no error on TypeAnAvpRecursively() at depth (4), got = (%s)", err)
+	}
+	if _, err := dictionary.TypeAnAvpRecursively(nestedAvp(5)); !errors.Is(err, diameter.ErrGroupedAvpNestingTooDeep) {
+		t.Errorf("expected ErrGroupedAvpNestingTooDeep at depth (5) with a maximum of (4), got = (%v)", err)
+	}
+
+	if !dictionary.AvpsSemanticallyEqual(nestedAvp(1000), nestedAvp(1000)) {
+		t.Errorf("expected deeply nested identical AVPs to be semantically equal")
+	}
+}
+
+func TestEveryAvpDataTypeIsDeclarableInYaml(t *testing.T) {
+	var yamlDictionary strings.Builder
+	yamlDictionary.WriteString("---\nAvpTypes:\n")
+
+	typeNames := []string{"Unsigned32", "Unsigned64", "Integer32", "Integer64", "Float32", "Float64", "Enumerated", "UTF8String",
+		"OctetString", "Time", "Address", "DiamIdent", "DiamURI", "Grouped", "IPFilterRule"}
+	for i, typeName := range typeNames {
+		fmt.Fprintf(&yamlDictionary, "    - Name: \"Avp-%d\"\n      Code: %d\n      Type: %s\n", i, i+1, typeName)
+	}
+
+	dictionary, err := diameter.DictionaryFromYamlString(yamlDictionary.String())
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	for i := range typeNames {
+		dataType, err := dictionary.DataTypeForAVPNamed(fmt.Sprintf("Avp-%d", i))
+		if err != nil {
+			t.Errorf("Error on DataTypeForAVPNamed(): %s", err)
+			continue
+		}
+		if expected := diameter.AVPDataType(int(diameter.Unsigned32) + i); dataType != expected {
+			t.Errorf("expected type (%s) to map to data type (%d), got (%d)", typeNames[i], expected, dataType)
+		}
+	}
+
+	if _, err := dictionary.ToYaml(); err != nil {
+		t.Errorf("expected no error on ToYaml() for dictionary with every type, got = (%s)", err)
+	}
+}
+
+func TestVendorSpecificAvpTypeLookup(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(`---
+AvpTypes:
+    - Name: "Vendor-Thing"
+      Code: 1
+      VendorId: 10415
+      Type: Unsigned32
+    - Name: "Swapped-Thing"
+      Code: 10415
+      VendorId: 1
+      Type: UTF8String
+    - Name: "Base-Thing"
+      Code: 1
+      Type: DiamIdent
+`)
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	testCases := []struct {
+		avp          *diameter.AVP
+		expectedType diameter.AVPDataType
+		expectedName string
+	}{
+		{diameter.NewAVP(1, 10415, true, []byte{0, 0, 0, 1}), diameter.Unsigned32, "Vendor-Thing"},
+		{diameter.NewAVP(10415, 1, true, []byte("value")), diameter.UTF8String, "Swapped-Thing"},
+		{diameter.NewAVP(1, 0, true, []byte("host.example.com")), diameter.DiamIdent, "Base-Thing"},
+		{diameter.NewAVP(1, 10416, true, []byte{0, 0, 0, 1}), diameter.TypeOrAvpUnknown, ""},
+	}
+
+	for i, testCase := range testCases {
+		if dataType := dictionary.DataTypeForAvp(testCase.avp); dataType != testCase.expectedType {
+			t.Errorf("(test case %d) expected DataTypeForAvp() = (%d), got (%d)", i+1, testCase.expectedType, dataType)
+		}
+
+		typed, err := dictionary.TypeAnAvp(testCase.avp)
+		if err != nil {
+			t.Errorf("(test case %d) expected no error on TypeAnAvp(), got = (%s)", i+1, err)
+			continue
+		}
+
+		if testCase.expectedName == "" {
+			if typed.ExtendedAttributes != nil {
+				t.Errorf("(test case %d) expected unknown AVP not to be typed, got name (%s)", i+1, typed.ExtendedAttributes.Name)
+			}
+		} else if typed.ExtendedAttributes == nil || typed.ExtendedAttributes.Name != testCase.expectedName {
+			t.Errorf("(test case %d) expected AVP to be typed as (%s), got = (%v)", i+1, testCase.expectedName, typed.ExtendedAttributes)
+		}
+	}
+}
+
+func TestDuplicateUniqueAvps(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(`---
+AvpTypes:
+    - Name: "Session-Id"
+      Code: 263
+      Type: UTF8String
+      MaxOccurrences: 1
+    - Name: "Origin-Host"
+      Code: 264
+      Type: DiamIdent
+      MaxOccurrences: 1
+    - Name: "Route-Record"
+      Code: 282
+      Type: DiamIdent
+    - Name: "Vendor-Thing"
+      Code: 1
+      VendorId: 10415
+      Type: Unsigned32
+      MaxOccurrences: 2
+`)
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	sessionId := dictionary.AVP("Session-Id", "client.example.com;1;1")
+	originHost := dictionary.AVP("Origin-Host", "client.example.com")
+	routeRecord := dictionary.AVP("Route-Record", "relay.example.com")
+	vendorThing := dictionary.AVP("Vendor-Thing", uint32(1))
+	unknownAvp := diameter.NewTypedAVP(999, 0, false, diameter.Unsigned32, uint32(1))
+
+	testCases := []struct {
+		avps               []*diameter.AVP
+		expectedDuplicates []diameter.AvpVendorIdAndCode
+	}{
+		{[]*diameter.AVP{sessionId, originHost, routeRecord, routeRecord, vendorThing, vendorThing, unknownAvp, unknownAvp}, nil},
+		{[]*diameter.AVP{sessionId, originHost, sessionId}, []diameter.AvpVendorIdAndCode{{VendorId: 0, Code: 263}}},
+		{[]*diameter.AVP{originHost, sessionId, originHost, sessionId, sessionId}, []diameter.AvpVendorIdAndCode{{VendorId: 0, Code: 264}, {VendorId: 0, Code: 263}}},
+		{[]*diameter.AVP{vendorThing, vendorThing, vendorThing}, []diameter.AvpVendorIdAndCode{{VendorId: 10415, Code: 1}}},
+	}
+
+	for i, testCase := range testCases {
+		m := diameter.NewMessage(diameter.MsgFlagRequest, 272, 4, 1, 1, testCase.avps, nil)
+		if diff := deep.Equal(dictionary.DuplicateUniqueAvps(m), testCase.expectedDuplicates); diff != nil {
+			t.Errorf("(test case %d) %s", i+1, diff)
+		}
+	}
+}
+
+func TestGroupedAvpFlagViolations(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(`---
+AvpTypes:
+    - Name: "Vendor-Specific-Application-Id"
+      Code: 260
+      Type: Grouped
+      MandatoryFlag: Must
+    - Name: "Vendor-Id"
+      Code: 266
+      Type: Unsigned32
+      MandatoryFlag: Must
+    - Name: "Auth-Application-Id"
+      Code: 258
+      Type: Unsigned32
+      MandatoryFlag: Must
+    - Name: "Subscription-Id"
+      Code: 443
+      Type: Grouped
+    - Name: "Subscription-Id-Data"
+      Code: 444
+      Type: UTF8String
+      MandatoryFlag: MustNot
+    - Name: "Proxy-Info"
+      Code: 284
+      Type: Grouped
+      MandatoryFlag: Must
+`)
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	vendorID := func(mandatory bool) *diameter.AVP {
+		return diameter.NewTypedAVP(266, 0, mandatory, diameter.Unsigned32, uint32(10415))
+	}
+	authApplicationID := diameter.NewTypedAVP(258, 0, true, diameter.Unsigned32, uint32(4))
+	subscriptionIDData := func(mandatory bool) *diameter.AVP {
+		return diameter.NewTypedAVP(444, 0, mandatory, diameter.UTF8String, "15551234567")
+	}
+	group := func(code uint32, mandatory bool, children ...*diameter.AVP) *diameter.AVP {
+		return diameter.NewTypedAVP(code, 0, mandatory, diameter.Grouped, children)
+	}
+
+	testCases := []struct {
+		avps               []*diameter.AVP
+		expectedViolations []diameter.AvpVendorIdAndCode
+	}{
+		{[]*diameter.AVP{group(260, true, vendorID(true), authApplicationID), group(443, false, subscriptionIDData(false))}, nil},
+		{[]*diameter.AVP{group(260, true, vendorID(false), authApplicationID)}, []diameter.AvpVendorIdAndCode{{VendorId: 0, Code: 266}}},
+		{[]*diameter.AVP{group(443, true, subscriptionIDData(true))}, []diameter.AvpVendorIdAndCode{{VendorId: 0, Code: 444}}},
+		{[]*diameter.AVP{group(260, false, vendorID(true))}, []diameter.AvpVendorIdAndCode{{VendorId: 0, Code: 266}}},
+		{[]*diameter.AVP{group(284, true, group(443, true, subscriptionIDData(true)), vendorID(false))}, []diameter.AvpVendorIdAndCode{{VendorId: 0, Code: 444}, {VendorId: 0, Code: 266}}},
+		{[]*diameter.AVP{diameter.NewAVP(260, 0, true, []byte{0, 0, 1})}, nil},
+	}
+
+	for i, testCase := range testCases {
+		m := diameter.NewMessage(diameter.MsgFlagRequest, 272, 4, 1, 1, nil, testCase.avps)
+
+		var violatingChildren []diameter.AvpVendorIdAndCode
+		for _, violation := range dictionary.GroupedAvpFlagViolations(m) {
+			if violation.Reason == "" {
+				t.Errorf("(test case %d) expected violation for child (%d) to have a reason", i+1, violation.Child.Code)
+			}
+			violatingChildren = append(violatingChildren, violation.Child)
+		}
+
+		if diff := deep.Equal(violatingChildren, testCase.expectedViolations); diff != nil {
+			t.Errorf("(test case %d) %s", i+1, diff)
+		}
+	}
+
+	nested := diameter.NewMessage(diameter.MsgFlagRequest, 272, 4, 1, 1, []*diameter.AVP{group(284, true, group(443, true, subscriptionIDData(true)))}, nil)
+	if violations := dictionary.GroupedAvpFlagViolations(nested); len(violations) != 1 || violations[0].Group != (diameter.AvpVendorIdAndCode{VendorId: 0, Code: 443}) {
+		t.Errorf("expected violation to name the directly enclosing Grouped AVP (443), got = (%v)", violations)
+	}
+
+	if _, err := diameter.DictionaryFromYamlString(`---
+AvpTypes:
+    - Name: "Vendor-Id"
+      Code: 266
+      Type: Unsigned32
+      MandatoryFlag: Sometimes
+`); err == nil {
+		t.Errorf("expected error on DictionaryFromYamlString() for unknown MandatoryFlag, got none")
+	}
+}
+
+func TestAVPWithFlags(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(`---
+AvpTypes:
+    - Name: "Origin-Host"
+      Code: 264
+      Type: DiamIdent
+    - Name: "Vendor-Thing"
+      Code: 1
+      VendorId: 10415
+      Type: Unsigned32
+`)
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	testCases := []struct {
+		name      string
+		mandatory bool
+		value     interface{}
+		expected  *diameter.AVP
+	}{
+		{"Origin-Host", true, "host.example.com", diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "host.example.com")},
+		{"Origin-Host", false, "host.example.com", diameter.NewTypedAVP(264, 0, false, diameter.DiamIdent, "host.example.com")},
+		{"Vendor-Thing", true, uint32(10), diameter.NewTypedAVP(1, 10415, true, diameter.Unsigned32, uint32(10))},
+		{"Vendor-Thing", false, uint32(10), diameter.NewTypedAVP(1, 10415, false, diameter.Unsigned32, uint32(10))},
+	}
+
+	for i, testCase := range testCases {
+		avp, err := dictionary.AVPWithFlags(testCase.name, testCase.mandatory, testCase.value)
+		if err != nil {
+			t.Errorf("(test case %d) expected no error on AVPWithFlags(), got = (%s)", i+1, err)
+			continue
+		}
+		if avp.Mandatory != testCase.mandatory || avp.Encode()[4]&0x40 != testCase.expected.Encode()[4]&0x40 {
+			t.Errorf("(test case %d) expected mandatory = (%t), got = (%t)", i+1, testCase.mandatory, avp.Mandatory)
+		}
+		if !avp.Equal(testCase.expected) {
+			t.Errorf("(test case %d) AVP does not match expected AVP", i+1)
+		}
+	}
+
+	if _, err := dictionary.AVPWithFlags("No-Such-Avp", true, uint32(1)); err == nil {
+		t.Errorf("expected error on AVPWithFlags() for unknown AVP name, got none")
+	}
+	if _, err := dictionary.AVPWithFlags("Vendor-Thing", true, "not-a-uint32"); err == nil {
+		t.Errorf("expected error on AVPWithFlags() for incorrect value type, got none")
+	}
+}
+
+func TestTypedEnumValue(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(`---
+AvpTypes:
+    - Name: "Disconnect-Cause"
+      Code: 273
+      Type: Enumerated
+      Enumeration:
+        - Name: "REBOOTING"
+          Value: 0
+        - Name: "BUSY"
+          Value: 1
+        - Name: "DO_NOT_WANT_TO_TALK_TO_YOU"
+          Value: 2
+    - Name: "Origin-Host"
+      Code: 264
+      Type: DiamIdent
+`)
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	testCases := []struct {
+		avp           *diameter.AVP
+		expectAnError bool
+		expectedValue int32
+		expectedName  string
+		expectedKnown bool
+	}{
+		{diameter.NewTypedAVP(273, 0, true, diameter.Enumerated, int32(0)), false, 0, "REBOOTING", true},
+		{diameter.NewTypedAVP(273, 0, true, diameter.Enumerated, int32(2)), false, 2, "DO_NOT_WANT_TO_TALK_TO_YOU", true},
+		{diameter.NewTypedAVP(273, 0, true, diameter.Enumerated, int32(3)), false, 3, "", false},
+		{diameter.NewTypedAVP(273, 0, true, diameter.Enumerated, int32(-1)), false, -1, "", false},
+		{diameter.NewAVP(273, 0, true, []byte{0, 1}), true, 0, "", false},
+		{diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "host.example.com"), true, 0, "", false},
+		{diameter.NewTypedAVP(273, 10415, true, diameter.Enumerated, int32(1)), true, 0, "", false},
+	}
+
+	for i, testCase := range testCases {
+		value, name, known, err := dictionary.TypedEnumValue(testCase.avp)
+
+		if testCase.expectAnError {
+			if err == nil {
+				t.Errorf("(test case %d) expected an error, got none", i+1)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("(test case %d) expected no error, got = (%s)", i+1, err)
+			continue
+		}
+
+		if value != testCase.expectedValue || name != testCase.expectedName || known != testCase.expectedKnown {
+			t.Errorf("(test case %d) expected (%d, %q, %t), got (%d, %q, %t)", i+1, testCase.expectedValue, testCase.expectedName, testCase.expectedKnown, value, name, known)
+		}
+	}
+}
+
+const avpFactoryTestDictionaryYaml = `---
+AvpTypes:
+    - Name: "Origin-Host"
+      Code: 264
+      Type: DiamIdent
+    - Name: "Result-Code"
+      Code: 268
+      Type: Unsigned32
+    - Name: "Vendor-Thing"
+      Code: 1
+      VendorId: 10415
+      Type: Integer64
+`
+
+func TestAvpFactory(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(avpFactoryTestDictionaryYaml)
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	testCases := []struct {
+		name  string
+		value interface{}
+	}{
+		{"Origin-Host", "host.example.com"},
+		{"Result-Code", uint32(2001)},
+		{"Vendor-Thing", int64(-10)},
+	}
+
+	for i, testCase := range testCases {
+		factory, err := dictionary.AvpFactory(testCase.name)
+		if err != nil {
+			t.Errorf("(test case %d) expected no error on AvpFactory(), got = (%s)", i+1, err)
+			continue
+		}
+
+		fromFactory, err := factory.NewErrorable(testCase.value)
+		if err != nil {
+			t.Errorf("(test case %d) expected no error on NewErrorable(), got = (%s)", i+1, err)
+			continue
+		}
+		fromDictionary := dictionary.AVP(testCase.name, testCase.value)
+
+		if diff := deep.Equal(fromFactory, fromDictionary); diff != nil {
+			t.Errorf("(test case %d) AVP from factory does not match AVP from dictionary: %s", i+1, diff)
+		}
+		if !bytes.Equal(factory.New(testCase.value).Encode(), fromDictionary.Encode()) {
+			t.Errorf("(test case %d) encoded AVP from factory does not match encoded AVP from dictionary", i+1)
+		}
+	}
+
+	if _, err := dictionary.AvpFactory("No-Such-Avp"); err == nil {
+		t.Errorf("expected error on AvpFactory() for unknown AVP name, got none")
+	}
+
+	factory, _ := dictionary.AvpFactory("Result-Code")
+	if _, err := factory.NewErrorable("not-a-uint32"); err == nil {
+		t.Errorf("expected error on NewErrorable() for incorrect value type, got none")
+	}
+}
+
+func BenchmarkDictionaryAVP(b *testing.B) {
+	dictionary, err := diameter.DictionaryFromYamlString(avpFactoryTestDictionaryYaml)
+	if err != nil {
+		b.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		dictionary.AVP("Result-Code", uint32(2001))
+	}
+}
+
+func BenchmarkAvpFactoryNew(b *testing.B) {
+	dictionary, err := diameter.DictionaryFromYamlString(avpFactoryTestDictionaryYaml)
+	if err != nil {
+		b.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+	factory, err := dictionary.AvpFactory("Result-Code")
+	if err != nil {
+		b.Fatalf("Error on AvpFactory(): %s", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		factory.New(uint32(2001))
+	}
+}
@@ -0,0 +1,77 @@
+package diameter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Errors returned when decoding messages and AVPs.  The errors returned by DecodeMessage(), DecodeAVP(),
+// the message readers and the conversion of Grouped AVP data wrap these, so they can be tested with
+// errors.Is().
+var (
+	// ErrTruncatedMessage means that the input ends before the end of the message header, or before the
+	// end of the message according to the length in the header.
+	ErrTruncatedMessage = errors.New("truncated Diameter message")
+
+	// ErrUnknownVersion means that the version in the message header is not 1.
+	ErrUnknownVersion = errors.New("unknown Diameter version")
+
+	// ErrInvalidMessageLength means that the length in the message header is less than the header size.
+	ErrInvalidMessageLength = errors.New("message length is less than the Diameter message header size")
+
+	// ErrAvpLengthExceedsMessage means that an AVP, including its padding, extends beyond the end of the
+	// message (or the enclosing Grouped AVP, or the input to DecodeAVP()).
+	ErrAvpLengthExceedsMessage = errors.New("AVP length exceeds the message length")
+
+	// ErrTruncatedAvp means that the input ends before the end of the AVP header.
+	ErrTruncatedAvp = errors.New("truncated AVP header")
+
+	// ErrInvalidAvpLength means that the length in an AVP header is less than the AVP header size.
+	ErrInvalidAvpLength = errors.New("AVP length is less than the AVP header size")
+
+	// ErrGroupedAvpNestingTooDeep means that Grouped AVPs are nested more deeply than the maximum nesting
+	// depth of the Dictionary used to decode them (see Dictionary.SetMaxGroupedAvpNestingDepth()).
+	ErrGroupedAvpNestingTooDeep = errors.New("Grouped AVPs are nested too deeply")
+)
+
+// ErrInvalidHeaderBits is returned by Message.ValidateHeaderFlags() when the message header has a
+// combination of flags that is not permitted, and by Message.ValidateReservedHeaderFlags() when a reserved
+// bit is set.
+var ErrInvalidHeaderBits = errors.New("invalid message header flag bits")
+
+// ErrMessageTooLarge is returned by Message.EncodeErrorable() (and is the panic value of Message.Encode())
+// when a message is larger than MaxMessageLength, the largest length the message header can hold.
+var ErrMessageTooLarge = errors.New("message length exceeds the maximum Diameter message length")
+
+// AvpDecodeError is returned when an AVP in a message, or in the data of a Grouped AVP, cannot be
+// decoded.  Code is the AVP code, or 0 if there are too few bytes for the code.  Offset is the offset of
+// the AVP from the start of the message (or of the Grouped AVP data).  Err is the underlying error, which
+// usually wraps one of the Err* values.
+type AvpDecodeError struct {
+	Code   uint32
+	Offset int
+	Err    error
+}
+
+func (e *AvpDecodeError) Error() string {
+	return fmt.Sprintf("unable to decode AVP with code (%d) at offset (%d): %s", e.Code, e.Offset, e.Err)
+}
+
+func (e *AvpDecodeError) Unwrap() error {
+	return e.Err
+}
+
+// newAvpDecodeError returns an AvpDecodeError for the AVP at the start of avpBytes, which is at offset.
+func newAvpDecodeError(avpBytes []byte, offset int, err error) *AvpDecodeError {
+	var code uint32
+	if len(avpBytes) >= 4 {
+		code = binary.BigEndian.Uint32(avpBytes[0:4])
+	}
+
+	return &AvpDecodeError{
+		Code:   code,
+		Offset: offset,
+		Err:    err,
+	}
+}
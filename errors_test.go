@@ -0,0 +1,107 @@
+package diameter_test
+
+import (
+	"errors"
+	"testing"
+
+	diameter "github.com/blorticus-go/diameter"
+)
+
+func TestDecodeMessageErrorsMatchSentinels(t *testing.T) {
+	header := func(length byte) []byte {
+		return []byte{0x01, 0x00, 0x00, length, 0x80, 0x00, 0x01, 0x10, 0, 0, 0, 4, 0, 0, 0, 1, 0, 0, 0, 1}
+	}
+
+	testCases := []struct {
+		input            []byte
+		expectedSentinel error
+		expectedAvpError *diameter.AvpDecodeError
+	}{
+		{header(0x14)[:12], diameter.ErrTruncatedMessage, nil},
+		{header(0x1c), diameter.ErrTruncatedMessage, nil},
+		{header(0x10), diameter.ErrInvalidMessageLength, nil},
+		{append(header(0x1c), 0x00, 0x00, 0x01, 0x07, 0x40, 0x00, 0x00, 0x10), diameter.ErrAvpLengthExceedsMessage, &diameter.AvpDecodeError{Code: 263, Offset: 20}},
+		{append(header(0x25), 0x00, 0x00, 0x01, 0x0c, 0x40, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x07, 0xd1, 0x00, 0x00, 0x01, 0x07, 0x40), diameter.ErrTruncatedAvp, &diameter.AvpDecodeError{Code: 263, Offset: 32}},
+		{append(header(0x1c), 0x00, 0x00, 0x01, 0x07, 0x40, 0x00, 0x00, 0x04), diameter.ErrInvalidAvpLength, &diameter.AvpDecodeError{Code: 263, Offset: 20}},
+		{append(header(0x21), 0x00, 0x00, 0x01, 0x07, 0x40, 0x00, 0x00, 0x0d, 0x61, 0x3b, 0x62, 0x3b, 0x63), diameter.ErrAvpLengthExceedsMessage, &diameter.AvpDecodeError{Code: 263, Offset: 20}},
+	}
+
+	for i, testCase := range testCases {
+		_, err := diameter.DecodeMessage(testCase.input)
+		if !errors.Is(err, testCase.expectedSentinel) {
+			t.Errorf("(test case %d) expected error matching (%s), got = (%v)", i+1, testCase.expectedSentinel, err)
+			continue
+		}
+
+		if testCase.expectedAvpError == nil {
+			continue
+		}
+
+		var avpError *diameter.AvpDecodeError
+		if !errors.As(err, &avpError) {
+			t.Errorf("(test case %d) expected *diameter.AvpDecodeError, got = (%T) %v", i+1, err, err)
+		} else if avpError.Code != testCase.expectedAvpError.Code || avpError.Offset != testCase.expectedAvpError.Offset {
+			t.Errorf("(test case %d) expected AVP code (%d) at offset (%d), got code (%d) at offset (%d)", i+1, testCase.expectedAvpError.Code, testCase.expectedAvpError.Offset, avpError.Code, avpError.Offset)
+		}
+	}
+}
+
+func TestDecodeAVPErrorsMatchSentinels(t *testing.T) {
+	testCases := []struct {
+		input            []byte
+		expectedSentinel error
+	}{
+		{[]byte{0x00, 0x00, 0x01, 0x07, 0x40}, diameter.ErrTruncatedAvp},
+		{[]byte{0x00, 0x00, 0x01, 0x07, 0x40, 0x00, 0x00, 0x10, 0x61}, diameter.ErrAvpLengthExceedsMessage},
+		{[]byte{0x00, 0x00, 0x01, 0x07, 0x40, 0x00, 0x00, 0x06, 0x61, 0x62}, diameter.ErrInvalidAvpLength},
+		{[]byte{0x00, 0x00, 0x01, 0x0a, 0xc0, 0x00, 0x00, 0x08, 0x00, 0x00, 0x28, 0xaf}, diameter.ErrInvalidAvpLength},
+	}
+
+	for i, testCase := range testCases {
+		if _, err := diameter.DecodeAVP(testCase.input); !errors.Is(err, testCase.expectedSentinel) {
+			t.Errorf("(test case %d) expected error matching (%s), got = (%v)", i+1, testCase.expectedSentinel, err)
+		}
+	}
+
+	_, _, err := diameter.DecodeAVPWithConsumed([]byte{0x00, 0x00, 0x01, 0x07, 0x40, 0x00, 0x00, 0x0d, 0x61, 0x3b, 0x62, 0x3b, 0x63})
+	if !errors.Is(err, diameter.ErrAvpLengthExceedsMessage) {
+		t.Errorf("expected DecodeAVPWithConsumed() error matching (%s), got = (%v)", diameter.ErrAvpLengthExceedsMessage, err)
+	}
+
+	_, err = diameter.ConvertAVPDataToTypedData([]byte{0x00, 0x00, 0x01, 0x0c, 0x40, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x07, 0xd1, 0x00, 0x00, 0x01, 0x07}, diameter.Grouped)
+	var avpError *diameter.AvpDecodeError
+	if !errors.Is(err, diameter.ErrTruncatedAvp) || !errors.As(err, &avpError) || avpError.Code != 263 || avpError.Offset != 12 {
+		t.Errorf("expected error for AVP with code (263) at offset (12) in group matching (%s), got = (%v)", diameter.ErrTruncatedAvp, err)
+	}
+}
+
+func TestMessageReaderErrorsMatchSentinels(t *testing.T) {
+	reader := diameter.NewMessageByteReader()
+
+	_, err := reader.ReceiveBytes([]byte{0x02, 0x00, 0x00, 0x14})
+	if !errors.Is(err, diameter.ErrUnknownVersion) {
+		t.Errorf("expected error matching (%s), got = (%v)", diameter.ErrUnknownVersion, err)
+	}
+}
+
+func TestLastAvpOverrunningTheMessageIsAnError(t *testing.T) {
+	// message length (45) covers a Result-Code AVP and a Session-Id AVP whose length (13) is within the
+	// message, but whose padded length (16) is not; the pad bytes follow in the stream
+	streamBytes := []byte{
+		0x01, 0x00, 0x00, 0x2d, 0x00, 0x00, 0x01, 0x10, 0, 0, 0, 4, 0, 0, 0, 1, 0, 0, 0, 1,
+		0x00, 0x00, 0x01, 0x0c, 0x40, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x07, 0xd1,
+		0x00, 0x00, 0x01, 0x07, 0x40, 0x00, 0x00, 0x0d, 0x61, 0x3b, 0x62, 0x3b, 0x63,
+		0x00, 0x00, 0x00,
+	}
+
+	_, err := diameter.DecodeMessage(streamBytes)
+	var avpError *diameter.AvpDecodeError
+	if !errors.Is(err, diameter.ErrAvpLengthExceedsMessage) || !errors.As(err, &avpError) || avpError.Code != 263 || avpError.Offset != 32 {
+		t.Errorf("expected error for AVP with code (263) at offset (32) matching (%s), got = (%v)", diameter.ErrAvpLengthExceedsMessage, err)
+	}
+
+	_, err = diameter.NewMessageByteReader().ReceiveBytes(streamBytes)
+	if !errors.Is(err, diameter.ErrAvpLengthExceedsMessage) {
+		t.Errorf("expected MessageByteReader error matching (%s), got = (%v)", diameter.ErrAvpLengthExceedsMessage, err)
+	}
+}
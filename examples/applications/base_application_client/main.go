@@ -73,6 +73,9 @@ func main() {
 				logDiameterMessage(ccr, dictionary, "sent", event.Peer)
 			}
 
+		case agent.PeerInitiatedDisconnectEvent:
+			logGeneralEvent("peer initiated disconnect", event.Connection, event.Peer)
+
 		case agent.DiameterConnectionClosedEvent:
 			logGeneralEvent("diameter connection closed", event.Connection, event.Peer)
 
@@ -133,7 +136,7 @@ func logGeneralEvent(eventDetail string, conn net.Conn, peer *agent.Peer) {
 }
 
 func logDiameterMessage(m *diameter.Message, dictionary *diameter.Dictionary, direction string, peer *agent.Peer) {
-	fmt.Printf(`message direction=%s,type=%s`, direction, dictionary.MessageCodeAsAString(m))
+	fmt.Printf(`message direction=%s,type=%s`, direction, dictionary.MessageCodeAsAStringOrDefault(m))
 	if peer != nil {
 		fmt.Printf(`,peer="%s"`, peer.Identity.OriginHost)
 	}
@@ -92,7 +92,7 @@ func logGeneralEvent(eventDetail string, conn net.Conn, peer *agent.Peer) {
 }
 
 func logDiameterMessage(m *diameter.Message, dictionary *diameter.Dictionary, direction string, peer *agent.Peer) {
-	fmt.Printf(`message direction=%s,type=%s`, direction, dictionary.MessageCodeAsAString(m))
+	fmt.Printf(`message direction=%s,type=%s`, direction, dictionary.MessageCodeAsAStringOrDefault(m))
 	if peer != nil {
 		fmt.Printf(`,peer="%s"`, peer.Identity.OriginHost)
 	}
@@ -115,10 +115,8 @@ func generateCCAFromCCR(ccr *diameter.Message, localOriginHost string, localOrig
 		return nil, fmt.Errorf("expected a CCR from the peer")
 	}
 
-	for _, avpCode := range []diameter.Uint24{263, 258, 416, 415} {
-		if ccr.DoesNotHaveATopLevelAvpMatching(0, avpCode) {
-			return nil, fmt.Errorf("the CCR is missing AVP with code (%d)", avpCode)
-		}
+	if missing := ccr.MissingAnyOf([]diameter.AvpVendorIdAndCode{{Code: 263}, {Code: 258}, {Code: 416}, {Code: 415}}); len(missing) > 0 {
+		return nil, fmt.Errorf("the CCR is missing AVP with code (%d)", missing[0].Code)
 	}
 
 	cca := dictionary.Message("CCA", diameter.MessageFlags{}, []*diameter.AVP{
@@ -0,0 +1,37 @@
+package diameter_test
+
+import (
+	"testing"
+
+	diameter "github.com/blorticus-go/diameter"
+)
+
+func FuzzDecodeMessage(f *testing.F) {
+	for _, testMessage := range testMessagesByName {
+		f.Add(testMessage.EncodedBytes)
+	}
+	// message length field less than the header size
+	f.Add([]byte{0x01, 0x00, 0x00, 0x04, 0x80, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01})
+	// final AVP is not padded to the message length
+	f.Add([]byte{0x01, 0x00, 0x00, 0x1d, 0x80, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x01, 0x08, 0x40, 0x00, 0x00, 0x09, 0x61})
+	// grouped AVP containing a truncated AVP
+	f.Add([]byte{0x01, 0x00, 0x00, 0x24, 0x80, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x01, 0x29, 0x40, 0x00, 0x00, 0x10, 0x00, 0x00, 0x01, 0x0a, 0x40, 0x00, 0x00, 0x0c})
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		m, err := diameter.DecodeMessage(input)
+		if err != nil {
+			return
+		}
+
+		for _, avp := range m.Avps {
+			for _, avpType := range []diameter.AVPDataType{diameter.Unsigned32, diameter.Unsigned64, diameter.Integer32, diameter.Integer64, diameter.Float32, diameter.Float64,
+				diameter.Enumerated, diameter.UTF8String, diameter.OctetString, diameter.Time, diameter.Address, diameter.DiamIdent, diameter.DiamURI, diameter.Grouped, diameter.IPFilterRule} {
+				diameter.ConvertAVPDataToTypedData(avp.Data, avpType)
+			}
+		}
+
+		if _, err := diameter.NewMessageByteReader().ReceiveBytes(input); err != nil {
+			return
+		}
+	})
+}
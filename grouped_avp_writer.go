@@ -0,0 +1,115 @@
+package diameter
+
+import "io"
+
+// GroupedAvpWriter incrementally builds a Grouped AVP from its children.  Unlike NewGroupedAVP, which
+// encodes each child separately and then copies the result into the group data, the writer tracks the
+// total size as children are added, then encodes every child directly into a single buffer of exactly
+// that size (Finalize) or directly to an io.Writer (WriteTo).  This is intended for Grouped AVPs with a
+// very large number of children.  A GroupedAvpWriter is not safe for concurrent use.
+type GroupedAvpWriter struct {
+	code       uint32
+	vendorID   uint32
+	mandatory  bool
+	children   []*AVP
+	dataLength int
+}
+
+// NewGroupedAvpWriter creates a GroupedAvpWriter for a Grouped AVP with the provided code and vendorID.
+// The vendor-specific flag is set if vendorID is non-zero, and the mandatory flag is set if mandatory is
+// true.
+func NewGroupedAvpWriter(code uint32, vendorID uint32, mandatory bool) *GroupedAvpWriter {
+	return &GroupedAvpWriter{
+		code:      code,
+		vendorID:  vendorID,
+		mandatory: mandatory,
+	}
+}
+
+// AddChild appends child to the group.  The child is not encoded until Finalize() or WriteTo() is called,
+// so it must not be changed before then.
+func (w *GroupedAvpWriter) AddChild(child *AVP) *GroupedAvpWriter {
+	w.children = append(w.children, child)
+	w.dataLength += child.encodedSize()
+	return w
+}
+
+// Length returns the value of the Length field of the Grouped AVP with the children added so far.
+// Since every child is padded, this is normally also the padded length of the Grouped AVP.
+func (w *GroupedAvpWriter) Length() int {
+	return w.headerLength() + w.dataLength
+}
+
+// paddedLength returns Length() rounded up to a multiple of four.  This differs from Length() only if
+// the Length or PaddedLength of a child is inconsistent with its Data.
+func (w *GroupedAvpWriter) paddedLength() int {
+	return (w.Length() + 3) &^ 3
+}
+
+// Finalize returns the Grouped AVP containing the children added so far, in order.  The result is the
+// same as NewGroupedAVP() with the same children.
+func (w *GroupedAvpWriter) Finalize() *AVP {
+	data := make([]byte, 0, w.dataLength)
+	for _, child := range w.children {
+		data = child.appendEncodingWithLengthField(data, child.Length)
+	}
+
+	children := make([]*AVP, len(w.children))
+	copy(children, w.children)
+
+	return &AVP{
+		Code:           w.code,
+		VendorID:       w.vendorID,
+		VendorSpecific: w.vendorID != 0,
+		Mandatory:      w.mandatory,
+		Data:           data,
+		Length:         w.Length(),
+		PaddedLength:   w.paddedLength(),
+		ExtendedAttributes: &AVPExtendedAttributes{
+			DataType:   Grouped,
+			TypedValue: children,
+		},
+	}
+}
+
+// WriteTo writes the encoded Grouped AVP containing the children added so far to writer, without
+// encoding the whole AVP in memory.  It returns the number of bytes written.  This implements
+// io.WriterTo.
+func (w *GroupedAvpWriter) WriteTo(writer io.Writer) (int64, error) {
+	headerOnly := &AVP{Code: w.code, VendorID: w.vendorID, VendorSpecific: w.vendorID != 0, Mandatory: w.mandatory}
+	header := headerOnly.appendEncodingWithLengthField(make([]byte, 0, w.headerLength()), w.Length())
+
+	n, err := writer.Write(header)
+	bytesWritten := int64(n)
+	if err != nil {
+		return bytesWritten, err
+	}
+
+	var scratch []byte
+	for _, child := range w.children {
+		scratch = child.appendEncodingWithLengthField(scratch[:0], child.Length)
+
+		n, err := writer.Write(scratch)
+		bytesWritten += int64(n)
+		if err != nil {
+			return bytesWritten, err
+		}
+	}
+
+	if padding := w.paddedLength() - w.Length(); padding > 0 {
+		n, err := writer.Write(make([]byte, padding))
+		bytesWritten += int64(n)
+		if err != nil {
+			return bytesWritten, err
+		}
+	}
+
+	return bytesWritten, nil
+}
+
+func (w *GroupedAvpWriter) headerLength() int {
+	if w.vendorID != 0 {
+		return vendorSpecificAvpHeaderLength
+	}
+	return nonVendorSpecificAvpHeaderLength
+}
@@ -0,0 +1,113 @@
+package diameter_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	diameter "github.com/blorticus-go/diameter"
+)
+
+func groupedAvpWriterTestChildren(count int) []*diameter.AVP {
+	children := make([]*diameter.AVP, 0, count)
+	for i := 0; i < count; i++ {
+		switch i % 3 {
+		case 0:
+			children = append(children, diameter.NewTypedAVP(485, 0, true, diameter.Unsigned32, uint32(i)))
+		case 1:
+			children = append(children, diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, fmt.Sprintf("client.example.com;%d", i)))
+		case 2:
+			children = append(children, diameter.NewTypedAVP(1, 10415, false, diameter.OctetString, []byte{byte(i)}))
+		}
+	}
+	return children
+}
+
+func TestGroupedAvpWriterMatchesNewGroupedAVP(t *testing.T) {
+	// the Data of this child is longer than its Length and PaddedLength describe
+	childWithChangedData := diameter.NewTypedAVP(1, 10415, false, diameter.OctetString, []byte{0x01})
+	childWithChangedData.Data = []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a}
+
+	testCases := []struct {
+		code      uint32
+		vendorID  uint32
+		mandatory bool
+		children  []*diameter.AVP
+	}{
+		{873, 10415, true, groupedAvpWriterTestChildren(10)},
+		{456, 0, true, groupedAvpWriterTestChildren(1)},
+		{456, 0, false, nil},
+		{456, 0, false, []*diameter.AVP{diameter.NewGroupedAVP(437, 0, true, groupedAvpWriterTestChildren(4)...)}},
+		{456, 0, false, []*diameter.AVP{childWithChangedData, diameter.NewTypedAVP(485, 0, true, diameter.Unsigned32, uint32(1))}},
+	}
+
+	for i, testCase := range testCases {
+		expected := diameter.NewGroupedAVP(testCase.code, testCase.vendorID, testCase.mandatory, testCase.children...)
+
+		writer := diameter.NewGroupedAvpWriter(testCase.code, testCase.vendorID, testCase.mandatory)
+		for _, child := range testCase.children {
+			writer.AddChild(child)
+		}
+
+		if writer.Length() != expected.Length {
+			t.Errorf("(test case %d) expected Length() = (%d), got = (%d)", i+1, expected.Length, writer.Length())
+		}
+
+		finalized := writer.Finalize()
+		if !finalized.Equal(expected) {
+			t.Errorf("(test case %d) expected Finalize() to match NewGroupedAVP()", i+1)
+		}
+		if !bytes.Equal(finalized.Encode(), expected.Encode()) {
+			t.Errorf("(test case %d) expected Finalize() encoding (% x), got (% x)", i+1, expected.Encode(), finalized.Encode())
+		}
+
+		buf := new(bytes.Buffer)
+		bytesWritten, err := writer.WriteTo(buf)
+		if err != nil {
+			t.Errorf("(test case %d) expected no error on WriteTo(), got = (%s)", i+1, err)
+			continue
+		}
+		if bytesWritten != int64(expected.PaddedLength) {
+			t.Errorf("(test case %d) expected WriteTo() to write (%d) bytes, got (%d)", i+1, expected.PaddedLength, bytesWritten)
+		}
+		if !bytes.Equal(buf.Bytes(), expected.Encode()) {
+			t.Errorf("(test case %d) expected WriteTo() encoding (% x), got (% x)", i+1, expected.Encode(), buf.Bytes())
+		}
+	}
+}
+
+func BenchmarkNewGroupedAVPWithManyChildren(b *testing.B) {
+	children := groupedAvpWriterTestChildren(5000)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		diameter.NewGroupedAVP(873, 10415, true, children...)
+	}
+}
+
+func BenchmarkGroupedAvpWriterFinalizeWithManyChildren(b *testing.B) {
+	children := groupedAvpWriterTestChildren(5000)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		writer := diameter.NewGroupedAvpWriter(873, 10415, true)
+		for _, child := range children {
+			writer.AddChild(child)
+		}
+		writer.Finalize()
+	}
+}
+
+func BenchmarkGroupedAvpWriterWriteToWithManyChildren(b *testing.B) {
+	children := groupedAvpWriterTestChildren(5000)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		writer := diameter.NewGroupedAvpWriter(873, 10415, true)
+		for _, child := range children {
+			writer.AddChild(child)
+		}
+		writer.WriteTo(io.Discard)
+	}
+}
@@ -0,0 +1,98 @@
+package diameter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HexDump returns an annotated hex and ASCII dump of the encoded message, in the style of
+// "hexdump -C".  A comment line (starting with ';') precedes the message header and each
+// top-level AVP, and the dump of each starts on a new line.  Offsets are from the start of
+// the encoded message.  Each AVP is dumped as it is actually encoded, even if its Data does not
+// match its Length, so that a malformed message can be inspected.  If the message cannot be
+// encoded (e.g., because it is too large), the dump is a single comment line with the error.
+func (m *Message) HexDump() string {
+	dump := new(strings.Builder)
+
+	encoded, err := m.EncodeErrorable()
+	if err != nil {
+		fmt.Fprintf(dump, "; message cannot be encoded: %s\n", err)
+		return dump.String()
+	}
+
+	fmt.Fprintf(dump, "; message header (%d bytes): code %d, application-id %d, flags %#02x\n", MsgHeaderSize, m.Code, m.AppID, m.Flags)
+	writeHexDumpLines(dump, encoded[:MsgHeaderSize], 0)
+
+	offset := int(MsgHeaderSize)
+	for i, avp := range m.Avps {
+		end := min(offset+avp.encodedSize(), len(encoded))
+		writeAvpHexDumpComment(dump, fmt.Sprintf("AVP %d", i), avp)
+		writeHexDumpLines(dump, encoded[min(offset, end):end], offset)
+		offset = end
+	}
+
+	return dump.String()
+}
+
+// HexDump returns an annotated hex and ASCII dump of the encoded AVP, in the style of
+// "hexdump -C".  A comment line (starting with ';') precedes the AVP header and the AVP data
+// (including any padding), and the dump of each starts on a new line.  Offsets are from the
+// start of the encoded AVP.
+func (avp *AVP) HexDump() string {
+	encoded := avp.Encode()
+	dump := new(strings.Builder)
+
+	headerLength := nonVendorSpecificAvpHeaderLength
+	if avp.VendorSpecific {
+		headerLength = vendorSpecificAvpHeaderLength
+	}
+
+	writeAvpHexDumpComment(dump, "AVP header", avp)
+	writeHexDumpLines(dump, encoded[:headerLength], 0)
+
+	if len(encoded) > headerLength {
+		fmt.Fprintf(dump, "; AVP data (%d bytes, %d bytes padding)\n", len(avp.Data), avp.PaddedLength-avp.Length)
+		writeHexDumpLines(dump, encoded[headerLength:], headerLength)
+	}
+
+	return dump.String()
+}
+
+func writeAvpHexDumpComment(dump *strings.Builder, label string, avp *AVP) {
+	if avp.VendorSpecific {
+		fmt.Fprintf(dump, "; %s: code %d, vendor-id %d, length %d (%d padded)\n", label, avp.Code, avp.VendorID, avp.Length, avp.PaddedLength)
+	} else {
+		fmt.Fprintf(dump, "; %s: code %d, length %d (%d padded)\n", label, avp.Code, avp.Length, avp.PaddedLength)
+	}
+}
+
+// writeHexDumpLines writes data in "hexdump -C" format, sixteen bytes per line.  The offset
+// shown on each line starts at baseOffset.
+func writeHexDumpLines(dump *strings.Builder, data []byte, baseOffset int) {
+	for lineStart := 0; lineStart < len(data); lineStart += 16 {
+		line := data[lineStart:min(lineStart+16, len(data))]
+
+		fmt.Fprintf(dump, "%08x  ", baseOffset+lineStart)
+
+		for i := 0; i < 16; i++ {
+			if i < len(line) {
+				fmt.Fprintf(dump, "%02x ", line[i])
+			} else {
+				dump.WriteString("   ")
+			}
+			if i == 7 {
+				dump.WriteByte(' ')
+			}
+		}
+
+		dump.WriteString(" |")
+		for _, b := range line {
+			if b >= 0x20 && b < 0x7f {
+				dump.WriteByte(b)
+			} else {
+				dump.WriteByte('.')
+			}
+		}
+		dump.WriteString("|\n")
+	}
+}
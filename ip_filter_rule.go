@@ -0,0 +1,224 @@
+package diameter
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// AddressTypeToIPNet returns the net.IPNet with prefixLength leading bits of address, which must
+// be an IP4 or IP6 AddressType.  The host bits of the returned IP are cleared.  Returns an error if
+// address is not an IP address, or if prefixLength is negative or longer than the address.
+func AddressTypeToIPNet(address AddressType, prefixLength int) (*net.IPNet, error) {
+	ip := address.ToIP()
+	if ip == nil {
+		return nil, fmt.Errorf("address is not an IPv4 or IPv6 address")
+	}
+
+	bits := len(*ip) * 8
+	if prefixLength < 0 || prefixLength > bits {
+		return nil, fmt.Errorf("prefix length (%d) is not valid for an address of (%d) bits", prefixLength, bits)
+	}
+
+	mask := net.CIDRMask(prefixLength, bits)
+
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// NewAddressTypeFromIPNet creates an AddressType from the network address of ipNet (that is, its IP
+// with the host bits cleared).  Panics if ipNet.IP is not an IP address.
+func NewAddressTypeFromIPNet(ipNet *net.IPNet) AddressType {
+	return NewAddressTypeFromIP(ipNet.IP.Mask(ipNet.Mask))
+}
+
+// FilterRuleAction is the action of an IPFilterRule.
+type FilterRuleAction string
+
+// FilterRuleAction values (RFC 6733 section 4.3.1).
+const (
+	FilterRulePermit FilterRuleAction = "permit"
+	FilterRuleDeny   FilterRuleAction = "deny"
+)
+
+// FilterRuleDirection is the direction of an IPFilterRule.  FilterRuleIn is for packets from the
+// terminal, and FilterRuleOut is for packets to the terminal.
+type FilterRuleDirection string
+
+// FilterRuleDirection values (RFC 6733 section 4.3.1).
+const (
+	FilterRuleIn  FilterRuleDirection = "in"
+	FilterRuleOut FilterRuleDirection = "out"
+)
+
+// FilterRulePortRange is a range of ports in an IPFilterRule.  For a single port, First and Last
+// are the same.
+type FilterRulePortRange struct {
+	First uint16
+	Last  uint16
+}
+
+// FilterRulePort returns the FilterRulePortRange for the single port.
+func FilterRulePort(port uint16) FilterRulePortRange {
+	return FilterRulePortRange{port, port}
+}
+
+func (r FilterRulePortRange) String() string {
+	if r.First == r.Last {
+		return strconv.Itoa(int(r.First))
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+type filterRuleEndpoint struct {
+	network  *net.IPNet
+	assigned bool
+	ports    []FilterRulePortRange
+}
+
+// FilterRuleBuilder builds the value of an IPFilterRule AVP (e.g., 3GPP Packet-Filter-Content),
+// which has the form:
+//
+//	action dir proto from src [ports] to dst [ports] [options]
+//
+// The protocol is "ip" (any protocol), and the source and destination are "any", unless they are
+// set.  An address is written as a bare IP address if its mask covers the whole address, and in
+// CIDR form otherwise.  A FilterRuleBuilder is not safe for concurrent use.
+type FilterRuleBuilder struct {
+	action      FilterRuleAction
+	direction   FilterRuleDirection
+	protocol    string
+	source      filterRuleEndpoint
+	destination filterRuleEndpoint
+	options     []string
+}
+
+// NewFilterRuleBuilder creates a FilterRuleBuilder for a rule with the provided action and direction.
+func NewFilterRuleBuilder(action FilterRuleAction, direction FilterRuleDirection) *FilterRuleBuilder {
+	return &FilterRuleBuilder{
+		action:    action,
+		direction: direction,
+		protocol:  "ip",
+	}
+}
+
+// Protocol sets the IP protocol number (e.g., 6 for TCP or 17 for UDP).
+func (b *FilterRuleBuilder) Protocol(protocolNumber uint8) *FilterRuleBuilder {
+	b.protocol = strconv.Itoa(int(protocolNumber))
+	return b
+}
+
+// From sets the source network.  If source is nil, the source is "any".
+func (b *FilterRuleBuilder) From(source *net.IPNet) *FilterRuleBuilder {
+	b.source.network, b.source.assigned = source, false
+	return b
+}
+
+// FromAssigned sets the source to "assigned" (the addresses assigned to the terminal).
+func (b *FilterRuleBuilder) FromAssigned() *FilterRuleBuilder {
+	b.source.network, b.source.assigned = nil, true
+	return b
+}
+
+// FromPorts sets the source ports.
+func (b *FilterRuleBuilder) FromPorts(ports ...FilterRulePortRange) *FilterRuleBuilder {
+	b.source.ports = ports
+	return b
+}
+
+// To sets the destination network.  If destination is nil, the destination is "any".
+func (b *FilterRuleBuilder) To(destination *net.IPNet) *FilterRuleBuilder {
+	b.destination.network, b.destination.assigned = destination, false
+	return b
+}
+
+// ToAssigned sets the destination to "assigned" (the addresses assigned to the terminal).
+func (b *FilterRuleBuilder) ToAssigned() *FilterRuleBuilder {
+	b.destination.network, b.destination.assigned = nil, true
+	return b
+}
+
+// ToPorts sets the destination ports.
+func (b *FilterRuleBuilder) ToPorts(ports ...FilterRulePortRange) *FilterRuleBuilder {
+	b.destination.ports = ports
+	return b
+}
+
+// Option appends an option (e.g., "established" or "icmptypes 0,8") to the end of the rule.  The
+// option is not validated.
+func (b *FilterRuleBuilder) Option(option string) *FilterRuleBuilder {
+	b.options = append(b.options, option)
+	return b
+}
+
+// Build is the same as BuildErrorable() but panics if an error occurs.
+func (b *FilterRuleBuilder) Build() string {
+	rule, err := b.BuildErrorable()
+	if err != nil {
+		panic(err)
+	}
+	return rule
+}
+
+// BuildErrorable returns the rule string.  Returns an error if a network mask is not a prefix mask,
+// or if a port range has a First port greater than its Last port.
+func (b *FilterRuleBuilder) BuildErrorable() (string, error) {
+	source, err := b.source.format()
+	if err != nil {
+		return "", fmt.Errorf("source: %w", err)
+	}
+
+	destination, err := b.destination.format()
+	if err != nil {
+		return "", fmt.Errorf("destination: %w", err)
+	}
+
+	parts := []string{string(b.action), string(b.direction), b.protocol, "from", source, "to", destination}
+
+	return strings.Join(append(parts, b.options...), " "), nil
+}
+
+func (e *filterRuleEndpoint) format() (string, error) {
+	var formatted string
+
+	switch {
+	case e.assigned:
+		formatted = "assigned"
+
+	case e.network == nil:
+		formatted = "any"
+
+	default:
+		ip := e.network.IP.Mask(e.network.Mask)
+		if ip == nil {
+			return "", fmt.Errorf("network mask does not match the address")
+		}
+		ones, bits := e.network.Mask.Size()
+		if bits == 0 {
+			return "", fmt.Errorf("network mask (%s) is not a prefix mask", e.network.Mask)
+		}
+		if bits == 8*net.IPv6len && ip.To4() != nil && ones >= 96 {
+			// an IPv4-mapped IPv6 network is written as an IPv4 network
+			ones, bits = ones-96, 8*net.IPv4len
+		}
+		if ones == bits {
+			formatted = ip.String()
+		} else {
+			formatted = fmt.Sprintf("%s/%d", ip, ones)
+		}
+	}
+
+	if len(e.ports) == 0 {
+		return formatted, nil
+	}
+
+	ports := make([]string, 0, len(e.ports))
+	for _, r := range e.ports {
+		if r.First > r.Last {
+			return "", fmt.Errorf("port range (%d-%d) is not valid", r.First, r.Last)
+		}
+		ports = append(ports, r.String())
+	}
+
+	return formatted + " " + strings.Join(ports, ","), nil
+}
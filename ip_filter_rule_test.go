@@ -0,0 +1,128 @@
+package diameter_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	diameter "github.com/blorticus-go/diameter"
+)
+
+func mustParseCIDR(t *testing.T, cidr string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("failed to parse CIDR (%s): %s", cidr, err)
+	}
+	return ipNet
+}
+
+func TestFilterRuleBuilder(t *testing.T) {
+	testCases := []struct {
+		builder      *diameter.FilterRuleBuilder
+		expectedRule string
+	}{
+		{
+			builder:      diameter.NewFilterRuleBuilder(diameter.FilterRulePermit, diameter.FilterRuleOut),
+			expectedRule: "permit out ip from any to any",
+		},
+		{
+			builder: diameter.NewFilterRuleBuilder(diameter.FilterRulePermit, diameter.FilterRuleOut).
+				Protocol(17).
+				From(mustParseCIDR(t, "10.0.0.0/8")).FromPorts(diameter.FilterRulePortRange{First: 1000, Last: 2000}, diameter.FilterRulePort(3000)).
+				ToAssigned().ToPorts(diameter.FilterRulePort(53)),
+			expectedRule: "permit out 17 from 10.0.0.0/8 1000-2000,3000 to assigned 53",
+		},
+		{
+			builder: diameter.NewFilterRuleBuilder(diameter.FilterRuleDeny, diameter.FilterRuleIn).
+				Protocol(6).
+				FromAssigned().
+				To(&net.IPNet{IP: net.ParseIP("192.0.2.10"), Mask: net.CIDRMask(32, 32)}).ToPorts(diameter.FilterRulePort(443)).
+				Option("established"),
+			expectedRule: "deny in 6 from assigned to 192.0.2.10 443 established",
+		},
+		{
+			builder: diameter.NewFilterRuleBuilder(diameter.FilterRulePermit, diameter.FilterRuleIn).
+				From(&net.IPNet{IP: net.ParseIP("2001:db8::1234"), Mask: net.CIDRMask(32, 128)}).
+				To(mustParseCIDR(t, "2001:db8:1::1/128")),
+			expectedRule: "permit in ip from 2001:db8::/32 to 2001:db8:1::1",
+		},
+		{
+			builder: diameter.NewFilterRuleBuilder(diameter.FilterRulePermit, diameter.FilterRuleOut).
+				Protocol(1).
+				From(&net.IPNet{IP: net.ParseIP("198.51.100.7"), Mask: net.CIDRMask(120, 128)}).
+				Option("icmptypes 0,8"),
+			expectedRule: "permit out 1 from 198.51.100.0/24 to any icmptypes 0,8",
+		},
+	}
+
+	for i, testCase := range testCases {
+		rule, err := testCase.builder.BuildErrorable()
+		if err != nil {
+			t.Errorf("(test case %d) expected no error on BuildErrorable(), got = (%s)", i+1, err)
+			continue
+		}
+		if rule != testCase.expectedRule {
+			t.Errorf("(test case %d) expected rule (%s), got (%s)", i+1, testCase.expectedRule, rule)
+		}
+	}
+
+	badMask := diameter.NewFilterRuleBuilder(diameter.FilterRulePermit, diameter.FilterRuleOut).
+		From(&net.IPNet{IP: net.ParseIP("10.0.0.0").To4(), Mask: net.IPv4Mask(255, 0, 255, 0)})
+	if _, err := badMask.BuildErrorable(); err == nil {
+		t.Errorf("expected error on BuildErrorable() for non-prefix mask, got none")
+	}
+
+	badPorts := diameter.NewFilterRuleBuilder(diameter.FilterRulePermit, diameter.FilterRuleOut).
+		ToPorts(diameter.FilterRulePortRange{First: 2000, Last: 1000})
+	if _, err := badPorts.BuildErrorable(); err == nil {
+		t.Errorf("expected error on BuildErrorable() for reversed port range, got none")
+	}
+}
+
+func TestAddressTypeToIPNet(t *testing.T) {
+	testCases := []struct {
+		address      diameter.AddressType
+		prefixLength int
+		expectedCIDR string
+	}{
+		{diameter.NewAddressTypeFromIP(net.ParseIP("10.1.2.3")), 16, "10.1.0.0/16"},
+		{diameter.NewAddressTypeFromIP(net.ParseIP("10.1.2.3")), 32, "10.1.2.3/32"},
+		{diameter.NewAddressTypeFromIP(net.ParseIP("2001:db8::1")), 64, "2001:db8::/64"},
+	}
+
+	for i, testCase := range testCases {
+		ipNet, err := diameter.AddressTypeToIPNet(testCase.address, testCase.prefixLength)
+		if err != nil {
+			t.Errorf("(test case %d) expected no error on AddressTypeToIPNet(), got = (%s)", i+1, err)
+			continue
+		}
+		if ipNet.String() != testCase.expectedCIDR {
+			t.Errorf("(test case %d) expected (%s), got (%s)", i+1, testCase.expectedCIDR, ipNet)
+		}
+
+		expectedAddress := diameter.NewAddressTypeFromIP(ipNet.IP)
+		if roundTrip := diameter.NewAddressTypeFromIPNet(ipNet); !bytes.Equal(roundTrip, expectedAddress) {
+			t.Errorf("(test case %d) expected NewAddressTypeFromIPNet() = (%v), got (%v)", i+1, expectedAddress, roundTrip)
+		}
+	}
+
+	if _, err := diameter.AddressTypeToIPNet(diameter.NewAddressTypeFromIP(net.ParseIP("10.1.2.3")), 33); err == nil {
+		t.Errorf("expected error on AddressTypeToIPNet() for prefix longer than IPv4 address, got none")
+	}
+	if _, err := diameter.AddressTypeToIPNet(diameter.NewAddressType(diameter.E164, []byte("15551234567")), 8); err == nil {
+		t.Errorf("expected error on AddressTypeToIPNet() for non-IP address, got none")
+	}
+}
+
+func TestFilterRuleBuilderOutputAsPacketFilterContent(t *testing.T) {
+	rule := diameter.NewFilterRuleBuilder(diameter.FilterRulePermit, diameter.FilterRuleOut).
+		Protocol(17).
+		From(mustParseCIDR(t, "10.0.0.0/8")).
+		ToAssigned().
+		Build()
+
+	avp := diameter.NewTypedAVP(1059, 10415, true, diameter.IPFilterRule, rule)
+	if v, ok := avp.AsString(); !ok || v != "permit out 17 from 10.0.0.0/8 to assigned" {
+		t.Errorf("expected Packet-Filter-Content AVP value to be the built rule, got (%s, %t)", v, ok)
+	}
+}
@@ -3,8 +3,12 @@ package diameter
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
+	"fmt"
 	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
 )
 
 // Uint24 is a documentation reference type.  There is no enforcement of boundaries;
@@ -18,7 +22,12 @@ const (
 	MsgFlagProxiable           = 0x40
 	MsgFlagError               = 0x20
 	MsgFlagPotentialRetransmit = 0x10
-	MsgHeaderSize              = Uint24(20)
+	// MsgFlagsReserved are the flag bits that are reserved and must be zero (RFC 6733 section 3)
+	MsgFlagsReserved = 0x0f
+	MsgHeaderSize    = Uint24(20)
+	// MaxMessageLength is the largest value that the 24-bit message Length field can hold, and so the
+	// largest encoded message size.
+	MaxMessageLength = Uint24(0x00ffffff)
 )
 
 // MessageExtendedAttributes includes extended Message attributes that can be
@@ -41,17 +50,29 @@ type Message struct {
 	Avps               []*AVP
 	ExtendedAttributes *MessageExtendedAttributes
 
-	mapOfAvpsByVendorAndCode map[AvpVendorIdAndCode][]*AVP
+	mapOfAvpsByVendorAndCode      map[AvpVendorIdAndCode][]*AVP
+	mapOfAvpsByVendorAndCodeMutex sync.Mutex
 }
 
-// FirstAvpMatching returns the first instance of the identified AVP associated
-// with the current Message, or nil if the Message has no instances of the AVP
-func (m *Message) FirstAvpMatching(vendorId uint32, code Uint24) *AVP {
+// avpMap returns the internal map of top-level AVPs by vendor-id and code, generating it
+// if it has not yet been generated.  This is safe to call from multiple goroutines, so a
+// received message may be handed to more than one reader.  The Avps must not be modified
+// concurrently.
+func (m *Message) avpMap() map[AvpVendorIdAndCode][]*AVP {
+	m.mapOfAvpsByVendorAndCodeMutex.Lock()
+	defer m.mapOfAvpsByVendorAndCodeMutex.Unlock()
+
 	if m.mapOfAvpsByVendorAndCode == nil {
 		m.mapOfAvpsByVendorAndCode = GenerateMapOfAvpsByVendorAndCode(m.Avps)
 	}
 
-	if avpSet := m.mapOfAvpsByVendorAndCode[AvpVendorIdAndCode{vendorId, uint32(code)}]; len(avpSet) == 0 {
+	return m.mapOfAvpsByVendorAndCode
+}
+
+// FirstAvpMatching returns the first instance of the identified AVP associated
+// with the current Message, or nil if the Message has no instances of the AVP
+func (m *Message) FirstAvpMatching(vendorId uint32, code Uint24) *AVP {
+	if avpSet := m.avpMap()[AvpVendorIdAndCode{vendorId, uint32(code)}]; len(avpSet) == 0 {
 		return nil
 	} else {
 		return avpSet[0]
@@ -67,15 +88,39 @@ func (m *Message) MapOfAvpsByCode() map[AvpVendorIdAndCode][]*AVP {
 	return GenerateMapOfAvpsByVendorAndCode(m.Avps)
 }
 
+// AvpsInOrder returns the top-level AVPs of the message in the order in which they appear in the
+// message.  The grouping returned by MapOfAvpsByCode() and used by TopLevelAvpsMatching() preserves the
+// order only among AVPs with the same vendor-id and code; m.Avps remains the source of truth for the
+// order of all AVPs.  The returned slice is a copy, so it may be reordered or appended to without
+// changing the message.  The AVPs themselves are not copied.
+func (m *Message) AvpsInOrder() []*AVP {
+	avps := make([]*AVP, len(m.Avps))
+	copy(avps, m.Avps)
+	return avps
+}
+
+// AvpCodesPresent returns the distinct vendor-id and code pairs of the top-level AVPs in the message, in
+// the order in which the first AVP with each pair appears.  AVPs inside Grouped AVPs are not included.
+func (m *Message) AvpCodesPresent() []AvpVendorIdAndCode {
+	codes := make([]AvpVendorIdAndCode, 0, len(m.Avps))
+	seen := make(map[AvpVendorIdAndCode]struct{}, len(m.Avps))
+
+	for _, avp := range m.Avps {
+		vendorAndCode := AvpVendorIdAndCode{avp.VendorID, avp.Code}
+		if _, alreadySeen := seen[vendorAndCode]; !alreadySeen {
+			seen[vendorAndCode] = struct{}{}
+			codes = append(codes, vendorAndCode)
+		}
+	}
+
+	return codes
+}
+
 // TopLevelAvpsMatching returns the set of top-level AVPs in the message that match
 // the provided vendorId and code.  "top-level" here means AVPs that are not part of
 // a Grouped AVP contained within the message.
 func (m *Message) TopLevelAvpsMatching(vendorId uint32, code Uint24) []*AVP {
-	if m.mapOfAvpsByVendorAndCode == nil {
-		m.mapOfAvpsByVendorAndCode = GenerateMapOfAvpsByVendorAndCode(m.Avps)
-	}
-
-	return m.mapOfAvpsByVendorAndCode[AvpVendorIdAndCode{vendorId, uint32(code)}]
+	return m.avpMap()[AvpVendorIdAndCode{vendorId, uint32(code)}]
 }
 
 // HasATopLevelAvpMatching returns true if there is at least one top-level AVP in the message
@@ -96,6 +141,73 @@ func (m *Message) NumberOfTopLevelAvpsMatching(vendorId uint32, code Uint24) int
 	return len(m.TopLevelAvpsMatching(vendorId, code))
 }
 
+// MissingAnyOf returns the members of required for which there is no top-level AVP in the
+// message with matching vendorId and code, in the order they appear in required.  Returns nil
+// if all required AVPs are present.
+func (m *Message) MissingAnyOf(required []AvpVendorIdAndCode) []AvpVendorIdAndCode {
+	var missing []AvpVendorIdAndCode
+
+	for _, r := range required {
+		if m.DoesNotHaveATopLevelAvpMatching(r.VendorId, Uint24(r.Code)) {
+			missing = append(missing, r)
+		}
+	}
+
+	return missing
+}
+
+// ApplicationIdConsistencyCheck returns an error if the Application-Id in the message header differs
+// from the value of any top-level Auth-Application-Id (code 258) or Acct-Application-Id (code 259) AVP,
+// or of any such AVP inside a top-level Vendor-Specific-Application-Id (code 260) AVP.  It also returns
+// an error if any of these AVPs is malformed.  Messages with an Application-Id of 0 are not checked,
+// because base protocol messages (e.g., the Capabilities-Exchange) advertise other applications in these
+// AVPs.  Returns nil if the message has none of these AVPs.
+func (m *Message) ApplicationIdConsistencyCheck() error {
+	if m.AppID == 0 {
+		return nil
+	}
+
+	applicationIdAvps := make([]*AVP, 0, 2)
+	for _, avp := range m.Avps {
+		if avp.VendorID != 0 {
+			continue
+		}
+
+		switch avp.Code {
+		case 258, 259:
+			applicationIdAvps = append(applicationIdAvps, avp)
+		case 260:
+			children, err := ConvertAVPDataToTypedData(avp.Data, Grouped)
+			if err != nil {
+				return fmt.Errorf("malformed Vendor-Specific-Application-Id: %s", err)
+			}
+			for _, child := range children.([]*AVP) {
+				if child.VendorID == 0 && (child.Code == 258 || child.Code == 259) {
+					applicationIdAvps = append(applicationIdAvps, child)
+				}
+			}
+		}
+	}
+
+	for _, avp := range applicationIdAvps {
+		avpName := "Auth-Application-Id"
+		if avp.Code == 259 {
+			avpName = "Acct-Application-Id"
+		}
+
+		appID, err := ConvertAVPDataToTypedData(avp.Data, Unsigned32)
+		if err != nil {
+			return fmt.Errorf("malformed %s: %s", avpName, err)
+		}
+
+		if appID.(uint32) != m.AppID {
+			return fmt.Errorf("%s (%d) does not match the message header Application-Id (%d)", avpName, appID.(uint32), m.AppID)
+		}
+	}
+
+	return nil
+}
+
 // IsRequest returns true if the message is a Diameter Request message (that
 // is, the request flag in the Diameter message header is set)
 func (m *Message) IsRequest() bool {
@@ -125,20 +237,154 @@ func (m *Message) IsPotentiallyRetransmitted() bool {
 	return (m.Flags & MsgFlagPotentialRetransmit) != 0
 }
 
+// SetErrorFlag sets the error flag in the Diameter message header if isError is true, and clears
+// it otherwise.  No other flag is changed.
+func (m *Message) SetErrorFlag(isError bool) {
+	m.setFlag(MsgFlagError, isError)
+}
+
+// SetProxiableFlag sets the proxiable flag in the Diameter message header if isProxiable is true,
+// and clears it otherwise.  No other flag is changed.
+func (m *Message) SetProxiableFlag(isProxiable bool) {
+	m.setFlag(MsgFlagProxiable, isProxiable)
+}
+
+// SetPotentialRetransmitFlag sets the potentially retransmit flag in the Diameter message header if
+// isPotentiallyRetransmitted is true, and clears it otherwise.  No other flag is changed.  RFC 6733
+// section 3 requires this flag on a request that is sent again after a link failover, so logic that
+// replays an unanswered request on a new transport should call SetPotentialRetransmitFlag(true) on it.
+func (m *Message) SetPotentialRetransmitFlag(isPotentiallyRetransmitted bool) {
+	m.setFlag(MsgFlagPotentialRetransmit, isPotentiallyRetransmitted)
+}
+
+// ValidateHeaderFlags checks that the combination of flags in the message header is permitted by RFC 6733
+// section 3, which does not allow the E-bit to be set on a request.  The reserved bits are not checked,
+// because the RFC requires a receiver to ignore them (see ValidateReservedHeaderFlags()).  Returns an
+// error wrapping ErrInvalidHeaderBits if the flags are not permitted.
+func (m *Message) ValidateHeaderFlags() error {
+	if m.IsRequest() && m.IsError() {
+		return fmt.Errorf("%w: E-bit is set on a request", ErrInvalidHeaderBits)
+	}
+
+	return nil
+}
+
+// ValidateReservedHeaderFlags checks that the reserved bits (MsgFlagsReserved) of the message header are
+// zero.  RFC 6733 section 3 requires a sender to clear them but a receiver to ignore them, so this is only
+// for a receiver that chooses to be stricter than the RFC.  NewMessage() clears the reserved bits, but
+// DecodeMessage() retains them as received.  Returns an error wrapping ErrInvalidHeaderBits if any
+// reserved bit is set.
+func (m *Message) ValidateReservedHeaderFlags() error {
+	if m.Flags&MsgFlagsReserved != 0 {
+		return fmt.Errorf("%w: reserved bits are set in flags (%#02x)", ErrInvalidHeaderBits, m.Flags)
+	}
+
+	return nil
+}
+
+func (m *Message) setFlag(flag uint8, isSet bool) {
+	if isSet {
+		m.Flags |= flag
+	} else {
+		m.Flags &^= flag
+	}
+}
+
+// RecomputeLength sets the message Length to the header size plus the padded length of each AVP
+// in Avps.  The Length is computed when a message is created or decoded, so this should be called
+// after AVPs are added to, removed from, or changed in Avps.
+func (m *Message) RecomputeLength() {
+	m.Length = MsgHeaderSize
+	for _, avp := range m.Avps {
+		m.Length += Uint24(avp.PaddedLength)
+	}
+}
+
+// EncodedSize returns the number of octets that Encode() would produce for the message, without
+// encoding it.  This is the header size plus the padded length of each AVP in Avps, which is the
+// message Length if the Length is current (see RecomputeLength()).
+func (m *Message) EncodedSize() int {
+	size := int(MsgHeaderSize)
+	for _, avp := range m.Avps {
+		size += avp.encodedSize()
+	}
+
+	return size
+}
+
 // Encode transforms the current message into an octet stream appropriate
-// for network transmission
+// for network transmission.  It is the same as EncodeErrorable, except that it panics if the
+// message is too large to encode.
 func (m *Message) Encode() []byte {
-	buf := new(bytes.Buffer)
+	encoded, err := m.EncodeErrorable()
+	if err != nil {
+		panic(err)
+	}
+
+	return encoded
+}
+
+// EncodeErrorable transforms the current message into an octet stream appropriate for network
+// transmission.  Returns an error wrapping ErrMessageTooLarge if the encoded message, or the
+// message Length, exceeds MaxMessageLength, because the 24-bit Length field cannot represent it.
+func (m *Message) EncodeErrorable() ([]byte, error) {
+	return m.appendAvpsUsing(func(buf []byte, avp *AVP) []byte {
+		return avp.appendEncodingWithLengthField(buf, avp.Length)
+	})
+}
+
+// EncodeUsingRaw is the same as Encode, except that each AVP is encoded using its EncodeUsingRaw()
+// method, so that AVPs decoded by DecodeMessageRetainingRawAvps() are emitted exactly as they were
+// received.  The header is encoded from the message fields, so, for example, a changed HopByHopID
+// is reflected.  If AVPs are added, removed or changed, RecomputeLength() should be called first.
+// It is the same as EncodeUsingRawErrorable, except that it panics if the message is too large to
+// encode.
+func (m *Message) EncodeUsingRaw() []byte {
+	encoded, err := m.EncodeUsingRawErrorable()
+	if err != nil {
+		panic(err)
+	}
+
+	return encoded
+}
+
+// EncodeUsingRawErrorable is the same as EncodeErrorable, except that each AVP is encoded using its
+// EncodeUsingRaw() method (see EncodeUsingRaw).  Returns an error wrapping ErrMessageTooLarge if the
+// encoded message, or the message Length, exceeds MaxMessageLength.  A proxy should use this to forward
+// a message received from the network, which may be too large to encode.
+func (m *Message) EncodeUsingRawErrorable() ([]byte, error) {
+	return m.appendAvpsUsing(func(buf []byte, avp *AVP) []byte {
+		if avp.rawEncoded != nil {
+			return append(buf, avp.rawEncoded...)
+		}
+		return avp.appendEncodingWithLengthField(buf, avp.Length)
+	})
+}
+
+// appendAvpsUsing encodes the message header into a buffer sized by EncodedSize(), then appends each
+// AVP to it using appendAvp.  Returns an error if the message is larger than MaxMessageLength.
+func (m *Message) appendAvpsUsing(appendAvp func(buf []byte, avp *AVP) []byte) ([]byte, error) {
+	encodedSize := m.EncodedSize()
+	if encodedSize > int(MaxMessageLength) {
+		return nil, fmt.Errorf("%w: encoded size is (%d)", ErrMessageTooLarge, encodedSize)
+	}
+	if m.Length > MaxMessageLength {
+		return nil, fmt.Errorf("%w: message Length is (%d)", ErrMessageTooLarge, m.Length)
+	}
+
+	buf := make([]byte, MsgHeaderSize, encodedSize)
+
+	binary.BigEndian.PutUint32(buf[0:4], uint32(m.Version)<<24|uint32(m.Length))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(m.Flags)<<24|uint32(m.Code)&0x00ffffff)
+	binary.BigEndian.PutUint32(buf[8:12], m.AppID)
+	binary.BigEndian.PutUint32(buf[12:16], m.HopByHopID)
+	binary.BigEndian.PutUint32(buf[16:20], m.EndToEndID)
 
-	binary.Write(buf, binary.BigEndian, uint32(m.Version)<<24|uint32(m.Length)&0x00ffffff)
-	binary.Write(buf, binary.BigEndian, uint32(m.Flags)<<24|uint32(m.Code)&0x00ffffff)
-	binary.Write(buf, binary.BigEndian, m.AppID)
-	binary.Write(buf, binary.BigEndian, m.HopByHopID)
-	binary.Write(buf, binary.BigEndian, m.EndToEndID)
 	for _, avp := range m.Avps {
-		buf.Write(avp.Encode())
+		buf = appendAvp(buf, avp)
 	}
-	return buf.Bytes()
+
+	return buf, nil
 }
 
 // DecodeMessage accepts an octet stream and attempts to interpret it as a Diameter
@@ -148,108 +394,165 @@ func (m *Message) Encode() []byte {
 // the stream or creation of the message, return nil and an error; otherwise
 // return a Message object and nil for the error.
 func DecodeMessage(input []byte) (*Message, error) {
-	m := new(Message)
-	buf := bytes.NewReader(input)
-	var flagsAndLength uint32
-	err := binary.Read(buf, binary.BigEndian, &flagsAndLength)
-	if err != nil {
-		return nil, err
-	}
+	return decodeMessage(input, messageDecodeOptions{})
+}
 
-	m.Version = byte((flagsAndLength & 0xFF000000) >> 24)
-	m.Length = Uint24(flagsAndLength & 0x00FFFFFF)
+// DecodeMessageRetainingRawAvps is the same as DecodeMessage, except that each top-level AVP in the
+// returned message retains a copy of the bytes from which it was decoded, as if it were decoded by
+// DecodeAVPRetainingRaw().  This is intended for a proxy that inspects the typed values of AVPs but
+// forwards the message using EncodeUsingRaw().
+func DecodeMessageRetainingRawAvps(input []byte) (*Message, error) {
+	return decodeMessage(input, messageDecodeOptions{retainRawAvps: true})
+}
 
-	if Uint24(len(input)) < m.Length {
-		return nil, errors.New("header length does not match stream length")
-	}
+// DecodeMessageNoCopy is the same as DecodeMessage, except that the Data of each top-level AVP in the
+// returned message is a sub-slice of input, rather than a copy.  This avoids an allocation and copy per
+// AVP, and is intended for a proxy that decodes a message, inspects it, and discards it.  It is unsafe
+// unless input is left unchanged for as long as the message (or any of its AVPs) is used: if the buffer
+// is reused (e.g., for the next read from a transport), the AVP Data changes with it.  Likewise, changing
+// an element of the Data of an AVP changes input.  The capacity of each Data slice is its length, so
+// appending to it does not overwrite input.
+func DecodeMessageNoCopy(input []byte) (*Message, error) {
+	return decodeMessage(input, messageDecodeOptions{aliasAvpData: true})
+}
 
-	err = binary.Read(buf, binary.BigEndian, &flagsAndLength)
-	if err != nil {
-		return nil, err
+// messageDecodeOptions are the variations of DecodeMessage.
+type messageDecodeOptions struct {
+	// retainRawAvps retains a copy of the encoding of each top-level AVP
+	retainRawAvps bool
+	// aliasAvpData makes the Data of each top-level AVP a sub-slice of the input
+	aliasAvpData bool
+}
+
+func decodeMessage(input []byte, options messageDecodeOptions) (*Message, error) {
+	if len(input) < int(MsgHeaderSize) {
+		return nil, fmt.Errorf("%w: input length (%d) is less than the Diameter message header size", ErrTruncatedMessage, len(input))
 	}
 
-	m.Flags = byte((flagsAndLength & 0xFF000000) >> 24)
-	m.Code = Uint24(flagsAndLength & 0x00FFFFFF)
+	m := new(Message)
 
-	err = binary.Read(buf, binary.BigEndian, &m.AppID)
-	if err != nil {
-		return nil, err
+	versionAndLength := binary.BigEndian.Uint32(input[0:4])
+	m.Version = byte((versionAndLength & 0xFF000000) >> 24)
+	m.Length = Uint24(versionAndLength & 0x00FFFFFF)
+
+	if m.Version != 1 {
+		return nil, fmt.Errorf("%w: version is (%d)", ErrUnknownVersion, m.Version)
 	}
 
-	err = binary.Read(buf, binary.BigEndian, &m.HopByHopID)
-	if err != nil {
-		return nil, err
+	if Uint24(len(input)) < m.Length {
+		return nil, fmt.Errorf("%w: header length (%d) exceeds stream length (%d)", ErrTruncatedMessage, m.Length, len(input))
 	}
 
-	err = binary.Read(buf, binary.BigEndian, &m.EndToEndID)
-	if err != nil {
-		return nil, err
+	if m.Length < MsgHeaderSize {
+		return nil, fmt.Errorf("%w: header length is (%d)", ErrInvalidMessageLength, m.Length)
 	}
 
+	flagsAndCode := binary.BigEndian.Uint32(input[4:8])
+	m.Flags = byte((flagsAndCode & 0xFF000000) >> 24)
+	m.Code = Uint24(flagsAndCode & 0x00FFFFFF)
+
+	m.AppID = binary.BigEndian.Uint32(input[8:12])
+	m.HopByHopID = binary.BigEndian.Uint32(input[12:16])
+	m.EndToEndID = binary.BigEndian.Uint32(input[16:20])
+
 	m.Avps = make([]*AVP, 0)
 	b := input[MsgHeaderSize:int(m.Length)]
+	offset := int(MsgHeaderSize)
 	for len(b) > 0 {
-		var avp *AVP
-		avp, err = DecodeAVP(b)
-
+		avp, consumed, err := decodeAVPWithConsumed(b, !options.aliasAvpData)
 		if err != nil {
-			return nil, err
+			return nil, newAvpDecodeError(b, offset, err)
 		}
 
-		b = b[avp.PaddedLength:]
+		if options.retainRawAvps {
+			avp.retainRawEncodingFrom(b)
+		}
+
+		b = b[consumed:]
+		offset += consumed
 		m.Avps = append(m.Avps, avp)
 	}
 
-	if err != nil {
-		return nil, err
-	}
-	return m, err
+	return m, nil
 }
 
 // NewMessage creates a new diameter.Message instance.  'mandatoryAvps' will all
 // have their Mandatory flag set to true.  The Mandatory flag for 'additionalAvps'
 // will be left untouched.
 func NewMessage(flags uint8, code Uint24, appID uint32, hopByHopID uint32, endToEndID uint32, mandatoryAvps []*AVP, additionalAvps []*AVP) (m *Message) {
-	m = new(Message)
+	for _, avp := range mandatoryAvps {
+		// AVPs are often shared between messages (e.g., cached AVPs used by concurrent peers),
+		// so only write the flag when it changes
+		if !avp.Mandatory {
+			avp.Mandatory = true
+		}
+	}
 
-	m.Version = 1
-	m.Flags = flags & 0xf0
-	m.Code = code & 0x00ffffff
-	m.AppID = appID
-	m.HopByHopID = hopByHopID
-	m.EndToEndID = endToEndID
-	m.Avps = make([]*AVP, len(mandatoryAvps)+len(additionalAvps))
+	avps := make([]*AVP, 0, len(mandatoryAvps)+len(additionalAvps))
+	avps = append(avps, mandatoryAvps...)
+	avps = append(avps, additionalAvps...)
 
-	m.Length = MsgHeaderSize
-	for i := 0; i < len(mandatoryAvps); i++ {
-		m.Length += Uint24(mandatoryAvps[i].PaddedLength)
-		m.Avps[i] = mandatoryAvps[i]
-		m.Avps[i].Mandatory = true
-	}
+	return newMessageWithAvpSlice(flags, code, appID, hopByHopID, endToEndID, avps)
+}
+
+// NewMessageWithVersion is the same as NewMessage, except that the message header has the provided
+// version rather than 1.  Since 1 is the only defined version, this is intended for testing that a
+// message with another version is rejected.
+func NewMessageWithVersion(version uint8, flags uint8, code Uint24, appID uint32, hopByHopID uint32, endToEndID uint32, mandatoryAvps []*AVP, additionalAvps []*AVP) *Message {
+	m := NewMessage(flags, code, appID, hopByHopID, endToEndID, mandatoryAvps, additionalAvps)
+	m.Version = version
+
+	return m
+}
 
-	t := len(mandatoryAvps)
+// NewMessageNoFlagForcing is the same as NewMessage, except that the flags of every AVP in avps are left
+// untouched.  This is useful when an AVP must keep a clear Mandatory flag, or when AVP objects are reused
+// and should not be modified.  The message Length is computed from avps.
+func NewMessageNoFlagForcing(flags uint8, code Uint24, appID uint32, hopByHopID uint32, endToEndID uint32, avps []*AVP) *Message {
+	avpsCopy := make([]*AVP, len(avps))
+	copy(avpsCopy, avps)
 
-	for i := 0; i < len(additionalAvps); i++ {
-		m.Length += Uint24(additionalAvps[i].PaddedLength)
-		m.Avps[t+i] = additionalAvps[i]
+	return newMessageWithAvpSlice(flags, code, appID, hopByHopID, endToEndID, avpsCopy)
+}
+
+// newMessageWithAvpSlice creates a Message that uses avps as its Avps slice, and computes the Length.
+func newMessageWithAvpSlice(flags uint8, code Uint24, appID uint32, hopByHopID uint32, endToEndID uint32, avps []*AVP) *Message {
+	m := &Message{
+		Version:    1,
+		Flags:      flags & 0xf0,
+		Code:       code & 0x00ffffff,
+		AppID:      appID,
+		HopByHopID: hopByHopID,
+		EndToEndID: endToEndID,
+		Avps:       avps,
 	}
 
+	m.RecomputeLength()
+
 	return m
 }
 
 // Clone makes a copy of the current message.  No effort is made to be thread-safe
 // against changes to the message being cloned.  All AVPs in this message are also
-// cloned.
+// cloned.  The internal map used by FirstAvpMatching and TopLevelAvpsMatching is
+// not copied, so it is regenerated from the cloned AVPs on first use.
 func (m *Message) Clone() *Message {
 	clonedAvps := make([]*AVP, len(m.Avps))
-	for _, srcAvp := range m.Avps {
-		clonedAvps = append(clonedAvps, srcAvp.Clone())
+	for i, srcAvp := range m.Avps {
+		clonedAvps[i] = srcAvp.Clone()
 	}
 
-	clonedMessage := *m
-	clonedMessage.Avps = clonedAvps
-
-	return &clonedMessage
+	return &Message{
+		Version:            m.Version,
+		Length:             m.Length,
+		Flags:              m.Flags,
+		Code:               m.Code,
+		AppID:              m.AppID,
+		HopByHopID:         m.HopByHopID,
+		EndToEndID:         m.EndToEndID,
+		Avps:               clonedAvps,
+		ExtendedAttributes: m.ExtendedAttributes,
+	}
 }
 
 // Equals compares the current Message object to a different message object.  If
@@ -305,6 +608,38 @@ const (
 	streamReaderBaseBufferSizeInBytes int = 16384
 )
 
+// MaxDecodeErrorCapturedBytes is the maximum number of bytes that a MessageDecodeError captures
+// from the stream that could not be decoded.
+const MaxDecodeErrorCapturedBytes = 256
+
+// MessageDecodeError is returned by a MessageByteReader or a MessageStreamReader when the incoming
+// stream cannot be decoded as a Diameter message.  Bytes is a copy of the start of the stream at the
+// message that failed, up to MaxDecodeErrorCapturedBytes long.  Err is the underlying decoding error.
+type MessageDecodeError struct {
+	Bytes []byte
+	Err   error
+}
+
+// NewMessageDecodeError returns a MessageDecodeError for err, capturing a bounded copy of
+// undecodableBytes.
+func NewMessageDecodeError(err error, undecodableBytes []byte) *MessageDecodeError {
+	captured := make([]byte, min(len(undecodableBytes), MaxDecodeErrorCapturedBytes))
+	copy(captured, undecodableBytes)
+
+	return &MessageDecodeError{
+		Bytes: captured,
+		Err:   err,
+	}
+}
+
+func (e *MessageDecodeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *MessageDecodeError) Unwrap() error {
+	return e.Err
+}
+
 // MessageByteReader simplifies the reading of an octet stream which must be
 // converted to one or more diameter.Message objects.  Generally, a new
 // MessageByteReader is created, then ReceiveBytes() is repeatedly called on
@@ -348,7 +683,9 @@ func (reader *MessageByteReader) ReceiveBytes(incoming []byte) ([]*Message, erro
 // ReceiveBytesButReturnAtMostOneMessage is the same as ReceiveBytes(), but it will return no more
 // than one message.  If more than one message is available in the internal buffer plus the incoming bytes,
 // all messages after the first are saved in the internal buffer, which means they'll be returned on the
-// next call to ReceiveBytes().
+// next call to ReceiveBytes().  If the buffered bytes hold a complete header (or part of one) but not the
+// full message length that the header declares, nil is returned with no error, and the bytes are kept
+// until enough arrive on later calls.
 func (reader *MessageByteReader) ReceiveBytesButReturnAtMostOneMessage(incoming []byte) (*Message, error) {
 	reader.incomingBuffer = append(reader.incomingBuffer, incoming...)
 
@@ -368,9 +705,10 @@ func (reader *MessageByteReader) ReceiveBytesButReturnAtMostOneMessage(incoming
 
 // Read a stream buffer and attempt to extract a Message, if there are enough
 // bytes in the stream.  If not, return (nil, incoming, nil).  If the stream is malformed for
-// a message, return (nil, incoming, error). If there is at least enough bytes for a message
-// and the stream is well-formed, return (m, leftOverBytes, nil), where m is a Message and
-// remainder is a slice of incoming, starting one byte after the extracted message.
+// a message, return (nil, incoming, error), where error is a *MessageDecodeError.  If there
+// is at least enough bytes for a message and the stream is well-formed, return
+// (m, leftOverBytes, nil), where m is a Message and remainder is a slice of incoming, starting
+// one byte after the extracted message.
 func extractNextMessageInByteBufferIfThereIsOne(incoming []byte) (*Message, []byte, error) {
 	if len(incoming) == 0 {
 		return nil, incoming, nil
@@ -378,15 +716,17 @@ func extractNextMessageInByteBufferIfThereIsOne(incoming []byte) (*Message, []by
 
 	buf := bytes.NewReader(incoming)
 
-	// 20 is the diameter header length
-	if len(incoming) < 20 {
+	// Until the full header has arrived, the message length is not known, so only the version can be
+	// checked.  Once it has, the message is not decoded until every byte of the declared length has
+	// arrived, even if that is not until a later call.
+	if len(incoming) < int(MsgHeaderSize) {
 		var version uint8
 		err := binary.Read(buf, binary.BigEndian, &version)
 
 		if err != nil {
 			return nil, incoming, err
 		} else if version != 1 {
-			return nil, incoming, errors.New("unknown Diameter version")
+			return nil, incoming, NewMessageDecodeError(ErrUnknownVersion, incoming)
 		} else {
 			return nil, incoming, nil
 		}
@@ -402,7 +742,7 @@ func extractNextMessageInByteBufferIfThereIsOne(incoming []byte) (*Message, []by
 		length := Uint24(flagsAndLength & 0x00FFFFFF)
 
 		if version != 1 {
-			return nil, incoming, errors.New("invalid Diameter message version")
+			return nil, incoming, NewMessageDecodeError(fmt.Errorf("%w: version is (%d)", ErrUnknownVersion, version), incoming)
 		}
 
 		if len(incoming) < int(length) {
@@ -412,7 +752,7 @@ func extractNextMessageInByteBufferIfThereIsOne(incoming []byte) (*Message, []by
 		m, err := DecodeMessage(incoming)
 
 		if err != nil {
-			return nil, incoming, err
+			return nil, incoming, NewMessageDecodeError(err, incoming)
 		}
 
 		return m, incoming[m.Length:], nil
@@ -444,7 +784,9 @@ func NewMessageStreamReader(usingReader io.Reader) *MessageStreamReader {
 // call will return that message and buffer again any left over bytes.  This will
 // continue until the internal buffer no longer contains a complete message, at which
 // point, another Read() will occur.  The returned error may be io.EOF.  In this case,
-// the returned message will still be nil.
+// the returned message will still be nil.  If the underlying Reader returns io.EOF
+// while the internal buffer holds an incomplete message, io.ErrUnexpectedEOF is
+// returned instead.
 func (reader *MessageStreamReader) ReadNextMessage() (*Message, error) {
 	for {
 		message, err := reader.ReadOnce()
@@ -458,27 +800,135 @@ func (reader *MessageStreamReader) ReadNextMessage() (*Message, error) {
 	}
 }
 
+// readDeadlineSetter is implemented by Readers that support read deadlines, such as net.Conn.
+type readDeadlineSetter interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// ReadNextMessageWithDeadline is the same as ReadNextMessage(), but it returns an error if a complete
+// message has not arrived by deadline, even if the bytes of the message are still arriving (e.g., from a
+// peer that sends a header, then stalls).  If the underlying Reader has a SetReadDeadline() method (as a
+// net.Conn does), its read deadline is set to deadline, and is left set when this returns, replacing any
+// deadline set before.  Otherwise, the deadline is checked only between Read()s, so a Read() that blocks
+// is not interrupted.  If the bytes read before the deadline complete a message, the message is returned
+// rather than an error.  On timeout, the returned error matches os.ErrDeadlineExceeded (using
+// errors.Is()).  Bytes of an incomplete message remain buffered, so a later call may still return the
+// message.
+func (reader *MessageStreamReader) ReadNextMessageWithDeadline(deadline time.Time) (*Message, error) {
+	if deadlineSetter, ok := reader.underlyingReader.(readDeadlineSetter); ok {
+		if err := deadlineSetter.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		message, err := reader.ReadOnce()
+		if err != nil {
+			if bufferedMessage, _ := reader.nextBufferedMessage(); bufferedMessage != nil {
+				return bufferedMessage, nil
+			}
+			return nil, err
+		}
+
+		if message != nil {
+			return message, nil
+		}
+
+		if !time.Now().Before(deadline) {
+			if bufferedMessage, err := reader.nextBufferedMessage(); bufferedMessage != nil || err != nil {
+				return bufferedMessage, err
+			}
+			return nil, fmt.Errorf("no complete message before the deadline: %w", os.ErrDeadlineExceeded)
+		}
+	}
+}
+
+// nextBufferedMessage removes and returns the next complete message in the internal byte buffer, without
+// reading from the underlying Reader.  Returns nil if the buffer does not hold a complete message.
+func (reader *MessageStreamReader) nextBufferedMessage() (*Message, error) {
+	message, leftOverBytes, err := extractNextMessageInByteBufferIfThereIsOne(reader.internalByteBuffer)
+	if err != nil || message == nil {
+		return nil, err
+	}
+
+	reader.internalByteBuffer = leftOverBytes
+	return message, nil
+}
+
 // ReadOnce does the same as ReadNextMessage(), but it will perform no more than a
 // single Read() on the underlying Reader.  If the Read() (plus any internal buffer)
 // does not yield a complete message, this will return.  In that case, the returned
 // Message and error will both be nil.
 func (reader *MessageStreamReader) ReadOnce() (*Message, error) {
-	message, leftOverBytes, err := extractNextMessageInByteBufferIfThereIsOne(reader.internalByteBuffer)
+	if message, err := reader.nextBufferedMessage(); message != nil || err != nil {
+		return message, err
+	}
+
+	bytesRead, err := reader.underlyingReader.Read(reader.readBuffer)
+	reader.internalByteBuffer = append(reader.internalByteBuffer, reader.readBuffer[:bytesRead]...)
+
 	if err != nil {
+		if err == io.EOF && len(reader.internalByteBuffer) > 0 {
+			if bytesRead > 0 {
+				// the bytes read with the EOF may complete a message, and the underlying
+				// reader will return io.EOF again on the next Read()
+				return nil, nil
+			}
+			return nil, io.ErrUnexpectedEOF
+		}
 		return nil, err
 	}
 
-	if message != nil {
-		reader.internalByteBuffer = leftOverBytes
-		return message, nil
+	return nil, nil
+}
+
+// maxMessagePacketSize is the largest packet that a MessagePacketReader will read.
+const maxMessagePacketSize = 65535
+
+// MessagePacketReader reads messages from a packet-based connection, where each packet must contain
+// exactly one complete message.  Diameter does not run over a packet transport (e.g., UDP), so this is
+// intended only for test tooling, such as a message injector.
+type MessagePacketReader struct {
+	conn       net.PacketConn
+	readBuffer []byte
+}
+
+// NewMessagePacketReader creates a reader which will use conn for each call to ReadNextMessage().
+func NewMessagePacketReader(conn net.PacketConn) *MessagePacketReader {
+	return &MessagePacketReader{
+		conn:       conn,
+		readBuffer: make([]byte, maxMessagePacketSize),
 	}
+}
 
-	bytesRead, err := reader.underlyingReader.Read(reader.readBuffer)
+// ReadNextMessage reads the next packet from the connection and decodes it as a message.  It returns
+// the message and the address of the packet source.  If the packet contains only part of a message, or
+// contains more than one message, or is otherwise malformed, a *MessageDecodeError is returned.  If the
+// read fails, the error from the connection is returned.
+func (reader *MessagePacketReader) ReadNextMessage() (*Message, net.Addr, error) {
+	bytesRead, sourceAddr, err := reader.conn.ReadFrom(reader.readBuffer)
 	if err != nil {
-		return nil, err
+		return nil, sourceAddr, err
 	}
 
-	reader.internalByteBuffer = append(reader.internalByteBuffer, reader.readBuffer[:bytesRead]...)
+	packet := reader.readBuffer[:bytesRead]
 
-	return nil, nil
+	if len(packet) < int(MsgHeaderSize) {
+		return nil, sourceAddr, NewMessageDecodeError(fmt.Errorf("%w: packet length (%d) is less than the Diameter message header size", ErrTruncatedMessage, len(packet)), packet)
+	}
+
+	messageLength := int(binary.BigEndian.Uint32(packet[0:4]) & 0x00ffffff)
+	if messageLength > len(packet) {
+		return nil, sourceAddr, NewMessageDecodeError(fmt.Errorf("%w: packet contains a partial message: message length is (%d) but packet length is (%d)", ErrTruncatedMessage, messageLength, len(packet)), packet)
+	}
+	if messageLength < len(packet) {
+		return nil, sourceAddr, NewMessageDecodeError(fmt.Errorf("packet contains more than one message: message length is (%d) but packet length is (%d)", messageLength, len(packet)), packet)
+	}
+
+	m, err := DecodeMessage(packet)
+	if err != nil {
+		return nil, sourceAddr, NewMessageDecodeError(err, packet)
+	}
+
+	return m, sourceAddr, nil
 }
@@ -0,0 +1,273 @@
+package diameter
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// MessageTemplate describes a message by the names of its type and AVPs in a Dictionary, with
+// placeholders of the form ${Name} in AVP values that are substituted when the template is instantiated
+// by Dictionary.InstantiateTemplate().  A template is written in YAML:
+//
+//	Message: Credit-Control-Request
+//	Flags:
+//	  Proxiable: true
+//	Avps:
+//	  - Session-Id: "${SessionId}"
+//	  - Origin-Host: client.example.com
+//	  - Destination-Realm: "${DestinationRealm}"
+//	  - CC-Request-Type: INITIAL_REQUEST
+//	  - Subscription-Id:
+//	      - Subscription-Id-Type: 0
+//	      - Subscription-Id-Data: "${Msisdn}"
+//
+// Message is the name or abbreviation of a message type in the dictionary.  Each element of Avps maps
+// one AVP name to its value, so that AVPs keep their order and may repeat.  The value of a Grouped AVP
+// is a list of its children, in the same form.  Other values are written as they would be read: numbers
+// for the integer and float types, the enumeration name or number for Enumerated, an IP address for
+// Address, an RFC 3339 timestamp for Time, and text for the remaining types.
+type MessageTemplate struct {
+	Message string               `yaml:"Message"`
+	Flags   MessageFlags         `yaml:"Flags"`
+	Avps    []MessageTemplateAvp `yaml:"Avps"`
+}
+
+// MessageTemplateAvp is an AVP in a MessageTemplate.  Value is a string (possibly with placeholders), or,
+// for a Grouped AVP, the children.
+type MessageTemplateAvp struct {
+	Name  string
+	Value interface{}
+}
+
+// UnmarshalYAML reads a MessageTemplateAvp from a map with a single key, the AVP name.
+func (templateAvp *MessageTemplateAvp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var nameAndValue yaml.MapSlice
+	if err := unmarshal(&nameAndValue); err != nil {
+		return err
+	}
+
+	if len(nameAndValue) != 1 {
+		return fmt.Errorf("template AVP must be a map with exactly one AVP name, got (%d) keys", len(nameAndValue))
+	}
+
+	name, isString := nameAndValue[0].Key.(string)
+	if !isString {
+		return fmt.Errorf("template AVP name (%v) is not a string", nameAndValue[0].Key)
+	}
+
+	value, err := messageTemplateAvpValue(name, nameAndValue[0].Value)
+	if err != nil {
+		return err
+	}
+
+	templateAvp.Name, templateAvp.Value = name, value
+
+	return nil
+}
+
+// messageTemplateAvpValue converts the YAML value of the template AVP name to a string or, if it is a
+// list, to []MessageTemplateAvp.
+func messageTemplateAvpValue(name string, yamlValue interface{}) (interface{}, error) {
+	switch v := yamlValue.(type) {
+	case []interface{}:
+		children := make([]MessageTemplateAvp, 0, len(v))
+		for _, yamlChild := range v {
+			child, err := messageTemplateAvpFromYamlMap(yamlChild)
+			if err != nil {
+				return nil, fmt.Errorf("in (%s): %s", name, err)
+			}
+			children = append(children, child)
+		}
+		return children, nil
+
+	case nil:
+		return nil, fmt.Errorf("template AVP (%s) has no value", name)
+
+	case map[interface{}]interface{}, yaml.MapSlice:
+		return nil, fmt.Errorf("value of template AVP (%s) must be a scalar or a list", name)
+
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+func messageTemplateAvpFromYamlMap(yamlValue interface{}) (MessageTemplateAvp, error) {
+	var name interface{}
+	var value interface{}
+	keys := 0
+
+	switch v := yamlValue.(type) {
+	case map[interface{}]interface{}:
+		for name, value = range v {
+			keys++
+		}
+	case yaml.MapSlice:
+		for _, item := range v {
+			name, value = item.Key, item.Value
+			keys++
+		}
+	default:
+		return MessageTemplateAvp{}, fmt.Errorf("template AVP must be a map with exactly one AVP name")
+	}
+
+	if keys != 1 {
+		return MessageTemplateAvp{}, fmt.Errorf("template AVP must be a map with exactly one AVP name, got (%d) keys", keys)
+	}
+
+	nameString, isString := name.(string)
+	if !isString {
+		return MessageTemplateAvp{}, fmt.Errorf("template AVP name (%v) is not a string", name)
+	}
+
+	typedValue, err := messageTemplateAvpValue(nameString, value)
+	if err != nil {
+		return MessageTemplateAvp{}, err
+	}
+
+	return MessageTemplateAvp{Name: nameString, Value: typedValue}, nil
+}
+
+// MessageTemplateFromYamlString reads a MessageTemplate from YAML.  Returns an error if the YAML is not
+// valid or is not in the form described for MessageTemplate.  Names are not resolved until the
+// template is instantiated.
+func MessageTemplateFromYamlString(yamlString string) (*MessageTemplate, error) {
+	template := new(MessageTemplate)
+	if err := yaml.UnmarshalStrict([]byte(yamlString), template); err != nil {
+		return nil, err
+	}
+
+	if template.Message == "" {
+		return nil, fmt.Errorf("template has no Message")
+	}
+
+	return template, nil
+}
+
+var messageTemplatePlaceholderPattern = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// InstantiateTemplate builds the message described by template, after replacing each ${Name} in an AVP
+// value with values[Name].  The M-bit of each AVP is set if the dictionary requires it (MandatoryFlag
+// "Must").  The hop-by-hop-id and end-to-end-id are zero.  Returns an error if the message type or an
+// AVP name is not in the dictionary, if a placeholder has no value, or if a value cannot be converted to
+// the type of its AVP.
+func (dictionary *Dictionary) InstantiateTemplate(template *MessageTemplate, values map[string]string) (*Message, error) {
+	avps, err := dictionary.instantiateTemplateAvps(template.Avps, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return dictionary.MessageErrorable(template.Message, template.Flags, nil, avps)
+}
+
+func (dictionary *Dictionary) instantiateTemplateAvps(templateAvps []MessageTemplateAvp, values map[string]string) ([]*AVP, error) {
+	avps := make([]*AVP, 0, len(templateAvps))
+
+	for _, templateAvp := range templateAvps {
+		descriptor, isInMap := dictionary.avpDescriptorByName[templateAvp.Name]
+		if !isInMap {
+			return nil, fmt.Errorf("no AVP named (%s) in the dictionary", templateAvp.Name)
+		}
+
+		value, err := dictionary.templateAvpTypedValue(descriptor, templateAvp.Value, values)
+		if err != nil {
+			return nil, fmt.Errorf("AVP (%s): %s", templateAvp.Name, err)
+		}
+
+		avp, err := NewTypedAVPErrorable(descriptor.code, descriptor.vendorID, descriptor.mandatoryFlag == mandatoryFlagMust, descriptor.dataType, value)
+		if err != nil {
+			return nil, fmt.Errorf("AVP (%s): %s", templateAvp.Name, err)
+		}
+
+		avps = append(avps, avp)
+	}
+
+	return avps, nil
+}
+
+// templateAvpTypedValue converts the template value for an AVP described by descriptor to a value accepted
+// by NewTypedAVPErrorable() for its type.
+func (dictionary *Dictionary) templateAvpTypedValue(descriptor *dictionaryAvpDescriptor, templateValue interface{}, values map[string]string) (interface{}, error) {
+	if children, isGrouped := templateValue.([]MessageTemplateAvp); isGrouped {
+		if descriptor.dataType != Grouped {
+			return nil, fmt.Errorf("a list of AVPs is only allowed for a Grouped AVP")
+		}
+		return dictionary.instantiateTemplateAvps(children, values)
+	}
+
+	if descriptor.dataType == Grouped {
+		return nil, fmt.Errorf("value of a Grouped AVP must be a list of AVPs")
+	}
+
+	templateString, isString := templateValue.(string)
+	if !isString {
+		return nil, fmt.Errorf("value must be a string, not (%T)", templateValue)
+	}
+
+	s, err := substituteTemplatePlaceholders(templateString, values)
+	if err != nil {
+		return nil, err
+	}
+
+	switch descriptor.dataType {
+	case Unsigned32:
+		v, err := strconv.ParseUint(s, 0, 32)
+		return uint32(v), err
+	case Unsigned64:
+		return strconv.ParseUint(s, 0, 64)
+	case Integer32:
+		v, err := strconv.ParseInt(s, 0, 32)
+		return int32(v), err
+	case Integer64:
+		return strconv.ParseInt(s, 0, 64)
+	case Float32:
+		v, err := strconv.ParseFloat(s, 32)
+		return float32(v), err
+	case Float64:
+		return strconv.ParseFloat(s, 64)
+	case Enumerated:
+		if v, isKnown := descriptor.enumeratedValueNamed(s); isKnown {
+			return v, nil
+		}
+		v, err := strconv.ParseInt(s, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("(%s) is neither an enumeration name nor a number", s)
+		}
+		return int32(v), nil
+	case Address:
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("(%s) is not an IP address", s)
+		}
+		return ip, nil
+	case Time:
+		return time.Parse(time.RFC3339, s)
+	case OctetString:
+		return []byte(s), nil
+	default:
+		return s, nil
+	}
+}
+
+func substituteTemplatePlaceholders(s string, values map[string]string) (string, error) {
+	var missingValueName string
+
+	substituted := messageTemplatePlaceholderPattern.ReplaceAllStringFunc(s, func(placeholder string) string {
+		name := placeholder[2 : len(placeholder)-1]
+		value, hasValue := values[name]
+		if !hasValue && missingValueName == "" {
+			missingValueName = name
+		}
+		return value
+	})
+
+	if missingValueName != "" {
+		return "", fmt.Errorf("no value for placeholder (${%s})", missingValueName)
+	}
+
+	return substituted, nil
+}
@@ -0,0 +1,183 @@
+package diameter_test
+
+import (
+	"testing"
+
+	diameter "github.com/blorticus-go/diameter"
+)
+
+const messageTemplateTestDictionary = `---
+MessageTypes:
+    - Basename: "Credit-Control"
+      Abbreviations:
+          Request: "CCR"
+          Answer: "CCA"
+      Code: 272
+      ApplicationId: 4
+AvpTypes:
+    - Name: "Session-Id"
+      Code: 263
+      Type: "UTF8String"
+      MandatoryFlag: "Must"
+    - Name: "Origin-Host"
+      Code: 264
+      Type: "DiamIdent"
+      MandatoryFlag: "Must"
+    - Name: "Destination-Realm"
+      Code: 283
+      Type: "DiamIdent"
+      MandatoryFlag: "Must"
+    - Name: "CC-Request-Type"
+      Code: 416
+      Type: "Enumerated"
+      MandatoryFlag: "Must"
+      Enumeration:
+        - Name: "INITIAL_REQUEST"
+          Value: 1
+        - Name: "UPDATE_REQUEST"
+          Value: 2
+        - Name: "TERMINATION_REQUEST"
+          Value: 3
+    - Name: "CC-Request-Number"
+      Code: 415
+      Type: "Unsigned32"
+      MandatoryFlag: "Must"
+    - Name: "Subscription-Id"
+      Code: 443
+      Type: "Grouped"
+      MandatoryFlag: "Must"
+    - Name: "Subscription-Id-Type"
+      Code: 450
+      Type: "Enumerated"
+      MandatoryFlag: "Must"
+    - Name: "Subscription-Id-Data"
+      Code: 444
+      Type: "UTF8String"
+      MandatoryFlag: "Must"
+`
+
+const creditControlRequestTemplate = `---
+Message: CCR
+Flags:
+    Proxiable: true
+Avps:
+    - Session-Id: "client.example.com;${SessionId}"
+    - Origin-Host: client.example.com
+    - Destination-Realm: "${DestinationRealm}"
+    - CC-Request-Type: INITIAL_REQUEST
+    - CC-Request-Number: 0
+    - Subscription-Id:
+        - Subscription-Id-Type: 0
+        - Subscription-Id-Data: "${Msisdn}"
+`
+
+func TestInstantiateTemplate(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(messageTemplateTestDictionary)
+	if err != nil {
+		t.Fatalf("DictionaryFromYamlString() error: %s", err)
+	}
+
+	template, err := diameter.MessageTemplateFromYamlString(creditControlRequestTemplate)
+	if err != nil {
+		t.Fatalf("MessageTemplateFromYamlString() error: %s", err)
+	}
+
+	ccr, err := dictionary.InstantiateTemplate(template, map[string]string{
+		"SessionId":        "1;1001",
+		"DestinationRealm": "server.example.com",
+		"Msisdn":           "15555551234",
+	})
+	if err != nil {
+		t.Fatalf("InstantiateTemplate() error: %s", err)
+	}
+
+	if ccr.Code != 272 || ccr.AppID != 4 || !ccr.IsRequest() || !ccr.IsProxiable() {
+		t.Errorf("expected proxiable CCR (code 272, app 4), got code (%d), app (%d), flags (0x%02x)", ccr.Code, ccr.AppID, ccr.Flags)
+	}
+
+	expectedAvps := []*diameter.AVP{
+		diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1;1001"),
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "client.example.com"),
+		diameter.NewTypedAVP(283, 0, true, diameter.DiamIdent, "server.example.com"),
+		diameter.NewTypedAVP(416, 0, true, diameter.Enumerated, int32(1)),
+		diameter.NewTypedAVP(415, 0, true, diameter.Unsigned32, uint32(0)),
+		diameter.NewSubscriptionId(diameter.SubscriptionIdTypeEndUserE164, "15555551234"),
+	}
+
+	if len(ccr.Avps) != len(expectedAvps) {
+		t.Fatalf("expected (%d) AVPs, got (%d)", len(expectedAvps), len(ccr.Avps))
+	}
+
+	for i, expected := range expectedAvps {
+		if !ccr.Avps[i].Equal(expected) {
+			t.Errorf("AVP at index (%d) (code %d) does not match expected AVP (code %d)", i, ccr.Avps[i].Code, expected.Code)
+		}
+	}
+
+	if _, err := diameter.DecodeMessage(ccr.Encode()); err != nil {
+		t.Errorf("DecodeMessage() of encoded instantiated template error: %s", err)
+	}
+}
+
+func TestInstantiateTemplateErrors(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString(messageTemplateTestDictionary)
+	if err != nil {
+		t.Fatalf("DictionaryFromYamlString() error: %s", err)
+	}
+
+	for _, testCase := range []struct {
+		name     string
+		template string
+		values   map[string]string
+	}{
+		{
+			name:     "missing placeholder value",
+			template: creditControlRequestTemplate,
+			values:   map[string]string{"SessionId": "1;1001", "Msisdn": "15555551234"},
+		},
+		{
+			name:     "unknown message type",
+			template: "Message: XYZ\nAvps:\n  - Session-Id: abc\n",
+		},
+		{
+			name:     "unknown AVP name",
+			template: "Message: CCR\nAvps:\n  - No-Such-Avp: abc\n",
+		},
+		{
+			name:     "unknown enumeration name",
+			template: "Message: CCR\nAvps:\n  - CC-Request-Type: FINAL_REQUEST\n",
+		},
+		{
+			name:     "non-numeric value for Unsigned32",
+			template: "Message: CCR\nAvps:\n  - CC-Request-Number: ${Number}\n",
+			values:   map[string]string{"Number": "first"},
+		},
+		{
+			name:     "scalar value for Grouped AVP",
+			template: "Message: CCR\nAvps:\n  - Subscription-Id: abc\n",
+		},
+		{
+			name:     "list value for non-Grouped AVP",
+			template: "Message: CCR\nAvps:\n  - Session-Id:\n      - Origin-Host: abc\n",
+		},
+	} {
+		template, err := diameter.MessageTemplateFromYamlString(testCase.template)
+		if err != nil {
+			t.Errorf("[%s] MessageTemplateFromYamlString() error: %s", testCase.name, err)
+			continue
+		}
+
+		if _, err := dictionary.InstantiateTemplate(template, testCase.values); err == nil {
+			t.Errorf("[%s] expected error from InstantiateTemplate(), got none", testCase.name)
+		}
+	}
+
+	builtInCode := &diameter.MessageTemplate{Message: "CCR", Avps: []diameter.MessageTemplateAvp{{Name: "CC-Request-Number", Value: 5}}}
+	if _, err := dictionary.InstantiateTemplate(builtInCode, nil); err == nil {
+		t.Errorf("expected error from InstantiateTemplate() for AVP value that is not a string, got none")
+	}
+
+	if _, err := diameter.MessageTemplateFromYamlString("Message: CCR\nAvps:\n  - Session-Id: abc\n    Origin-Host: abc\n"); err == nil {
+		t.Errorf("expected error from MessageTemplateFromYamlString() for AVP map with two names, got none")
+	}
+}
@@ -1,9 +1,16 @@
 package diameter_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"io"
 	"net"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	diameter "github.com/blorticus-go/diameter"
 	"github.com/go-test/deep"
@@ -345,6 +352,99 @@ var decodetests = []DecodeTestSet{
 		flags: 0xc0, code: 257, appID: 0, hopByHopID: 0x10101010, endToEndID: 0xabcd0000, avpCount: 7},
 }
 
+func TestEncodeMessageLargerThanMaxMessageLength(t *testing.T) {
+	// two AVPs of half the maximum length make the message larger than the maximum
+	halfOfMaxMessageLength := make([]byte, diameter.MaxMessageLength/2)
+	m := diameter.NewMessage(diameter.MsgFlagRequest, 271, 3, 1, 1, []*diameter.AVP{
+		diameter.NewTypedAVP(480, 0, true, diameter.OctetString, halfOfMaxMessageLength),
+		diameter.NewTypedAVP(480, 0, true, diameter.OctetString, halfOfMaxMessageLength),
+	}, nil)
+
+	if m.EncodedSize() <= int(diameter.MaxMessageLength) {
+		t.Fatalf("expected EncodedSize() to exceed (%d), got (%d)", diameter.MaxMessageLength, m.EncodedSize())
+	}
+
+	encoded, err := m.EncodeErrorable()
+	if !errors.Is(err, diameter.ErrMessageTooLarge) {
+		t.Errorf("expected EncodeErrorable() error to wrap ErrMessageTooLarge, got (%v)", err)
+	}
+	if encoded != nil {
+		t.Errorf("expected EncodeErrorable() to return nil encoding on error, got (%d) bytes", len(encoded))
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("expected Encode() to panic, but it did not")
+			} else if err, isError := r.(error); !isError || !errors.Is(err, diameter.ErrMessageTooLarge) {
+				t.Errorf("expected Encode() panic value to wrap ErrMessageTooLarge, got (%v)", r)
+			}
+		}()
+		m.Encode()
+	}()
+
+	if encoded, err := m.EncodeUsingRawErrorable(); !errors.Is(err, diameter.ErrMessageTooLarge) || encoded != nil {
+		t.Errorf("expected EncodeUsingRawErrorable() to return (nil, error wrapping ErrMessageTooLarge), got (%d bytes, %v)", len(encoded), err)
+	}
+
+	// a stale Length that cannot be represented in the header is also refused
+	m = diameter.NewMessage(diameter.MsgFlagRequest, 280, 0, 1, 1, []*diameter.AVP{}, nil)
+	m.Length = diameter.MaxMessageLength + 1
+	if _, err := m.EncodeErrorable(); !errors.Is(err, diameter.ErrMessageTooLarge) {
+		t.Errorf("expected EncodeErrorable() error for Length (%d) to wrap ErrMessageTooLarge, got (%v)", m.Length, err)
+	}
+
+	if _, err := m.EncodeUsingRawErrorable(); !errors.Is(err, diameter.ErrMessageTooLarge) {
+		t.Errorf("expected EncodeUsingRawErrorable() error for Length (%d) to wrap ErrMessageTooLarge, got (%v)", m.Length, err)
+	}
+
+	m.RecomputeLength()
+	if _, err := m.EncodeErrorable(); err != nil {
+		t.Errorf("expected no error from EncodeErrorable() after RecomputeLength(), got (%s)", err)
+	}
+}
+
+func TestValidateHeaderFlags(t *testing.T) {
+	for _, testCase := range []struct {
+		flags               uint8
+		expectError         bool
+		expectReservedError bool
+	}{
+		{flags: diameter.MsgFlagRequest | diameter.MsgFlagProxiable | diameter.MsgFlagPotentialRetransmit},
+		{flags: diameter.MsgFlagError | diameter.MsgFlagProxiable},
+		{flags: diameter.MsgFlagNone},
+		{flags: diameter.MsgFlagRequest | 0x01, expectReservedError: true},
+		{flags: 0x08, expectReservedError: true},
+		{flags: diameter.MsgFlagRequest | diameter.MsgFlagError, expectError: true},
+		{flags: diameter.MsgFlagRequest | diameter.MsgFlagError | 0x04, expectError: true, expectReservedError: true},
+	} {
+		encoded := diameter.NewMessage(diameter.MsgFlagRequest, 280, 0, 1, 1, []*diameter.AVP{}, nil).Encode()
+		encoded[4] = testCase.flags
+
+		m, err := diameter.DecodeMessage(encoded)
+		if err != nil {
+			t.Fatalf("(flags %#02x) expected no error on DecodeMessage(), got (%s)", testCase.flags, err)
+		}
+		if m.Flags != testCase.flags {
+			t.Errorf("(flags %#02x) expected DecodeMessage() to retain flags, got (%#02x)", testCase.flags, m.Flags)
+		}
+
+		err = m.ValidateHeaderFlags()
+		if testCase.expectError && !errors.Is(err, diameter.ErrInvalidHeaderBits) {
+			t.Errorf("(flags %#02x) expected ValidateHeaderFlags() error to wrap ErrInvalidHeaderBits, got (%v)", testCase.flags, err)
+		} else if !testCase.expectError && err != nil {
+			t.Errorf("(flags %#02x) expected no error from ValidateHeaderFlags(), got (%s)", testCase.flags, err)
+		}
+
+		err = m.ValidateReservedHeaderFlags()
+		if testCase.expectReservedError && !errors.Is(err, diameter.ErrInvalidHeaderBits) {
+			t.Errorf("(flags %#02x) expected ValidateReservedHeaderFlags() error to wrap ErrInvalidHeaderBits, got (%v)", testCase.flags, err)
+		} else if !testCase.expectReservedError && err != nil {
+			t.Errorf("(flags %#02x) expected no error from ValidateReservedHeaderFlags(), got (%s)", testCase.flags, err)
+		}
+	}
+}
+
 func TestDecode(t *testing.T) {
 	for testnum, set := range decodetests {
 		m, err := diameter.DecodeMessage(set.encoded)
@@ -604,6 +704,57 @@ func TestStreamReaderWithExactlyOneMessageInOnePart(t *testing.T) {
 	}
 }
 
+func TestStreamReaderWithHalfAMessageThenEOF(t *testing.T) {
+	basicCer01 := testMessagesByName["Basic-CER-01"]
+
+	stream := basicCer01.EncodedBytes
+	reader := NewControlledReader([][]byte{stream, stream[:len(stream)/2]})
+
+	streamReader := diameter.NewMessageStreamReader(reader)
+
+	m, err := streamReader.ReadNextMessage()
+	if err != nil {
+		t.Fatalf("on first ReadNextMessage(), expected no error, got = (%s)", err)
+	}
+	if diff := deep.Equal(m, basicCer01.Message); diff != nil {
+		t.Fatalf("after first ReadNextMessage(), messages differ: %s", diff)
+	}
+
+	m, err = streamReader.ReadNextMessage()
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("on second ReadNextMessage(), expected io.ErrUnexpectedEOF, got error = (%v)", err)
+	}
+	if m != nil {
+		t.Fatalf("on second ReadNextMessage(), expected message to be nil, but it is not")
+	}
+}
+
+func TestStreamReaderCapturesBytesThatFailToDecode(t *testing.T) {
+	// a 400 byte message with a single AVP claiming to be 1000 bytes long
+	malformed := make([]byte, 400)
+	copy(malformed, []byte{0x01, 0x00, 0x01, 0x90, 0x80, 0x00, 0x01, 0x01, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1})
+	copy(malformed[20:], []byte{0x00, 0x00, 0x01, 0x08, 0x40, 0x00, 0x03, 0xe8})
+
+	badVersion := []byte{0x02, 0x00, 0x00, 0x14, 0x80, 0x00, 0x01, 0x01}
+
+	for i, stream := range [][]byte{malformed, badVersion} {
+		streamReader := diameter.NewMessageStreamReader(NewControlledReader([][]byte{stream}))
+
+		_, err := streamReader.ReadNextMessage()
+
+		var decodeError *diameter.MessageDecodeError
+		if !errors.As(err, &decodeError) {
+			t.Errorf("(test case %d) expected *diameter.MessageDecodeError, got = (%T) %v", i+1, err, err)
+			continue
+		}
+
+		expectedBytes := stream[:min(len(stream), diameter.MaxDecodeErrorCapturedBytes)]
+		if diff := deep.Equal(decodeError.Bytes, expectedBytes); diff != nil {
+			t.Errorf("(test case %d) captured bytes differ: %s", i+1, diff)
+		}
+	}
+}
+
 func TestFindFirstAVPByCode(t *testing.T) {
 	message := diameter.NewMessage(diameter.MsgFlagRequest|diameter.MsgFlagProxiable, 257, 0, 0x10101010, 0xabcd0000, []*diameter.AVP{
 		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "host.example.com"),
@@ -679,6 +830,97 @@ func TestFindFirstAVPByCode(t *testing.T) {
 	}
 }
 
+func TestFirstAvpMatchingFromConcurrentGoroutines(t *testing.T) {
+	encoded := diameter.NewMessage(diameter.MsgFlagRequest|diameter.MsgFlagProxiable, 257, 0, 0x10101010, 0xabcd0000, []*diameter.AVP{
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "host.example.com"),
+		diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+		diameter.NewTypedAVP(257, 0, true, diameter.Address, net.ParseIP("10.20.30.1")),
+		diameter.NewTypedAVP(266, 0, true, diameter.Unsigned32, uint32(0)),
+		diameter.NewTypedAVP(269, 0, true, diameter.UTF8String, "GoDiameter"),
+	}, []*diameter.AVP{}).Encode()
+
+	message, err := diameter.DecodeMessage(encoded)
+	if err != nil {
+		t.Fatalf("expected no error on DecodeMessage(), got = (%s)", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, code := range []diameter.Uint24{264, 296, 257, 266, 269} {
+				if message.FirstAvpMatching(0, code) == nil {
+					t.Errorf("expected FirstAvpMatching(%d) to return non-nil, returned nil", code)
+				}
+				if len(message.TopLevelAvpsMatching(0, code)) != 1 {
+					t.Errorf("expected TopLevelAvpsMatching(%d) to return one AVP", code)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMessageClone(t *testing.T) {
+	original := diameter.NewMessage(diameter.MsgFlagRequest|diameter.MsgFlagProxiable, 257, 0, 0x10101010, 0xabcd0000, []*diameter.AVP{
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "host.example.com"),
+		diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+		diameter.NewTypedAVP(266, 0, true, diameter.Unsigned32, uint32(0)),
+	}, []*diameter.AVP{})
+
+	// populate the internal AVP map on the original before cloning
+	originalOriginHost := original.FirstAvpMatching(0, 264)
+
+	clone := original.Clone()
+
+	if len(clone.Avps) != len(original.Avps) {
+		t.Fatalf("expected clone to have (%d) AVPs, got (%d)", len(original.Avps), len(clone.Avps))
+	}
+	if !clone.Equals(original) {
+		t.Fatalf("expected clone.Equals(original) to be true, but it is false")
+	}
+
+	cloneOriginHost := clone.FirstAvpMatching(0, 264)
+	if cloneOriginHost == originalOriginHost {
+		t.Fatalf("expected clone FirstAvpMatching(264) to return the cloned AVP, but it returned the original AVP")
+	}
+
+	cloneOriginHost.Data[0] = 'H'
+	clone.Avps[2].Data[3] = 1
+
+	if string(originalOriginHost.Data) != "host.example.com" {
+		t.Errorf("expected original Origin-Host to be unchanged, got = (%s)", string(originalOriginHost.Data))
+	}
+	if original.Avps[2].Data[3] != 0 {
+		t.Errorf("expected original Vendor-Id to be unchanged, but it changed")
+	}
+	if clone.Equals(original) {
+		t.Errorf("expected clone.Equals(original) to be false after mutating the clone, but it is true")
+	}
+}
+
+func TestMissingAnyOf(t *testing.T) {
+	message := diameter.NewMessage(diameter.MsgFlagRequest, 272, 4, 1, 1, []*diameter.AVP{
+		diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1;1"),
+		diameter.NewTypedAVP(258, 0, true, diameter.Unsigned32, uint32(4)),
+		diameter.NewTypedAVP(628, 10415, true, diameter.OctetString, []byte{0x01}),
+	}, nil)
+
+	if missing := message.MissingAnyOf([]diameter.AvpVendorIdAndCode{{Code: 263}, {Code: 258}, {VendorId: 10415, Code: 628}}); missing != nil {
+		t.Errorf("expected no missing AVPs, got = %v", missing)
+	}
+
+	missing := message.MissingAnyOf([]diameter.AvpVendorIdAndCode{{Code: 263}, {Code: 416}, {Code: 628}, {Code: 258}, {Code: 415}})
+	if diff := deep.Equal(missing, []diameter.AvpVendorIdAndCode{{Code: 416}, {Code: 628}, {Code: 415}}); diff != nil {
+		t.Errorf("missing AVPs differ from expected: %s", diff)
+	}
+
+	if missing := message.MissingAnyOf(nil); missing != nil {
+		t.Errorf("expected no missing AVPs for empty required set, got = %v", missing)
+	}
+}
+
 func TestMessageEqualsWhenMessagesAreEqual(t *testing.T) {
 	leftMessage := diameter.NewMessage(diameter.MsgFlagRequest|diameter.MsgFlagProxiable, 257, 0, 0x10101010, 0xabcd0000, []*diameter.AVP{
 		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "host.example.com"),
@@ -790,3 +1032,929 @@ func TestMessageEqualsWhenMessagesAreNotEqual(t *testing.T) {
 		}
 	}
 }
+
+func TestMessageFlagSetters(t *testing.T) {
+	testCases := []struct {
+		name   string
+		flag   uint8
+		setter func(m *diameter.Message, isSet bool)
+	}{
+		{"SetErrorFlag", diameter.MsgFlagError, (*diameter.Message).SetErrorFlag},
+		{"SetProxiableFlag", diameter.MsgFlagProxiable, (*diameter.Message).SetProxiableFlag},
+		{"SetPotentialRetransmitFlag", diameter.MsgFlagPotentialRetransmit, (*diameter.Message).SetPotentialRetransmitFlag},
+	}
+
+	for _, testCase := range testCases {
+		for _, startingFlags := range []uint8{diameter.MsgFlagNone, diameter.MsgFlagRequest, 0xf0} {
+			m := diameter.NewMessage(startingFlags, 280, 0, 1, 1, []*diameter.AVP{}, nil)
+
+			testCase.setter(m, true)
+			if m.Flags != startingFlags|testCase.flag {
+				t.Errorf("%s(true) on flags (%#02x): expected flags (%#02x), got (%#02x)", testCase.name, startingFlags, startingFlags|testCase.flag, m.Flags)
+			}
+
+			testCase.setter(m, true)
+			if m.Flags != startingFlags|testCase.flag {
+				t.Errorf("%s(true) repeated on flags (%#02x): expected flags (%#02x), got (%#02x)", testCase.name, startingFlags, startingFlags|testCase.flag, m.Flags)
+			}
+
+			testCase.setter(m, false)
+			if m.Flags != startingFlags&^testCase.flag {
+				t.Errorf("%s(false) on flags (%#02x): expected flags (%#02x), got (%#02x)", testCase.name, startingFlags, startingFlags&^testCase.flag, m.Flags)
+			}
+		}
+	}
+
+	m := diameter.NewMessage(diameter.MsgFlagRequest, 280, 0, 1, 1, []*diameter.AVP{}, nil)
+	m.SetErrorFlag(true)
+	m.SetProxiableFlag(true)
+	m.SetPotentialRetransmitFlag(true)
+	if !m.IsRequest() || !m.IsError() || !m.IsProxiable() || !m.IsPotentiallyRetransmitted() {
+		t.Errorf("expected all flags to be set, got flags (%#02x)", m.Flags)
+	}
+}
+
+func TestDecodeEncodeRoundTripPreservesUnknownVendorAvps(t *testing.T) {
+	encodedMessage := []byte{
+		// version, length (92)
+		0x01, 0x00, 0x00, 0x5c,
+		// flags (R, P), code (316)
+		0xc0, 0x00, 0x01, 0x3c,
+		// application-id (16777251)
+		0x01, 0x00, 0x00, 0x23,
+		// hop-by-hop-id, end-to-end-id
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x02,
+		// Session-Id (263), M flag, length 13, value "a;b;c", 3 bytes padding
+		0x00, 0x00, 0x01, 0x07, 0x40, 0x00, 0x00, 0x0d,
+		0x61, 0x3b, 0x62, 0x3b, 0x63, 0x00, 0x00, 0x00,
+		// unknown vendor AVP (code 99999, vendor 10415), V+M+P flags, length 17, 5 data bytes, 3 bytes padding
+		0x00, 0x01, 0x86, 0x9f, 0xe0, 0x00, 0x00, 0x11,
+		0x00, 0x00, 0x28, 0xaf,
+		0xde, 0xad, 0xbe, 0xef, 0x01, 0x00, 0x00, 0x00,
+		// unknown vendor AVP (code 1, vendor 9999), V flag and two reserved flag bits, length 12, no data
+		0x00, 0x00, 0x00, 0x01, 0x83, 0x00, 0x00, 0x0c,
+		0x00, 0x00, 0x27, 0x0f,
+		// unknown vendor grouped-looking AVP (code 2, vendor 9999), V+M, length 24, containing a
+		// non-vendor AVP (code 3) with 4 bytes of data
+		0x00, 0x00, 0x00, 0x02, 0xc0, 0x00, 0x00, 0x18,
+		0x00, 0x00, 0x27, 0x0f,
+		0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x0c,
+		0x01, 0x02, 0x03, 0x04,
+	}
+
+	m, err := diameter.DecodeMessage(encodedMessage)
+	if err != nil {
+		t.Fatalf("expected no error on DecodeMessage(), got = (%s)", err)
+	}
+
+	if len(m.Avps) != 4 {
+		t.Fatalf("expected 4 AVPs, got (%d)", len(m.Avps))
+	}
+
+	unknownAvp := m.Avps[1]
+	if !unknownAvp.VendorSpecific || !unknownAvp.Mandatory || !unknownAvp.Protected || unknownAvp.VendorID != 10415 || unknownAvp.Code != 99999 {
+		t.Errorf("expected unknown AVP to retain V, M and P flags, vendor (10415) and code (99999), got V=%t M=%t P=%t vendor (%d) code (%d)",
+			unknownAvp.VendorSpecific, unknownAvp.Mandatory, unknownAvp.Protected, unknownAvp.VendorID, unknownAvp.Code)
+	}
+
+	if diff := deep.Equal(m.Encode(), encodedMessage); diff != nil {
+		t.Errorf("expected re-encoded message to be byte-identical to the original: %s", diff)
+	}
+
+	if diff := deep.Equal(m.Clone().Encode(), encodedMessage); diff != nil {
+		t.Errorf("expected re-encoded clone to be byte-identical to the original: %s", diff)
+	}
+}
+
+func TestAvpsInOrder(t *testing.T) {
+	avps := []*diameter.AVP{
+		diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1;1"),
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "client.example.com"),
+		diameter.NewTypedAVP(265, 0, true, diameter.Unsigned32, uint32(10415)),
+		diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+		diameter.NewTypedAVP(265, 0, true, diameter.Unsigned32, uint32(5535)),
+	}
+	m := diameter.NewMessage(diameter.MsgFlagRequest, 257, 0, 1, 1, avps[:2], avps[2:])
+
+	inOrder := m.AvpsInOrder()
+	if len(inOrder) != len(avps) {
+		t.Fatalf("expected (%d) AVPs, got (%d)", len(avps), len(inOrder))
+	}
+	for i := range avps {
+		if inOrder[i] != avps[i] {
+			t.Errorf("expected AVP (%d) to have code (%d), got code (%d)", i, avps[i].Code, inOrder[i].Code)
+		}
+	}
+
+	inOrder[0], inOrder[4] = inOrder[4], inOrder[0]
+	inOrder = append(inOrder, diameter.NewTypedAVP(278, 0, true, diameter.Unsigned32, uint32(1)))
+	if len(m.Avps) != len(avps) || m.Avps[0] != avps[0] || m.Avps[4] != avps[4] {
+		t.Errorf("expected changes to the returned slice not to change the message")
+	}
+	if len(inOrder) != len(avps)+1 {
+		t.Errorf("expected append to the returned slice to succeed")
+	}
+}
+
+func TestMessageHexDump(t *testing.T) {
+	m := diameter.NewMessage(diameter.MsgFlagRequest, 257, 0, 1, 2, []*diameter.AVP{
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "host.example.com"),
+		diameter.NewTypedAVP(1, 10415, true, diameter.UTF8String, "abc"),
+	}, nil)
+
+	expectedDump := strings.Join([]string{
+		"; message header (20 bytes): code 257, application-id 0, flags 0x80",
+		"00000000  01 00 00 3c 80 00 01 01  00 00 00 00 00 00 00 01  |...<............|",
+		"00000010  00 00 00 02                                       |....|",
+		"; AVP 0: code 264, length 24 (24 padded)",
+		"00000014  00 00 01 08 40 00 00 18  68 6f 73 74 2e 65 78 61  |....@...host.exa|",
+		"00000024  6d 70 6c 65 2e 63 6f 6d                           |mple.com|",
+		"; AVP 1: code 1, vendor-id 10415, length 15 (16 padded)",
+		"0000002c  00 00 00 01 c0 00 00 0f  00 00 28 af 61 62 63 00  |..........(.abc.|",
+		"",
+	}, "\n")
+
+	if diff := deep.Equal(strings.Split(m.HexDump(), "\n"), strings.Split(expectedDump, "\n")); diff != nil {
+		t.Errorf("Message.HexDump() differs from expected: %s", diff)
+	}
+
+	expectedAvpDump := strings.Join([]string{
+		"; AVP header: code 1, vendor-id 10415, length 15 (16 padded)",
+		"00000000  00 00 00 01 c0 00 00 0f  00 00 28 af              |..........(.|",
+		"; AVP data (3 bytes, 1 bytes padding)",
+		"0000000c  61 62 63 00                                       |abc.|",
+		"",
+	}, "\n")
+
+	if diff := deep.Equal(strings.Split(m.Avps[1].HexDump(), "\n"), strings.Split(expectedAvpDump, "\n")); diff != nil {
+		t.Errorf("AVP.HexDump() differs from expected: %s", diff)
+	}
+}
+
+func TestMessageHexDumpOfAvpWhoseDataDoesNotMatchItsLength(t *testing.T) {
+	inconsistent := diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "host.example.com")
+	inconsistent.Data = []byte("abc")
+
+	m := diameter.NewMessage(diameter.MsgFlagRequest, 257, 0, 1, 2, []*diameter.AVP{
+		inconsistent,
+		diameter.NewTypedAVP(1, 10415, true, diameter.UTF8String, "abc"),
+	}, nil)
+
+	expectedDump := strings.Join([]string{
+		"; message header (20 bytes): code 257, application-id 0, flags 0x80",
+		"00000000  01 00 00 3c 80 00 01 01  00 00 00 00 00 00 00 01  |...<............|",
+		"00000010  00 00 00 02                                       |....|",
+		"; AVP 0: code 264, length 24 (24 padded)",
+		"00000014  00 00 01 08 40 00 00 18  61 62 63                 |....@...abc|",
+		"; AVP 1: code 1, vendor-id 10415, length 15 (16 padded)",
+		"0000001f  00 00 00 01 c0 00 00 0f  00 00 28 af 61 62 63 00  |..........(.abc.|",
+		"",
+	}, "\n")
+
+	if diff := deep.Equal(strings.Split(m.HexDump(), "\n"), strings.Split(expectedDump, "\n")); diff != nil {
+		t.Errorf("Message.HexDump() differs from expected: %s", diff)
+	}
+}
+
+func TestMessageHexDumpOfMessageThatCannotBeEncoded(t *testing.T) {
+	m := diameter.NewMessage(diameter.MsgFlagRequest, 272, 4, 1, 2, []*diameter.AVP{
+		diameter.NewTypedAVP(263, 0, true, diameter.OctetString, make([]byte, int(diameter.MaxMessageLength))),
+	}, nil)
+
+	if dump := m.HexDump(); !strings.HasPrefix(dump, "; message cannot be encoded: ") || strings.Count(dump, "\n") != 1 {
+		t.Errorf("expected Message.HexDump() to be a single comment line with the error, got (%.200s)", dump)
+	}
+}
+
+func TestApplicationIdConsistencyCheck(t *testing.T) {
+	vendorSpecificApplicationId := func(vendorID uint32, appIDCode uint32, appID uint32) *diameter.AVP {
+		return diameter.NewGroupedAVP(260, 0, true,
+			diameter.NewTypedAVP(266, 0, true, diameter.Unsigned32, vendorID),
+			diameter.NewTypedAVP(appIDCode, 0, true, diameter.Unsigned32, appID),
+		)
+	}
+
+	testCases := []struct {
+		appID         uint32
+		avps          []*diameter.AVP
+		expectAnError bool
+	}{
+		{4, []*diameter.AVP{diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "s")}, false},
+		{4, []*diameter.AVP{diameter.NewTypedAVP(258, 0, true, diameter.Unsigned32, uint32(4))}, false},
+		{3, []*diameter.AVP{diameter.NewTypedAVP(259, 0, true, diameter.Unsigned32, uint32(3))}, false},
+		{16777238, []*diameter.AVP{vendorSpecificApplicationId(10415, 258, 16777238)}, false},
+		{16777238, []*diameter.AVP{diameter.NewTypedAVP(258, 0, true, diameter.Unsigned32, uint32(16777238)), vendorSpecificApplicationId(10415, 258, 16777238)}, false},
+		{0, []*diameter.AVP{diameter.NewTypedAVP(258, 0, true, diameter.Unsigned32, uint32(4)), diameter.NewTypedAVP(259, 0, true, diameter.Unsigned32, uint32(3))}, false},
+		{4, []*diameter.AVP{diameter.NewTypedAVP(258, 10415, true, diameter.Unsigned32, uint32(16777238))}, false},
+		{4, []*diameter.AVP{diameter.NewTypedAVP(258, 0, true, diameter.Unsigned32, uint32(16777238))}, true},
+		{4, []*diameter.AVP{diameter.NewTypedAVP(259, 0, true, diameter.Unsigned32, uint32(3))}, true},
+		{16777238, []*diameter.AVP{vendorSpecificApplicationId(10415, 258, 16777236)}, true},
+		{16777238, []*diameter.AVP{vendorSpecificApplicationId(10415, 259, 16777236)}, true},
+		{4, []*diameter.AVP{diameter.NewTypedAVP(258, 0, true, diameter.Unsigned32, uint32(4)), diameter.NewTypedAVP(258, 0, true, diameter.Unsigned32, uint32(5))}, true},
+		{4, []*diameter.AVP{diameter.NewAVP(258, 0, true, []byte{0, 4})}, true},
+		{4, []*diameter.AVP{diameter.NewAVP(260, 0, true, []byte{0, 0, 1, 2, 0x40})}, true},
+	}
+
+	for i, testCase := range testCases {
+		m := diameter.NewMessage(diameter.MsgFlagRequest, 272, testCase.appID, 1, 1, testCase.avps, nil)
+
+		err := m.ApplicationIdConsistencyCheck()
+		if testCase.expectAnError && err == nil {
+			t.Errorf("(test case %d) expected an error, got none", i+1)
+		} else if !testCase.expectAnError && err != nil {
+			t.Errorf("(test case %d) expected no error, got = (%s)", i+1, err)
+		}
+	}
+}
+
+func TestNewMessageNoFlagForcing(t *testing.T) {
+	notMandatory := diameter.NewTypedAVP(1, 10415, false, diameter.Unsigned32, uint32(1))
+	mandatory := diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "a;b;c")
+	avps := []*diameter.AVP{notMandatory, mandatory}
+
+	m := diameter.NewMessageNoFlagForcing(diameter.MsgFlagRequest, 272, 4, 1, 2, avps)
+
+	if notMandatory.Mandatory || !mandatory.Mandatory {
+		t.Errorf("expected AVP flags to be untouched, got mandatory = (%t, %t)", notMandatory.Mandatory, mandatory.Mandatory)
+	}
+	if m.Length != diameter.Uint24(diameter.MsgHeaderSize)+diameter.Uint24(notMandatory.PaddedLength+mandatory.PaddedLength) {
+		t.Errorf("expected message length (%d), got (%d)", int(diameter.MsgHeaderSize)+notMandatory.PaddedLength+mandatory.PaddedLength, m.Length)
+	}
+	if len(m.Avps) != 2 || m.Avps[0] != notMandatory || m.Avps[1] != mandatory {
+		t.Fatalf("expected message AVPs to be the provided AVPs in order")
+	}
+
+	decoded, err := diameter.DecodeMessage(m.Encode())
+	if err != nil {
+		t.Fatalf("expected no error on DecodeMessage(), got = (%s)", err)
+	}
+	if decoded.Avps[0].Mandatory || !decoded.Avps[1].Mandatory {
+		t.Errorf("expected encoded AVP flags to be preserved, got mandatory = (%t, %t)", decoded.Avps[0].Mandatory, decoded.Avps[1].Mandatory)
+	}
+
+	avps[0] = mandatory
+	if m.Avps[0] != notMandatory {
+		t.Errorf("expected changes to the provided slice not to change the message")
+	}
+
+	diameter.NewMessage(diameter.MsgFlagRequest, 272, 4, 1, 2, []*diameter.AVP{notMandatory}, nil)
+	if !notMandatory.Mandatory {
+		t.Errorf("expected NewMessage() to set the Mandatory flag on mandatoryAvps")
+	}
+}
+
+// pipePacketConn is a net.PacketConn backed by one side of a net.Pipe.  Each Write on the other side
+// of the pipe is read as a single packet.
+type pipePacketConn struct {
+	net.Conn
+}
+
+func (c *pipePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.Conn.Read(p)
+	return n, c.Conn.RemoteAddr(), err
+}
+
+func (c *pipePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.Conn.Write(p)
+}
+
+func TestMessagePacketReader(t *testing.T) {
+	readerSide, writerSide := net.Pipe()
+	defer readerSide.Close()
+
+	packetReader := diameter.NewMessagePacketReader(&pipePacketConn{readerSide})
+
+	cer := testMessagesByName["Basic-CER-01"]
+	encoded := cer.EncodedBytes
+
+	twoMessages := append(append([]byte{}, encoded...), encoded...)
+
+	packets := [][]byte{encoded, encoded[:len(encoded)-4], twoMessages, encoded[:12], encoded}
+	go func() {
+		for _, packet := range packets {
+			writerSide.Write(packet)
+		}
+		writerSide.Close()
+	}()
+
+	testCases := []struct {
+		expectAMessage bool
+	}{
+		{true},
+		{false},
+		{false},
+		{false},
+		{true},
+	}
+
+	for i, testCase := range testCases {
+		m, sourceAddr, err := packetReader.ReadNextMessage()
+
+		if !testCase.expectAMessage {
+			var decodeError *diameter.MessageDecodeError
+			if !errors.As(err, &decodeError) {
+				t.Errorf("(test case %d) expected *diameter.MessageDecodeError, got = (%T) %v", i+1, err, err)
+			} else if !bytes.Equal(decodeError.Bytes, packets[i][:min(len(packets[i]), diameter.MaxDecodeErrorCapturedBytes)]) {
+				t.Errorf("(test case %d) expected the error to capture the packet", i+1)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("(test case %d) expected no error, got = (%s)", i+1, err)
+			continue
+		}
+		if diff := deep.Equal(m, cer.Message); diff != nil {
+			t.Errorf("(test case %d) messages differ: %s", i+1, diff)
+		}
+		if sourceAddr == nil {
+			t.Errorf("(test case %d) expected the source address, got nil", i+1)
+		}
+	}
+
+	if _, _, err := packetReader.ReadNextMessage(); err != io.EOF {
+		t.Errorf("expected io.EOF after the writer is closed, got = (%v)", err)
+	}
+}
+
+func TestRecomputeLength(t *testing.T) {
+	originHost := diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "host.example.com")
+	originRealm := diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com")
+	resultCode := diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2001))
+
+	m := diameter.NewMessage(0, 280, 0, 1, 1, []*diameter.AVP{originHost}, nil)
+
+	m.Avps = append(m.Avps, originRealm, resultCode)
+	m.RecomputeLength()
+	if expected := diameter.Uint24(20 + originHost.PaddedLength + originRealm.PaddedLength + resultCode.PaddedLength); m.Length != expected {
+		t.Errorf("after adding AVPs, expected Length = (%d), got = (%d)", expected, m.Length)
+	}
+	expectLengthMatchesEncoding(t, m)
+
+	m.Avps = m.Avps[1:]
+	m.RecomputeLength()
+	if expected := diameter.Uint24(20 + originRealm.PaddedLength + resultCode.PaddedLength); m.Length != expected {
+		t.Errorf("after removing an AVP, expected Length = (%d), got = (%d)", expected, m.Length)
+	}
+	expectLengthMatchesEncoding(t, m)
+
+	m.Avps = nil
+	m.RecomputeLength()
+	if m.Length != diameter.MsgHeaderSize {
+		t.Errorf("after removing all AVPs, expected Length = (%d), got = (%d)", diameter.MsgHeaderSize, m.Length)
+	}
+	expectLengthMatchesEncoding(t, m)
+}
+
+// expectLengthMatchesEncoding checks that m.Length is the length of the encoded message, and that the
+// encoded message decodes.
+func expectLengthMatchesEncoding(t *testing.T, m *diameter.Message) {
+	t.Helper()
+
+	encoded := m.Encode()
+	if int(m.Length) != len(encoded) {
+		t.Errorf("expected Length (%d) to equal encoded length (%d)", m.Length, len(encoded))
+	}
+	if _, err := diameter.DecodeMessage(encoded); err != nil {
+		t.Errorf("expected no error on DecodeMessage() of encoded message, got = (%s)", err)
+	}
+}
+
+func TestNewMessageWithVersion(t *testing.T) {
+	avps := []*diameter.AVP{diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "host.example.com")}
+
+	m := diameter.NewMessageWithVersion(2, diameter.MsgFlagRequest, 280, 0, 1, 2, avps, nil)
+	if m.Version != 2 {
+		t.Errorf("expected Version = (2), got = (%d)", m.Version)
+	}
+
+	encoded := m.Encode()
+	if encoded[0] != 2 {
+		t.Errorf("expected encoded version = (2), got = (%d)", encoded[0])
+	}
+
+	if _, err := diameter.DecodeMessage(encoded); !errors.Is(err, diameter.ErrUnknownVersion) {
+		t.Errorf("expected error matching (%s) on DecodeMessage(), got = (%v)", diameter.ErrUnknownVersion, err)
+	}
+
+	reader := diameter.NewMessageStreamReader(bytes.NewReader(encoded))
+	if _, err := reader.ReadNextMessage(); !errors.Is(err, diameter.ErrUnknownVersion) {
+		t.Errorf("expected error matching (%s) on ReadNextMessage(), got = (%v)", diameter.ErrUnknownVersion, err)
+	}
+
+	versionOne := diameter.NewMessageWithVersion(1, diameter.MsgFlagRequest, 280, 0, 1, 2, avps, nil)
+	if diff := deep.Equal(versionOne, diameter.NewMessage(diameter.MsgFlagRequest, 280, 0, 1, 2, avps, nil)); diff != nil {
+		t.Errorf("expected version 1 message to match NewMessage(): %s", diff)
+	}
+	if _, err := diameter.DecodeMessage(versionOne.Encode()); err != nil {
+		t.Errorf("expected no error on DecodeMessage() of version 1 message, got = (%s)", err)
+	}
+}
+
+func TestPotentialRetransmitFlagSurvivesEncodeAndDecode(t *testing.T) {
+	avps := []*diameter.AVP{diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "host.example.com")}
+	m := diameter.NewMessage(diameter.MsgFlagRequest|diameter.MsgFlagProxiable, 272, 4, 1, 2, avps, nil)
+
+	if m.IsPotentiallyRetransmitted() {
+		t.Fatalf("expected new message not to be marked potentially retransmitted")
+	}
+
+	m.SetPotentialRetransmitFlag(true)
+	if !m.IsPotentiallyRetransmitted() {
+		t.Errorf("expected message to be marked potentially retransmitted after SetPotentialRetransmitFlag(true)")
+	}
+	if !m.IsRequest() || !m.IsProxiable() || m.IsError() {
+		t.Errorf("expected SetPotentialRetransmitFlag() not to change other flags, flags = (%#x)", m.Flags)
+	}
+
+	encoded := m.Encode()
+	if encoded[4]&diameter.MsgFlagPotentialRetransmit == 0 {
+		t.Errorf("expected encoded flags to include the T-bit, got = (%#x)", encoded[4])
+	}
+
+	decoded, err := diameter.DecodeMessage(encoded)
+	if err != nil {
+		t.Fatalf("expected no error on DecodeMessage(), got = (%s)", err)
+	}
+	if !decoded.IsPotentiallyRetransmitted() {
+		t.Errorf("expected decoded message to be marked potentially retransmitted")
+	}
+	if decoded.Flags != m.Flags {
+		t.Errorf("expected decoded flags = (%#x), got = (%#x)", m.Flags, decoded.Flags)
+	}
+}
+
+func TestMessageByteReaderWaitsForBodyAfterExactlyTheHeader(t *testing.T) {
+	m := diameter.NewMessage(diameter.MsgFlagRequest, 257, 0, 1, 2, []*diameter.AVP{
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "host.example.com"),
+		diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+	}, nil)
+	encoded := m.Encode()
+
+	for _, headerSplit := range [][]int{{20}, {19, 1}, {1, 19}} {
+		reader := diameter.NewMessageByteReader()
+
+		offset := 0
+		for _, chunkLength := range headerSplit {
+			received, err := reader.ReceiveBytesButReturnAtMostOneMessage(encoded[offset : offset+chunkLength])
+			if err != nil {
+				t.Fatalf("(split %v) expected no error on header bytes, got = (%s)", headerSplit, err)
+			}
+			if received != nil {
+				t.Fatalf("(split %v) expected no message after (%d) header bytes, got one", headerSplit, offset+chunkLength)
+			}
+			offset += chunkLength
+		}
+
+		received, err := reader.ReceiveBytesButReturnAtMostOneMessage(encoded[20 : len(encoded)-1])
+		if err != nil {
+			t.Fatalf("(split %v) expected no error on partial body, got = (%s)", headerSplit, err)
+		}
+		if received != nil {
+			t.Fatalf("(split %v) expected no message before the last byte of the body, got one", headerSplit)
+		}
+
+		received, err = reader.ReceiveBytesButReturnAtMostOneMessage(encoded[len(encoded)-1:])
+		if err != nil {
+			t.Fatalf("(split %v) expected no error on last body byte, got = (%s)", headerSplit, err)
+		}
+		if received == nil {
+			t.Fatalf("(split %v) expected message after the full body, got none", headerSplit)
+		}
+		if !bytes.Equal(received.Encode(), encoded) {
+			t.Errorf("(split %v) decoded message does not match the sent message", headerSplit)
+		}
+
+		if received, err = reader.ReceiveBytesButReturnAtMostOneMessage(nil); received != nil || err != nil {
+			t.Errorf("(split %v) expected (nil, nil) once the buffer is drained, got = (%v, %v)", headerSplit, received, err)
+		}
+	}
+}
+
+func TestMessageByteReaderHeaderOnlyMessage(t *testing.T) {
+	encoded := diameter.NewMessage(diameter.MsgFlagRequest, 280, 0, 1, 2, nil, nil).Encode()
+	if len(encoded) != 20 {
+		t.Fatalf("expected header-only message to encode to (20) bytes, got (%d)", len(encoded))
+	}
+
+	received, err := diameter.NewMessageByteReader().ReceiveBytesButReturnAtMostOneMessage(encoded)
+	if err != nil {
+		t.Fatalf("expected no error, got = (%s)", err)
+	}
+	if received == nil || received.Code != 280 || len(received.Avps) != 0 {
+		t.Errorf("expected header-only DWR message from exactly (20) bytes, got = (%v)", received)
+	}
+}
+
+func TestMessageByteReaderRejectsDeclaredLengthShorterThanHeader(t *testing.T) {
+	header := []byte{
+		0x01, 0x00, 0x00, 0x10,
+		0x80, 0x00, 0x01, 0x18,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x02,
+	}
+
+	_, err := diameter.NewMessageByteReader().ReceiveBytesButReturnAtMostOneMessage(header)
+	if !errors.Is(err, diameter.ErrInvalidMessageLength) {
+		t.Errorf("expected error matching (%s), got = (%v)", diameter.ErrInvalidMessageLength, err)
+	}
+}
+
+func TestReadNextMessageWithDeadlineWhenPeerStallsAfterHeader(t *testing.T) {
+	encoded := diameter.NewMessage(diameter.MsgFlagRequest, 280, 0, 1, 2, []*diameter.AVP{
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "host.example.com"),
+	}, nil).Encode()
+
+	localConn, remoteConn := net.Pipe()
+	defer localConn.Close()
+	defer remoteConn.Close()
+
+	go func() {
+		remoteConn.Write(encoded[:20])
+	}()
+
+	reader := diameter.NewMessageStreamReader(localConn)
+
+	started := time.Now()
+	m, err := reader.ReadNextMessageWithDeadline(started.Add(100 * time.Millisecond))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected error matching (%s), got = (%v)", os.ErrDeadlineExceeded, err)
+	}
+	if m != nil {
+		t.Errorf("expected no message on timeout, got one")
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("expected ReadNextMessageWithDeadline() to return near the deadline, took (%s)", elapsed)
+	}
+
+	go func() {
+		remoteConn.Write(encoded[20:])
+	}()
+
+	m, err = reader.ReadNextMessageWithDeadline(time.Now().Add(2 * time.Second))
+	if err != nil {
+		t.Fatalf("expected no error once the rest of the message arrives, got = (%s)", err)
+	}
+	if !bytes.Equal(m.Encode(), encoded) {
+		t.Errorf("expected message from buffered header plus later body to match the sent message")
+	}
+}
+
+func TestReadNextMessageWithDeadlineWithoutDeadlineSupport(t *testing.T) {
+	encoded := diameter.NewMessage(diameter.MsgFlagRequest, 280, 0, 1, 2, nil, nil).Encode()
+
+	trickle := make([][]byte, 0, len(encoded))
+	for i := range encoded {
+		trickle = append(trickle, encoded[i:i+1])
+	}
+
+	if _, err := diameter.NewMessageStreamReader(NewControlledReader(trickle)).ReadNextMessageWithDeadline(time.Now().Add(-time.Second)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected error matching (%s) for trickled message after deadline, got = (%v)", os.ErrDeadlineExceeded, err)
+	}
+
+	m, err := diameter.NewMessageStreamReader(NewControlledReader(trickle)).ReadNextMessageWithDeadline(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("expected no error for trickled message before deadline, got = (%s)", err)
+	}
+	if m.Code != 280 {
+		t.Errorf("expected message with code (280), got (%d)", m.Code)
+	}
+}
+
+func TestReadNextMessageWithDeadlineReturnsAMessageCompletedAtTheDeadline(t *testing.T) {
+	encoded := diameter.NewMessage(diameter.MsgFlagRequest, 280, 0, 1, 2, nil, nil).Encode()
+
+	m, err := diameter.NewMessageStreamReader(NewControlledReader([][]byte{encoded})).ReadNextMessageWithDeadline(time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("expected no error for message completed by the read at the deadline, got = (%s)", err)
+	}
+	if m.Code != 280 {
+		t.Errorf("expected message with code (280), got (%d)", m.Code)
+	}
+}
+
+func TestReadNextMessageWithDeadlineLeavesTheReadDeadlineSet(t *testing.T) {
+	encoded := diameter.NewMessage(diameter.MsgFlagRequest, 280, 0, 1, 2, nil, nil).Encode()
+
+	localConn, remoteConn := net.Pipe()
+	defer localConn.Close()
+	defer remoteConn.Close()
+
+	go func() {
+		remoteConn.Write(encoded)
+	}()
+
+	reader := diameter.NewMessageStreamReader(localConn)
+	if _, err := reader.ReadNextMessageWithDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatalf("expected no error on ReadNextMessageWithDeadline(), got = (%s)", err)
+	}
+
+	if _, err := reader.ReadNextMessage(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected later ReadNextMessage() to stop at the deadline that was left set, got = (%v)", err)
+	}
+}
+
+func TestAvpCodesPresent(t *testing.T) {
+	m := diameter.NewMessage(diameter.MsgFlagRequest, 272, 4, 1, 2, []*diameter.AVP{
+		diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1;1"),
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "client.example.com"),
+		diameter.NewTypedAVP(282, 0, true, diameter.DiamIdent, "relay1.example.com"),
+		diameter.NewTypedAVP(1, 10415, true, diameter.Unsigned32, uint32(1)),
+		diameter.NewTypedAVP(282, 0, true, diameter.DiamIdent, "relay2.example.com"),
+		diameter.NewTypedAVP(1, 0, true, diameter.UTF8String, "user"),
+		diameter.NewTypedAVP(1, 10415, true, diameter.Unsigned32, uint32(2)),
+		diameter.NewTypedAVP(443, 0, true, diameter.Grouped, []*diameter.AVP{
+			diameter.NewTypedAVP(450, 0, true, diameter.Enumerated, int32(0)),
+		}),
+	}, nil)
+
+	expected := []diameter.AvpVendorIdAndCode{
+		{VendorId: 0, Code: 263},
+		{VendorId: 0, Code: 264},
+		{VendorId: 0, Code: 282},
+		{VendorId: 10415, Code: 1},
+		{VendorId: 0, Code: 1},
+		{VendorId: 0, Code: 443},
+	}
+
+	if diff := deep.Equal(m.AvpCodesPresent(), expected); diff != nil {
+		t.Errorf("AvpCodesPresent(): %s", diff)
+	}
+
+	if codes := diameter.NewMessage(diameter.MsgFlagRequest, 280, 0, 1, 2, nil, nil).AvpCodesPresent(); len(codes) != 0 {
+		t.Errorf("expected no AVP codes for message without AVPs, got (%v)", codes)
+	}
+}
+
+func TestDecodeMessageRetainingRawAvpsForwardsOriginalBytes(t *testing.T) {
+	encodedMessage := []byte{
+		// version, length (56)
+		0x01, 0x00, 0x00, 0x38,
+		// flags (R, P), code (272)
+		0xc0, 0x00, 0x01, 0x10,
+		// application-id (4)
+		0x00, 0x00, 0x00, 0x04,
+		// hop-by-hop-id, end-to-end-id
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x02,
+		// Session-Id (263), M flag, length 13, value "a;b;c", 3 non-zero pad bytes
+		0x00, 0x00, 0x01, 0x07, 0x40, 0x00, 0x00, 0x0d,
+		0x61, 0x3b, 0x62, 0x3b, 0x63, 0xaa, 0xbb, 0xcc,
+		// Subscription-Id (443), M flag, length 20, containing Subscription-Id-Data (444) with
+		// value "12", 2 non-zero pad bytes
+		0x00, 0x00, 0x01, 0xbb, 0x40, 0x00, 0x00, 0x14,
+		0x00, 0x00, 0x01, 0xbc, 0x40, 0x00, 0x00, 0x0a,
+		0x31, 0x32, 0xdd, 0xee,
+	}
+
+	m, err := diameter.DecodeMessageRetainingRawAvps(encodedMessage)
+	if err != nil {
+		t.Fatalf("expected no error on DecodeMessageRetainingRawAvps(), got = (%s)", err)
+	}
+
+	if sessionId, err := m.Avps[0].ConvertDataToTypedData(diameter.UTF8String); err != nil || sessionId != "a;b;c" {
+		t.Errorf("expected Session-Id to decode as (a;b;c), got = (%v), error = (%v)", sessionId, err)
+	}
+
+	subscriptionIdData, err := m.Avps[1].FindNestedAvp(444)
+	if err != nil {
+		t.Fatalf("expected no error on FindNestedAvp(444), got = (%s)", err)
+	}
+	if string(subscriptionIdData.Data) != "12" {
+		t.Errorf("expected Subscription-Id-Data to be (12), got = (%s)", string(subscriptionIdData.Data))
+	}
+
+	if diff := deep.Equal(m.Avps[0].RawEncoded(), encodedMessage[20:36]); diff != nil {
+		t.Errorf("expected RawEncoded() of Session-Id to be its original bytes: %s", diff)
+	}
+
+	if diff := deep.Equal(m.EncodeUsingRaw(), encodedMessage); diff != nil {
+		t.Errorf("expected EncodeUsingRaw() to be byte-identical to the original: %s", diff)
+	}
+
+	if bytes.Equal(m.Encode(), encodedMessage) {
+		t.Errorf("expected Encode() to zero the pad bytes, but it is byte-identical to the original")
+	}
+
+	m.HopByHopID = 0x10
+	forwarded := m.EncodeUsingRaw()
+	if diff := deep.Equal(forwarded[12:16], []byte{0x00, 0x00, 0x00, 0x10}); diff != nil {
+		t.Errorf("expected EncodeUsingRaw() to use the changed Hop-by-Hop-Id: %s", diff)
+	}
+	if diff := deep.Equal(forwarded[16:], encodedMessage[16:]); diff != nil {
+		t.Errorf("expected EncodeUsingRaw() to leave the rest of the message unchanged: %s", diff)
+	}
+
+	m.Avps[0].SetData([]byte("d;e;f"))
+	if m.Avps[0].RawEncoded() != nil {
+		t.Errorf("expected SetData() to discard RawEncoded()")
+	}
+	if diff := deep.Equal(m.Avps[0].EncodeUsingRaw(), m.Avps[0].Encode()); diff != nil {
+		t.Errorf("expected EncodeUsingRaw() after SetData() to be the same as Encode(): %s", diff)
+	}
+
+	decoded, err := diameter.DecodeMessage(encodedMessage)
+	if err != nil {
+		t.Fatalf("expected no error on DecodeMessage(), got = (%s)", err)
+	}
+	if decoded.Avps[0].RawEncoded() != nil {
+		t.Errorf("expected DecodeMessage() not to retain raw AVP bytes")
+	}
+}
+
+func TestDecodeAVPRetainingRawWithoutTrailingPadding(t *testing.T) {
+	encodedAvp := []byte{0x00, 0x00, 0x01, 0x07, 0x40, 0x00, 0x00, 0x0d, 0x61, 0x3b, 0x62, 0x3b, 0x63}
+
+	avp, err := diameter.DecodeAVPRetainingRaw(encodedAvp)
+	if err != nil {
+		t.Fatalf("expected no error on DecodeAVPRetainingRaw(), got = (%s)", err)
+	}
+
+	if diff := deep.Equal(avp.EncodeUsingRaw(), append(encodedAvp, 0x00, 0x00, 0x00)); diff != nil {
+		t.Errorf("expected EncodeUsingRaw() to be the original bytes with zero padding: %s", diff)
+	}
+}
+
+func TestDecodeAndEncodeAreInverses(t *testing.T) {
+	reservedFlagsAvp := []byte{0x00, 0x00, 0x04, 0x03, 0x87, 0x00, 0x00, 0x0f, 0x00, 0x00, 0x28, 0xaf, 0x45, 0x2d, 0x55, 0x00}
+
+	for name, encoded := range map[string][]byte{
+		"Basic-CER-01":           testMessagesByName["Basic-CER-01"].EncodedBytes,
+		"Credit-Control":         benchmarkCreditControlRequest().Encode(),
+		"reserved AVP flag bits": flattedBytes([]byte{0x01, 0x00, 0x00, 0x24, 0x80, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02}, reservedFlagsAvp),
+	} {
+		m, err := diameter.DecodeMessage(encoded)
+		if err != nil {
+			t.Errorf("%s: error on DecodeMessage(): %s", name, err)
+			continue
+		}
+
+		if reencoded := m.Encode(); !bytes.Equal(reencoded, encoded) {
+			t.Errorf("%s: expected Encode() of decoded message to be the original bytes, got (%x)", name, reencoded)
+		}
+
+		header := encoded[:diameter.MsgHeaderSize]
+		if m.Version != header[0] || int(m.Length) != len(encoded) || m.Flags != header[4] || m.Code != diameter.Uint24(binary.BigEndian.Uint32(header[4:8])&0x00ffffff) ||
+			m.AppID != binary.BigEndian.Uint32(header[8:12]) || m.HopByHopID != binary.BigEndian.Uint32(header[12:16]) || m.EndToEndID != binary.BigEndian.Uint32(header[16:20]) {
+			t.Errorf("%s: decoded header fields do not match encoded header (%x)", name, header)
+		}
+	}
+
+	expected := testMessagesByName["Basic-CER-01"]
+	decoded, _ := diameter.DecodeMessage(expected.EncodedBytes)
+	if !decoded.Equals(expected.Message) {
+		t.Errorf("expected decoded Basic-CER-01 to equal the test message")
+	}
+
+	input := append([]byte(nil), reservedFlagsAvp...)
+	avp, err := diameter.DecodeAVP(input)
+	if err != nil {
+		t.Fatalf("error on DecodeAVP(): %s", err)
+	}
+	input[12] = 0
+	if string(avp.Data) != "E-U" {
+		t.Errorf("expected decoded AVP Data to be a copy of the input, got (%q)", avp.Data)
+	}
+}
+
+func TestEncodedSize(t *testing.T) {
+	staleLength := benchmarkCreditControlRequest()
+	staleLength.Avps = append(staleLength.Avps, diameter.NewTypedAVP(1, 0, true, diameter.UTF8String, "user@example.com"))
+
+	basicCer01, _ := diameter.DecodeMessage(testMessagesByName["Basic-CER-01"].EncodedBytes)
+
+	for name, m := range map[string]*diameter.Message{
+		"Basic-CER-01":    basicCer01,
+		"Credit-Control":  benchmarkCreditControlRequest(),
+		"no AVPs":         diameter.NewMessage(diameter.MsgFlagRequest, 280, 0, 1, 1, nil, nil),
+		"stale Length":    staleLength,
+		"vendor-specific": diameter.NewMessage(0, 316, 16777251, 1, 1, []*diameter.AVP{diameter.NewTypedAVP(1407, 10415, true, diameter.OctetString, []byte{0x01})}, nil),
+	} {
+		if size, encoded := m.EncodedSize(), m.Encode(); size != len(encoded) {
+			t.Errorf("%s: expected EncodedSize() = len(Encode()) = (%d), got (%d)", name, len(encoded), size)
+		}
+	}
+}
+
+func TestDecodeMessageNoCopyAliasesInput(t *testing.T) {
+	input := benchmarkCreditControlRequest().Encode()
+
+	m, err := diameter.DecodeMessageNoCopy(input)
+	if err != nil {
+		t.Fatalf("expected no error on DecodeMessageNoCopy(), got = (%s)", err)
+	}
+
+	expected, _ := diameter.DecodeMessage(input)
+	if !m.Equals(expected) {
+		t.Errorf("expected DecodeMessageNoCopy() to produce the same message as DecodeMessage()")
+	}
+	if !bytes.Equal(m.Encode(), input) {
+		t.Errorf("expected Encode() of message decoded by DecodeMessageNoCopy() to be the input")
+	}
+
+	originHost := m.FirstAvpMatching(0, 264)
+	originHostDataOffset := bytes.Index(input, originHost.Encode()) + 8
+	input[originHostDataOffset] = 'C'
+	if string(originHost.Data) != "Client.example.com" {
+		t.Errorf("expected AVP Data to alias the input, got Origin-Host (%s)", originHost.Data)
+	}
+	if string(expected.FirstAvpMatching(0, 264).Data) != "client.example.com" {
+		t.Errorf("expected AVP Data from DecodeMessage() not to alias the input")
+	}
+
+	sessionId := m.FirstAvpMatching(0, 263)
+	bytesFollowingSessionIdData := append([]byte(nil), input[int(diameter.MsgHeaderSize)+sessionId.Length:][:8]...)
+	_ = append(sessionId.Data, "-appended"...)
+	if !bytes.Equal(input[int(diameter.MsgHeaderSize)+sessionId.Length:][:8], bytesFollowingSessionIdData) {
+		t.Errorf("expected appending to AVP Data not to overwrite the input")
+	}
+}
+
+// benchmarkCreditControlRequest returns a Credit-Control Request of a typical size and shape, with
+// unpadded, vendor-specific and Grouped AVPs.
+func benchmarkCreditControlRequest() *diameter.Message {
+	return diameter.NewMessage(diameter.MsgFlagRequest|diameter.MsgFlagProxiable, 272, 4, 0x10203040, 0x50607080, []*diameter.AVP{
+		diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1096298391;1"),
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "client.example.com"),
+		diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+		diameter.NewTypedAVP(283, 0, true, diameter.DiamIdent, "server.example.com"),
+		diameter.NewTypedAVP(258, 0, true, diameter.Unsigned32, uint32(4)),
+		diameter.NewTypedAVP(461, 0, true, diameter.UTF8String, "32251@3gpp.org"),
+		diameter.NewTypedAVP(416, 0, true, diameter.Enumerated, int32(1)),
+		diameter.NewTypedAVP(415, 0, true, diameter.Unsigned32, uint32(0)),
+		diameter.NewTypedAVP(55, 0, true, diameter.Time, time.Date(2024, time.March, 9, 16, 30, 5, 0, time.UTC)),
+		diameter.NewTypedAVP(443, 0, true, diameter.Grouped, []*diameter.AVP{
+			diameter.NewTypedAVP(450, 0, true, diameter.Enumerated, int32(0)),
+			diameter.NewTypedAVP(444, 0, true, diameter.UTF8String, "15551234567"),
+		}),
+		diameter.NewTypedAVP(456, 0, true, diameter.Grouped, []*diameter.AVP{
+			diameter.NewTypedAVP(437, 0, true, diameter.Grouped, []*diameter.AVP{
+				diameter.NewTypedAVP(412, 0, true, diameter.Unsigned64, uint64(1048576)),
+			}),
+			diameter.NewTypedAVP(432, 0, true, diameter.Unsigned32, uint32(1)),
+		}),
+		diameter.NewTypedAVP(1032, 10415, true, diameter.Enumerated, int32(1004)),
+		diameter.NewTypedAVP(1027, 10415, false, diameter.UTF8String, "E-UTRAN"),
+	}, nil)
+}
+
+// The header and AVP fields are read and written directly with binary.BigEndian, rather than through
+// a bytes.Reader or bytes.Buffer, and a message is encoded into a single buffer of its Length.  On a
+// 2.x GHz amd64 host (go test -bench . -benchmem), this changed:
+//
+//	BenchmarkDecodeMessage   ~3700 ns/op  2824 B/op  92 allocs/op  ->  ~3100 ns/op  1800 B/op  32 allocs/op
+//	BenchmarkEncodeMessage   ~3600 ns/op  2620 B/op  70 allocs/op  ->   ~270 ns/op   352 B/op   1 allocs/op
+//	BenchmarkDecodeAVP        ~350 ns/op   176 B/op   7 allocs/op  ->   ~140 ns/op   104 B/op   2 allocs/op
+//
+// DecodeMessageNoCopy, which does not copy the Data of each AVP, measured in a single run alongside
+// DecodeMessage:
+//
+//	BenchmarkDecodeMessage        ~1650 ns/op  1800 B/op  32 allocs/op
+//	BenchmarkDecodeMessageNoCopy  ~1350 ns/op  1576 B/op  19 allocs/op
+func BenchmarkDecodeMessage(b *testing.B) {
+	encoded := benchmarkCreditControlRequest().Encode()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := diameter.DecodeMessage(encoded); err != nil {
+			b.Fatalf("Error on DecodeMessage(): %s", err)
+		}
+	}
+}
+
+func BenchmarkDecodeMessageNoCopy(b *testing.B) {
+	encoded := benchmarkCreditControlRequest().Encode()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := diameter.DecodeMessageNoCopy(encoded); err != nil {
+			b.Fatalf("Error on DecodeMessageNoCopy(): %s", err)
+		}
+	}
+}
+
+func BenchmarkEncodeMessage(b *testing.B) {
+	m := benchmarkCreditControlRequest()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m.Encode()
+	}
+}
+
+func BenchmarkDecodeAVP(b *testing.B) {
+	encoded := diameter.NewTypedAVP(1027, 10415, false, diameter.UTF8String, "E-UTRAN").Encode()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := diameter.DecodeAVP(encoded); err != nil {
+			b.Fatalf("Error on DecodeAVP(): %s", err)
+		}
+	}
+}
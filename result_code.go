@@ -0,0 +1,95 @@
+package diameter
+
+// NewExperimentalResult creates an Experimental-Result AVP (code 297), which is a Grouped AVP
+// containing a Vendor-Id AVP (code 266) with the value vendorID and an Experimental-Result-Code
+// AVP (code 298) with the value code.  The M-bit is set on the Experimental-Result AVP and
+// its children.
+func NewExperimentalResult(vendorID uint32, code uint32) *AVP {
+	return NewTypedAVP(297, 0, true, Grouped, []*AVP{
+		NewTypedAVP(266, 0, true, Unsigned32, vendorID),
+		NewTypedAVP(298, 0, true, Unsigned32, code),
+	})
+}
+
+// ExperimentalResultCode extracts the Vendor-Id and Experimental-Result-Code values from the
+// first top-level Experimental-Result AVP in the message.  If the message has no Experimental-Result
+// AVP, or the AVP is malformed or lacks either of these children, ok is false.
+func (m *Message) ExperimentalResultCode() (vendorID uint32, code uint32, ok bool) {
+	experimentalResultAvp := m.FirstAvpMatching(0, 297)
+	if experimentalResultAvp == nil {
+		return 0, 0, false
+	}
+
+	children, err := ConvertAVPDataToTypedData(experimentalResultAvp.Data, Grouped)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	foundVendorId, foundCode := false, false
+	for _, child := range children.([]*AVP) {
+		if child.VendorID != 0 || len(child.Data) != 4 {
+			continue
+		}
+
+		switch child.Code {
+		case 266:
+			vendorID = MustConvertAVPDataToTypedData(child.Data, Unsigned32).(uint32)
+			foundVendorId = true
+		case 298:
+			code = MustConvertAVPDataToTypedData(child.Data, Unsigned32).(uint32)
+			foundCode = true
+		}
+	}
+
+	if !foundVendorId || !foundCode {
+		return 0, 0, false
+	}
+
+	return vendorID, code, true
+}
+
+// ResultCode is the value of a Result-Code AVP (code 268).  RFC 6733 section 7.1 classifies Result-Codes
+// by their thousands digit, which the Is* methods test.
+type ResultCode uint32
+
+// IsInformational returns true if the Result-Code is in the range 1000-1999, which are informational
+// (e.g., DIAMETER_MULTI_ROUND_AUTH).
+func (code ResultCode) IsInformational() bool {
+	return code >= 1000 && code < 2000
+}
+
+// IsSuccess returns true if the Result-Code is in the range 2000-2999, which indicate that the request
+// was successfully completed (e.g., DIAMETER_SUCCESS).
+func (code ResultCode) IsSuccess() bool {
+	return code >= 2000 && code < 3000
+}
+
+// IsProtocolError returns true if the Result-Code is in the range 3000-3999, which are protocol errors
+// (e.g., DIAMETER_UNABLE_TO_DELIVER).  An answer with a protocol error has the E-bit set.
+func (code ResultCode) IsProtocolError() bool {
+	return code >= 3000 && code < 4000
+}
+
+// IsTransientFailure returns true if the Result-Code is in the range 4000-4999, which indicate that the
+// request could not be satisfied at the time it was received but may succeed in the future (e.g.,
+// DIAMETER_AUTHENTICATION_REJECTED).
+func (code ResultCode) IsTransientFailure() bool {
+	return code >= 4000 && code < 5000
+}
+
+// IsPermanentFailure returns true if the Result-Code is in the range 5000-5999, which indicate that the
+// request failed and should not be attempted again (e.g., DIAMETER_UNABLE_TO_COMPLY).
+func (code ResultCode) IsPermanentFailure() bool {
+	return code >= 5000 && code < 6000
+}
+
+// ResultCode extracts the value of the first top-level Result-Code AVP (code 268) in the message.  If
+// the message has no Result-Code AVP, or its data is not a valid Unsigned32, ok is false.
+func (m *Message) ResultCode() (code ResultCode, ok bool) {
+	resultCodeAvp := m.FirstAvpMatching(0, 268)
+	if resultCodeAvp == nil || len(resultCodeAvp.Data) != 4 {
+		return 0, false
+	}
+
+	return ResultCode(MustConvertAVPDataToTypedData(resultCodeAvp.Data, Unsigned32).(uint32)), true
+}
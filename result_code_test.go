@@ -0,0 +1,170 @@
+package diameter_test
+
+import (
+	"testing"
+
+	diameter "github.com/blorticus-go/diameter"
+)
+
+func TestNewExperimentalResult(t *testing.T) {
+	avp := diameter.NewExperimentalResult(10415, 5001)
+
+	expectedEncoding := []byte{
+		0x00, 0x00, 0x01, 0x29, 0x40, 0x00, 0x00, 0x20,
+		0x00, 0x00, 0x01, 0x0a, 0x40, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x28, 0xaf,
+		0x00, 0x00, 0x01, 0x2a, 0x40, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x13, 0x89,
+	}
+
+	encoded := avp.Encode()
+	if len(encoded) != len(expectedEncoding) {
+		t.Fatalf("expected encoded length (%d), got (%d)", len(expectedEncoding), len(encoded))
+	}
+	for i := range expectedEncoding {
+		if encoded[i] != expectedEncoding[i] {
+			t.Errorf("encoded byte (%d) expected (%#02x), got (%#02x)", i, expectedEncoding[i], encoded[i])
+		}
+	}
+}
+
+func TestExperimentalResultCodeRoundTrip(t *testing.T) {
+	m := diameter.NewMessage(0, 316, 16777251, 1, 1, []*diameter.AVP{
+		diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "hss.example.com;1;1"),
+		diameter.NewExperimentalResult(10415, 5001),
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "hss.example.com"),
+	}, nil)
+
+	decoded, err := diameter.DecodeMessage(m.Encode())
+	if err != nil {
+		t.Fatalf("expected no error on DecodeMessage(), got = (%s)", err)
+	}
+
+	vendorID, code, ok := decoded.ExperimentalResultCode()
+	if !ok {
+		t.Fatalf("expected ExperimentalResultCode() to find the Experimental-Result, but it did not")
+	}
+	if vendorID != 10415 || code != 5001 {
+		t.Errorf("expected vendorID = 10415 and code = 5001, got vendorID = %d and code = %d", vendorID, code)
+	}
+}
+
+func TestExperimentalResultCodeWhenAbsentOrIncomplete(t *testing.T) {
+	m := diameter.NewMessage(0, 316, 16777251, 1, 1, []*diameter.AVP{
+		diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2001)),
+	}, nil)
+
+	if _, _, ok := m.ExperimentalResultCode(); ok {
+		t.Errorf("expected ExperimentalResultCode() to return ok = false for message without Experimental-Result")
+	}
+
+	m = diameter.NewMessage(0, 316, 16777251, 1, 1, []*diameter.AVP{
+		diameter.NewTypedAVP(297, 0, true, diameter.Grouped, []*diameter.AVP{
+			diameter.NewTypedAVP(298, 0, true, diameter.Unsigned32, uint32(5001)),
+		}),
+	}, nil)
+
+	if _, _, ok := m.ExperimentalResultCode(); ok {
+		t.Errorf("expected ExperimentalResultCode() to return ok = false for Experimental-Result without Vendor-Id")
+	}
+}
+
+func TestGroupedDecodeProducesOnlyTheGroupedAvps(t *testing.T) {
+	children := []*diameter.AVP{
+		diameter.NewTypedAVP(266, 0, true, diameter.Unsigned32, uint32(10415)),
+		diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "abc"),
+		diameter.NewTypedAVP(298, 0, true, diameter.Unsigned32, uint32(5001)),
+	}
+
+	grouped := diameter.NewTypedAVP(297, 0, true, diameter.Grouped, children)
+
+	typedValue, err := diameter.ConvertAVPDataToTypedData(grouped.Data, diameter.Grouped)
+	if err != nil {
+		t.Fatalf("expected no error on ConvertAVPDataToTypedData(), got = (%s)", err)
+	}
+
+	decodedChildren := typedValue.([]*diameter.AVP)
+	if len(decodedChildren) != len(children) {
+		t.Fatalf("expected (%d) decoded children, got (%d)", len(children), len(decodedChildren))
+	}
+
+	for i := range children {
+		if !decodedChildren[i].Equal(children[i]) {
+			t.Errorf("decoded child (%d) does not match the original", i)
+		}
+	}
+}
+
+func TestResultCodeClassification(t *testing.T) {
+	for _, testCase := range []struct {
+		code                                                                      diameter.ResultCode
+		informational, success, protocolError, transientFailure, permanentFailure bool
+	}{
+		{code: 0},
+		{code: 999},
+		{code: 1000, informational: true},
+		{code: 1001, informational: true},
+		{code: 1999, informational: true},
+		{code: 2000, success: true},
+		{code: 2001, success: true},
+		{code: 2999, success: true},
+		{code: 3000, protocolError: true},
+		{code: 3002, protocolError: true},
+		{code: 3999, protocolError: true},
+		{code: 4000, transientFailure: true},
+		{code: 4001, transientFailure: true},
+		{code: 4999, transientFailure: true},
+		{code: 5000, permanentFailure: true},
+		{code: 5012, permanentFailure: true},
+		{code: 5999, permanentFailure: true},
+		{code: 6000},
+		{code: 0xffffffff},
+	} {
+		if got := testCase.code.IsInformational(); got != testCase.informational {
+			t.Errorf("(%d).IsInformational() expected (%t), got (%t)", testCase.code, testCase.informational, got)
+		}
+		if got := testCase.code.IsSuccess(); got != testCase.success {
+			t.Errorf("(%d).IsSuccess() expected (%t), got (%t)", testCase.code, testCase.success, got)
+		}
+		if got := testCase.code.IsProtocolError(); got != testCase.protocolError {
+			t.Errorf("(%d).IsProtocolError() expected (%t), got (%t)", testCase.code, testCase.protocolError, got)
+		}
+		if got := testCase.code.IsTransientFailure(); got != testCase.transientFailure {
+			t.Errorf("(%d).IsTransientFailure() expected (%t), got (%t)", testCase.code, testCase.transientFailure, got)
+		}
+		if got := testCase.code.IsPermanentFailure(); got != testCase.permanentFailure {
+			t.Errorf("(%d).IsPermanentFailure() expected (%t), got (%t)", testCase.code, testCase.permanentFailure, got)
+		}
+	}
+}
+
+func TestMessageResultCode(t *testing.T) {
+	m := diameter.NewMessage(0, 272, 4, 1, 1, []*diameter.AVP{
+		diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "ocs.example.com;1;1"),
+		diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(4012)),
+		diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2001)),
+	}, nil)
+
+	decoded, err := diameter.DecodeMessage(m.Encode())
+	if err != nil {
+		t.Fatalf("expected no error on DecodeMessage(), got = (%s)", err)
+	}
+
+	if code, ok := decoded.ResultCode(); !ok || code != 4012 || !code.IsTransientFailure() {
+		t.Errorf("expected first Result-Code (4012) as transient failure, got (%d), ok = (%t)", code, ok)
+	}
+
+	for name, m := range map[string]*diameter.Message{
+		"no Result-Code": diameter.NewMessage(0, 272, 4, 1, 1, []*diameter.AVP{
+			diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "ocs.example.com;1;1"),
+		}, nil),
+		"malformed Result-Code": diameter.NewMessage(0, 272, 4, 1, 1, []*diameter.AVP{
+			diameter.NewAVP(268, 0, true, []byte{0x00, 0x07, 0xd1}),
+		}, nil),
+		"vendor-specific Result-Code": diameter.NewMessage(0, 272, 4, 1, 1, []*diameter.AVP{
+			diameter.NewTypedAVP(268, 10415, true, diameter.Unsigned32, uint32(2001)),
+		}, nil),
+	} {
+		if code, ok := m.ResultCode(); ok {
+			t.Errorf("[%s] expected ok = false from ResultCode(), got code (%d)", name, code)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package diameter
+
+// SessionTerminationCode is the command code for Session-Termination Request and Answer (RFC 6733
+// section 8.4).
+const SessionTerminationCode = Uint24(275)
+
+// Values for the Termination-Cause AVP (code 295).
+const (
+	TerminationCauseDiameterLogout     int32 = 1
+	TerminationCauseServiceNotProvided int32 = 2
+	TerminationCauseBadAnswer          int32 = 3
+	TerminationCauseAdministrative     int32 = 4
+	TerminationCauseLinkBroken         int32 = 5
+	TerminationCauseAuthExpired        int32 = 6
+	TerminationCauseUserMoved          int32 = 7
+	TerminationCauseSessionTimeout     int32 = 8
+)
+
+// NewSessionTerminationRequest creates a Session-Termination Request for the application appID, with
+// the code set to 275 and the request and proxiable flags set.  The message contains, in order, the
+// Session-Id, Origin-Host, Origin-Realm, Destination-Realm, Auth-Application-Id (appID) and
+// Termination-Cause AVPs.  cause should be one of the TerminationCause* values.  The hop-by-hop-id and
+// end-to-end-id are zero.
+func NewSessionTerminationRequest(sessionId string, originHost string, originRealm string, destinationRealm string, appID uint32, cause int32) *Message {
+	return NewMessage(MsgFlagRequest|MsgFlagProxiable, SessionTerminationCode, appID, 0, 0, []*AVP{
+		NewTypedAVP(263, 0, true, UTF8String, sessionId),
+		NewTypedAVP(264, 0, true, DiamIdent, originHost),
+		NewTypedAVP(296, 0, true, DiamIdent, originRealm),
+		NewTypedAVP(283, 0, true, DiamIdent, destinationRealm),
+		NewTypedAVP(258, 0, true, Unsigned32, appID),
+		NewTypedAVP(295, 0, true, Enumerated, cause),
+	}, nil)
+}
+
+// IsSessionTerminationRequest returns true if the message is a Session-Termination Request (that is,
+// the code is 275 and the request flag is set).
+func (m *Message) IsSessionTerminationRequest() bool {
+	return m.Code == SessionTerminationCode && m.IsRequest()
+}
+
+// Values for the Auth-Session-State AVP (code 277) (RFC 6733 section 8.11).  When the server
+// maintains session state, the client must send a Session-Termination Request when the session ends.
+const (
+	AuthSessionStateMaintained   int32 = 0
+	AuthSessionNoStateMaintained int32 = 1
+)
+
+// NewAuthSessionState creates an Auth-Session-State AVP (code 277) with the M-bit set.  state should
+// be AuthSessionStateMaintained or AuthSessionNoStateMaintained.
+func NewAuthSessionState(state int32) *AVP {
+	return NewTypedAVP(277, 0, true, Enumerated, state)
+}
+
+// AuthSessionState extracts the value of the first top-level Auth-Session-State AVP in the message.
+// If the message has no Auth-Session-State AVP, or the AVP is malformed, ok is false.  RFC 6733
+// specifies that STATE_MAINTAINED is assumed when the AVP is absent.
+func (m *Message) AuthSessionState() (state int32, ok bool) {
+	authSessionStateAvp := m.FirstAvpMatching(0, 277)
+	if authSessionStateAvp == nil || len(authSessionStateAvp.Data) != 4 {
+		return 0, false
+	}
+
+	return MustConvertAVPDataToTypedData(authSessionStateAvp.Data, Enumerated).(int32), true
+}
@@ -0,0 +1,80 @@
+package diameter_test
+
+import (
+	"testing"
+
+	diameter "github.com/blorticus-go/diameter"
+)
+
+func TestNewSessionTerminationRequest(t *testing.T) {
+	str := diameter.NewSessionTerminationRequest("client.example.com;1;1", "client.example.com", "example.com", "server.example.com", 16777238, diameter.TerminationCauseDiameterLogout)
+
+	if str.Code != 275 || str.AppID != 16777238 {
+		t.Errorf("expected code (275) and appId (16777238), got code (%d) and appId (%d)", str.Code, str.AppID)
+	}
+	if !str.IsRequest() || !str.IsProxiable() {
+		t.Errorf("expected request and proxiable flags to be set, got flags (%#02x)", str.Flags)
+	}
+	if !str.IsSessionTerminationRequest() {
+		t.Errorf("expected IsSessionTerminationRequest() to be true")
+	}
+
+	expectedAvps := []*diameter.AVP{
+		diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1;1"),
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "client.example.com"),
+		diameter.NewTypedAVP(296, 0, true, diameter.DiamIdent, "example.com"),
+		diameter.NewTypedAVP(283, 0, true, diameter.DiamIdent, "server.example.com"),
+		diameter.NewTypedAVP(258, 0, true, diameter.Unsigned32, uint32(16777238)),
+		diameter.NewTypedAVP(295, 0, true, diameter.Enumerated, int32(1)),
+	}
+
+	if len(str.Avps) != len(expectedAvps) {
+		t.Fatalf("expected (%d) AVPs, got (%d)", len(expectedAvps), len(str.Avps))
+	}
+	for i := range expectedAvps {
+		if !str.Avps[i].Equal(expectedAvps[i]) {
+			t.Errorf("AVP (%d) expected code (%d), got AVP with code (%d) or differing value", i, expectedAvps[i].Code, str.Avps[i].Code)
+		}
+	}
+
+	sta := str.GenerateMatchingResponseWithAvps([]*diameter.AVP{str.FirstAvpMatching(0, 263)}, nil)
+	if sta.IsSessionTerminationRequest() {
+		t.Errorf("expected IsSessionTerminationRequest() to be false for an STA")
+	}
+
+	if ccr := diameter.NewCreditControlRequest("s", "h", "r", "d", diameter.CreditControlTerminationRequest, 1); ccr.IsSessionTerminationRequest() {
+		t.Errorf("expected IsSessionTerminationRequest() to be false for a CCR")
+	}
+}
+
+func TestAuthSessionState(t *testing.T) {
+	testCases := []struct {
+		avps          []*diameter.AVP
+		expectedState int32
+		expectedOk    bool
+	}{
+		{[]*diameter.AVP{diameter.NewAuthSessionState(diameter.AuthSessionNoStateMaintained)}, 1, true},
+		{[]*diameter.AVP{diameter.NewAuthSessionState(diameter.AuthSessionStateMaintained)}, 0, true},
+		{[]*diameter.AVP{
+			diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1;1"),
+			diameter.NewAuthSessionState(diameter.AuthSessionNoStateMaintained),
+			diameter.NewAuthSessionState(diameter.AuthSessionStateMaintained),
+		}, 1, true},
+		{[]*diameter.AVP{diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "client.example.com;1;1")}, 0, false},
+		{[]*diameter.AVP{diameter.NewAVP(277, 0, true, []byte{0, 1})}, 0, false},
+	}
+
+	for i, testCase := range testCases {
+		m := diameter.NewMessage(diameter.MsgFlagRequest, 272, 4, 1, 1, testCase.avps, nil)
+
+		state, ok := m.AuthSessionState()
+		if state != testCase.expectedState || ok != testCase.expectedOk {
+			t.Errorf("(test case %d) expected (%d, %t), got (%d, %t)", i+1, testCase.expectedState, testCase.expectedOk, state, ok)
+		}
+	}
+
+	avp := diameter.NewAuthSessionState(diameter.AuthSessionNoStateMaintained)
+	if avp.Code != 277 || avp.VendorID != 0 || !avp.Mandatory {
+		t.Errorf("expected Auth-Session-State AVP with code (277), vendor-id (0) and M-bit set, got code (%d), vendor-id (%d), mandatory (%t)", avp.Code, avp.VendorID, avp.Mandatory)
+	}
+}
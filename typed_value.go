@@ -0,0 +1,80 @@
+package diameter
+
+import (
+	"net"
+	"time"
+)
+
+// The As* methods return the typed value of an AVP.  Each returns false if the AVP is not typed (that
+// is, ExtendedAttributes is nil), or if the typed value is not of the requested Go type.  The Go type
+// of the typed value for each AVPDataType is the type produced by NewTypedAVP().
+
+// AsUint32 returns the typed value of an Unsigned32 AVP.
+func (avp *AVP) AsUint32() (uint32, bool) {
+	return typedValueAs[uint32](avp)
+}
+
+// AsUint64 returns the typed value of an Unsigned64 AVP.
+func (avp *AVP) AsUint64() (uint64, bool) {
+	return typedValueAs[uint64](avp)
+}
+
+// AsInt32 returns the typed value of an Integer32 or Enumerated AVP.
+func (avp *AVP) AsInt32() (int32, bool) {
+	return typedValueAs[int32](avp)
+}
+
+// AsInt64 returns the typed value of an Integer64 AVP.
+func (avp *AVP) AsInt64() (int64, bool) {
+	return typedValueAs[int64](avp)
+}
+
+// AsFloat32 returns the typed value of a Float32 AVP.
+func (avp *AVP) AsFloat32() (float32, bool) {
+	return typedValueAs[float32](avp)
+}
+
+// AsFloat64 returns the typed value of a Float64 AVP.
+func (avp *AVP) AsFloat64() (float64, bool) {
+	return typedValueAs[float64](avp)
+}
+
+// AsString returns the typed value of a UTF8String, DiamIdent, DiamURI or IPFilterRule AVP.
+func (avp *AVP) AsString() (string, bool) {
+	return typedValueAs[string](avp)
+}
+
+// AsOctetString returns the typed value of an OctetString AVP.
+func (avp *AVP) AsOctetString() ([]byte, bool) {
+	return typedValueAs[[]byte](avp)
+}
+
+// AsTime returns the typed value of a Time AVP.
+func (avp *AVP) AsTime() (*time.Time, bool) {
+	return typedValueAs[*time.Time](avp)
+}
+
+// AsAddress returns the typed value of an Address AVP.  The typed value of an Address AVP is an
+// AddressType if the AVP was created by NewTypedAVP(), but a net.IP if it was typed from its data (e.g.,
+// by Dictionary.TypeAnAvp() after DecodeMessage()), so a net.IP is converted to an AddressType.
+func (avp *AVP) AsAddress() (AddressType, bool) {
+	if ip, isIP := typedValueAs[net.IP](avp); isIP {
+		return NewAddressTypeFromIP(ip), true
+	}
+	return typedValueAs[AddressType](avp)
+}
+
+// AsGrouped returns the typed value of a Grouped AVP, which is the set of AVPs in the group.
+func (avp *AVP) AsGrouped() ([]*AVP, bool) {
+	return typedValueAs[[]*AVP](avp)
+}
+
+func typedValueAs[T any](avp *AVP) (T, bool) {
+	if avp.ExtendedAttributes == nil {
+		var zero T
+		return zero, false
+	}
+
+	v, isOfType := avp.ExtendedAttributes.TypedValue.(T)
+	return v, isOfType
+}
@@ -0,0 +1,120 @@
+package diameter_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	diameter "github.com/blorticus-go/diameter"
+)
+
+func TestTypedValueAccessorsForMatchingTypes(t *testing.T) {
+	if v, ok := diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2001)).AsUint32(); !ok || v != 2001 {
+		t.Errorf("AsUint32(): expected (2001, true), got (%d, %t)", v, ok)
+	}
+	if v, ok := diameter.NewTypedAVP(287, 0, true, diameter.Unsigned64, uint64(1<<40)).AsUint64(); !ok || v != 1<<40 {
+		t.Errorf("AsUint64(): expected (%d, true), got (%d, %t)", uint64(1<<40), v, ok)
+	}
+	if v, ok := diameter.NewTypedAVP(1, 10415, true, diameter.Integer32, int32(-5)).AsInt32(); !ok || v != -5 {
+		t.Errorf("AsInt32() for Integer32: expected (-5, true), got (%d, %t)", v, ok)
+	}
+	if v, ok := diameter.NewTypedAVP(273, 0, true, diameter.Enumerated, int32(2)).AsInt32(); !ok || v != 2 {
+		t.Errorf("AsInt32() for Enumerated: expected (2, true), got (%d, %t)", v, ok)
+	}
+	if v, ok := diameter.NewTypedAVP(2, 10415, true, diameter.Integer64, int64(-1<<40)).AsInt64(); !ok || v != -1<<40 {
+		t.Errorf("AsInt64(): expected (%d, true), got (%d, %t)", int64(-1<<40), v, ok)
+	}
+	if v, ok := diameter.NewTypedAVP(3, 10415, true, diameter.Float32, float32(1.5)).AsFloat32(); !ok || v != 1.5 {
+		t.Errorf("AsFloat32(): expected (1.5, true), got (%f, %t)", v, ok)
+	}
+	if v, ok := diameter.NewTypedAVP(4, 10415, true, diameter.Float64, float64(2.5)).AsFloat64(); !ok || v != 2.5 {
+		t.Errorf("AsFloat64(): expected (2.5, true), got (%f, %t)", v, ok)
+	}
+
+	for _, avp := range []*diameter.AVP{
+		diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "value"),
+		diameter.NewTypedAVP(264, 0, true, diameter.DiamIdent, "value"),
+		diameter.NewTypedAVP(292, 0, true, diameter.DiamURI, "value"),
+		diameter.NewTypedAVP(1059, 10415, true, diameter.IPFilterRule, "value"),
+	} {
+		if v, ok := avp.AsString(); !ok || v != "value" {
+			t.Errorf("AsString() for AVP with code (%d): expected (value, true), got (%s, %t)", avp.Code, v, ok)
+		}
+	}
+
+	if v, ok := diameter.NewTypedAVP(44, 0, true, diameter.OctetString, []byte{1, 2, 3}).AsOctetString(); !ok || !bytes.Equal(v, []byte{1, 2, 3}) {
+		t.Errorf("AsOctetString(): expected ([1 2 3], true), got (%v, %t)", v, ok)
+	}
+
+	eventTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if v, ok := diameter.NewTypedAVP(55, 0, true, diameter.Time, eventTime).AsTime(); !ok || v == nil || !v.Equal(eventTime) {
+		t.Errorf("AsTime(): expected (%s, true), got (%v, %t)", eventTime, v, ok)
+	}
+
+	if v, ok := diameter.NewTypedAVP(257, 0, true, diameter.Address, net.ParseIP("10.1.1.1")).AsAddress(); !ok || !bytes.Equal(v, diameter.NewAddressTypeFromIP(net.ParseIP("10.1.1.1"))) {
+		t.Errorf("AsAddress(): expected address for (10.1.1.1), got (%v, %t)", v, ok)
+	}
+
+	children := []*diameter.AVP{diameter.NewTypedAVP(266, 0, true, diameter.Unsigned32, uint32(10415))}
+	if v, ok := diameter.NewTypedAVP(260, 0, true, diameter.Grouped, children).AsGrouped(); !ok || len(v) != 1 || v[0] != children[0] {
+		t.Errorf("AsGrouped(): expected the child AVPs, got (%v, %t)", v, ok)
+	}
+}
+
+func TestTypedValueAccessorsForMismatchedTypes(t *testing.T) {
+	unsigned32 := diameter.NewTypedAVP(268, 0, true, diameter.Unsigned32, uint32(2001))
+
+	if _, ok := unsigned32.AsString(); ok {
+		t.Errorf("expected AsString() to fail for Unsigned32 AVP")
+	}
+	if _, ok := unsigned32.AsUint64(); ok {
+		t.Errorf("expected AsUint64() to fail for Unsigned32 AVP")
+	}
+	if _, ok := unsigned32.AsInt32(); ok {
+		t.Errorf("expected AsInt32() to fail for Unsigned32 AVP")
+	}
+	if _, ok := unsigned32.AsGrouped(); ok {
+		t.Errorf("expected AsGrouped() to fail for Unsigned32 AVP")
+	}
+	if _, ok := diameter.NewTypedAVP(263, 0, true, diameter.UTF8String, "value").AsOctetString(); ok {
+		t.Errorf("expected AsOctetString() to fail for UTF8String AVP")
+	}
+	if _, ok := diameter.NewTypedAVP(44, 0, true, diameter.OctetString, []byte{1}).AsString(); ok {
+		t.Errorf("expected AsString() to fail for OctetString AVP")
+	}
+	if _, ok := diameter.NewTypedAVP(273, 0, true, diameter.Enumerated, int32(1)).AsTime(); ok {
+		t.Errorf("expected AsTime() to fail for Enumerated AVP")
+	}
+
+	untyped := diameter.NewAVP(268, 0, true, []byte{0, 0, 0x07, 0xd1})
+	if _, ok := untyped.AsUint32(); ok {
+		t.Errorf("expected AsUint32() to fail for an untyped AVP")
+	}
+	if _, ok := untyped.AsString(); ok {
+		t.Errorf("expected AsString() to fail for an untyped AVP")
+	}
+}
+
+func TestAsAddressForDecodedAndTypedAvps(t *testing.T) {
+	dictionary, err := diameter.DictionaryFromYamlString("AvpTypes:\n    - Name: \"Host-IP-Address\"\n      Code: 257\n      Type: Address\n")
+	if err != nil {
+		t.Fatalf("Error on DictionaryFromYamlString(): %s", err)
+	}
+
+	for _, ip := range []net.IP{net.ParseIP("10.1.1.1"), net.ParseIP("fd00::1")} {
+		decoded, err := diameter.DecodeAVP(diameter.NewTypedAVP(257, 0, true, diameter.Address, ip).Encode())
+		if err != nil {
+			t.Fatalf("Error on DecodeAVP() for (%s): %s", ip, err)
+		}
+
+		typed, err := dictionary.TypeAnAvp(decoded)
+		if err != nil {
+			t.Fatalf("Error on TypeAnAvp() for (%s): %s", ip, err)
+		}
+
+		if v, ok := typed.AsAddress(); !ok || !bytes.Equal(v, diameter.NewAddressTypeFromIP(ip)) {
+			t.Errorf("AsAddress() for decoded AVP: expected address for (%s), got (%v, %t)", ip, v, ok)
+		}
+	}
+}